@@ -8,30 +8,54 @@
 //
 //   http://research.microsoft.com/en-us/um/people/lamport/pubs/pubs.html#paxos-simple
 //
-// TODO:
-// * make all nodes peers, able to assume any role
-// * timeouts for unresponsive participants
-// * switch to UDP-based networking and distributed implementation
+// The proposers and acceptors are from the paxos package under src,
+// which any program can use.  Here they run in one process, and
+// talk over channels that lose messages with "-loss".
+//
+// With "-runs N", bpaxos instead repeats the whole thing with seeds
+// 1 through N, for each count of proposers in "-p" and acceptors in
+// "-a", like "-p 1,2,4 -a 3,5".  Proposers that are refused or time
+// out back off for a random time and try again, until one gets a
+// value chosen, and each run is a line of CSV on the output.
+//
+// With "-diagram FILE", a single run also writes each message, lost
+// or not, and each answer as a sequence diagram, in PlantUML if FILE
+// ends in ".puml" and in Mermaid otherwise.
+//
+// upaxos.go is the version that runs as separate processes on a
+// network.
 
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"paxos"
+	"trace"
 )
 
 const NMaxProposers = 10
 
 type proposer struct {
+	*paxos.Proposer
 	name    string
-	num     int64
 	success bool
 }
 
 type acceptor struct {
-	biggest int64
-	val     value
+	*paxos.Acceptor
 }
 
 type value *string
@@ -41,89 +65,218 @@ type proposal struct {
 	val value
 }
 
+// A proposalMsg is a Prepare, with no value, or an Accept!, sent to
+// one acceptor's channel.  The acceptor answers on c.
 type proposalMsg struct {
 	proposal
 	sender string
-	c      chan proposal
+	c      chan response
+}
+
+type response struct {
+	promise  paxos.Promise
+	accepted paxos.Accepted
+}
+
+// network is a proposer's paxos.Transport: a channel to each
+// acceptor.
+type network struct {
+	name string
+	accs []chan proposalMsg
+	r    *run
+}
+
+// A run is one group of proposers and acceptors, with its own
+// random choices.
+type run struct {
+	mu      sync.Mutex
+	rng     *rand.Rand
+	stopped bool           // no more calls; guarded by mu
+	calls   sync.WaitGroup // calls on their way to acceptors
+
+	msgs int64 // requests and responses sent, lost or not
+}
+
+func newRun(seed int64) *run {
+	return &run{rng: rand.New(rand.NewSource(seed))}
+}
+
+// lost reports whether a message goes astray, which the proposer
+// finds out when its request times out.
+func (r *run) lost() bool {
+	atomic.AddInt64(&r.msgs, 1)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Float64() < loss
+}
+
+// stop waits for the calls still on their way, which give up once
+// their rounds are over, and then stops the acceptors.  A proposer
+// may still be retrying a request when its round ends, so closing
+// the acceptors' channels any sooner could close one under a send.
+func (r *run) stop(accs []chan proposalMsg) {
+	r.mu.Lock()
+	r.stopped = true
+	r.mu.Unlock()
+	r.calls.Wait()
+	for _, c := range accs {
+		close(c)
+	}
+}
+
+// backoff returns a random time to wait before another round.
+func (r *run) backoff() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(r.rng.Int63n(int64(backoff)))
 }
 
-func (p *proposer) exceed(n int64) {
-	// different producer should not use my numbers
-	if p.num == n {
-		panic("derp")
+func (n *network) call(ctx context.Context, a int, p proposal) (response, error) {
+	n.r.mu.Lock()
+	if n.r.stopped {
+		n.r.mu.Unlock()
+		return response{}, context.Canceled
+	}
+	n.r.calls.Add(1)
+	n.r.mu.Unlock()
+	defer n.r.calls.Done()
+	c := make(chan response, 1)
+	acc := fmt.Sprintf("acceptor%d", a)
+	req := p.request()
+	if n.r.lost() {
+		dia.send(n.name, acc, req, true)
+		<-ctx.Done()
+		return response{}, ctx.Err()
 	}
-	for p.num < n {
-		p.num += NMaxProposers
+	dia.send(n.name, acc, req, false)
+	select {
+	case n.accs[a] <- proposalMsg{p, n.name, c}:
+	case <-ctx.Done():
+		return response{}, ctx.Err()
+	}
+	select {
+	case r := <-c:
+		if n.r.lost() {
+			dia.reply(acc, n.name, r.String(p), true)
+			<-ctx.Done()
+			return response{}, ctx.Err()
+		}
+		dia.reply(acc, n.name, r.String(p), false)
+		return r, nil
+	case <-ctx.Done():
+		return response{}, ctx.Err()
 	}
 }
 
-func (p *proposer) propose(n int, acceptors chan proposalMsg, exit chan bool) {
+func (n *network) Prepare(ctx context.Context, a int, num int64) (paxos.Promise, error) {
+	r, err := n.call(ctx, a, proposal{num, nil})
+	return r.promise, err
+}
+
+func (n *network) Accept(ctx context.Context, a int, num int64, v string) (paxos.Accepted, error) {
+	r, err := n.call(ctx, a, proposal{num, &v})
+	return r.accepted, err
+}
+
+// propose runs one round, with the value left by an earlier proposer
+// if there is one, or a value of its own.
+func (p *proposer) propose(exit chan bool) {
 	defer func() {
 		exit <- p.success
 	}()
-	c := make(chan proposal)
-	for i := 0; i < n; i++ {
-		// try out this proposal number
-		log.Printf("%s sending proposed number %d iter %d\n",
-			p.name, p.num, i)
-		acceptors <- proposalMsg{proposal{p.num, nil}, p.name, c}
-	}
-	var v value
-
-	abort := false
-	orig_pnum := p.num
-	// "Paxos Made Simple", Phase 2. (a), says
-	// that proposer uses value with highest number
-	// from responses to "prepare" messages.
-	maxRspNum := int64(-1)
-	for i := 0; i < n; i++ {
-		log.Printf("%s reading rsp to proposed number %d iter %d\n",
-			p.name, orig_pnum, i)
-		rsp := <-c
-		if rsp.num != p.num {
-			p.exceed(rsp.num)
-			p.success = false
-			abort = true
-		}
-		if rsp.val != nil && rsp.num > maxRspNum {
-			maxRspNum = rsp.num
-			v = rsp.val
-		}
-	}
-	if abort {
-		log.Printf("%s aborting after proposing number %d\n",
-			p.name, orig_pnum)
-		p.success = false
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	n := p.N()
+	log.Printf("%s proposing number %d\n", p.name, n)
+	dia.note(fmt.Sprintf("round %d", n), p.name)
+	v, err := p.Round(ctx, fmt.Sprintf("v%d my name is %s", n, p.name))
+	if err != nil {
+		log.Printf("%s aborting after proposing number %d: %s\n",
+			p.name, n, err)
+		dia.note(fmt.Sprintf("round %d aborted", n), p.name)
 		return
 	}
-	if v == nil {
-		s := fmt.Sprintf("v%d my name is %s", p.num, p.name)
-		v = &s
-	}
-	for i := 0; i < n; i++ {
-		// attempt to set value
-		log.Printf("%s setting val for proposed number %d iter %d\n",
-			p.name, p.num, i)
-		acceptors <- proposalMsg{proposal{p.num, v}, p.name, c}
-	}
+	p.success = true
+	dia.note(fmt.Sprintf("%q chosen", v), p.name)
+	log.Printf("%s exiting with success(%v), value %q\n",
+		p.name, p.success, v)
+}
 
-	for i := 0; i < n; i++ {
-		log.Printf("%s reading rsp after setting val for proposed number %d iter %d\n",
-			p.name, p.num, i)
-		rsp := <-c
-		if rsp.num != p.num {
-			p.exceed(rsp.num)
-			p.success = false
-			abort = true
+// decide runs rounds until this proposer gets a value chosen, or
+// another one does and cancels ctx, counting each round and why the
+// ones that failed did.
+func (p *proposer) decide(ctx context.Context, r *run, st *stats) {
+	for {
+		rctx, cancel := context.WithTimeout(ctx, timeout)
+		n := p.N()
+		_, err := p.Round(rctx, fmt.Sprintf("v%d my name is %s", n, p.name))
+		cancel()
+		if ctx.Err() != nil {
+			return // decided elsewhere
+		}
+		st.add(p.name, err)
+		if err == nil {
+			p.success = true
+			return
 		}
-		if rsp.val != v {
-			p.success = false
-			abort = true
+		select {
+		case <-time.After(r.backoff()):
+		case <-ctx.Done():
+			return
 		}
 	}
-	p.success = !abort
-	log.Printf("%s exiting with success(%v)\n",
-		p.name, p.success)
+}
+
+// stats are what a run of many rounds came to.
+type stats struct {
+	mu       sync.Mutex
+	rounds   int
+	rejected [3]int // by phase
+	timeouts int
+	winner   string
+}
+
+func (st *stats) add(name string, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.rounds++
+	var rej *paxos.Rejected
+	switch {
+	case err == nil:
+		if st.winner == "" {
+			st.winner = name
+		}
+	case errors.As(err, &rej):
+		st.rejected[rej.Phase]++
+	default:
+		st.timeouts++
+	}
+}
+
+// request is the message as the diagram shows it.
+func (r proposal) request() string {
+	if r.val == nil {
+		return fmt.Sprintf("Prepare %d", r.num)
+	}
+	return fmt.Sprintf("Accept! %d %q", r.num, *r.val)
+}
+
+// String returns the answer to p.
+func (r response) String(p proposal) string {
+	if p.val == nil {
+		return r.promise.String()
+	}
+	return r.accepted.String()
+}
+
+func (r proposal) String() string {
+	if r.val == nil {
+		return fmt.Sprintf("%d", r.num)
+	}
+	return fmt.Sprintf("%d %q", r.num, *r.val)
 }
 
 func (a *acceptor) show(cmd proposalMsg) {
@@ -133,39 +286,35 @@ func (a *acceptor) show(cmd proposalMsg) {
 	} else {
 		t += fmt.Sprintf("propose %d", cmd.num)
 	}
-	// XXX changing the line below to "log.Printf" reveals deadlock
+	biggest, acc := a.State()
+	var val value
+	if acc != nil {
+		val = &acc.V
+	}
+	if quiet {
+		return
+	}
 	fmt.Printf("acceptor saw %s %s; responding with biggest:%d val:%v\n",
-		cmd.sender, t, a.biggest, a.val)
+		cmd.sender, t, biggest, val)
 }
 
 func (a *acceptor) handleCmd(cmd proposalMsg) {
+	tr.Add(trace.Event{Node: a.ID, Kind: trace.Recv,
+		Msg: cmd.sender + " " + cmd.proposal.String()})
+	var rsp response
+	var s fmt.Stringer
 	if cmd.val == nil {
 		// it's a Prepare message
-		if cmd.num > a.biggest {
-			a.biggest = cmd.num
-
-			// When acceptor gets higher num
-			// prepare, it responds with its current
-			// value. The proposer sees all the
-			// values in the prepare responses and
-			// picks the highest numbered one. The
-			// same acceptor will then accept
-			// whatever the proposer says is the
-			// value.  That implies the acceptor must
-			// retain the previously accepted value
-			// at this step.
-		}
+		rsp.promise = a.Prepare(cmd.num)
+		s = rsp.promise
 	} else {
 		// Accept! message
-		if cmd.num >= a.biggest {
-			// for unreliable delivery of Accept!
-			// messages with cmd.num > a.biggest,
-			// proposer can keep trying for a quorum
-			a.val = cmd.val
-		}
+		rsp.accepted = a.Accept(cmd.num, *cmd.val)
+		s = rsp.accepted
 	}
 	a.show(cmd)
-	cmd.c <- proposal{a.biggest, a.val}
+	tr.Add(trace.Event{Node: a.ID, Kind: trace.Send, Msg: s.String()})
+	cmd.c <- rsp
 }
 
 func (a *acceptor) accept(proposers chan proposalMsg) {
@@ -174,34 +323,314 @@ func (a *acceptor) accept(proposers chan proposalMsg) {
 	}
 }
 
-var nProds int
-var nAccs int
+var nProds, nAccs []int
+var loss float64
+var timeout, retry, backoff time.Duration
+var runs int
+var quiet bool
+var traceFile string
+var diagramFile string
+
+// tr is the trace, nil for none.  Acceptors are nodes 0 through
+// nAccs-1 in it, and proposers follow.
+var tr *trace.Writer
+
+// counts is a flag with one or more counts, like "1,2,4".
+type counts struct {
+	p *[]int
+}
+
+func (c counts) String() string {
+	if c.p == nil {
+		return ""
+	}
+	s := make([]string, len(*c.p))
+	for k, n := range *c.p {
+		s[k] = fmt.Sprint(n)
+	}
+	return strings.Join(s, ",")
+}
+
+func (c counts) Set(s string) error {
+	*c.p = nil
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 1 {
+			return fmt.Errorf("bad count %q", f)
+		}
+		*c.p = append(*c.p, n)
+	}
+	return nil
+}
 
 func init() {
-	flag.IntVar(&nProds, "p", 1, "specify number of proposers")
-	flag.IntVar(&nAccs, "a", 3, "specify number of acceptors")
+	nProds, nAccs = []int{1}, []int{3}
+	flag.Var(counts{&nProds}, "p", "specify number of proposers")
+	flag.Var(counts{&nAccs}, "a", "specify number of acceptors")
+	flag.Float64Var(&loss, "loss", 0,
+		"fraction of messages lost between proposers and acceptors")
+	flag.DurationVar(&timeout, "timeout", 5*time.Second,
+		"give up on a round after this long")
+	flag.DurationVar(&retry, "retry", paxos.DefaultTimeout,
+		"send a request again after this long without an answer")
+	flag.DurationVar(&backoff, "backoff", paxos.DefaultBackoff,
+		"with -runs, wait up to this long before trying another round")
+	flag.IntVar(&runs, "runs", 0,
+		"run with seeds 1 through this many, until a value is chosen, and write CSV")
+	flag.StringVar(&traceFile, "trace", "",
+		"write a JSON-lines trace of messages and state changes to this file")
+	flag.StringVar(&diagramFile, "diagram", "",
+		"write a sequence diagram of the messages to this file, PlantUML for .puml, else Mermaid")
 }
-func main() {
-	flag.Parse()
-	fmt.Println(nProds, nAccs)
+
+// start starts the acceptors, and returns the proposers, which talk
+// to them over channels.  close(accs[i]) stops acceptor i.
+func start(np, na int, r *run) (p []*proposer, accs []chan proposalMsg) {
+	accs = make([]chan proposalMsg, na)
+	for i := 0; i < na; i++ {
+		a := &acceptor{paxos.NewAcceptor(int64(i))}
+		a.Trace = tr
+		tr.Add(trace.Event{Node: a.ID, Kind: trace.Config,
+			N: na, Quorum: "majority"})
+		accs[i] = make(chan proposalMsg)
+		go a.accept(accs[i])
+	}
+	p = make([]*proposer, np)
+	for i := 0; i < np; i++ {
+		name := fmt.Sprintf("proposer%d", i)
+		pp := paxos.NewProposer(i, np, &network{name, accs, r}, na)
+		pp.ID = int64(na + i)
+		pp.Timeout = retry
+		pp.Trace = tr
+		p[i] = &proposer{Proposer: pp, name: name}
+	}
+	return p, accs
+}
+
+// once has each proposer run one round, and writes whether each got
+// a value chosen to w.
+func once(w io.Writer) {
+	np, na := nProds[0], nAccs[0]
+	fmt.Fprintln(w, np, na)
 	pexitc := make(chan bool) // for the proposers to signal exit
-	p := make([]*proposer, nProds)
-	for i := 0; i < nProds; i++ {
-		p[i] = &proposer{fmt.Sprintf("proposer%d", i), int64(i), false}
+	r := newRun(time.Now().UnixNano())
+	p, accs := start(np, na, r)
+	for i := 0; i < np; i++ {
+		dia.participant(p[i].name)
 	}
-	cmdc := make(chan proposalMsg)
-	for i := 0; i < nAccs; i++ {
-		a := &acceptor{-1, nil}
-		go a.accept(cmdc)
+	for i := 0; i < na; i++ {
+		dia.participant(fmt.Sprintf("acceptor%d", i))
 	}
-	for i := 0; i < nProds; i++ {
-		go p[i].propose(nAccs, cmdc, pexitc)
+	for i := 0; i < np; i++ {
+		go p[i].propose(pexitc)
 	}
-	for i := 0; i < nProds; i++ {
+	for i := 0; i < np; i++ {
 		<-pexitc
 	}
-	for i := 0; i < nProds; i++ {
-		fmt.Printf("%s got consensus? %v\n", p[i].name, p[i].success)
+	for i := 0; i < np; i++ {
+		fmt.Fprintf(w, "%s got consensus? %v\n", p[i].name, p[i].success)
+	}
+	r.stop(accs)
+}
+
+// many runs each group once for each seed, until a value is chosen,
+// and writes a line of CSV for each to w.
+func many(w io.Writer) {
+	quiet = true
+	log.SetOutput(io.Discard)
+	fmt.Fprintln(w, "proposers,acceptors,seed,loss,rounds,messages,ms,"+
+		"prepare_rejected,accept_rejected,timeouts,winner")
+	for _, np := range nProds {
+		for _, na := range nAccs {
+			for seed := int64(1); seed <= int64(runs); seed++ {
+				r := newRun(seed)
+				p, accs := start(np, na, r)
+				st := &stats{}
+				ctx, cancel := context.WithCancel(context.Background())
+				begin := time.Now()
+				var wg sync.WaitGroup
+				for _, pp := range p {
+					wg.Add(1)
+					go func(pp *proposer) {
+						defer wg.Done()
+						pp.decide(ctx, r, st)
+						if pp.success {
+							cancel()
+						}
+					}(pp)
+				}
+				wg.Wait()
+				cancel()
+				took := time.Since(begin)
+				r.stop(accs)
+				fmt.Fprintf(w, "%d,%d,%d,%g,%d,%d,%.3f,%d,%d,%d,%s\n",
+					np, na, seed, loss, st.rounds,
+					atomic.LoadInt64(&r.msgs),
+					float64(took)/float64(time.Millisecond),
+					st.rejected[1], st.rejected[2], st.timeouts, st.winner)
+			}
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	for _, np := range nProds {
+		if np > NMaxProposers {
+			log.Fatalf("at most %d proposers", NMaxProposers)
+		}
+	}
+	if traceFile != "" {
+		f, err := os.Create(traceFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		tr = trace.NewWriter(f)
+	}
+	if runs > 0 {
+		if diagramFile != "" {
+			log.Fatal("-diagram is for a single run, without -runs")
+		}
+		many(os.Stdout)
+		return
+	}
+	if len(nProds) > 1 || len(nAccs) > 1 {
+		log.Fatal("more than one count of proposers or acceptors needs -runs")
+	}
+	if diagramFile != "" {
+		dia = &diagram{}
+	}
+	once(os.Stdout)
+	if dia != nil {
+		if err := dia.writeFile(diagramFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// dia is the sequence diagram, nil for none.
+var dia *diagram
+
+// A diagram collects messages and notes as they happen, to be
+// written as a sequence diagram.  Goroutines race to add them, so
+// two messages to different acceptors may show up in either order,
+// but each proposer's own steps are in order.  Its methods do
+// nothing on nil.
+type diagram struct {
+	mu    sync.Mutex
+	who   []string
+	steps []step
+}
+
+// A step is an arrow from one participant to another, or a note
+// over some participants when from is "".
+type step struct {
+	from, to string
+	text     string
+	reply    bool
+	lost     bool
+	over     []string
+}
+
+func (d *diagram) participant(name string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.who = append(d.who, name)
+}
+
+func (d *diagram) add(s step) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.steps = append(d.steps, s)
+}
+
+// send notes a request that the acceptor got, or that was lost on
+// the way.
+func (d *diagram) send(from, to, text string, lost bool) {
+	d.add(step{from: from, to: to, text: text, lost: lost})
+}
+
+// reply notes an answer that the proposer got, or that was lost on
+// the way.
+func (d *diagram) reply(from, to, text string, lost bool) {
+	d.add(step{from: from, to: to, text: text, reply: true, lost: lost})
+}
+
+func (d *diagram) note(text string, over ...string) {
+	d.add(step{text: text, over: over})
+}
+
+func (d *diagram) writeFile(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(name, ".puml") {
+		d.writePlantUML(f)
+	} else {
+		d.writeMermaid(f)
+	}
+	return f.Close()
+}
+
+func (d *diagram) writeMermaid(w io.Writer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// a semicolon would end the line
+	esc := strings.NewReplacer(";", "#59;", "#", "#35;").Replace
+	fmt.Fprintln(w, "sequenceDiagram")
+	for _, p := range d.who {
+		fmt.Fprintf(w, "    participant %s\n", p)
+	}
+	for _, s := range d.steps {
+		if s.from == "" {
+			fmt.Fprintf(w, "    Note over %s: %s\n",
+				strings.Join(s.over, ","), esc(s.text))
+			continue
+		}
+		arrow := "->>"
+		if s.reply {
+			arrow = "-->>"
+		}
+		text := esc(s.text)
+		if s.lost {
+			arrow = strings.TrimSuffix(arrow, ">>") + "x"
+			text += " (lost)"
+		}
+		fmt.Fprintf(w, "    %s%s%s: %s\n", s.from, arrow, s.to, text)
+	}
+}
+
+func (d *diagram) writePlantUML(w io.Writer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintln(w, "@startuml")
+	for _, p := range d.who {
+		fmt.Fprintf(w, "participant %s\n", p)
+	}
+	for _, s := range d.steps {
+		if s.from == "" {
+			fmt.Fprintf(w, "note over %s : %s\n",
+				strings.Join(s.over, ", "), s.text)
+			continue
+		}
+		arrow := "->"
+		if s.reply {
+			arrow = "-->"
+		}
+		text := s.text
+		if s.lost {
+			arrow += "x"
+			text += " (lost)"
+		}
+		fmt.Fprintf(w, "%s %s %s : %s\n", s.from, arrow, s.to, text)
 	}
-	close(cmdc)
+	fmt.Fprintln(w, "@enduml")
 }
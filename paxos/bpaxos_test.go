@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestCSV checks the header and each field of the line of CSV that
+// -runs writes for one lossless run with one proposer.
+func TestCSV(t *testing.T) {
+	nProds, nAccs, runs, loss = []int{1}, []int{3}, 1, 0
+	var out bytes.Buffer
+	many(&out)
+	lines, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("%d lines of CSV, want a header and a row", len(lines))
+	}
+	header, row := lines[0], lines[1]
+	num := func(s string) float64 {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return -1
+		}
+		return f
+	}
+	for k, tc := range []struct {
+		name string
+		ok   func(s string) bool
+	}{
+		{"proposers", func(s string) bool { return s == "1" }},
+		{"acceptors", func(s string) bool { return s == "3" }},
+		{"seed", func(s string) bool { return s == "1" }},
+		{"loss", func(s string) bool { return s == "0" }},
+		{"rounds", func(s string) bool { return s == "1" }},
+		// each phase needs two of the three answers, and may get
+		// the third
+		{"messages", func(s string) bool { return num(s) >= 8 && num(s) <= 12 }},
+		{"ms", func(s string) bool { return num(s) >= 0 }},
+		{"prepare_rejected", func(s string) bool { return s == "0" }},
+		{"accept_rejected", func(s string) bool { return s == "0" }},
+		{"timeouts", func(s string) bool { return s == "0" }},
+		{"winner", func(s string) bool { return s == "proposer0" }},
+	} {
+		if k >= len(header) || header[k] != tc.name {
+			t.Errorf("column %d is not %s in %q", k, tc.name, header)
+			continue
+		}
+		if k >= len(row) || !tc.ok(row[k]) {
+			t.Errorf("%s is not right in %q", tc.name, row)
+		}
+	}
+	if len(header) != 11 || len(row) != 11 {
+		t.Errorf("%d columns and %d fields, want 11", len(header), len(row))
+	}
+}
+
+// TestDiagram checks the sequence diagrams of a run with one
+// proposer and one acceptor, which has nothing to race.
+func TestDiagram(t *testing.T) {
+	nProds, nAccs, loss, quiet = []int{1}, []int{1}, 0, true
+	dia = &diagram{}
+	defer func() { dia = nil }()
+	once(io.Discard)
+
+	for _, tc := range []struct {
+		write func(w io.Writer)
+		want  []string
+	}{
+		{dia.writeMermaid, []string{
+			"sequenceDiagram",
+			"    participant proposer0",
+			"    participant acceptor0",
+			"    Note over proposer0: round 0",
+			"    proposer0->>acceptor0: Prepare 0",
+			"    acceptor0-->>proposer0: Promise true 0",
+			`    proposer0->>acceptor0: Accept! 0 "v0 my name is proposer0"`,
+			"    acceptor0-->>proposer0: Accepted true 0",
+			`    Note over proposer0: "v0 my name is proposer0" chosen`,
+		}},
+		{dia.writePlantUML, []string{
+			"@startuml",
+			"participant proposer0",
+			"participant acceptor0",
+			"note over proposer0 : round 0",
+			"proposer0 -> acceptor0 : Prepare 0",
+			"acceptor0 --> proposer0 : Promise true 0",
+			`proposer0 -> acceptor0 : Accept! 0 "v0 my name is proposer0"`,
+			"acceptor0 --> proposer0 : Accepted true 0",
+			`note over proposer0 : "v0 my name is proposer0" chosen`,
+			"@enduml",
+		}},
+	} {
+		var b strings.Builder
+		tc.write(&b)
+		got := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+		if len(got) != len(tc.want) {
+			t.Errorf("got %d lines, want %d:\n%s", len(got), len(tc.want), b.String())
+			continue
+		}
+		for k := range got {
+			if got[k] != tc.want[k] {
+				t.Errorf("line %d is %q, want %q", k+1, got[k], tc.want[k])
+			}
+		}
+	}
+}
+
+// TestDiagramSteps checks the line each kind of step becomes.
+func TestDiagramSteps(t *testing.T) {
+	for _, tc := range []struct {
+		s        step
+		mermaid  string
+		plantUML string
+	}{
+		{step{from: "p", to: "a", text: "Prepare 1"},
+			"p->>a: Prepare 1", "p -> a : Prepare 1"},
+		{step{from: "p", to: "a", text: "Prepare 1", lost: true},
+			"p-xa: Prepare 1 (lost)", "p ->x a : Prepare 1 (lost)"},
+		{step{from: "a", to: "p", text: "Promise true 1", reply: true},
+			"a-->>p: Promise true 1", "a --> p : Promise true 1"},
+		{step{from: "a", to: "p", text: "Promise true 1", reply: true, lost: true},
+			"a--xp: Promise true 1 (lost)", "a -->x p : Promise true 1 (lost)"},
+		{step{text: "round 1", over: []string{"p", "q"}},
+			"Note over p,q: round 1", "note over p, q : round 1"},
+		{step{from: "p", to: "a", text: `Accept! 1 "x;#y"`},
+			`p->>a: Accept! 1 "x#59;#35;y"`, `p -> a : Accept! 1 "x;#y"`},
+	} {
+		d := &diagram{steps: []step{tc.s}}
+		var m, u strings.Builder
+		d.writeMermaid(&m)
+		d.writePlantUML(&u)
+		if want := "sequenceDiagram\n    " + tc.mermaid + "\n"; m.String() != want {
+			t.Errorf("Mermaid %q, want %q", m.String(), want)
+		}
+		if want := "@startuml\n" + tc.plantUML + "\n@enduml\n"; u.String() != want {
+			t.Errorf("PlantUML %q, want %q", u.String(), want)
+		}
+	}
+}
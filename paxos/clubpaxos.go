@@ -1,18 +1,20 @@
 // clubpaxos.go
-// This is the skeleton of a process that will be able to join
-// or found a club, where the club can outlive any particular
-// set of processes that are members.
+// This is a process that can join or found clubs, where a club can
+// outlive any particular set of processes that are members.  The
+// club package under src does the work.  One process can be in any
+// number of clubs, and a club can have any number of members.
 //
 // Club State
 //
-//   a list of members
+//   a list of members, agreed on one command at a time with
+//   Multi-Paxos among the members
 //
 // User Message Format Examples
 //
 //   node named "david" asks to join club "boodles":
 //     join boodles david
 //
-//   node ask for club name
+//   node ask for club name, and the members answer with theirs
 //     name
 //
 // Club Operations (not messages but stuff that happens)
@@ -21,137 +23,130 @@
 //   paul oust {name}	paul asks club to remove member {name}
 //   paul toast {name}	raise a glass to health of a member
 //
+// Users ask for the last two with "oust boodles {name}" and
+// "toast boodles {name}".  Any member can ask, and if the leader
+// does not get it done, takes over leading to do it.
+//
 // Club Message Format Examples
 //
 //   paul, acting leader of "boodles" asks the club to add new
-//   member "david with instance number 50 proposal number 1.
-//     club boodles paul 50 1 add david
-//     [gets accepts]
+//   member "david with instance number 50 proposal number 1.paul.
+//     club boodles paul 50 1.paul write 9:add david
+//     [gets accepts, like "club boodles ron 50 1.paul accept"]
+//     club boodles paul 50 1.paul chosen 9:add david
 //
 //   ron, first-time leader of "boodles" uses instance 34 of paxos to
 //   ask the club to add new member "david", using proposal number
-//   5 (presumably because someone else is trying to lead):
-//     club boodles ron 34 5 propose
-//     [gets promises]
-//     club boodles ron 34 5 propose add david
+//   5.ron (presumably because someone else is trying to lead):
+//     club boodles ron 34 5.ron propose
+//     [gets promises, like "club boodles paul 34 5.ron promise 0:"]
+//     club boodles ron 34 5.ron write 9:add david
 //     [gets accepts]
+//
+// The messages are records, as upnet.Record formats them, on a UDP
+// multicast group by default, so that every process hears all of
+// them, and each goes to the club named in it.  Send user messages
+// with upclient, like
+//
+//   upclient -t udp -g 239.253.0.2:9999 send join boodles david
+//
+// Each process logs what it knows of each club to club-NAME-ID.log,
+// so that with the same ID and name it comes back as the same
+// member of the same clubs.
 
 package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
-	"net"
+	"os"
+	"os/signal"
 	"strings"
-	"time"
-)
-
-type ureq struct {
-	f []string // fields of last user request
-	t time.Time
-}
 
-type node struct {
-	name     string // my name
-	step     int64  // Paxos algorithm instance
-	pseen    int64  // greatest proposal num seen for this instance
-	lastReq  ureq   // last user request
-	amLeader bool
-}
+	"club"
+	"stable"
+	"upnet"
+)
 
-func (p *node) nextProposal() int64 {
-	rounds := p.pseen / maxNodes
-	m := maxNodes*rounds + int64(myID)
-	m += maxNodes
-	p.pseen = m
-	return m
-}
+// clubAddr is the group club processes listen on by default.
+const clubAddr = "239.253.0.2:9999"
 
-func (p *node) askClub(s string) {
-	if p.amLeader {
-		log.Printf("club %s %d %d %d %s",
-			myClub, myID, p.step, p.nextProposal(), s)
-	} else {
-		panic("XXX implement new leader")
-	}
-}
+var myClubs, joinClubs string
+var myID int
+var myName string
+var transport, groupAddr string
+var dir string
 
-func (p *node) handleJoin(f []string) {
-	if len(f) < 3 {
-		log.Printf("%s ignoring malformed join\n", p.name)
-		return
-	}
-	if myClub != f[1] {
-		return
-	}
-	if p.amLeader {
-		p.askClub("add " + f[2])
-	} else {
-		p.lastReq = ureq{f, time.Now()}
-	}
+func init() {
+	flag.IntVar(&myID, "i", -1,
+		"the unique integer ID of this participant, for its log files")
+	flag.StringVar(&myName, "n", "",
+		"the name of this participant as a member (default node ID)")
+	flag.StringVar(&myClubs, "c", "",
+		"the clubs this participant will found, separated by commas")
+	flag.StringVar(&joinClubs, "j", "",
+		"the clubs this participant will ask to join, or rejoin, separated by commas")
+	flag.StringVar(&transport, "t", "udp",
+		"group transport: \"ip\" (raw IP, needs root) or \"udp\" (multicast)")
+	flag.StringVar(&groupAddr, "g", clubAddr,
+		"group address to listen and send on")
+	flag.StringVar(&dir, "d", ".",
+		"directory for the clubs' log files")
 }
 
-func (p *node) serve(c chan string) {
-	// see go/src/pkg/net/protoconn_test.go
-	la, err := net.ResolveUDPAddr("udp4", "127.0.0.1:9999")
-	if err != nil {
-		panic(err)
-	}
-	conn, err := net.ListenUDP("udp4", la)
-	if err != nil {
-		panic(err)
-	}
-	buf := make([]byte, 9999)
-	for {
-		n, raddr, err := conn.ReadFromUDP(buf)
-		if err != nil {
-			panic(err)
+// names splits a list of club names.
+func names(list string) []string {
+	var r []string
+	for _, name := range strings.Split(list, ",") {
+		if name == "" {
+			continue
 		}
-		s := string(buf[:n])
-		log.Printf("%s says %s", raddr, s)
-		c <- s
+		if strings.ContainsAny(name, "/ \t") {
+			log.Panicf("bad club name %q", name)
+		}
+		r = append(r, name)
 	}
-	c <- "EOF"
+	return r
 }
 
-const maxNodes = 4
-
-var I node
-var myClub string
-var myID int
-
-const noClub = "(no club)"
-
-func init() {
-	flag.IntVar(&myID, "i", -1,
-		"the unique integer ID of this participant")
-	flag.StringVar(&myClub, "c", noClub,
-		"the club this participant will found")
-}
 func main() {
 	flag.Parse()
 	if myID < 0 {
-		panic("no ID provided")
-	} else if myID >= maxNodes {
-		panic("max ID is " + string(maxNodes-1))
+		log.Panic("no ID provided")
 	}
-	if myClub != noClub {
-		log.Printf("%d founding club %s", myID, myClub)
-		I.amLeader = true
+	if myName == "" {
+		myName = fmt.Sprint("node", myID)
 	}
 
-	c := make(chan string, 5)
-	go I.serve(c)
-	log.Printf("%d started", myID)
-	for {
-		s := <-c
-		if s == "EOF" {
-			break
+	conn, err := upnet.Join(transport, groupAddr)
+	if err != nil {
+		log.Panic(err)
+	}
+	n := club.New(club.Config{
+		Name: myName,
+		Open: func(name string) (stable.Log, error) {
+			return stable.Open(dir, "club-"+name, myID)
+		},
+	}, conn)
+	for _, name := range names(myClubs) {
+		log.Printf("%d founding club %s", myID, name)
+		if err := n.Found(name); err != nil {
+			log.Panic(err)
 		}
-		f := strings.Fields(s)
-		switch strings.ToLower(f[0]) {
-		case "join":
-			I.handleJoin(f)
+	}
+	for _, name := range names(joinClubs) {
+		log.Printf("%d joining club %s", myID, name)
+		if err := n.Join(name); err != nil {
+			log.Panic(err)
 		}
 	}
+	n.Start()
+	log.Printf("%d started as %s", myID, myName)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	n.Close()
+	log.Printf("%d ending", myID)
 }
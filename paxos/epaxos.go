@@ -0,0 +1,89 @@
+// epaxos.go - leaderless Egalitarian Paxos replica over unreliable broadcast
+
+package main
+
+import (
+	"flag"
+	"log"
+	"runtime"
+
+	"epaxos"
+	"flow"
+	"rsm"
+	"stable"
+	"upnet"
+)
+
+var cfg = epaxos.Config{ID: -1, N: -1, Auth: &upnet.Auth{}}
+var keyFile, adminKeyFile string
+var rateFlag string
+var transport string
+var groupAddr string
+
+func init() {
+	flag.IntVar(&cfg.ID, "i", -1,
+		"identifier for this replica")
+	flag.IntVar(&cfg.N, "n", -1,
+		"number of replicas, odd")
+	flag.StringVar(&keyFile, "k", "",
+		"file with the group key that signs replicas' messages")
+	flag.StringVar(&adminKeyFile, "K", "",
+		"file with the key that admin commands like quit need")
+	flag.DurationVar(&cfg.Retry, "retry", epaxos.DefaultRetry,
+		"resend a command leader's phase after this long")
+	flag.DurationVar(&cfg.Recover, "recover", epaxos.DefaultRecover,
+		"take over an instance or request stuck this long")
+	flag.StringVar(&rateFlag, "rate",
+		"PreAccept=200,PreAcceptOK=500,Slow=200,SlowOK=500,Commit=200,"+
+			"Prepare=100,PrepareOK=100,Refuse=100,OK=500",
+		"messages per second allowed for each type")
+	flag.StringVar(&transport, "t", "ip",
+		"group transport: \"ip\" (raw IP, needs root) or \"udp\" (multicast)")
+	flag.StringVar(&groupAddr, "g", "",
+		"group address (default "+upnet.DefaultIPAddr+" for ip, "+
+			upnet.DefaultUDPAddr+" for udp)")
+}
+
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	flag.Parse()
+	if cfg.ID == -1 || cfg.N == -1 || cfg.N%2 == 0 {
+		log.Panic("usage")
+	}
+	if keyFile != "" {
+		k, err := upnet.ReadKey(keyFile)
+		if err != nil {
+			log.Panic(err)
+		}
+		cfg.Auth.Key = k
+	}
+	if adminKeyFile != "" {
+		k, err := upnet.ReadKey(adminKeyFile)
+		if err != nil {
+			log.Panic(err)
+		}
+		cfg.Auth.AdminKey = k
+	}
+	var err error
+	if cfg.Rates, err = flow.Rates(rateFlag); err != nil {
+		log.Panic(err)
+	}
+	log.Printf("epaxos id(%d) started in group of %d", cfg.ID, cfg.N)
+	defer log.Printf("epaxos id(%d) ending", cfg.ID)
+
+	store, err := stable.Open(".", "epaxos", cfg.ID)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer store.Close()
+
+	conn, err := upnet.Join(transport, groupAddr)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	n := epaxos.New(cfg, conn, store, rsm.NewKV())
+	n.Start()
+	n.Wait()
+	n.Close()
+}
@@ -33,7 +33,7 @@
 //
 // Then give them something to talk about:
 //
-// ~$ echo Request 0 hi | sudo go run ~/git/go-getting/paxos/iptest-send.go -a 127.0.0.1 -p 253
+// ~$ sudo go run ~/git/go-getting/paxos/upclient.go send Request 0 hi
 // ~$
 
 package main
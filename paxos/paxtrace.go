@@ -0,0 +1,63 @@
+// paxtrace.go - check Paxos traces, or export them for TLA+
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"trace"
+)
+
+var tlaModule string
+
+func init() {
+	flag.StringVar(&tlaModule, "tla", "",
+		"instead of checking, write the trace as a TLA+ module with this name")
+}
+
+// input is the named trace files one after another, or stdin.  A
+// participant's events stay in order within its own file, which is
+// all that checking needs.
+func input() io.Reader {
+	if flag.NArg() == 0 {
+		return os.Stdin
+	}
+	rs := []io.Reader{}
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rs = append(rs, f)
+	}
+	return io.MultiReader(rs...)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: paxtrace [-tla Module] [trace.jsonl ...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if tlaModule != "" {
+		if err := trace.TLA(input(), os.Stdout, tlaModule); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	bad, err := trace.Check(input())
+	for _, s := range bad {
+		fmt.Println(s)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(bad) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
@@ -0,0 +1,88 @@
+// raft.go - Raft server over unreliable broadcast, for comparison with upaxos
+
+package main
+
+import (
+	"flag"
+	"log"
+	"runtime"
+
+	"flow"
+	"raft"
+	"rsm"
+	"stable"
+	"upnet"
+)
+
+var cfg = raft.Config{ID: -1, N: -1, Auth: &upnet.Auth{}}
+var keyFile, adminKeyFile string
+var rateFlag string
+var transport string
+var groupAddr string
+
+func init() {
+	flag.IntVar(&cfg.ID, "i", -1,
+		"identifier for this server")
+	flag.IntVar(&cfg.N, "n", -1,
+		"number of servers")
+	flag.StringVar(&keyFile, "k", "",
+		"file with the group key that signs servers' messages")
+	flag.StringVar(&adminKeyFile, "K", "",
+		"file with the key that admin commands like quit need")
+	flag.DurationVar(&cfg.Heartbeat, "hb", raft.DefaultHeartbeat,
+		"time between the leader's heartbeats")
+	flag.DurationVar(&cfg.Election, "election", raft.DefaultElection,
+		"least time without a leader before a follower stands for election")
+	flag.StringVar(&rateFlag, "rate",
+		"Vote=100,Voted=100,Append=500,Appended=500,OK=500",
+		"messages per second allowed for each type")
+	flag.StringVar(&transport, "t", "ip",
+		"group transport: \"ip\" (raw IP, needs root) or \"udp\" (multicast)")
+	flag.StringVar(&groupAddr, "g", "",
+		"group address (default "+upnet.DefaultIPAddr+" for ip, "+
+			upnet.DefaultUDPAddr+" for udp)")
+}
+
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	flag.Parse()
+	if cfg.ID == -1 || cfg.N == -1 {
+		log.Panic("usage")
+	}
+	if keyFile != "" {
+		k, err := upnet.ReadKey(keyFile)
+		if err != nil {
+			log.Panic(err)
+		}
+		cfg.Auth.Key = k
+	}
+	if adminKeyFile != "" {
+		k, err := upnet.ReadKey(adminKeyFile)
+		if err != nil {
+			log.Panic(err)
+		}
+		cfg.Auth.AdminKey = k
+	}
+	var err error
+	if cfg.Rates, err = flow.Rates(rateFlag); err != nil {
+		log.Panic(err)
+	}
+	log.Printf("raft id(%d) started in group of %d", cfg.ID, cfg.N)
+	defer log.Printf("raft id(%d) ending", cfg.ID)
+
+	store, err := stable.Open(".", "raft", cfg.ID)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer store.Close()
+
+	conn, err := upnet.Join(transport, groupAddr)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	n := raft.New(cfg, conn, store, rsm.NewKV())
+	n.Start()
+	n.Wait()
+	n.Close()
+}
@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newServer(t *testing.T) (*Server, string) {
+	s := NewServer("test")
+	s.Log = log.New(io.Discard, "", 0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(s.Close)
+	return s, l.Addr().String()
+}
+
+// expect reads lines until one contains want, or fails the test.
+func expect(t *testing.T, lines <-chan string, want string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("hung up before %q", want)
+			}
+			if strings.Contains(line, want) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("no %q", want)
+		}
+	}
+}
+
+func dial(t *testing.T, addr, nick string) *Client {
+	c, err := Dial(addr, nick, nick)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		line, cmd string
+		args      []string
+	}{
+		{"NICK ann", "NICK", []string{"ann"}},
+		{"privmsg #c :hi there", "PRIVMSG", []string{"#c", "hi there"}},
+		{":ann!~ann@h PRIVMSG bob :a :b", "PRIVMSG", []string{"bob", "a :b"}},
+		{"PING", "PING", []string{}},
+		{"", "", nil},
+	} {
+		cmd, args := parse(tc.line)
+		if cmd != tc.cmd || strings.Join(args, "|") != strings.Join(tc.args, "|") {
+			t.Errorf("parse(%q) = %q %q, want %q %q", tc.line, cmd, args, tc.cmd, tc.args)
+		}
+	}
+}
+
+func TestChat(t *testing.T) {
+	_, addr := newServer(t)
+	ann := dial(t, addr, "ann")
+	bob := dial(t, addr, "bob")
+	if _, err := Dial(addr, "ann", "ann"); err == nil {
+		t.Error("two anns")
+	}
+
+	ann.Send("JOIN #c")
+	expect(t, ann.Lines, "366 ann #c")
+	bob.Send("JOIN #c")
+	expect(t, bob.Lines, "353 bob = #c :ann bob")
+	expect(t, ann.Lines, ":bob!~bob@127.0.0.1 JOIN #c")
+
+	bob.Send("PRIVMSG #c :hello, all")
+	expect(t, ann.Lines, ":bob!~bob@127.0.0.1 PRIVMSG #c :hello, all")
+	ann.Send("PRIVMSG bob :just you")
+	expect(t, bob.Lines, "PRIVMSG bob :just you")
+	ann.Send("PRIVMSG carl :anyone?")
+	expect(t, ann.Lines, "401 ann carl")
+
+	bob.Send("PART #c :bye")
+	expect(t, ann.Lines, "PART #c :bye")
+	ann.Send("PRIVMSG #c :alone")
+	bob.Send("NAMES #c")
+	expect(t, bob.Lines, "353 bob = #c :ann")
+	bob.Close()
+	ann.Send("NAMES #c")
+	expect(t, ann.Lines, "353 ann = #c :ann")
+}
+
+// TestLines has a player with nothing but a line-based connection.
+func TestLines(t *testing.T) {
+	_, addr := newServer(t)
+	ann := dial(t, addr, "ann")
+	ann.Send("JOIN #c")
+	expect(t, ann.Lines, "366 ann #c")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "NICK bob\nJOIN #c\nhello there\n")
+	expect(t, ann.Lines, ":bob!~bob@127.0.0.1 PRIVMSG #c :hello there")
+	io.WriteString(conn, "QUIT :later\n")
+	expect(t, ann.Lines, ":bob!~bob@127.0.0.1 QUIT :later")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if strings.Contains(line, " 421 ") {
+			t.Errorf("bob got %q", line)
+		}
+	}
+}
+
+// TestStalled has a client that never reads while the others chat
+// on.  The server hangs up on it rather than wait for it.
+func TestStalled(t *testing.T) {
+	_, addr := newServer(t)
+	ann := dial(t, addr, "ann")
+	bob := dial(t, addr, "bob")
+	ann.Send("JOIN #c")
+	expect(t, ann.Lines, "366 ann #c")
+	bob.Send("JOIN #c")
+	expect(t, bob.Lines, "366 bob #c")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "NICK carl\nJOIN #c\n")
+	expect(t, bob.Lines, ":carl!~carl@127.0.0.1 JOIN #c")
+
+	// in all, more than carl's outbox and socket buffers hold
+	text := strings.Repeat("x", 500)
+	for k := 0; k < 40; k++ {
+		for j := 0; j < Outbox/2; j++ {
+			ann.Send("PRIVMSG #c :" + text)
+		}
+		ann.Send(fmt.Sprintf("PRIVMSG #c :round %d", k))
+		expect(t, bob.Lines, fmt.Sprintf("PRIVMSG #c :round %d", k))
+	}
+	ann.Send("NAMES #c")
+	expect(t, ann.Lines, "353 ann = #c :ann bob")
+}
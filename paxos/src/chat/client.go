@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Client is a connection to an IRC server, this package's or any
+// other, that answers PING itself.
+type Client struct {
+	Nick  string
+	Lines <-chan string // from the server, closed when it hangs up
+
+	conn net.Conn
+	mu   sync.Mutex
+	w    *bufio.Writer
+	err  error
+}
+
+// DialTimeout is how long Dial waits for the server to welcome it.
+var DialTimeout = 30 * time.Second
+
+// Dial connects to the server at addr and registers as nick, with
+// user as the user name.  It returns once the server welcomes it.
+func Dial(addr, nick, user string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	lines := make(chan string, 100)
+	c := &Client{Nick: nick, Lines: lines, conn: conn, w: bufio.NewWriter(conn)}
+	c.Send("NICK " + nick)
+	c.Send(fmt.Sprintf("USER %s 0 * :%s", user, user))
+
+	welcome := make(chan error, 1)
+	go c.recv(lines, welcome)
+	select {
+	case err = <-welcome:
+	case <-time.After(DialTimeout):
+		err = fmt.Errorf("chat: no welcome from %s", addr)
+	}
+	if err != nil {
+		conn.Close()
+		for range lines {
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// recv reads lines from the server, answering PING, and passes the
+// rest on.  It tells welcome how registering went.
+func (c *Client) recv(lines chan<- string, welcome chan<- error) {
+	defer close(lines)
+	r := bufio.NewReader(c.conn)
+	welcomed := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if !welcomed {
+				welcome <- fmt.Errorf("chat: %v before welcome", err)
+			}
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd, args := parse(line)
+		switch {
+		case cmd == "PING":
+			token := ""
+			if len(args) > 0 {
+				token = args[len(args)-1]
+			}
+			c.Send("PONG :" + token)
+			continue
+		case welcomed:
+		case cmd == "001":
+			welcomed = true
+			welcome <- nil
+		case cmd == "432" || cmd == "433":
+			welcomed = true
+			welcome <- fmt.Errorf("chat: %s", strings.Join(args[1:], " "))
+			continue
+		}
+		lines <- line
+	}
+}
+
+// Send sends a line to the server, like "JOIN #pmodtesting".
+func (c *Client) Send(line string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.w.WriteString(line + "\r\n")
+	c.err = c.w.Flush()
+	return c.err
+}
+
+// Close says goodbye and hangs up.  Lines is closed soon after.
+func (c *Client) Close() error {
+	c.Send("QUIT")
+	return c.conn.Close()
+}
@@ -0,0 +1,434 @@
+// Package chat is a small chat server that speaks enough IRC for
+// common IRC clients, and a client for it, so that a classroom can
+// chat without an IRC network.  The server knows NICK, USER, JOIN,
+// PART, PRIVMSG, NOTICE, NAMES, PING and QUIT, and nothing of
+// operators, modes or other servers.
+//
+// It is also a line-based chat for players with nothing but nc: once
+// a client is in one channel, a line that is not a command it knows
+// goes to the channel, as though sent with PRIVMSG.
+//
+//	$ nc localhost 6667
+//	NICK ann
+//	JOIN #pmodtesting
+//	hello there
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Outbox is how many lines may wait for a client to read them.  A
+// client that falls this far behind is hung up on, so that it cannot
+// hold up the others.
+const Outbox = 1000
+
+// A Server relays messages among its clients.
+type Server struct {
+	Name string // in the prefix of its own messages
+	Log  *log.Logger
+
+	mu       sync.Mutex
+	clients  map[*client]bool
+	nicks    map[string]*client
+	channels map[string]map[*client]bool
+	ls       []net.Listener
+	wg       sync.WaitGroup
+}
+
+type client struct {
+	s     *Server
+	conn  net.Conn
+	host  string
+	nick  string // "" until NICK
+	user  string
+	chans []string // the channels joined, in order
+	why   string   // given with QUIT
+
+	// Lines go out through out, to a goroutine that writes them, so
+	// no one waits on the client's connection while holding s.mu.
+	out  chan string
+	gone bool // out is closed
+}
+
+func NewServer(name string) *Server {
+	return &Server{
+		Name:     name,
+		Log:      log.New(log.Writer(), "", log.LstdFlags),
+		clients:  make(map[*client]bool),
+		nicks:    make(map[string]*client),
+		channels: make(map[string]map[*client]bool),
+	}
+}
+
+// Serve accepts clients on l until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.ls = append(s.ls, l)
+	s.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		c := &client{s: s, conn: conn, host: host, out: make(chan string, Outbox)}
+		s.mu.Lock()
+		s.clients[c] = true
+		s.wg.Add(2)
+		s.mu.Unlock()
+		go c.serve()
+		go c.write()
+	}
+}
+
+// Close stops the listeners and disconnects every client.
+func (s *Server) Close() {
+	s.mu.Lock()
+	for _, l := range s.ls {
+		l.Close()
+	}
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// prefix says who sent a message, like "ann!~ann@127.0.0.1".
+func (c *client) prefix() string {
+	return fmt.Sprintf("%s!~%s@%s", c.nick, c.user, c.host)
+}
+
+// send queues a line for the client.  It is called with s.mu held,
+// and never waits: a client whose outbox is full is hung up on.
+func (c *client) send(line string) {
+	if c.gone {
+		return
+	}
+	select {
+	case c.out <- line:
+	default:
+		c.s.Log.Printf("chat: %s: not reading, hanging up", c.host)
+		c.hangup()
+		c.conn.Close() // serve sees it and quits
+	}
+}
+
+// hangup closes the outbox.  The writer sends what is in it, and
+// then closes the connection.
+func (c *client) hangup() {
+	if !c.gone {
+		c.gone = true
+		close(c.out)
+	}
+}
+
+// write sends the client its lines until it is hung up on, and then
+// forgets it.
+func (c *client) write() {
+	s := c.s
+	defer s.wg.Done()
+	w := bufio.NewWriter(c.conn)
+	for line := range c.out {
+		w.WriteString(line + "\r\n")
+		if len(c.out) > 0 {
+			continue // flush once for all that is waiting
+		}
+		if err := w.Flush(); err != nil {
+			break
+		}
+	}
+	c.conn.Close()
+	s.mu.Lock()
+	delete(s.clients, c)
+	s.mu.Unlock()
+}
+
+// reply sends a numeric reply from the server.
+func (c *client) reply(code, text string) {
+	nick := c.nick
+	if nick == "" {
+		nick = "*"
+	}
+	c.send(fmt.Sprintf(":%s %s %s %s", c.s.Name, code, nick, text))
+}
+
+func (c *client) serve() {
+	defer c.s.wg.Done()
+	defer c.quit()
+	r := bufio.NewReader(c.conn)
+	for {
+		line, err := r.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			if !c.handle(line) {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				c.s.Log.Printf("chat: %s: %v", c.host, err)
+			}
+			return
+		}
+	}
+}
+
+// handle does what a line from the client says, and reports whether
+// the client is still connected.
+func (c *client) handle(line string) bool {
+	cmd, args := parse(line)
+	s := c.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cmd == "QUIT" {
+		if len(args) > 0 {
+			c.why = args[len(args)-1]
+		}
+		return false
+	}
+	if c.nick == "" && cmd != "NICK" && cmd != "USER" && cmd != "PING" {
+		c.reply("451", ":You have not registered")
+		return true
+	}
+	switch cmd {
+	case "NICK":
+		if len(args) < 1 {
+			c.reply("431", ":No nickname given")
+			break
+		}
+		nick := args[0]
+		if strings.ContainsAny(nick, "#:!@,") {
+			c.reply("432", nick+" :Erroneous nickname")
+			break
+		}
+		if other, ok := s.nicks[nick]; ok && other != c {
+			c.reply("433", nick+" :Nickname is already in use")
+			break
+		}
+		if c.nick == "" {
+			c.nick = nick
+			if c.user == "" {
+				c.user = nick
+			}
+			s.nicks[nick] = c
+			c.reply("001", fmt.Sprintf(":Welcome to %s, %s", s.Name, nick))
+			c.reply("422", ":MOTD File is missing")
+			break
+		}
+		old := c.prefix()
+		delete(s.nicks, c.nick)
+		c.nick = nick
+		s.nicks[nick] = c
+		c.tell(fmt.Sprintf(":%s NICK :%s", old, nick), true)
+	case "USER":
+		if len(args) >= 1 {
+			c.user = args[0]
+		}
+	case "PING":
+		token := s.Name
+		if len(args) > 0 {
+			token = args[len(args)-1]
+		}
+		c.send(fmt.Sprintf(":%s PONG %s :%s", s.Name, s.Name, token))
+	case "PONG":
+	case "JOIN":
+		if len(args) < 1 {
+			c.reply("461", "JOIN :Not enough parameters")
+			break
+		}
+		for _, ch := range strings.Split(args[0], ",") {
+			c.join(ch)
+		}
+	case "PART":
+		if len(args) < 1 {
+			c.reply("461", "PART :Not enough parameters")
+			break
+		}
+		why := ""
+		if len(args) > 1 {
+			why = args[1]
+		}
+		for _, ch := range strings.Split(args[0], ",") {
+			c.part(ch, why)
+		}
+	case "NAMES":
+		for _, ch := range args {
+			c.names(ch)
+		}
+	case "PRIVMSG", "NOTICE":
+		if len(args) < 2 {
+			if cmd == "PRIVMSG" {
+				c.reply("411", ":No recipient or text given")
+			}
+			break
+		}
+		c.privmsg(cmd, args[0], args[len(args)-1])
+	default:
+		if len(c.chans) == 1 {
+			c.privmsg("PRIVMSG", c.chans[0], line) // line-based chat
+			break
+		}
+		c.reply("421", cmd+" :Unknown command")
+	}
+	return true
+}
+
+// parse splits a line into its command and its arguments, the last
+// of which may follow a " :" and hold spaces.  A prefix, as clients
+// may send, is dropped.
+func parse(line string) (cmd string, args []string) {
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	line, text, found := strings.Cut(line, " :")
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return "", nil
+	}
+	cmd, args = strings.ToUpper(f[0]), f[1:]
+	if found {
+		args = append(args, text)
+	}
+	return cmd, args
+}
+
+func (c *client) in(ch string) bool {
+	for _, x := range c.chans {
+		if x == ch {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *client) join(ch string) {
+	if !strings.HasPrefix(ch, "#") || len(ch) < 2 {
+		c.reply("403", ch+" :No such channel")
+		return
+	}
+	if c.in(ch) {
+		return
+	}
+	s := c.s
+	if s.channels[ch] == nil {
+		s.channels[ch] = make(map[*client]bool)
+	}
+	s.channels[ch][c] = true
+	c.chans = append(c.chans, ch)
+	for m := range s.channels[ch] {
+		m.send(fmt.Sprintf(":%s JOIN %s", c.prefix(), ch))
+	}
+	c.names(ch)
+}
+
+func (c *client) names(ch string) {
+	var nicks []string
+	for m := range c.s.channels[ch] {
+		nicks = append(nicks, m.nick)
+	}
+	sort.Strings(nicks)
+	if len(nicks) > 0 {
+		c.reply("353", fmt.Sprintf("= %s :%s", ch, strings.Join(nicks, " ")))
+	}
+	c.reply("366", ch+" :End of /NAMES list")
+}
+
+func (c *client) part(ch, why string) {
+	if !c.in(ch) {
+		c.reply("442", ch+" :You're not on that channel")
+		return
+	}
+	msg := fmt.Sprintf(":%s PART %s", c.prefix(), ch)
+	if why != "" {
+		msg += " :" + why
+	}
+	for m := range c.s.channels[ch] {
+		m.send(msg)
+	}
+	c.leave(ch)
+}
+
+// leave takes the client out of a channel without a word.
+func (c *client) leave(ch string) {
+	s := c.s
+	delete(s.channels[ch], c)
+	if len(s.channels[ch]) == 0 {
+		delete(s.channels, ch)
+	}
+	for k, x := range c.chans {
+		if x == ch {
+			c.chans = append(c.chans[:k:k], c.chans[k+1:]...)
+			break
+		}
+	}
+}
+
+func (c *client) privmsg(cmd, to, text string) {
+	s := c.s
+	msg := fmt.Sprintf(":%s %s %s :%s", c.prefix(), cmd, to, text)
+	if strings.HasPrefix(to, "#") {
+		if !c.in(to) {
+			c.reply("404", to+" :Cannot send to channel")
+			return
+		}
+		for m := range s.channels[to] {
+			if m != c {
+				m.send(msg)
+			}
+		}
+		return
+	}
+	m, ok := s.nicks[to]
+	if !ok {
+		if cmd == "PRIVMSG" {
+			c.reply("401", to+" :No such nick/channel")
+		}
+		return
+	}
+	m.send(msg)
+}
+
+// tell sends a line to everyone who shares a channel with the
+// client, once each, and to the client too if self.
+func (c *client) tell(line string, self bool) {
+	told := map[*client]bool{c: true}
+	if self {
+		c.send(line)
+	}
+	for _, ch := range c.chans {
+		for m := range c.s.channels[ch] {
+			if !told[m] {
+				told[m] = true
+				m.send(line)
+			}
+		}
+	}
+}
+
+// quit disconnects the client, and tells the others in its channels.
+func (c *client) quit() {
+	s := c.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.hangup()
+	if c.nick == "" || s.nicks[c.nick] != c {
+		return
+	}
+	why := c.why
+	if why == "" {
+		why = "Connection closed"
+	}
+	c.tell(fmt.Sprintf(":%s QUIT :%s", c.prefix(), why), false)
+	for _, ch := range append([]string{}, c.chans...) {
+		c.leave(ch)
+	}
+	delete(s.nicks, c.nick)
+}
@@ -0,0 +1,529 @@
+package club
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"stable"
+	"upnet"
+)
+
+// needMax is how many chosen commands a member sends for one need.
+const needMax = 16
+
+// A ballot is a proposal number: a round, and the member that
+// leads it, so that no two members use the same one.  It is
+// "ROUND.NAME" in messages, or just ROUND for none.
+type ballot struct {
+	n    int64
+	name string
+}
+
+func (b ballot) String() string {
+	if b.name == "" {
+		return fmt.Sprint(b.n)
+	}
+	return fmt.Sprintf("%d.%s", b.n, b.name)
+}
+
+func (b ballot) less(o ballot) bool {
+	return b.n < o.n || b.n == o.n && b.name < o.name
+}
+
+func parseBallot(s string) (b ballot, err error) {
+	n, name, _ := strings.Cut(s, ".")
+	b.name = name
+	b.n, err = strconv.ParseInt(n, 10, 64)
+	if err != nil {
+		err = fmt.Errorf("bad proposal number %q", s)
+	}
+	return b, err
+}
+
+type proposal struct {
+	b ballot
+	v string
+}
+
+// A request is a command a user asked for, and when the member
+// last saw it, or saw the club get something done.
+type request struct {
+	cmd string
+	t   time.Time
+}
+
+// A club is what one member, or a process that asks to be one,
+// knows of a club.  Its node's lock protects it.
+type club struct {
+	name string
+	n    *Node
+
+	store   stable.Log  // nil for none
+	lf      *log.Logger // writes to store
+	loading bool
+
+	// learner
+	chosen  map[int64]string
+	next    int64    // the first instance not applied
+	members []string // after applying the instances before next
+	heard   int64    // the highest instance heard to be chosen
+	joining bool
+	needed  time.Time // when the member last sent need
+
+	// acceptor
+	promised ballot
+	accepted map[int64]proposal
+
+	// proposer
+	leading   bool
+	ballot    ballot
+	pseen     ballot // the highest proposal number seen
+	phase     int    // 1 or 2 while waiting for a quorum, else 0
+	inst      int64  // of the phase
+	value     string
+	votes     map[string]bool
+	prepared  bool // promised by the members for every instance from next on
+	recovered map[int64]proposal
+	sent      time.Time
+	pending   []request
+	patience  time.Duration // before taking over
+}
+
+func (c *club) send(i int64, b ballot, typ string, v *string, extra ...interface{}) {
+	s := fmt.Sprintf("club %s %s %d %s %s", c.name, c.n.Name, i, b, typ)
+	for _, x := range extra {
+		s += fmt.Sprint(" ", x)
+	}
+	c.n.send(upnet.Record(v, "%s", s))
+}
+
+func (c *club) member(name string) bool {
+	for _, m := range c.members {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *club) handle(m msg) {
+	if c.pseen.less(m.b) {
+		c.pseen = m.b
+	}
+	if m.typ != "chosen" && m.i-1 > c.heard {
+		// whoever sent m has learned every instance before m.i
+		c.heard = m.i - 1
+	}
+	switch m.typ {
+	case "propose":
+		c.yield(m)
+		if m.b.less(c.promised) {
+			c.send(m.i, m.b, "nack", nil, c.promised)
+			return
+		}
+		if c.promised != m.b {
+			c.promised = m.b
+			c.record(nil, "promise %s", m.b)
+			c.sync()
+		}
+		var acc []string
+		for i, p := range c.accepted {
+			if i >= m.i {
+				acc = append(acc, fmt.Sprintf("%d %s %s", i, p.b, p.v))
+			}
+		}
+		_, v := upnet.SplitCommand(upnet.Batch(acc))
+		c.send(m.i, m.b, "promise", &v)
+		// a proposer that is behind needs what was chosen
+		c.resend(m.i)
+	case "promise":
+		if !c.voting(1, m) || m.v == nil {
+			return
+		}
+		acc, err := upnet.SplitBatch(*m.v)
+		if err != nil {
+			c.n.Log.Printf("club %s: promise from %s: %v", c.name, m.from, err)
+			return
+		}
+		for _, a := range acc {
+			f := strings.SplitN(a, " ", 3)
+			if len(f) < 3 {
+				continue
+			}
+			i, err := strconv.ParseInt(f[0], 10, 64)
+			b, err2 := parseBallot(f[1])
+			if err != nil || err2 != nil {
+				continue
+			}
+			if r, ok := c.recovered[i]; !ok || r.b.less(b) {
+				c.recovered[i] = proposal{b, f[2]}
+			}
+		}
+		c.vote(m)
+	case "nack":
+		if c.leading && m.b == c.ballot && c.ballot.less(m.p) {
+			c.n.Log.Printf("club %s: %s promised %s, so %s stops leading",
+				c.name, m.from, m.p, c.n.Name)
+			c.unlead()
+		}
+	case "write":
+		c.yield(m)
+		if m.v == nil {
+			return
+		}
+		if m.b.less(c.promised) {
+			c.send(m.i, m.b, "nack", nil, c.promised)
+			return
+		}
+		c.promised = m.b
+		c.accepted[m.i] = proposal{m.b, *m.v}
+		c.record(m.v, "accept %d %s", m.i, m.b)
+		c.sync()
+		c.send(m.i, m.b, "accept", nil)
+	case "accept":
+		if c.voting(2, m) {
+			c.vote(m)
+		}
+	case "chosen":
+		if m.v != nil {
+			c.learn(m.i, *m.v)
+		}
+	case "need":
+		c.resend(m.i)
+	}
+}
+
+// yield stops leading for a higher proposal number than the
+// member's own.
+func (c *club) yield(m msg) {
+	if c.leading && c.ballot.less(m.b) {
+		c.n.Log.Printf("club %s: %s leads with %s, so %s stops leading",
+			c.name, m.from, m.b, c.n.Name)
+		c.unlead()
+	}
+}
+
+// voting reports whether m answers the member's own proposal in
+// the phase it is in, from a member.
+func (c *club) voting(phase int, m msg) bool {
+	return c.leading && c.phase == phase && m.i == c.inst &&
+		m.b == c.ballot && c.member(m.from)
+}
+
+func (c *club) vote(m msg) {
+	c.votes[m.from] = true
+	if len(c.votes) <= len(c.members)/2 {
+		return
+	}
+	switch c.phase {
+	case 1:
+		c.phase = 0
+		c.prepared = true
+		c.step()
+	case 2:
+		c.phase = 0
+		v := c.value
+		c.send(c.inst, c.ballot, "chosen", &v)
+		c.learn(c.inst, v) // goes on to the next
+	}
+}
+
+// resend sends the chosen commands from instance i on.
+func (c *club) resend(i int64) {
+	for k := 0; k < needMax && i < c.next; k, i = k+1, i+1 {
+		v := c.chosen[i]
+		c.send(i, ballot{}, "chosen", &v)
+	}
+}
+
+// learn notes that cmd is chosen for instance i, and applies what
+// it can in order.
+func (c *club) learn(i int64, cmd string) {
+	if _, ok := c.chosen[i]; ok || i < c.next {
+		return
+	}
+	c.chosen[i] = cmd
+	if !c.loading {
+		c.record(&cmd, "chosen %d", i)
+		c.sync()
+	}
+	if i > c.heard {
+		c.heard = i
+	}
+	for {
+		cmd, ok := c.chosen[c.next]
+		if !ok {
+			break
+		}
+		c.apply(c.next, cmd)
+		c.next++
+	}
+	if c.phase != 0 && c.inst < c.next {
+		c.phase = 0 // chosen, by this leader or another
+	}
+	now := time.Now()
+	for k := range c.pending {
+		c.pending[k].t = now // the club gets things done
+	}
+	c.step()
+}
+
+func (c *club) apply(i int64, cmd string) {
+	f := strings.Fields(cmd)
+	if len(f) != 2 {
+		c.n.Log.Printf("club %s: bad command %d %q", c.name, i, cmd)
+		return
+	}
+	who := f[1]
+	changed := false
+	switch f[0] {
+	case "found", "add":
+		if !c.member(who) {
+			c.members = append(c.members, who)
+			changed = true
+		}
+		c.n.Log.Printf("club %s: %d %s, members %v", c.name, i, cmd, c.members)
+		if who == c.n.Name && c.joining {
+			c.joining = false
+		}
+	case "oust":
+		for k, m := range c.members {
+			if m == who {
+				c.members = append(c.members[:k:k], c.members[k+1:]...)
+				changed = true
+				break
+			}
+		}
+		c.n.Log.Printf("club %s: %d %s, members %v", c.name, i, cmd, c.members)
+		if who == c.n.Name {
+			c.unlead()
+			c.pending = nil
+		}
+	case "toast":
+		c.n.Log.Printf("club %s: %d the club raises a glass to %s",
+			c.name, i, who)
+	}
+	if changed {
+		c.prepared = false
+	}
+	c.drop(cmd)
+	if c.n.OnApply != nil {
+		c.n.OnApply(c.name, i, cmd)
+	}
+}
+
+// request notes a user's request, unless there is nothing to do.
+func (c *club) request(op, who string) {
+	if !c.member(c.n.Name) {
+		return
+	}
+	cmd := op + " " + who
+	if op == "join" {
+		cmd = "add " + who
+	}
+	if c.done(cmd) {
+		return
+	}
+	for _, r := range c.pending {
+		if r.cmd == cmd {
+			return
+		}
+	}
+	c.pending = append(c.pending, request{cmd, time.Now()})
+	c.step()
+}
+
+// done reports whether a command would change nothing, or makes no
+// sense.
+func (c *club) done(cmd string) bool {
+	f := strings.Fields(cmd)
+	switch f[0] {
+	case "add":
+		return c.member(f[1])
+	case "oust", "toast":
+		return !c.member(f[1])
+	}
+	return true
+}
+
+// drop forgets requests that are done, including cmd.
+func (c *club) drop(cmd string) {
+	var left []request
+	for _, r := range c.pending {
+		if r.cmd != cmd && !c.done(r.cmd) {
+			left = append(left, r)
+		}
+	}
+	c.pending = left
+}
+
+func (c *club) lead() {
+	if !c.member(c.n.Name) {
+		return
+	}
+	c.leading = true
+	c.ballot = ballot{c.pseen.n + 1, c.n.Name}
+	c.pseen = c.ballot
+	// a leader that restarts must not use the number again, with
+	// another value
+	c.record(nil, "lead %s", c.ballot)
+	c.sync()
+	c.prepared = false
+	c.phase = 0
+	c.step()
+}
+
+func (c *club) unlead() {
+	c.leading = false
+	c.phase = 0
+	c.patience = c.n.Takeover + time.Duration(rand.Int63n(int64(c.n.Takeover)/2+1))
+	now := time.Now()
+	for k := range c.pending {
+		c.pending[k].t = now // give the new leader time
+	}
+}
+
+// step starts the leader's next phase, if it has one to start.
+func (c *club) step() {
+	if !c.leading || c.phase != 0 || c.heard >= c.next {
+		return // busy, or behind
+	}
+	if !c.prepared {
+		c.phase, c.inst = 1, c.next
+		c.votes = make(map[string]bool)
+		c.recovered = make(map[int64]proposal)
+		c.propose()
+		return
+	}
+	if r, ok := c.recovered[c.next]; ok {
+		c.value = r.v
+	} else if len(c.pending) > 0 {
+		c.value = c.pending[0].cmd
+	} else {
+		return
+	}
+	c.phase, c.inst = 2, c.next
+	c.votes = make(map[string]bool)
+	c.propose()
+}
+
+// propose sends the message for the leader's phase.
+func (c *club) propose() {
+	c.sent = time.Now()
+	if c.phase == 1 {
+		c.send(c.inst, c.ballot, "propose", nil)
+	} else {
+		v := c.value
+		c.send(c.inst, c.ballot, "write", &v)
+	}
+}
+
+func (c *club) tick(now time.Time) {
+	if c.leading && c.phase != 0 && now.Sub(c.sent) >= c.n.Retry {
+		c.propose()
+	}
+	if (c.heard >= c.next || c.joining) && now.Sub(c.needed) >= c.n.Retry {
+		c.needed = now
+		c.send(c.next, ballot{}, "need", nil)
+	}
+	if c.joining && now.Sub(c.sent) >= c.n.Takeover {
+		c.sent = now
+		c.n.send(upnet.Record(nil, "join %s %s", c.name, c.n.Name))
+	}
+	if c.leading || len(c.pending) == 0 || !c.member(c.n.Name) {
+		return
+	}
+	if now.Sub(c.pending[0].t) >= c.patience {
+		c.n.Log.Printf("club %s: %s takes over to %s", c.name, c.n.Name,
+			c.pending[0].cmd)
+		c.lead()
+	}
+}
+
+// record writes a version 1 record to the club's log.
+func (c *club) record(v *string, format string, a ...interface{}) {
+	if c.lf != nil {
+		c.lf.Print(upnet.Record(v, format, a...) + "\n")
+	}
+}
+
+func (c *club) sync() {
+	if c.store == nil {
+		return
+	}
+	stable.MustSync(c.store)
+}
+
+// load recovers the promise, the accepts and the commands chosen,
+// and truncates the log after its last good record, so that what
+// the club logs next does not follow a torn one.
+func (c *club) load() {
+	c.loading = true
+	defer func() { c.loading = false }()
+	lr := c.store.Log()
+	defer lr.Close()
+	br := stable.NewReader(lr)
+	var good int64 // where the last good record ends
+	for {
+		good = br.Offset()
+		if _, err := br.ReadString(' '); err != nil { // name prefix
+			break
+		}
+		if b, _ := br.Peek(len(upnet.Version) + 1); string(b) != upnet.Version+" " {
+			if _, err := br.ReadString('\n'); err != nil {
+				break
+			}
+			continue
+		}
+		br.Discard(len(upnet.Version) + 1)
+		m, err := upnet.ReadRecord(br.Reader)
+		if err != nil {
+			c.n.Log.Printf("club %s: stopping at bad log record: %s", c.name, err)
+			break
+		}
+		if len(m.F) < 2 {
+			continue
+		}
+		num := func(k int) int64 {
+			n, err := strconv.ParseInt(m.F[k], 10, 64)
+			if err != nil {
+				log.Panicf("bad log record %v", m.F)
+			}
+			return n
+		}
+		bal := func(k int) ballot {
+			b, err := parseBallot(m.F[k])
+			if err != nil {
+				log.Panicf("bad log record %v", m.F)
+			}
+			return b
+		}
+		switch m.F[0] {
+		case "promise":
+			c.promised = bal(1)
+		case "lead":
+			if b := bal(1); c.pseen.less(b) {
+				c.pseen = b
+			}
+		case "accept":
+			if len(m.F) < 3 || m.V == nil {
+				log.Panicf("bad log record %v", m.F)
+			}
+			c.promised = bal(2)
+			c.accepted[num(1)] = proposal{c.promised, *m.V}
+		case "chosen":
+			if m.V == nil {
+				log.Panicf("bad log record %v", m.F)
+			}
+			c.learn(num(1), *m.V)
+		}
+	}
+	stable.MustTruncate(c.store, good)
+	if c.pseen.less(c.promised) {
+		c.pseen = c.promised
+	}
+}
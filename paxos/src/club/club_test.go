@@ -0,0 +1,334 @@
+package club
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"simnet"
+	"stable"
+	"upnet"
+)
+
+// A sim is processes in clubs on a simnet, with a user.  Each keeps
+// its storage in memory, across restarts.
+type sim struct {
+	t      *testing.T
+	net    *simnet.Net
+	nodes  []*Node
+	stores []map[string]*stable.Mem
+	user   upnet.Conn
+
+	mu      sync.Mutex
+	applied map[string]string // the first command learned for each club and instance
+	bad     []string
+}
+
+func newSim(t *testing.T, n int, nc simnet.Config, seed int64) *sim {
+	s := &sim{
+		t:       t,
+		net:     simnet.New(nc, seed),
+		applied: make(map[string]string),
+	}
+	s.user = s.net.Join(100)
+	for i := 0; i < n; i++ {
+		s.stores = append(s.stores, make(map[string]*stable.Mem))
+		s.nodes = append(s.nodes, s.node(i))
+	}
+	return s
+}
+
+func (s *sim) node(i int) *Node {
+	c := Config{
+		Name:     fmt.Sprint("n", i),
+		Retry:    5 * time.Millisecond,
+		Takeover: 50 * time.Millisecond,
+		Log:      log.New(io.Discard, "", 0),
+		OnApply:  s.onApply,
+		Open: func(club string) (stable.Log, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			st, ok := s.stores[i][club]
+			if !ok {
+				st = &stable.Mem{}
+				s.stores[i][club] = st
+			}
+			return st, nil
+		},
+	}
+	return New(c, s.net.Join(i))
+}
+
+// restart crashes node i and starts it again from what it synced,
+// in the clubs it was in.
+func (s *sim) restart(i int) {
+	clubs := s.nodes[i].Clubs()
+	s.nodes[i].Close()
+	s.mu.Lock()
+	for club, st := range s.stores[i] {
+		s.stores[i][club] = st.Crash()
+	}
+	s.mu.Unlock()
+	s.nodes[i] = s.node(i)
+	for _, club := range clubs {
+		if err := s.nodes[i].Join(club); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	s.nodes[i].Start()
+}
+
+// onApply checks that every process learns the same commands.
+func (s *sim) onApply(club string, i int64, cmd string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := fmt.Sprint(club, " ", i)
+	if first, ok := s.applied[k]; !ok {
+		s.applied[k] = cmd
+	} else if first != cmd {
+		s.bad = append(s.bad, fmt.Sprintf("%s: %q and %q", k, first, cmd))
+	}
+}
+
+func (s *sim) close() {
+	for _, n := range s.nodes {
+		if n != nil {
+			n.Close()
+		}
+	}
+	s.user.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.bad {
+		s.t.Error(b)
+	}
+}
+
+// until sends the user's messages until ok, or fails the test
+// after a while.
+func (s *sim) until(ok func() bool, msgs ...string) bool {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, m := range msgs {
+			s.user.Send([]byte(upnet.Record(nil, "%s", m)))
+		}
+		if ok() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+// await sends the user's messages until every process in who has
+// the members want in boodles.
+func (s *sim) await(who []int, want string, msgs ...string) {
+	s.awaitClub("boodles", who, want, msgs...)
+}
+
+func (s *sim) awaitClub(club string, who []int, want string, msgs ...string) {
+	ok := s.until(func() bool {
+		for _, i := range who {
+			if members(s.nodes[i], club) != want {
+				return false
+			}
+		}
+		return true
+	}, msgs...)
+	if !ok {
+		for _, i := range who {
+			s.t.Errorf("n%d has members %q in %s, want %q",
+				i, members(s.nodes[i], club), club, want)
+		}
+		s.t.FailNow()
+	}
+}
+
+// count returns how many times cmd was chosen.
+func (s *sim) count(cmd string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := 0
+	for _, c := range s.applied {
+		if c == cmd {
+			k++
+		}
+	}
+	return k
+}
+
+// members returns a node's members of a club in order of name.
+func members(n *Node, club string) string {
+	m := n.Members(club)
+	sort.Strings(m)
+	return strings.Join(m, " ")
+}
+
+func TestClub(t *testing.T) {
+	for seed := int64(1); seed <= 10; seed++ {
+		nc := simnet.Config{Loss: 0.1, Dup: 0.05, MaxDelay: 2 * time.Millisecond}
+		s := newSim(t, 4, nc, seed)
+		s.nodes[0].Found("boodles")
+		for _, n := range s.nodes[1:] {
+			n.Join("boodles")
+		}
+		for _, n := range s.nodes {
+			n.Start()
+		}
+		s.await([]int{0, 1, 2, 3}, "n0 n1 n2 n3")
+		toasted := func() bool { return s.count("toast n1") > 0 }
+		if !s.until(toasted, "toast boodles n1") {
+			t.Fatalf("seed %d: no toast", seed)
+		}
+		s.await([]int{0, 1, 2}, "n0 n1 n2", "oust boodles n3")
+		s.close()
+		for i := 0; i < len(s.applied); i++ {
+			if _, ok := s.applied[fmt.Sprint("boodles ", i)]; !ok {
+				t.Errorf("seed %d: instance %d missing from %v", seed, i, s.applied)
+			}
+		}
+	}
+}
+
+// TestTakeover checks that the club goes on without its founder.
+func TestTakeover(t *testing.T) {
+	s := newSim(t, 4, simnet.Config{MaxDelay: time.Millisecond}, 1)
+	defer s.close()
+	s.nodes[0].Found("boodles")
+	s.nodes[1].Join("boodles")
+	s.nodes[2].Join("boodles")
+	for _, n := range s.nodes[:3] {
+		n.Start()
+	}
+	s.await([]int{0, 1, 2}, "n0 n1 n2")
+
+	s.nodes[0].Close()
+	s.nodes[0] = nil
+	s.await([]int{1, 2}, "n1 n2", "oust boodles n0")
+	if !s.nodes[1].Leading("boodles") && !s.nodes[2].Leading("boodles") {
+		t.Error("no one took over")
+	}
+
+	s.nodes[3].Join("boodles")
+	s.nodes[3].Start()
+	s.await([]int{1, 2, 3}, "n1 n2 n3")
+}
+
+// TestDuel has two members take over at once, again and again.
+func TestDuel(t *testing.T) {
+	nc := simnet.Config{Loss: 0.05, MaxDelay: 2 * time.Millisecond}
+	s := newSim(t, 3, nc, 2)
+	defer s.close()
+	s.nodes[0].Found("boodles")
+	s.nodes[1].Join("boodles")
+	s.nodes[2].Join("boodles")
+	for _, n := range s.nodes {
+		n.Start()
+	}
+	s.await([]int{0, 1, 2}, "n0 n1 n2")
+	for k := 1; k <= 5; k++ {
+		for _, n := range s.nodes {
+			n.mu.Lock()
+			n.clubs["boodles"].lead()
+			n.mu.Unlock()
+		}
+		toasted := func() bool { return s.count("toast n2") >= k }
+		if !s.until(toasted, "toast boodles n2") {
+			t.Fatalf("%d toasts after %d duels", s.count("toast n2"), k)
+		}
+	}
+}
+
+// TestClubs has processes in clubs with different members.
+func TestClubs(t *testing.T) {
+	nc := simnet.Config{Loss: 0.05, MaxDelay: time.Millisecond}
+	s := newSim(t, 5, nc, 3)
+	defer s.close()
+	s.nodes[0].Found("boodles")
+	s.nodes[1].Found("whites")
+	for _, i := range []int{1, 2, 3} {
+		s.nodes[i].Join("boodles")
+	}
+	for _, i := range []int{0, 2, 4} {
+		s.nodes[i].Join("whites")
+	}
+	for _, n := range s.nodes {
+		n.Start()
+	}
+	s.awaitClub("boodles", []int{0, 1, 2, 3}, "n0 n1 n2 n3")
+	s.awaitClub("whites", []int{0, 1, 2, 4}, "n0 n1 n2 n4")
+	s.awaitClub("boodles", []int{0, 1, 3}, "n0 n1 n3", "oust boodles n2")
+	s.awaitClub("whites", []int{0, 1, 2, 4}, "n0 n1 n2 n4")
+	if m := s.nodes[4].Members("boodles"); m != nil {
+		t.Errorf("n4 has members %q in boodles", m)
+	}
+}
+
+// TestRestart has members crash and come back as themselves.
+func TestRestart(t *testing.T) {
+	nc := simnet.Config{Loss: 0.05, MaxDelay: time.Millisecond}
+	s := newSim(t, 4, nc, 4)
+	defer s.close()
+	s.nodes[0].Found("boodles")
+	s.nodes[1].Join("boodles")
+	s.nodes[2].Join("boodles")
+	for _, n := range s.nodes[:3] {
+		n.Start()
+	}
+	s.await([]int{0, 1, 2}, "n0 n1 n2")
+
+	// the leader first, then the others
+	for _, i := range []int{0, 1, 2} {
+		s.restart(i)
+		if got := members(s.nodes[i], "boodles"); got != "n0 n1 n2" {
+			t.Errorf("n%d came back with members %q", i, got)
+		}
+	}
+	s.nodes[3].Join("boodles")
+	s.nodes[3].Start()
+	s.await([]int{0, 1, 2, 3}, "n0 n1 n2 n3")
+	s.restart(3)
+	s.await([]int{0, 1, 2, 3}, "n0 n1 n3", "oust boodles n2")
+}
+
+// TestTornLog has a member crash partway through logging an accept,
+// and checks that recovery cuts the torn record off, so that what the
+// member logs after the restart survives the next one.
+func TestTornLog(t *testing.T) {
+	m := &stable.Mem{}
+	recover := func() *club {
+		m = m.Crash()
+		n := New(Config{
+			Name: "n0",
+			Log:  log.New(io.Discard, "", 0),
+			Open: func(string) (stable.Log, error) { return m, nil },
+		}, nil)
+		c, err := n.newClub("boodles")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	accept := func(c *club, i int64, v string) {
+		c.record(&v, "accept %d %s", i, ballot{3, "n0"})
+		c.sync()
+	}
+	accept(recover(), 1, "a")
+	io.WriteString(m, "n0: v1 accept 2 3.n0 10:tor") // the crash
+	m.Sync()
+	accept(recover(), 3, "c")
+	c := recover()
+	for i, v := range map[int64]string{1: "a", 3: "c"} {
+		if p, ok := c.accepted[i]; !ok || p.v != v {
+			t.Errorf("lost the accept of %q in %d", v, i)
+		}
+	}
+	if p, ok := c.accepted[2]; ok {
+		t.Errorf("recovered the torn accept of %q in 2", p.v)
+	}
+}
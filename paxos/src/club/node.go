@@ -0,0 +1,332 @@
+// Package club keeps clubs: named groups of processes, the members,
+// that agree with Multi-Paxos on who the members are, so that a club
+// can outlive any particular set of processes.  A process founds
+// clubs, or asks to join them, and the members of each agree on a
+// sequence of commands, one per Paxos instance:
+//
+//	found NAME	the founder, alone in instance 0
+//	add NAME	a new member, for a join
+//	oust NAME	a member removed
+//	toast NAME	a glass raised to the health of a member
+//
+// Anyone on the group channel asks for the last three with a user
+// message, like "join boodles david", "oust boodles david" or
+// "toast boodles david".  The members of a club after instance i-1
+// are the acceptors for instance i, and a majority of them is a
+// quorum.
+//
+// One member leads.  It runs phase 1 for every instance from the
+// first it has not learned on, and again after each change of
+// members, since the promises of the old members need not intersect
+// the accepts of the new ones.  Then it proposes one command at a
+// time, each once the last is chosen.  A member that hears a request
+// go undone for Takeover takes over with a higher proposal number.
+//
+// Club messages, from member S in instance I with proposal number B,
+// which is a round and the name of the member that leads it, like
+// "5.ron", so that any number of members can take part:
+//
+//	club C S I B propose		phase 1, for I and every later instance
+//	club C S I B promise LEN:ACC	the accepted proposals from I on
+//	club C S I B nack P		B is refused, having promised P
+//	club C S I B write LEN:CMD	phase 2
+//	club C S I B accept		CMD is accepted
+//	club C S I B chosen LEN:CMD	CMD is chosen for I
+//	club C S I B need		the chosen commands from I on, please
+//	club C S I B members LEN:LIST	answers "name"
+//
+// A process logs its promises, its accepts and the commands chosen
+// to the stable.Log that Open gives for each club, if any, so that one
+// that restarts comes back as the same member.  Without, it must join
+// again under a new name, after the old one is ousted.
+package club
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"stable"
+	"upnet"
+)
+
+const DefaultRetry = 100 * time.Millisecond
+const DefaultTakeover = time.Second
+
+type Config struct {
+	Name string // as a member, without spaces
+
+	// A leader sends its propose or write again each Retry until a
+	// quorum answers.  A member takes over leading when a request has
+	// waited Takeover, plus up to half that again at random, so that
+	// they do not all try at once.
+	Retry    time.Duration
+	Takeover time.Duration
+
+	Log *log.Logger // the standard logger if nil
+
+	// OnApply, if set, is called with each command as the process
+	// learns it, in instance order.
+	OnApply func(club string, i int64, cmd string)
+
+	// Open, if set, returns the storage for a club, which holds what
+	// the process knew of it when it stopped, if anything.
+	Open func(club string) (stable.Log, error)
+}
+
+// A Node is one process, which belongs to clubs or asks to.
+type Node struct {
+	Config
+
+	conn upnet.Conn
+
+	mu    sync.Mutex
+	clubs map[string]*club
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func New(c Config, conn upnet.Conn) *Node {
+	if c.Retry == 0 {
+		c.Retry = DefaultRetry
+	}
+	if c.Takeover == 0 {
+		c.Takeover = DefaultTakeover
+	}
+	if c.Log == nil {
+		c.Log = log.New(log.Writer(), "", log.LstdFlags)
+	}
+	return &Node{
+		Config: c,
+		conn:   conn,
+		clubs:  make(map[string]*club),
+		done:   make(chan struct{}),
+	}
+}
+
+// Found makes the node the first member and leader of a new club.
+// The name must be new, since two clubs with one name would not
+// agree on anything.  If the node's storage shows that it founded or
+// joined the club before, it takes up where it left off instead.
+func (n *Node) Found(name string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c, err := n.newClub(name)
+	if err != nil || c.next > 0 {
+		return err
+	}
+	found := "found " + n.Name
+	c.learn(0, found)
+	c.send(0, ballot{}, "chosen", &found)
+	c.lead()
+	return nil
+}
+
+// Join has the node ask to join a club until it is a member, unless
+// its storage shows that it is one.
+func (n *Node) Join(name string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c, err := n.newClub(name)
+	if err != nil {
+		return err
+	}
+	c.joining = !c.member(n.Name)
+	return nil
+}
+
+// Clubs returns the names of the clubs the node is in or asks to
+// join, in order.
+func (n *Node) Clubs() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var r []string
+	for name := range n.clubs {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// Members returns the members of a club the node knows of, in the
+// order they were added, or nil if it is not in the club.
+func (n *Node) Members(club string) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c, ok := n.clubs[club]
+	if !ok {
+		return nil
+	}
+	return append([]string{}, c.members...)
+}
+
+// Leading reports whether the node leads a club.
+func (n *Node) Leading(club string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c, ok := n.clubs[club]
+	return ok && c.leading
+}
+
+func (n *Node) newClub(name string) (*club, error) {
+	if c, ok := n.clubs[name]; ok {
+		return c, nil
+	}
+	c := &club{
+		name:     name,
+		n:        n,
+		chosen:   make(map[int64]string),
+		accepted: make(map[int64]proposal),
+		heard:    -1,
+		promised: ballot{n: -1},
+		patience: n.Takeover + time.Duration(rand.Int63n(int64(n.Takeover)/2+1)),
+	}
+	if n.Open != nil {
+		st, err := n.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		c.store = st
+		c.load()
+		c.lf = log.New(st, n.Name+": ", 0)
+	}
+	n.clubs[name] = c
+	return c, nil
+}
+
+// Start has the node handle messages and time passing until Close.
+func (n *Node) Start() {
+	n.wg.Add(2)
+	go n.recv()
+	go n.tick()
+}
+
+// Close stops the node, and closes the clubs' storage if it can be.
+func (n *Node) Close() {
+	close(n.done)
+	n.conn.Close()
+	n.wg.Wait()
+	for _, c := range n.clubs {
+		if cl, ok := c.store.(io.Closer); ok {
+			cl.Close()
+		}
+	}
+}
+
+func (n *Node) recv() {
+	defer n.wg.Done()
+	buf := make([]byte, upnet.MaxDatagram)
+	for {
+		k, err := n.conn.Recv(buf)
+		if err != nil {
+			select {
+			case <-n.done:
+			default:
+				n.Log.Printf("club: %v", err)
+			}
+			return
+		}
+		m, err := upnet.Parse(buf[:k])
+		if err != nil {
+			continue
+		}
+		n.handle(m)
+	}
+}
+
+func (n *Node) tick() {
+	defer n.wg.Done()
+	t := time.NewTicker(n.Retry / 2)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			n.mu.Lock()
+			for _, c := range n.clubs {
+				c.tick(now)
+			}
+			n.mu.Unlock()
+		case <-n.done:
+			return
+		}
+	}
+}
+
+func (n *Node) handle(m upnet.Msg) {
+	if len(m.F) < 1 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch m.F[0] {
+	case "club":
+		cm, err := parse(m)
+		if err != nil {
+			n.Log.Printf("club: %v", err)
+			return
+		}
+		if c, ok := n.clubs[cm.club]; ok {
+			c.handle(cm)
+		}
+	case "join", "oust", "toast":
+		if len(m.F) < 3 {
+			n.Log.Printf("club: ignoring malformed %s", m.F[0])
+			return
+		}
+		if c, ok := n.clubs[m.F[1]]; ok {
+			c.request(m.F[0], m.F[2])
+		}
+	case "name":
+		for _, c := range n.clubs {
+			if c.member(n.Name) {
+				list := strings.Join(c.members, " ")
+				c.send(c.next, c.ballot, "members", &list)
+			}
+		}
+	}
+}
+
+func (n *Node) send(s string) {
+	if err := n.conn.Send([]byte(s)); err != nil {
+		n.Log.Printf("club: %v", err)
+	}
+}
+
+// msg is a club message.
+type msg struct {
+	club, from string
+	i          int64
+	b          ballot
+	typ        string
+	p          ballot // for nack, the number promised
+	v          *string
+}
+
+func parse(m upnet.Msg) (cm msg, err error) {
+	if len(m.F) < 6 {
+		return cm, fmt.Errorf("short club message %q", m.F)
+	}
+	cm = msg{club: m.F[1], from: m.F[2], typ: m.F[5], v: m.V}
+	if cm.i, err = strconv.ParseInt(m.F[3], 10, 64); err != nil {
+		return cm, fmt.Errorf("bad instance in %q", m.F)
+	}
+	if cm.b, err = parseBallot(m.F[4]); err != nil {
+		return cm, err
+	}
+	if cm.typ == "nack" {
+		if len(m.F) < 7 {
+			return cm, fmt.Errorf("short nack %q", m.F)
+		}
+		if cm.p, err = parseBallot(m.F[6]); err != nil {
+			return cm, err
+		}
+	}
+	return cm, nil
+}
@@ -0,0 +1,113 @@
+// Package elect picks a distinguished proposer from heartbeats.
+//
+// Every participant sends a heartbeat every so often, naming the
+// participant it takes to be the leader.  A participant not heard
+// from within the timeout is suspected to have failed.  The leader
+// stays the leader while it is heard from, so a participant that
+// comes back does not take over, and when the leader is suspected,
+// the lowest-numbered participant still heard from takes over.
+//
+// Detectors can disagree for a while, for example across a
+// partition, so two participants may both lead.  Paxos stays safe
+// regardless, and when they hear each other again, the higher one
+// steps down.
+package elect
+
+import (
+	"sync"
+	"time"
+)
+
+// None is the leader before a detector knows of one.
+const None = -1
+
+type Detector struct {
+	Self    int64
+	Timeout time.Duration // suspect a participant not heard from in this long
+	Clock   func() time.Time
+
+	mu     sync.Mutex
+	start  time.Time
+	heard  map[int64]time.Time // last heartbeat by participant
+	claims map[int64]bool      // whether the last heartbeat named its sender
+	leader int64
+}
+
+func New(self int64, timeout time.Duration) *Detector {
+	d := &Detector{Self: self, Timeout: timeout, Clock: time.Now}
+	d.init()
+	return d
+}
+
+func (d *Detector) init() {
+	if d.heard == nil {
+		d.heard = make(map[int64]time.Time)
+		d.claims = make(map[int64]bool)
+		d.start = d.Clock()
+		d.leader = None
+	}
+}
+
+// Heard notes a heartbeat from id that names leader.
+func (d *Detector) Heard(id, leader int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	d.heard[id] = d.Clock()
+	d.claims[id] = leader == id
+}
+
+func (d *Detector) alive(id int64) bool {
+	if id == d.Self {
+		return true
+	}
+	t, ok := d.heard[id]
+	return ok && d.Clock().Sub(t) < d.Timeout
+}
+
+// Alive says whether id has been heard from within the timeout.
+func (d *Detector) Alive(id int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	return d.alive(id)
+}
+
+// Leader returns who leads now, or None.  A participant that just
+// started waits a timeout before it leads, so that it hears of a
+// leader that is already there.
+func (d *Detector) Leader() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+
+	claimant := int64(None) // lowest live participant that claims to lead
+	lowest := d.Self        // lowest live participant
+	for id := range d.heard {
+		if !d.alive(id) {
+			continue
+		}
+		if d.claims[id] && (claimant == None || id < claimant) {
+			claimant = id
+		}
+		if id < lowest {
+			lowest = id
+		}
+	}
+	if d.leader == d.Self && (claimant == None || d.Self < claimant) {
+		claimant = d.Self
+	}
+
+	switch {
+	case claimant != None && (d.leader == None || claimant < d.leader ||
+		!d.alive(d.leader)):
+		d.leader = claimant
+	case d.leader != None && d.alive(d.leader):
+		// keep the leader we have
+	case d.Clock().Sub(d.start) < d.Timeout:
+		d.leader = None
+	default:
+		d.leader = lowest
+	}
+	return d.leader
+}
@@ -0,0 +1,129 @@
+package elect
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	interval = 100 * time.Millisecond
+	timeout  = 500 * time.Millisecond
+)
+
+// A cluster runs detectors on a fake clock and delivers every
+// heartbeat from the participants that are up.
+type cluster struct {
+	now time.Time
+	d   []*Detector
+	up  []bool
+}
+
+func newCluster(n int) *cluster {
+	c := &cluster{now: time.Unix(1000, 0)}
+	for i := 0; i < n; i++ {
+		c.d = append(c.d, c.detector(i))
+		c.up = append(c.up, true)
+	}
+	return c
+}
+
+func (c *cluster) detector(i int) *Detector {
+	d := &Detector{Self: int64(i), Timeout: timeout,
+		Clock: func() time.Time { return c.now }}
+	d.init()
+	return d
+}
+
+// run advances the clock by one heartbeat interval at a time.
+func (c *cluster) run(d time.Duration) {
+	for end := c.now.Add(d); c.now.Before(end); c.now = c.now.Add(interval) {
+		for i, from := range c.d {
+			if !c.up[i] {
+				continue
+			}
+			l := from.Leader()
+			for j, to := range c.d {
+				if j != i && c.up[j] {
+					to.Heard(int64(i), l)
+				}
+			}
+		}
+	}
+}
+
+// leader returns the leader the participants that are up agree on.
+func (c *cluster) leader(t *testing.T) int64 {
+	l := int64(None)
+	for i, d := range c.d {
+		if !c.up[i] {
+			continue
+		}
+		if dl := d.Leader(); l == None {
+			l = dl
+		} else if dl != l {
+			t.Fatalf("%d follows %d, others follow %d", i, dl, l)
+		}
+	}
+	return l
+}
+
+func TestStartup(t *testing.T) {
+	c := newCluster(3)
+	c.run(interval)
+	if l := c.leader(t); l != None {
+		t.Errorf("leader %d before anyone could hear the others", l)
+	}
+	c.run(timeout)
+	if l := c.leader(t); l != 0 {
+		t.Errorf("leader %d, not 0", l)
+	}
+}
+
+// TestTakeover stops the leader and checks that another takes over
+// within a timeout and an interval.
+func TestTakeover(t *testing.T) {
+	c := newCluster(5)
+	c.run(2 * timeout)
+	if l := c.leader(t); l != 0 {
+		t.Fatalf("leader %d, not 0", l)
+	}
+	c.up[0] = false
+	c.run(timeout + interval)
+	if l := c.leader(t); l != 1 {
+		t.Fatalf("leader %d, not 1", l)
+	}
+
+	// 0 comes back, hears that 1 leads, and follows
+	c.up[0] = true
+	c.d[0] = c.detector(0)
+	c.run(2 * timeout)
+	if l := c.leader(t); l != 1 {
+		t.Errorf("leader %d after 0 came back", l)
+	}
+}
+
+// TestHeal partitions the group, so that each side elects a leader,
+// and then heals it.  The lower leader wins.
+func TestHeal(t *testing.T) {
+	c := newCluster(4)
+	c.run(2 * timeout)
+	c.up[0] = false
+	c.run(2 * timeout)
+	if l := c.leader(t); l != 1 {
+		t.Fatalf("leader %d, not 1", l)
+	}
+
+	// 0 starts alone, as if cut off, and leads itself
+	c.up = []bool{true, false, false, false}
+	c.d[0] = c.detector(0)
+	c.run(2 * timeout)
+	if l := c.d[0].Leader(); l != 0 {
+		t.Fatalf("0 alone follows %d", l)
+	}
+
+	c.up = []bool{true, true, true, true}
+	c.run(2 * interval)
+	if l := c.leader(t); l != 0 {
+		t.Errorf("leader %d after healing", l)
+	}
+}
@@ -0,0 +1,112 @@
+package epaxos
+
+import (
+	"sort"
+
+	"upnet"
+)
+
+// execute runs each committed command once everything it depends on,
+// directly or not, has committed.  The dependency graph may have
+// cycles, where interfering commands each saw the other, so commands
+// run by strongly connected component, dependencies first, and in
+// seq order within one.  Every replica commits the same graph, so
+// interfering commands run in the same order everywhere.
+func (r *replica) execute() {
+	xs := make([]ref, 0, len(r.pending))
+	for x := range r.pending {
+		xs = append(xs, x)
+	}
+	sort.Slice(xs, func(a, b int) bool { return xs[a].less(xs[b]) })
+	for _, x := range xs {
+		if !r.pending[x] {
+			continue // ran with an earlier one
+		}
+		if order, ok := r.order(x); ok {
+			for _, y := range order {
+				r.apply(y)
+			}
+		}
+	}
+}
+
+// order returns the commands reachable from x that have not run, in
+// the order to run them, or false if any of them has not committed.
+func (r *replica) order(x ref) ([]ref, bool) {
+	index := map[ref]int{}
+	low := map[ref]int{}
+	on := map[ref]bool{}
+	stack := []ref{}
+	out := []ref{}
+	ok := true
+
+	// Tarjan's algorithm finds each component after every one
+	// that it reaches.
+	var visit func(v ref)
+	visit = func(v ref) {
+		index[v] = len(index)
+		low[v] = index[v]
+		stack = append(stack, v)
+		on[v] = true
+		for _, w := range r.insts[v].a.deps {
+			in := r.insts[w]
+			if in == nil || in.st < committed {
+				ok = false
+				return
+			}
+			if in.st == executed {
+				continue
+			}
+			if _, seen := index[w]; !seen {
+				visit(w)
+				if !ok {
+					return
+				}
+				if low[w] < low[v] {
+					low[v] = low[w]
+				}
+			} else if on[w] && index[w] < low[v] {
+				low[v] = index[w]
+			}
+		}
+		if low[v] != index[v] {
+			return
+		}
+		k := len(stack) - 1
+		for stack[k] != v {
+			k--
+		}
+		scc := append([]ref{}, stack[k:]...)
+		stack = stack[:k]
+		for _, w := range scc {
+			on[w] = false
+		}
+		sort.Slice(scc, func(a, b int) bool {
+			sa, sb := r.insts[scc[a]].a.seq, r.insts[scc[b]].a.seq
+			return sa < sb || (sa == sb && scc[a].less(scc[b]))
+		})
+		out = append(out, scc...)
+	}
+	visit(x)
+	return out, ok
+}
+
+// apply runs the command on the state machine, unless it is a no-op
+// or a request that already ran from another instance.
+func (r *replica) apply(x ref) {
+	in := r.insts[x]
+	in.st = executed
+	delete(r.pending, x)
+	id, v := upnet.SplitCommand(*in.cmd)
+	if id == noOpID || r.ran[id] {
+		return
+	}
+	if id != upnet.NoID {
+		r.ran[id] = true
+	}
+	r.count++
+	r.sm.Apply(r.count, v)
+	if r.OnExecute != nil {
+		r.OnExecute(r.count, *in.cmd)
+	}
+}
@@ -0,0 +1,98 @@
+package epaxos
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"rsm"
+	"upnet"
+)
+
+// testReplica has the commits, as "R.I SEQ DEPS", with the command
+// that sets "k" to "R.I".
+func testReplica(commits ...string) (*replica, *[]string) {
+	r := newReplica(New(Config{N: 3}, nil, nil, rsm.NewKV()))
+	ran := &[]string{}
+	r.OnExecute = func(x int64, cmd string) {
+		_, v := upnet.SplitCommand(cmd)
+		*ran = append(*ran, v)
+	}
+	for _, c := range commits {
+		var x ref
+		var seq int64
+		var deps string
+		fmt.Sscanf(c, "%d.%d %d %s", &x.r, &x.i, &seq, &deps)
+		d, err := parseDeps(deps)
+		if err != nil {
+			panic(err)
+		}
+		cmd := upnet.Command(x.String(), rsm.Set("k", x.String()))
+		in := r.get(x)
+		in.cmd, in.a, in.st = &cmd, attrs{seq, d}, committed
+		delete(r.open, x)
+		r.pending[x] = true
+	}
+	return r, ran
+}
+
+func sets(xs ...string) []string {
+	s := []string{}
+	for _, x := range xs {
+		s = append(s, rsm.Set("k", x))
+	}
+	return s
+}
+
+func TestExecuteOrder(t *testing.T) {
+	// 0.2 and 1.1 saw each other, and 2.1 came after both.
+	r, ran := testReplica(
+		"0.1 1 -",
+		"0.2 3 0.1,1.1",
+		"1.1 2 0.2",
+		"2.1 4 0.2,1.1",
+	)
+	r.execute()
+	if want := sets("0.1", "1.1", "0.2", "2.1"); !reflect.DeepEqual(*ran, want) {
+		t.Errorf("ran %q, not %q", *ran, want)
+	}
+}
+
+func TestExecuteWaits(t *testing.T) {
+	// 1.1 has not committed, so nothing after it runs.
+	r, ran := testReplica(
+		"0.1 1 -",
+		"0.2 2 1.1",
+		"2.1 3 0.2",
+	)
+	r.get(ref{1, 1})
+	r.execute()
+	if want := sets("0.1"); !reflect.DeepEqual(*ran, want) {
+		t.Errorf("ran %q, not %q", *ran, want)
+	}
+	cmd := upnet.Command("1.1", rsm.Set("k", "1.1"))
+	in := r.insts[ref{1, 1}]
+	in.cmd, in.a, in.st = &cmd, attrs{5, []ref{{2, 1}}}, committed
+	r.pending[ref{1, 1}] = true
+	r.execute()
+	// 1.1, 0.2 and 2.1 form a cycle, ordered by seq.
+	if want := sets("0.1", "0.2", "2.1", "1.1"); !reflect.DeepEqual(*ran, want) {
+		t.Errorf("ran %q, not %q", *ran, want)
+	}
+}
+
+func TestMsgDeps(t *testing.T) {
+	d, err := parseDeps("2.7,0.3,2.7")
+	if err != nil || depsString(d) != "0.3,2.7" {
+		t.Errorf("deps %v, %v", d, err)
+	}
+	if d, err := parseDeps("-"); err != nil || depsString(d) != "-" {
+		t.Errorf("no deps %v, %v", d, err)
+	}
+	cmd := "c"
+	m, _ := upnet.Parse([]byte(upnet.Record(&cmd, "1 PreAccept 0 4 0 2 0.3")))
+	e, err := parse(m)
+	if err != nil || e.x != (ref{0, 4}) || e.a.seq != 2 || *e.cmd != "c" {
+		t.Errorf("parsed %+v, %v", e, err)
+	}
+}
@@ -0,0 +1,197 @@
+package epaxos
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"upnet"
+)
+
+// A ref names an instance by the replica that first led it and its
+// slot among that replica's instances.
+type ref struct {
+	r, i int64
+}
+
+func (x ref) String() string {
+	return fmt.Sprintf("%d.%d", x.r, x.i)
+}
+
+func (x ref) less(y ref) bool {
+	return x.r < y.r || (x.r == y.r && x.i < y.i)
+}
+
+// attrs are what replicas agree on along with a command: the
+// interfering instances it must follow unless they depend on it too,
+// and a sequence number that orders the ones that do.
+type attrs struct {
+	seq  int64
+	deps []ref // sorted, no repeats
+}
+
+func (a attrs) equal(b attrs) bool {
+	if a.seq != b.seq || len(a.deps) != len(b.deps) {
+		return false
+	}
+	for k := range a.deps {
+		if a.deps[k] != b.deps[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// union has the higher seq and the deps of both.
+func (a attrs) union(b attrs) attrs {
+	u := attrs{a.seq, append([]ref{}, a.deps...)}
+	if b.seq > u.seq {
+		u.seq = b.seq
+	}
+	u.deps = sortDeps(append(u.deps, b.deps...))
+	return u
+}
+
+func sortDeps(d []ref) []ref {
+	sort.Slice(d, func(a, b int) bool { return d[a].less(d[b]) })
+	out := d[:0]
+	for k, x := range d {
+		if k == 0 || x != d[k-1] {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+// Deps are written "R.I,R.I,...", or "-" for none.
+func depsString(d []ref) string {
+	if len(d) == 0 {
+		return "-"
+	}
+	s := make([]string, len(d))
+	for k, x := range d {
+		s[k] = x.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func parseDeps(s string) ([]ref, error) {
+	d := []ref{}
+	if s == "-" {
+		return d, nil
+	}
+	for _, f := range strings.Split(s, ",") {
+		var x ref
+		if _, err := fmt.Sscanf(f, "%d.%d", &x.r, &x.i); err != nil {
+			return nil, fmt.Errorf("bad dep %q", f)
+		}
+		d = append(d, x)
+	}
+	return sortDeps(d), nil
+}
+
+type status int
+
+const (
+	none status = iota
+	preAccepted
+	accepted
+	committed
+	executed
+)
+
+var statusNames = []string{"none", "pre", "acc", "commit", "commit"}
+
+func parseStatus(s string) (status, error) {
+	for k, name := range statusNames[:committed+1] {
+		if s == name {
+			return status(k), nil
+		}
+	}
+	return none, fmt.Errorf("bad status %q", s)
+}
+
+// Replica message formats, where S is the sender, R and I name the
+// instance, B is a ballot, and SEQ and DEPS are attrs:
+//
+//	S PreAccept R I B SEQ DEPS LEN:CMD	phase 1, fast path
+//	S PreAcceptOK R I B SEQ DEPS		with the replica's attrs
+//	S Slow R I B SEQ DEPS LEN:CMD		phase 2, slow path
+//	S SlowOK R I B
+//	S Commit R I B SEQ DEPS LEN:CMD
+//	S Prepare R I B				recovery
+//	S PrepareOK R I B SEQ DEPS ST A U [LEN:CMD]
+//	S Refuse R I B				B is the ballot promised
+//
+// In a PrepareOK, ST is the replica's status for the instance, A is
+// the ballot of its attrs, and U is 1 if it pre-accepted the attrs
+// it was sent unchanged.
+type emsg struct {
+	s, b int64
+	typ  string
+	x    ref
+	a    attrs
+	cmd  *string
+	st   status
+	abal int64
+	same bool
+}
+
+// fields is how many fields each type has.
+var fields = map[string]int{
+	"PreAccept":   7,
+	"PreAcceptOK": 7,
+	"Slow":        7,
+	"SlowOK":      5,
+	"Commit":      7,
+	"Prepare":     5,
+	"PrepareOK":   10,
+	"Refuse":      5,
+}
+
+func parse(m upnet.Msg) (e emsg, err error) {
+	f := m.F
+	if len(f) < 2 || fields[f[1]] == 0 {
+		return e, fmt.Errorf("not a replica message")
+	}
+	if len(f) != fields[f[1]] {
+		return e, fmt.Errorf("%s with %d fields", f[1], len(f))
+	}
+	e.typ = f[1]
+	e.cmd = m.V
+	num := func(s string) int64 {
+		n, perr := strconv.ParseInt(s, 10, 64)
+		if perr != nil && err == nil {
+			err = fmt.Errorf("bad number %q in %s", s, e.typ)
+		}
+		return n
+	}
+	e.s = num(f[0])
+	e.x = ref{num(f[2]), num(f[3])}
+	e.b = num(f[4])
+	if len(f) >= 7 {
+		e.a.seq = num(f[5])
+		d, derr := parseDeps(f[6])
+		if derr != nil && err == nil {
+			err = derr
+		}
+		e.a.deps = d
+	}
+	if e.typ == "PrepareOK" {
+		st, serr := parseStatus(f[7])
+		if serr != nil && err == nil {
+			err = serr
+		}
+		e.st = st
+		e.abal = num(f[8])
+		e.same = f[9] == "1"
+	}
+	switch e.typ {
+	case "PreAccept", "Slow", "Commit":
+		if e.cmd == nil && err == nil {
+			err = fmt.Errorf("%s without a command", e.typ)
+		}
+	}
+	return e, err
+}
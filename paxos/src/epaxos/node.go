@@ -0,0 +1,152 @@
+// Package epaxos is an Egalitarian Paxos replica that talks over the
+// same unreliable broadcast channel as upaxos, and answers the same
+// client requests.  There is no leader.  Any replica leads the
+// instances for the requests it takes, and a request commits in one
+// round trip when a fast quorum of replicas agrees on the commands it
+// interferes with, and in two otherwise:
+//
+//	PreAccept:  the command leader sends the command with the
+//		    interfering instances it knows of, and each replica
+//		    adds the ones it knows of
+//	Slow:	    if they did not all agree, the leader has a
+//		    majority accept the union, like a Paxos phase 2
+//	Commit:     the leader tells everyone
+//	Prepare:    a replica that has waited too long for an
+//		    instance takes it over with a higher ballot, like
+//		    a Paxos phase 1
+//
+// Commands interfere when they touch the same key, as rsm.Key tells,
+// and each replica executes committed commands in an order that
+// follows the dependency graph, so interfering commands execute in
+// the same order everywhere.  Commands that do not interfere may
+// execute in different orders at different replicas.
+package epaxos
+
+import (
+	"hash/fnv"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"rsm"
+	"stable"
+	"upnet"
+	"upnode"
+)
+
+const DefaultRetry = 300 * time.Millisecond
+const DefaultRecover = time.Second
+
+type Config struct {
+	ID int // this replica
+	N  int // replicas in the group, an odd number
+
+	// A command leader resends its phase's messages after Retry.
+	// A replica takes over an instance it has not seen committed,
+	// or a request whose leader has not started it, after Recover.
+	Retry   time.Duration
+	Recover time.Duration
+
+	// Each message type has its own rate limit, in messages a
+	// second.  Types not in Rates are not limited.
+	Rates map[string]float64
+
+	// Key returns what a command's value changes.  Values with
+	// different keys commute, and a value it returns false for
+	// interferes with everything.  Nil means rsm.Key.
+	Key func(v string) (string, bool)
+
+	// With a group key, only clients' requests may go unsigned.
+	// With either key, admin commands need the admin key.
+	Auth *upnet.Auth
+
+	Log *log.Logger // debugging output, the standard logger if nil
+
+	// OnExecute, if set, is called with each command as it is
+	// executed, with the count of commands executed so far.
+	OnExecute func(x int64, cmd string)
+}
+
+type Node struct {
+	Config
+
+	proc  *upnode.Process
+	store stable.Log
+	sm    rsm.StateMachine
+
+	// commits by this replica as command leader, accessed atomically
+	fast, slow int64
+}
+
+// New returns a replica that talks over conn, keeps its recovery log
+// in store, and executes committed commands on sm.
+func New(c Config, conn upnet.Conn, store stable.Log, sm rsm.StateMachine) *Node {
+	if c.Retry == 0 {
+		c.Retry = DefaultRetry
+	}
+	if c.Recover == 0 {
+		c.Recover = DefaultRecover
+	}
+	if c.Key == nil {
+		c.Key = rsm.Key
+	}
+	if c.Auth == nil {
+		c.Auth = &upnet.Auth{}
+	}
+	if c.Log == nil {
+		c.Log = log.Default()
+	}
+	if c.N%2 == 0 {
+		log.Panicf("epaxos needs an odd number of replicas, not %d", c.N)
+	}
+	return &Node{
+		Config: c,
+		proc: upnode.New(upnode.Config{ID: c.ID, Auth: c.Auth, Log: c.Log,
+			Rates: c.Rates}, conn),
+		store: store,
+		sm:    sm,
+	}
+}
+
+// Start recovers from the log and starts the replica.
+func (n *Node) Start() {
+	r := newReplica(n)
+	lr := n.store.Log()
+	r.load(lr)
+	lr.Close()
+
+	replc := make(chan upnet.Msg)
+	n.proc.Run(func() { r.run(replc) })
+	n.proc.Listen(replc)
+}
+
+// Close stops the replica and closes the channel.
+func (n *Node) Close() error {
+	return n.proc.Close()
+}
+
+// Wait returns when an admin command tells the replica to quit, or
+// when it is closed.
+func (n *Node) Wait() {
+	n.proc.Wait()
+}
+
+// Paths returns how many commands this replica has committed as
+// their command leader on the fast path and on the slow path.
+func (n *Node) Paths() (fast, slow int64) {
+	return atomic.LoadInt64(&n.fast), atomic.LoadInt64(&n.slow)
+}
+
+// owner is the replica a request's ID hashes to.  It leads requests
+// that name no replica, and is the first to take over one whose
+// replica seems gone.
+func (n *Node) owner(id, v string) int64 {
+	h := fnv.New32a()
+	if id == upnet.NoID {
+		io.WriteString(h, v)
+	} else {
+		io.WriteString(h, id)
+	}
+	return int64(h.Sum32() % uint32(n.N))
+}
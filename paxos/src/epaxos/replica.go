@@ -0,0 +1,788 @@
+package epaxos
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"stable"
+	"upnet"
+)
+
+// noOpID is the request ID of the no-op that recovery commits in an
+// instance when no replica it hears from knows the command.
+const noOpID = "!noop"
+
+var noOp = upnet.Command(noOpID, "")
+
+// An inst is what a replica knows of one instance.
+type inst struct {
+	cmd    *string // nil until known
+	a      attrs
+	st     status
+	ballot int64     // the highest ballot promised
+	abal   int64     // the ballot a is from
+	same   bool      // pre-accepted the attrs it was sent, unchanged
+	since  time.Time // when it last made progress here
+	lead   *leading  // while this replica leads it
+}
+
+// leading is a command leader's state for an instance in progress.
+type leading struct {
+	b     int64
+	phase string // "PreAccept", "Slow" or "Prepare"
+	orig  attrs  // what the PreAccept proposed
+	a     attrs  // the union of the replies, or what Slow proposes
+	same  bool   // every reply so far agreed with orig
+	heard map[int64]bool
+	oks   []emsg // the PrepareOKs
+	sent  time.Time
+}
+
+// A waiter is a request that another replica owns.
+type waiter struct {
+	cmd   string
+	since time.Time
+	next  int64 // the first to take it over
+}
+
+// replica owns all the instance state, in one goroutine.
+type replica struct {
+	*Node
+	lf *log.Logger
+
+	insts   map[ref]*inst
+	open    map[ref]bool // instances not yet committed
+	pending map[ref]bool // committed and not yet executed
+	next    int64        // this replica's next slot
+
+	// The latest slot of each replica with a command on each key,
+	// and the highest seq, for finding what interferes.  Commands
+	// without a key are under wild.
+	keys    map[string]map[int64]int64
+	seqs    map[string]int64
+	wild    map[int64]int64
+	wildSeq int64
+
+	ids     map[string]ref // the instance of each request ID
+	waiting map[string]*waiter
+	ran     map[string]bool // request IDs executed
+	count   int64           // commands executed
+}
+
+func newReplica(n *Node) *replica {
+	return &replica{
+		Node:    n,
+		lf:      log.New(n.store, fmt.Sprintf("%d: ", n.ID), 0),
+		insts:   make(map[ref]*inst),
+		open:    make(map[ref]bool),
+		pending: make(map[ref]bool),
+		keys:    make(map[string]map[int64]int64),
+		seqs:    make(map[string]int64),
+		wild:    make(map[int64]int64),
+		ids:     make(map[string]ref),
+		waiting: make(map[string]*waiter),
+		ran:     make(map[string]bool),
+	}
+}
+
+func (r *replica) majority() int {
+	return r.N/2 + 1
+}
+
+// fastQuorum is 2F of 2F+1 replicas, counting the command leader.
+func (r *replica) fastQuorum() int {
+	if f := (r.N - 1) / 2; f > 0 {
+		return 2 * f
+	}
+	return 1
+}
+
+// get returns the instance, making an empty one if it is new here.
+func (r *replica) get(x ref) *inst {
+	in := r.insts[x]
+	if in == nil {
+		in = &inst{since: time.Now()}
+		r.insts[x] = in
+		r.open[x] = true
+	}
+	return in
+}
+
+// promise raises the instance's ballot, and a leader with a lower
+// one gives up the instance.
+func (r *replica) promise(in *inst, b int64) {
+	if b > in.ballot {
+		in.ballot = b
+	}
+	if in.lead != nil && in.lead.b < in.ballot {
+		in.lead = nil
+		in.since = time.Now()
+	}
+}
+
+// key returns the key a command interferes on, whether it interferes
+// with everything, and whether it interferes with nothing at all.
+func (r *replica) key(cmd string) (k string, all, nothing bool) {
+	id, v := upnet.SplitCommand(cmd)
+	if id == noOpID {
+		return "", false, true
+	}
+	k, ok := r.Key(v)
+	return k, !ok, false
+}
+
+// interfere returns attrs for cmd in x that follow every interfering
+// instance this replica knows of.
+func (r *replica) interfere(x ref, cmd string) attrs {
+	k, all, nothing := r.key(cmd)
+	a := attrs{deps: []ref{}}
+	if nothing {
+		return a
+	}
+	seq := r.wildSeq
+	add := func(last map[int64]int64) {
+		for rr, i := range last {
+			if y := (ref{rr, i}); y != x {
+				a.deps = append(a.deps, y)
+			}
+		}
+	}
+	add(r.wild)
+	if all {
+		for k, last := range r.keys {
+			add(last)
+			if r.seqs[k] > seq {
+				seq = r.seqs[k]
+			}
+		}
+	} else {
+		add(r.keys[k])
+		if r.seqs[k] > seq {
+			seq = r.seqs[k]
+		}
+	}
+	a.seq = seq + 1
+	a.deps = sortDeps(a.deps)
+	return a
+}
+
+// index notes what the instance's command interferes with, and
+// learns its request ID.
+func (r *replica) index(x ref, in *inst) {
+	if in.cmd == nil {
+		return
+	}
+	if x.r == int64(r.ID) && x.i >= r.next {
+		r.next = x.i + 1
+	}
+	id, _ := upnet.SplitCommand(*in.cmd)
+	if id != upnet.NoID && id != noOpID {
+		r.ids[id] = x
+	}
+	k, all, nothing := r.key(*in.cmd)
+	if nothing {
+		return
+	}
+	if all {
+		r.wildSeq = note(r.wild, x, in.a.seq, r.wildSeq)
+		return
+	}
+	if r.keys[k] == nil {
+		r.keys[k] = make(map[int64]int64)
+	}
+	r.seqs[k] = note(r.keys[k], x, in.a.seq, r.seqs[k])
+}
+
+// note raises the latest slot of x's replica to x, and returns the
+// higher seq.
+func note(last map[int64]int64, x ref, seq, max int64) int64 {
+	if i, ok := last[x.r]; !ok || x.i > i {
+		last[x.r] = x.i
+	}
+	if seq > max {
+		return seq
+	}
+	return max
+}
+
+// record writes a version 1 record to the recovery log.
+func (r *replica) record(v *string, format string, a ...interface{}) {
+	r.lf.Print(upnet.Record(v, format, a...) + "\n")
+}
+
+// logInst records the instance's state as kind: "pre", "acc" or
+// "commit".
+func (r *replica) logInst(kind string, x ref, in *inst) {
+	same := 0
+	if in.same {
+		same = 1
+	}
+	r.record(in.cmd, "%s %d %d %d %d %s %d", kind, x.r, x.i,
+		in.abal, in.a.seq, depsString(in.a.deps), same)
+}
+
+func (r *replica) bcast(v *string, format string, a ...interface{}) {
+	r.proc.Send(upnet.Record(v, "%d "+format,
+		append([]interface{}{r.ID}, a...)...))
+}
+
+// load recovers the instances from the log, and executes what was
+// committed.  It truncates the log after the last good record, so
+// that what the replica logs next does not follow a torn one.
+func (r *replica) load(lf io.Reader) {
+	br := stable.NewReader(lf)
+	var good int64 // where the last good record ends
+	for {
+		good = br.Offset()
+		if _, err := br.ReadString(' '); err != nil { // ID prefix
+			break
+		}
+		if b, _ := br.Peek(len(upnet.Version) + 1); string(b) != upnet.Version+" " {
+			if _, err := br.ReadString('\n'); err != nil {
+				break
+			}
+			continue
+		}
+		br.Discard(len(upnet.Version) + 1)
+		m, err := upnet.ReadRecord(br.Reader)
+		if err != nil {
+			r.Log.Printf("stopping at bad log record: %s", err)
+			break
+		}
+		if len(m.F) < 4 {
+			continue
+		}
+		num := func(s string) int64 {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				log.Panicf("bad log record %v", m.F)
+			}
+			return n
+		}
+		x := ref{num(m.F[1]), num(m.F[2])}
+		in := r.get(x)
+		b := num(m.F[3])
+		if b > in.ballot {
+			in.ballot = b
+		}
+		if m.F[0] == "ballot" || len(m.F) != 7 || in.st >= committed {
+			continue
+		}
+		deps, err := parseDeps(m.F[5])
+		if err != nil {
+			log.Panic(err)
+		}
+		in.cmd = m.V
+		in.a = attrs{num(m.F[4]), deps}
+		in.abal = b
+		in.same = m.F[6] == "1"
+		switch m.F[0] {
+		case "pre":
+			in.st = preAccepted
+		case "acc":
+			in.st = accepted
+		case "commit":
+			in.st = committed
+			delete(r.open, x)
+			r.pending[x] = true
+			for _, d := range deps {
+				r.get(d)
+			}
+		}
+	}
+	stable.MustTruncate(r.store, good)
+	for x, in := range r.insts {
+		r.index(x, in)
+	}
+	r.record(nil, "starting %d", r.ID)
+	r.execute()
+}
+
+func (r *replica) run(c chan upnet.Msg) {
+	tick := time.NewTicker(r.Retry / 3)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.proc.Done():
+			return
+		case now := <-tick.C:
+			r.tick(now)
+		case m := <-c:
+			r.handle(m)
+		}
+	}
+}
+
+func (r *replica) handle(m upnet.Msg) {
+	if len(m.F) < 2 {
+		return
+	}
+	switch m.F[0] {
+	case "Request":
+		r.request(m)
+		return
+	case "Query":
+		if m.V != nil {
+			rsp := r.sm.Query(*m.V)
+			r.bcast(&rsp, "OK %d %s", r.count, m.F[1])
+		}
+		return
+	}
+	e, err := parse(m)
+	if err != nil {
+		if len(m.F) > 1 && fields[m.F[1]] != 0 {
+			r.Log.Printf("skipping message: %s", err)
+		}
+		return
+	}
+	if e.s == int64(r.ID) {
+		return
+	}
+	switch e.typ {
+	case "PreAccept":
+		r.preAccept(e)
+	case "PreAcceptOK":
+		r.preAcceptOK(e)
+	case "Slow":
+		r.slowAccept(e)
+	case "SlowOK":
+		r.slowOK(e)
+	case "Commit":
+		r.committed(e)
+	case "Prepare":
+		r.prepare(e)
+	case "PrepareOK":
+		r.prepareOK(e)
+	case "Refuse":
+		if in := r.insts[e.x]; in != nil {
+			r.promise(in, e.b)
+		}
+	}
+}
+
+// request leads a client's request, if it names this replica, or
+// waits for the one it names to.  A client names the replica nearest
+// it, "Request 0 ID R LEN:V", so that its writes cross the network
+// only for their one round trip; a request that names none belongs
+// to its owner.  A retry of a committed request gets its OK again.
+// History reads have no meaning here, without a log of instances in
+// order, and are ignored.
+func (r *replica) request(m upnet.Msg) {
+	if m.V == nil || *m.V == "" {
+		return
+	}
+	id := upnet.NoID
+	if len(m.F) > 2 {
+		id = m.F[2]
+	}
+	if id == noOpID {
+		return
+	}
+	cmd := upnet.Command(id, *m.V)
+	if id != upnet.NoID {
+		if x, ok := r.ids[id]; ok {
+			if r.insts[x].st >= committed {
+				r.bcast(nil, "OK %d %s", r.slot(x), id)
+			}
+			return
+		}
+	}
+	leader := r.owner(id, *m.V)
+	if len(m.F) > 3 {
+		near, err := strconv.ParseInt(m.F[3], 0, 64)
+		if err == nil && near >= 0 && near < int64(r.N) {
+			leader = near
+		}
+	}
+	// The owner takes over if the leader seems gone, or the next
+	// replica if the owner is the leader.
+	next := r.owner(id, *m.V)
+	if next == leader {
+		next = (next + 1) % int64(r.N)
+	}
+	if leader == int64(r.ID) {
+		r.lead(cmd)
+	} else if id != upnet.NoID && r.waiting[id] == nil {
+		r.waiting[id] = &waiter{cmd, time.Now(), next}
+	}
+}
+
+// slot numbers an instance for a client's OK.
+func (r *replica) slot(x ref) int64 {
+	return x.i*int64(r.N) + x.r
+}
+
+// lead starts a new instance for cmd, with this replica as command
+// leader.
+func (r *replica) lead(cmd string) {
+	x := ref{int64(r.ID), r.next}
+	in := r.get(x)
+	in.cmd = &cmd
+	in.a = r.interfere(x, cmd)
+	in.st, in.abal, in.same = preAccepted, 0, true
+	r.index(x, in)
+	r.logInst("pre", x, in)
+	stable.MustSync(r.store)
+	in.lead = &leading{
+		phase: "PreAccept",
+		orig:  in.a,
+		a:     in.a,
+		same:  true,
+		heard: map[int64]bool{int64(r.ID): true},
+		sent:  time.Now(),
+	}
+	r.sendPhase(x, in)
+	r.advance(x, in, false)
+}
+
+// sendPhase sends, or resends, the leader's current phase.
+func (r *replica) sendPhase(x ref, in *inst) {
+	l := in.lead
+	switch l.phase {
+	case "PreAccept":
+		r.bcast(in.cmd, "PreAccept %d %d %d %d %s",
+			x.r, x.i, l.b, l.orig.seq, depsString(l.orig.deps))
+	case "Slow":
+		r.bcast(in.cmd, "Slow %d %d %d %d %s",
+			x.r, x.i, l.b, l.a.seq, depsString(l.a.deps))
+	case "Prepare":
+		r.bcast(nil, "Prepare %d %d %d", x.r, x.i, l.b)
+	}
+}
+
+func (r *replica) refuse(x ref, in *inst) {
+	r.bcast(nil, "Refuse %d %d %d", x.r, x.i, in.ballot)
+}
+
+func (r *replica) preAccept(e emsg) {
+	in := r.get(e.x)
+	if e.b < in.ballot {
+		r.refuse(e.x, in)
+		return
+	}
+	if in.st >= committed {
+		r.sendCommit(e.x, in)
+		return
+	}
+	if in.abal > e.b || (in.abal == e.b && in.st == accepted) {
+		return // stale
+	}
+	if in.abal != e.b || in.st != preAccepted || in.cmd == nil {
+		a := r.interfere(e.x, *e.cmd).union(e.a)
+		if in.cmd != nil && *in.cmd == *e.cmd {
+			a = a.union(in.a) // what was indexed before
+		}
+		r.promise(in, e.b)
+		in.cmd, in.a, in.st, in.abal = e.cmd, a, preAccepted, e.b
+		in.same = a.equal(e.a)
+		in.since = time.Now()
+		r.index(e.x, in)
+		r.logInst("pre", e.x, in)
+		stable.MustSync(r.store)
+	}
+	r.bcast(nil, "PreAcceptOK %d %d %d %d %s",
+		e.x.r, e.x.i, e.b, in.a.seq, depsString(in.a.deps))
+}
+
+func (r *replica) preAcceptOK(e emsg) {
+	in := r.insts[e.x]
+	if in == nil || in.lead == nil {
+		return
+	}
+	l := in.lead
+	if l.phase != "PreAccept" || l.b != e.b || l.heard[e.s] {
+		return
+	}
+	l.heard[e.s] = true
+	if !e.a.equal(l.orig) {
+		l.same = false
+	}
+	l.a = l.a.union(e.a)
+	r.advance(e.x, in, false)
+}
+
+// advance commits on the fast path when a fast quorum agreed with the
+// leader at the first ballot, or goes on to the slow path when a
+// majority replied and the fast path is out, or late.
+func (r *replica) advance(x ref, in *inst, late bool) {
+	l := in.lead
+	heard := len(l.heard)
+	if l.b == 0 && l.same && heard >= r.fastQuorum() {
+		atomic.AddInt64(&r.fast, 1)
+		r.commit(x, in, l.orig)
+	} else if heard >= r.majority() && (l.b != 0 || !l.same || late) {
+		r.startSlow(x, in, l.a)
+	}
+}
+
+// startSlow has a majority accept a for the instance.
+func (r *replica) startSlow(x ref, in *inst, a attrs) {
+	l := in.lead
+	l.phase, l.a = "Slow", a
+	l.heard = map[int64]bool{int64(r.ID): true}
+	l.sent = time.Now()
+	in.a, in.st, in.abal = a, accepted, l.b
+	r.index(x, in)
+	r.logInst("acc", x, in)
+	stable.MustSync(r.store)
+	r.sendPhase(x, in)
+	r.checkSlow(x, in)
+}
+
+func (r *replica) checkSlow(x ref, in *inst) {
+	if len(in.lead.heard) >= r.majority() {
+		atomic.AddInt64(&r.slow, 1)
+		r.commit(x, in, in.lead.a)
+	}
+}
+
+func (r *replica) slowAccept(e emsg) {
+	in := r.get(e.x)
+	if e.b < in.ballot {
+		r.refuse(e.x, in)
+		return
+	}
+	if in.st >= committed {
+		r.sendCommit(e.x, in)
+		return
+	}
+	r.promise(in, e.b)
+	in.cmd, in.a, in.st, in.abal = e.cmd, e.a, accepted, e.b
+	in.since = time.Now()
+	r.index(e.x, in)
+	r.logInst("acc", e.x, in)
+	stable.MustSync(r.store)
+	r.bcast(nil, "SlowOK %d %d %d", e.x.r, e.x.i, e.b)
+}
+
+func (r *replica) slowOK(e emsg) {
+	in := r.insts[e.x]
+	if in == nil || in.lead == nil {
+		return
+	}
+	l := in.lead
+	if l.phase != "Slow" || l.b != e.b || l.heard[e.s] {
+		return
+	}
+	l.heard[e.s] = true
+	r.checkSlow(e.x, in)
+}
+
+// commit records the instance as committed with a, tells everyone,
+// and answers the client.
+func (r *replica) commit(x ref, in *inst, a attrs) {
+	in.lead = nil
+	r.learn(x, in, in.cmd, a)
+	r.sendCommit(x, in)
+	if id, _ := upnet.SplitCommand(*in.cmd); id != noOpID {
+		r.bcast(nil, "OK %d %s", r.slot(x), id)
+	}
+	r.execute()
+}
+
+func (r *replica) sendCommit(x ref, in *inst) {
+	r.bcast(in.cmd, "Commit %d %d %d %d %s",
+		x.r, x.i, in.abal, in.a.seq, depsString(in.a.deps))
+}
+
+func (r *replica) committed(e emsg) {
+	in := r.get(e.x)
+	if in.st >= committed {
+		return
+	}
+	in.lead = nil
+	in.abal = e.b
+	r.learn(e.x, in, e.cmd, e.a)
+	r.execute()
+}
+
+// learn notes that the instance committed with cmd and a.
+func (r *replica) learn(x ref, in *inst, cmd *string, a attrs) {
+	if in.cmd != nil && *cmd == noOp {
+		id, _ := upnet.SplitCommand(*in.cmd)
+		if y, ok := r.ids[id]; ok && y == x {
+			delete(r.ids, id) // the request may go again
+		}
+	}
+	in.cmd, in.a, in.st = cmd, a, committed
+	r.index(x, in)
+	r.logInst("commit", x, in)
+	delete(r.open, x)
+	r.pending[x] = true
+	for _, d := range a.deps {
+		r.get(d)
+	}
+}
+
+// startPrepare takes over the instance with a ballot higher than any
+// this replica has seen, and unique to it.
+func (r *replica) startPrepare(x ref, in *inst) {
+	n := int64(r.N)
+	b := (in.ballot/n+1)*n + int64(r.ID)
+	r.promise(in, b)
+	r.record(nil, "ballot %d %d %d", x.r, x.i, b)
+	stable.MustSync(r.store)
+	in.lead = &leading{
+		b:     b,
+		phase: "Prepare",
+		heard: map[int64]bool{int64(r.ID): true},
+		oks:   []emsg{r.prepareReply(x, in)},
+		sent:  time.Now(),
+	}
+	r.sendPhase(x, in)
+	if len(in.lead.heard) >= r.majority() {
+		r.decide(x, in)
+	}
+}
+
+// prepareReply is what this replica knows of the instance.
+func (r *replica) prepareReply(x ref, in *inst) emsg {
+	st := in.st
+	if st > committed {
+		st = committed
+	}
+	return emsg{s: int64(r.ID), typ: "PrepareOK", x: x, b: in.ballot,
+		a: in.a, cmd: in.cmd, st: st, abal: in.abal, same: in.same}
+}
+
+func (r *replica) prepare(e emsg) {
+	in := r.get(e.x)
+	if e.b < in.ballot {
+		r.refuse(e.x, in)
+		return
+	}
+	if e.b > in.ballot {
+		r.promise(in, e.b)
+		r.record(nil, "ballot %d %d %d", e.x.r, e.x.i, e.b)
+		stable.MustSync(r.store)
+	}
+	in.since = time.Now()
+	p := r.prepareReply(e.x, in)
+	same := 0
+	if p.same {
+		same = 1
+	}
+	r.bcast(p.cmd, "PrepareOK %d %d %d %d %s %s %d %d",
+		e.x.r, e.x.i, e.b, p.a.seq, depsString(p.a.deps),
+		statusNames[p.st], p.abal, same)
+}
+
+func (r *replica) prepareOK(e emsg) {
+	in := r.insts[e.x]
+	if in == nil || in.lead == nil {
+		return
+	}
+	l := in.lead
+	if l.phase != "Prepare" || l.b != e.b || l.heard[e.s] {
+		return
+	}
+	l.heard[e.s] = true
+	l.oks = append(l.oks, e)
+	if len(l.heard) == r.majority() {
+		r.decide(e.x, in)
+	}
+}
+
+// decide carries on with the instance once a majority promised the
+// recovery ballot, with whatever may already have committed.
+func (r *replica) decide(x ref, in *inst) {
+	l := in.lead
+	var acc, pre *emsg
+	same := 0
+	for k := range l.oks {
+		ok := &l.oks[k]
+		switch {
+		case ok.st == committed:
+			in.cmd = ok.cmd
+			r.commit(x, in, ok.a)
+			return
+		case ok.st == accepted:
+			if acc == nil || ok.abal > acc.abal {
+				acc = ok
+			}
+		case ok.st == preAccepted:
+			pre = ok
+			if ok.abal == 0 && ok.same && ok.s != x.r {
+				same++
+			}
+		}
+	}
+	switch {
+	case acc != nil:
+		in.cmd = acc.cmd
+		r.startSlow(x, in, acc.a)
+	case pre != nil && same >= (r.N-1)/2 && same > 0:
+		// These F agreed with the command leader, who with
+		// F more may have committed on the fast path.
+		for k := range l.oks {
+			if ok := l.oks[k]; ok.abal == 0 && ok.same && ok.s != x.r {
+				in.cmd = ok.cmd
+				r.startSlow(x, in, ok.a)
+				return
+			}
+		}
+	case pre != nil:
+		in.cmd = pre.cmd
+		a := r.interfere(x, *in.cmd)
+		for _, ok := range l.oks {
+			if ok.st == preAccepted {
+				a = a.union(ok.a)
+			}
+		}
+		l.phase, l.orig, l.a, l.same = "PreAccept", a, a, true
+		l.heard = map[int64]bool{int64(r.ID): true}
+		l.sent = time.Now()
+		in.a, in.st, in.abal, in.same = a, preAccepted, l.b, false
+		r.index(x, in)
+		r.logInst("pre", x, in)
+		stable.MustSync(r.store)
+		r.sendPhase(x, in)
+		r.advance(x, in, false)
+	default:
+		cmd := noOp
+		in.cmd = &cmd
+		r.startSlow(x, in, attrs{deps: []ref{}})
+	}
+}
+
+// tick resends what leaders have not heard enough replies to, takes
+// over requests whose owners seem gone, and recovers instances that
+// have not committed in time.
+func (r *replica) tick(now time.Time) {
+	for x := range r.open {
+		in := r.insts[x]
+		if l := in.lead; l != nil {
+			if now.Sub(l.sent) < r.Retry {
+				continue
+			}
+			l.sent = now
+			if l.phase == "PreAccept" && len(l.heard) >= r.majority() {
+				r.advance(x, in, true)
+			} else {
+				r.sendPhase(x, in)
+			}
+		} else if now.Sub(in.since) > r.stagger(x.r) {
+			r.startPrepare(x, in)
+		}
+	}
+	for id, w := range r.waiting {
+		if _, ok := r.ids[id]; ok {
+			delete(r.waiting, id)
+		} else if now.Sub(w.since) > r.stagger(w.next) {
+			delete(r.waiting, id)
+			r.lead(w.cmd)
+		}
+	}
+}
+
+// stagger is how long to wait before taking over work, with replica
+// s first and the ones after it in turn, so that they do not all try
+// at once.
+func (r *replica) stagger(s int64) time.Duration {
+	k := (int64(r.ID) - s + int64(r.N)) % int64(r.N)
+	return r.Recover + time.Duration(k)*r.Retry
+}
@@ -0,0 +1,45 @@
+package epaxos
+
+import (
+	"io"
+	"testing"
+
+	"rsm"
+	"stable"
+)
+
+// TestTornLog has a replica crash partway through logging an accept,
+// and checks that recovery cuts the torn record off, so that what the
+// replica logs after the restart survives the next one.
+func TestTornLog(t *testing.T) {
+	c := simConfig(3)
+	c.Key = rsm.Key
+	m := &stable.Mem{}
+	n := &Node{Config: c, store: m, sm: rsm.NewKV()}
+	recover := func() *replica {
+		m = m.Crash()
+		n.store = m
+		r := newReplica(n)
+		lr := m.Log()
+		defer lr.Close()
+		r.load(lr)
+		return r
+	}
+	accept := func(r *replica, x ref, cmd string) {
+		r.logInst("acc", x, &inst{cmd: &cmd, a: attrs{seq: 1}})
+		stable.MustSync(m)
+	}
+	accept(newReplica(n), ref{0, 1}, "a")
+	io.WriteString(m, "0: v1 acc 0 2 0 1 - 0 10:tor") // the crash
+	m.Sync()
+	accept(recover(), ref{0, 3}, "c")
+	r := recover()
+	for _, x := range []ref{{0, 1}, {0, 3}} {
+		if in := r.insts[x]; in == nil || in.st != accepted {
+			t.Errorf("lost the accept of %v", x)
+		}
+	}
+	if in := r.insts[ref{0, 2}]; in != nil && in.cmd != nil {
+		t.Errorf("recovered the torn accept of 0.2: %q", *in.cmd)
+	}
+}
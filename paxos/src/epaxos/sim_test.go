@@ -0,0 +1,277 @@
+package epaxos
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"rsm"
+	"simgroup"
+	"simnet"
+	"stable"
+	"upnet"
+)
+
+var runs = flag.Int("runs", 100, "seeded simulations for TestSafety")
+var seed = flag.Int64("seed", 0, "run TestSafety with only this seed")
+
+// A sim is a group of replicas and clients in one process.
+type sim struct {
+	*simgroup.Group
+	cfg Config
+
+	mu        sync.Mutex
+	commits   map[ref]string        // the first commit heard for each instance
+	histories []map[string][]string // by key, each run of a replica
+	bad       []string
+}
+
+// simConfig is fast enough for a simulation to commit things in a
+// few milliseconds.
+func simConfig(n int) Config {
+	return Config{
+		N:       n,
+		Retry:   5 * time.Millisecond,
+		Recover: 20 * time.Millisecond,
+		Log:     log.New(io.Discard, "", 0),
+	}
+}
+
+func newSim(c Config, nc simnet.Config, seed int64) *sim {
+	s := &sim{
+		Group:   simgroup.New(nc, seed),
+		cfg:     c,
+		commits: make(map[ref]string),
+	}
+	s.Net.Tap(s.tap)
+	s.Start(c.N, s.start)
+	return s
+}
+
+func (s *sim) node(i int) *Node {
+	return s.Nodes[i].(*Node)
+}
+
+// tap checks that every Commit for an instance has the same command
+// and attrs.
+func (s *sim) tap(from int, b []byte) {
+	m, err := upnet.Parse(b)
+	if err != nil || len(m.F) < 2 || m.F[1] != "Commit" {
+		return
+	}
+	e, err := parse(m)
+	if err != nil {
+		return
+	}
+	c := fmt.Sprintf("%q %d %s", *e.cmd, e.a.seq, depsString(e.a.deps))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if first, ok := s.commits[e.x]; !ok {
+		s.commits[e.x] = c
+	} else if first != c {
+		s.bad = append(s.bad, fmt.Sprintf(
+			"%v committed as %s after %s", e.x, c, first))
+	}
+}
+
+// start starts replica i, recovering from its storage.  It executes
+// everything again, so its history starts over.
+func (s *sim) start(i int, conn upnet.Conn, store *stable.Mem) simgroup.Member {
+	c := s.cfg
+	c.ID = i
+	h := make(map[string][]string)
+	s.mu.Lock()
+	s.histories = append(s.histories, h)
+	s.mu.Unlock()
+	c.OnExecute = func(x int64, cmd string) {
+		id, v := upnet.SplitCommand(cmd)
+		k, _ := rsm.Key(v)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		h[k] = append(h[k], id)
+	}
+	n := New(c, conn, store, rsm.NewKV())
+	n.Start()
+	return n
+}
+
+// check reports any key whose commands two replicas executed in
+// different orders.  One may be behind the other.
+func (s *sim) check() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for a, ha := range s.histories {
+		for _, hb := range s.histories[a+1:] {
+			for k, xs := range ha {
+				ys := hb[k]
+				if len(ys) < len(xs) {
+					xs, ys = ys, xs
+				}
+				if strings.Join(xs, " ") != strings.Join(ys[:len(xs)], " ") {
+					s.bad = append(s.bad, fmt.Sprintf(
+						"key %q executed as %v and %v", k, xs, ys))
+				}
+			}
+		}
+	}
+}
+
+// propose has each client set keys one after another until ctx is
+// done, and returns how many commits it heard of.  Clients share the
+// keys, so their commands interfere.
+func (s *sim) propose(ctx context.Context, clients, values, keys int, tag string) int {
+	return s.Propose(ctx, clients, values, func(k, j int) string {
+		return rsm.Set(fmt.Sprintf("%s-%d", tag, (k+j)%keys), fmt.Sprint(k, j))
+	})
+}
+
+func simulate(seed int64) []string {
+	rng := rand.New(rand.NewSource(seed))
+	s := newSim(simConfig(3+2*rng.Intn(2)), simnet.Config{
+		Loss:     0.3 * rng.Float64(),
+		Dup:      0.2 * rng.Float64(),
+		MaxDelay: time.Duration(rng.Intn(3000)) * time.Microsecond,
+	}, seed)
+	defer s.Close()
+
+	chaos, stop := context.WithTimeout(context.Background(), 60*time.Millisecond)
+	defer stop()
+	go s.Disrupt(chaos, rng, 100, 101, 102)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	s.propose(ctx, 3, 5, 2, fmt.Sprint(seed))
+	stop()
+	s.check()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bad
+}
+
+// TestSafety checks that every commit of an instance agrees, and
+// that replicas execute the commands on each key in the same order,
+// over many simulations with lost, delayed, duplicated and reordered
+// messages, partitions and restarts.
+func TestSafety(t *testing.T) {
+	n := *runs
+	if testing.Short() && n > 20 {
+		n = 20
+	}
+	for _, b := range simgroup.Safety(n, *seed, simulate) {
+		t.Error(b)
+	}
+}
+
+// TestProgress checks that a group with some loss commits every
+// command, and that every replica executes them all.
+func TestProgress(t *testing.T) {
+	s := newSim(simConfig(3), simnet.Config{
+		Loss:     0.1,
+		Dup:      0.05,
+		MaxDelay: time.Millisecond,
+	}, 1)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	if ok := s.propose(ctx, 3, 10, 2, "p"); ok != 30 {
+		t.Errorf("%d of 30 commands committed", ok)
+	}
+	for {
+		done := true
+		s.mu.Lock()
+		for _, h := range s.histories {
+			if len(h["p-0"])+len(h["p-1"]) < 30 {
+				done = false
+			}
+		}
+		s.mu.Unlock()
+		if done || ctx.Err() != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.check()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, h := range s.histories {
+		if n := len(h["p-0"]) + len(h["p-1"]); n != 30 {
+			t.Errorf("replica %d executed %d of 30", i, n)
+		}
+	}
+	for _, b := range s.bad {
+		t.Error(b)
+	}
+}
+
+// TestFastPath checks that commands that interfere with nothing in
+// progress commit in one round trip.
+func TestFastPath(t *testing.T) {
+	s := newSim(simConfig(5), simnet.Config{}, 1)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	if ok := s.propose(ctx, 1, 20, 3, "f"); ok != 20 {
+		t.Fatalf("%d of 20 commands committed", ok)
+	}
+	var fast, slow int64
+	for _, n := range s.Nodes {
+		f, sl := n.(*Node).Paths()
+		fast += f
+		slow += sl
+	}
+	if fast != 20 || slow != 0 {
+		t.Errorf("%d fast and %d slow commits", fast, slow)
+	}
+}
+
+// TestNear has each client name a replica, and checks that the
+// replica leads its commands.
+func TestNear(t *testing.T) {
+	s := newSim(simConfig(3), simnet.Config{}, 1)
+	defer s.Close()
+	s.Near = true
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	if ok := s.propose(ctx, 3, 5, 3, "n"); ok != 15 {
+		t.Fatalf("%d of 15 commands committed", ok)
+	}
+	for i := range s.Nodes {
+		if f, sl := s.node(i).Paths(); f+sl != 5 {
+			t.Errorf("replica %d led %d commands", i, f+sl)
+		}
+	}
+}
+
+// TestTakeOver cuts off a replica, and checks that the others lead
+// the requests it owns and those that name it.
+func TestTakeOver(t *testing.T) {
+	s := newSim(simConfig(3), simnet.Config{}, 1)
+	defer s.Close()
+	s.Net.Partition([]int{1, 2, 100})
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	if ok := s.propose(ctx, 1, 10, 1, "t"); ok != 10 {
+		t.Fatalf("%d of 10 commands committed", ok)
+	}
+	s.Near = true // the client names replica 0
+	if ok := s.propose(ctx, 1, 10, 1, "u"); ok != 10 {
+		t.Fatalf("%d of 10 commands naming 0 committed", ok)
+	}
+	if f, sl := s.node(0).Paths(); f+sl != 0 {
+		t.Errorf("cut off replica committed %d", f+sl)
+	}
+	s.Net.Heal()
+	s.check()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.bad {
+		t.Error(b)
+	}
+}
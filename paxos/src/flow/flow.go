@@ -0,0 +1,204 @@
+// Package flow paces what a participant sends: token buckets limit
+// the rate of each message type, and backoff spaces retransmissions.
+package flow
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Bucket allows Rate events a second on average, in bursts of up
+// to Burst.
+type Bucket struct {
+	Rate  float64
+	Burst float64
+	Clock func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate, burst float64) *Bucket {
+	return &Bucket{Rate: rate, Burst: burst, Clock: time.Now, tokens: burst}
+}
+
+// Take takes a token and returns how long to wait before using it.
+// Tokens taken early are owed, so a crowd of waiters is spread out.
+func (b *Bucket) Take() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.Clock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.Rate
+		if b.tokens > b.Burst {
+			b.tokens = b.Burst
+		}
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.Rate * float64(time.Second))
+}
+
+// A Limiter has a bucket for each message type.  Types without one
+// are not limited.
+type Limiter struct {
+	buckets map[string]*Bucket
+}
+
+// NewLimiter makes buckets for the rates, in messages a second, with
+// bursts of a tenth of a second's worth, but at least one.
+func NewLimiter(rates map[string]float64) *Limiter {
+	l := &Limiter{make(map[string]*Bucket)}
+	for typ, r := range rates {
+		burst := r / 10
+		if burst < 1 {
+			burst = 1
+		}
+		l.buckets[typ] = NewBucket(r, burst)
+	}
+	return l
+}
+
+// A Queue holds messages for their turn under a Limiter, up to a
+// limit for each type, with one goroutine a type sending them.  A
+// message that finds its type's queue full is not queued, so a
+// sender that outruns its rate loses messages instead of piling up
+// goroutines and owed tokens.
+type Queue struct {
+	l    *Limiter
+	send func(string)
+	qs   map[string]chan string
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewQueue returns a queue of up to max messages for each type that
+// l limits, which sends each in turn with send.
+func NewQueue(l *Limiter, max int, send func(string)) *Queue {
+	q := &Queue{l: l, send: send, qs: make(map[string]chan string),
+		done: make(chan struct{})}
+	for typ := range l.buckets {
+		c := make(chan string, max)
+		q.qs[typ] = c
+		q.wg.Add(1)
+		go q.run(typ, c)
+	}
+	return q
+}
+
+func (q *Queue) run(typ string, c chan string) {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.done:
+			return
+		case s := <-c:
+			if d := q.l.buckets[typ].Take(); d > 0 {
+				t := time.NewTimer(d)
+				select {
+				case <-q.done:
+					t.Stop()
+					return
+				case <-t.C:
+				}
+			}
+			q.send(s)
+		}
+	}
+}
+
+// Put queues a message of the type, or sends it at once if the type
+// is not limited.  It returns false if the queue is full.
+func (q *Queue) Put(typ, s string) bool {
+	c, ok := q.qs[typ]
+	if !ok {
+		q.send(s)
+		return true
+	}
+	select {
+	case c <- s:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close drops what is queued and waits for the senders to stop.
+func (q *Queue) Close() {
+	close(q.done)
+	q.wg.Wait()
+}
+
+// Backoff doubles a delay each time, from Base up to Max.
+type Backoff struct {
+	Base, Max time.Duration
+	next      time.Duration
+}
+
+func (b *Backoff) Next() time.Duration {
+	if b.next == 0 {
+		b.next = b.Base
+	}
+	d := b.next
+	if b.next *= 2; b.next > b.Max {
+		b.next = b.Max
+	}
+	return d
+}
+
+func (b *Backoff) Reset() {
+	b.next = 0
+}
+
+// ParseTable parses "Type=val,Type=val" into a map.
+func ParseTable(s string) (map[string]string, error) {
+	t := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		f := strings.SplitN(kv, "=", 2)
+		if len(f) != 2 || f[0] == "" {
+			return nil, fmt.Errorf("flow: want Type=value, not %q", kv)
+		}
+		t[f[0]] = f[1]
+	}
+	return t, nil
+}
+
+// Rates parses a table of messages a second, like "Propose=100".
+func Rates(s string) (map[string]float64, error) {
+	t, err := ParseTable(s)
+	if err != nil {
+		return nil, err
+	}
+	r := make(map[string]float64)
+	for k, v := range t {
+		if r[k], err = strconv.ParseFloat(v, 64); err != nil || r[k] <= 0 {
+			return nil, fmt.Errorf("flow: bad rate %q for %s", v, k)
+		}
+	}
+	return r, nil
+}
+
+// Durations parses a table of durations, like "Write=200ms".
+func Durations(s string) (map[string]time.Duration, error) {
+	t, err := ParseTable(s)
+	if err != nil {
+		return nil, err
+	}
+	d := make(map[string]time.Duration)
+	for k, v := range t {
+		if d[k], err = time.ParseDuration(v); err != nil || d[k] <= 0 {
+			return nil, fmt.Errorf("flow: bad duration %q for %s", v, k)
+		}
+	}
+	return d, nil
+}
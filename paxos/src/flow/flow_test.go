@@ -0,0 +1,109 @@
+package flow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := NewBucket(10, 2)
+	b.Clock = func() time.Time { return now }
+
+	// the burst goes at once, then one every 100ms
+	for i := 0; i < 2; i++ {
+		if d := b.Take(); d != 0 {
+			t.Errorf("burst %d waits %v", i, d)
+		}
+	}
+	if d := b.Take(); d != 100*time.Millisecond {
+		t.Errorf("third waits %v", d)
+	}
+	if d := b.Take(); d != 200*time.Millisecond {
+		t.Errorf("fourth waits %v", d)
+	}
+
+	// a long quiet spell refills only up to the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if d := b.Take(); d != 0 {
+			t.Errorf("refilled burst %d waits %v", i, d)
+		}
+	}
+	if d := b.Take(); d == 0 {
+		t.Error("bucket over-filled")
+	}
+}
+
+func TestHours(t *testing.T) {
+	// no cap: a steady sender below the rate never waits
+	now := time.Unix(1000, 0)
+	b := NewBucket(100, 10)
+	b.Clock = func() time.Time { return now }
+	for i := 0; i < 3*3600*50; i++ {
+		now = now.Add(20 * time.Millisecond)
+		if d := b.Take(); d != 0 {
+			t.Fatalf("message %d waits %v", i, d)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Base: time.Second, Max: 3 * time.Second}
+	want := []time.Duration{1, 2, 3, 3}
+	for i, w := range want {
+		if d := b.Next(); d != w*time.Second {
+			t.Errorf("step %d: %v", i, d)
+		}
+	}
+	b.Reset()
+	if d := b.Next(); d != time.Second {
+		t.Errorf("after reset: %v", d)
+	}
+}
+
+func TestTables(t *testing.T) {
+	r, err := Rates("Propose=50,Write=200")
+	if err != nil || r["Propose"] != 50 || r["Write"] != 200 {
+		t.Errorf("got %v %v", r, err)
+	}
+	if _, err := Rates("Propose"); err == nil {
+		t.Error("accepted a rate without a value")
+	}
+	d, err := Durations("Write=200ms")
+	if err != nil || d["Write"] != 200*time.Millisecond {
+		t.Errorf("got %v %v", d, err)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	sent := make(chan string, 100)
+	l := NewLimiter(map[string]float64{"Propose": 1})
+	q := NewQueue(l, 2, func(s string) { sent <- s })
+	defer q.Close()
+
+	// the first goes at once, then the queue takes two more, and
+	// perhaps a third once the sender has the next one in hand
+	if !q.Put("Propose", "p1") {
+		t.Fatal("queue refused the first")
+	}
+	if s := <-sent; s != "p1" {
+		t.Fatalf("sent %q", s)
+	}
+	took := 0
+	for i := 0; i < 10; i++ {
+		if q.Put("Propose", "p") {
+			took++
+		}
+	}
+	if took < 2 || took > 3 {
+		t.Errorf("queue took %d of 10 with a limit of 2", took)
+	}
+	// others still go at once
+	if !q.Put("Heartbeat", "h1") {
+		t.Error("queue refused an unlimited type")
+	}
+	if s := <-sent; s != "h1" {
+		t.Errorf("sent %q before the heartbeat", s)
+	}
+}
@@ -0,0 +1,163 @@
+// Package lease lets a leader answer reads from its own state.
+//
+// An acceptor that promises to a leader's lease request grants it a
+// lease, and until the lease runs out, the acceptor refuses every
+// other proposer.  A leader holding grants from a quorum knows that
+// no one else can get a value chosen, so its learned state is
+// current.
+//
+// The leader's lease is counted from when it sent the request, which
+// is before any acceptor granted it, and it is shortened to allow for
+// clocks that run at different rates.  So the leader stops using the
+// lease before any acceptor that granted it would grant another.
+package lease
+
+import (
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+var SystemClock Clock = systemClock{}
+
+type Config struct {
+	Duration time.Duration // how long an acceptor's grant lasts
+
+	// Drift bounds how much faster or slower than real time any
+	// clock runs, as a fraction, so 0.001 is a thousandth.
+	Drift float64
+
+	// Margin is subtracted from the leader's lease for
+	// everything else, like scheduling delays.
+	Margin time.Duration
+}
+
+// held is how long the leader may use a lease by its own clock.
+func (c Config) held() time.Duration {
+	d := float64(c.Duration) * (1 - c.Drift) / (1 + c.Drift)
+	return time.Duration(d) - c.Margin
+}
+
+// A Grantor is an acceptor's record of the lease it granted.
+type Grantor struct {
+	Config
+	Clock Clock
+
+	holder  int64
+	until   time.Time
+	granted bool
+}
+
+func NewGrantor(c Config, clock Clock) *Grantor {
+	return &Grantor{Config: c, Clock: clock}
+}
+
+// Blocks says whether an unexpired lease held by someone else means
+// the acceptor must refuse id.
+func (g *Grantor) Blocks(id int64) bool {
+	return g.granted && g.holder != id && g.Clock.Now().Before(g.until)
+}
+
+// Grant grants or renews id's lease, unless another holds one.
+func (g *Grantor) Grant(id int64) bool {
+	if g.Blocks(id) {
+		return false
+	}
+	g.holder = id
+	g.until = g.Clock.Now().Add(g.Duration)
+	g.granted = true
+	return true
+}
+
+// Until returns when the last lease granted runs out.
+func (g *Grantor) Until() time.Time {
+	return g.until
+}
+
+// Restore takes up a grant made before a restart, as read from the
+// acceptor's log, unless a later one is known.
+func (g *Grantor) Restore(id int64, until time.Time) {
+	if !g.granted || until.After(g.until) {
+		g.holder = id
+		g.until = until
+		g.granted = true
+	}
+}
+
+// Holder returns who holds the unexpired lease, if anyone.
+func (g *Grantor) Holder() (int64, bool) {
+	if !g.granted || !g.Clock.Now().Before(g.until) {
+		return -1, false
+	}
+	return g.holder, true
+}
+
+// A Holder is a leader's view of its own lease.
+type Holder struct {
+	Config
+	Clock  Clock
+	Quorum int // grants needed
+
+	// Enough, if set, decides whether the acceptors that granted
+	// are enough, instead of Quorum.  They must include one from
+	// every phase-2 quorum, so that no one else can get a value
+	// accepted by a quorum.
+	Enough func(grants map[int64]bool) bool
+
+	round  int64
+	start  time.Time
+	grants map[int64]bool
+	until  time.Time
+}
+
+func NewHolder(c Config, clock Clock, quorum int) *Holder {
+	return &Holder{Config: c, Clock: clock, Quorum: quorum}
+}
+
+// Begin starts a round of lease requests.  Call it before sending
+// them, and tag them with the round it returns.
+func (h *Holder) Begin() int64 {
+	h.round++
+	h.start = h.Clock.Now()
+	h.grants = make(map[int64]bool)
+	return h.round
+}
+
+// Granted notes a grant from acceptor id in a round and says whether
+// the lease is now held.  Grants from old rounds do not count.
+func (h *Holder) Granted(round, id int64) bool {
+	if round != h.round || h.grants == nil {
+		return h.Valid()
+	}
+	h.grants[id] = true
+	if h.enough() {
+		if until := h.start.Add(h.held()); until.After(h.until) {
+			h.until = until
+		}
+	}
+	return h.Valid()
+}
+
+func (h *Holder) enough() bool {
+	if h.Enough != nil {
+		return h.Enough(h.grants)
+	}
+	return len(h.grants) >= h.Quorum
+}
+
+// Valid says whether the lease is held now.
+func (h *Holder) Valid() bool {
+	return h.Clock.Now().Before(h.until)
+}
+
+// Drop gives up the lease early, as when the leader learns someone
+// else is leading.
+func (h *Holder) Drop() {
+	h.until = time.Time{}
+}
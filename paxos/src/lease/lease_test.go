@@ -0,0 +1,130 @@
+package lease
+
+import (
+	"testing"
+	"time"
+)
+
+// A fakeClock runs at its own rate relative to a shared real time.
+type fakeClock struct {
+	real *time.Time
+	rate float64
+	base time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	el := c.real.Sub(c.base)
+	return c.base.Add(time.Duration(float64(el) * c.rate))
+}
+
+var cfg = Config{
+	Duration: 10 * time.Second,
+	Drift:    0.01,
+	Margin:   0,
+}
+
+// TestPartition has a leader take a lease and then get cut off.  A
+// rival keeps asking for a lease every few milliseconds.  The
+// leader's clock runs slow and the acceptors' clocks run fast, as
+// far as the drift bound allows, and still the two never hold a
+// lease at the same time.
+func TestPartition(t *testing.T) {
+	for _, rates := range [][2]float64{
+		{1 - cfg.Drift, 1 + cfg.Drift},
+		{1 + cfg.Drift, 1 - cfg.Drift},
+		{1, 1},
+	} {
+		real := time.Unix(1000, 0)
+		clock := func(rate float64) Clock {
+			return &fakeClock{&real, rate, real}
+		}
+		acceptors := []*Grantor{}
+		for i := 0; i < 3; i++ {
+			acceptors = append(acceptors, NewGrantor(cfg, clock(rates[1])))
+		}
+		leader := NewHolder(cfg, clock(rates[0]), 2)
+		rival := NewHolder(cfg, clock(1), 2)
+
+		// the leader's requests take a while to arrive
+		round := leader.Begin()
+		real = real.Add(50 * time.Millisecond)
+		for i, a := range acceptors {
+			if a.Grant(0) {
+				leader.Granted(round, int64(i))
+			}
+		}
+		if !leader.Valid() {
+			t.Fatal("leader got no lease")
+		}
+
+		// partition: only the rival can reach the acceptors
+		rivalFirst := time.Time{}
+		for step := 0; step < 3000; step++ {
+			real = real.Add(5 * time.Millisecond)
+			round := rival.Begin()
+			for i, a := range acceptors {
+				if a.Grant(1) {
+					rival.Granted(round, int64(i))
+				}
+			}
+			if rival.Valid() && rivalFirst.IsZero() {
+				rivalFirst = real
+			}
+			if rival.Valid() && leader.Valid() {
+				t.Fatalf("rates %v: both hold leases at %v",
+					rates, real)
+			}
+		}
+		if rivalFirst.IsZero() {
+			t.Errorf("rates %v: rival never got the lease", rates)
+		}
+	}
+}
+
+func TestOldRound(t *testing.T) {
+	real := time.Unix(1000, 0)
+	h := NewHolder(cfg, &fakeClock{&real, 1, real}, 2)
+	old := h.Begin()
+	h.Granted(old, 1)
+	real = real.Add(time.Second)
+	h.Begin()
+	h.Granted(old, 2)
+	if h.Valid() {
+		t.Error("grants from different rounds made a lease")
+	}
+}
+
+func TestRenewal(t *testing.T) {
+	real := time.Unix(1000, 0)
+	g := NewGrantor(cfg, &fakeClock{&real, 1, real})
+	if !g.Grant(0) {
+		t.Fatal("no first grant")
+	}
+	real = real.Add(9 * time.Second)
+	if !g.Grant(0) || g.Grant(1) {
+		t.Fatal("renewal went wrong")
+	}
+	real = real.Add(9 * time.Second)
+	if id, ok := g.Holder(); !ok || id != 0 {
+		t.Error("renewed lease ran out early")
+	}
+	real = real.Add(2 * time.Second)
+	if !g.Grant(1) {
+		t.Error("expired lease still blocks")
+	}
+}
+
+// TestEnough checks that grants are counted by the quorum system's
+// rule when there is one.
+func TestEnough(t *testing.T) {
+	real := time.Unix(1000, 0)
+	h := NewHolder(cfg, &fakeClock{&real, 1, real}, 0)
+	h.Enough = func(g map[int64]bool) bool { return g[0] && g[3] }
+	r := h.Begin()
+	if h.Granted(r, 1) || h.Granted(r, 2) || h.Granted(r, 0) {
+		t.Error("lease held without grants from 0 and 3")
+	}
+	if !h.Granted(r, 3) {
+		t.Error("no lease with grants from 0 and 3")
+	}
+}
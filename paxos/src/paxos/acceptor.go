@@ -0,0 +1,69 @@
+package paxos
+
+import (
+	"sync"
+
+	"trace"
+)
+
+// An Acceptor remembers the highest number it promised and the
+// proposal it accepted last.  Its methods are safe to call at once.
+// It keeps its state in memory only, so one that restarts must come
+// back as a new acceptor in a new group.
+type Acceptor struct {
+	ID    int64         // in the trace
+	Trace *trace.Writer // nil for none
+
+	mu       sync.Mutex
+	promised int64
+	accepted *Proposal
+}
+
+func NewAcceptor(id int64) *Acceptor {
+	return &Acceptor{ID: id, promised: -1}
+}
+
+// Prepare promises n, unless the acceptor promised a higher number.
+// A proposer that sends Prepare again with the same number gets the
+// same promise.
+func (a *Acceptor) Prepare(n int64) Promise {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ok := n >= a.promised
+	if ok && n > a.promised {
+		a.promised = n
+		a.Trace.Add(trace.Event{Node: a.ID, Kind: trace.Promise, Ballot: n})
+	}
+	return Promise{OK: ok, Promised: a.promised, Accepted: a.copy()}
+}
+
+// Accept accepts the proposal, unless the acceptor promised a higher
+// number.  Accepting is promising too, so that a lower Prepare cannot
+// get a promise and then replace the value.
+func (a *Acceptor) Accept(n int64, v string) Accepted {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if n < a.promised {
+		return Accepted{OK: false, Promised: a.promised}
+	}
+	a.promised = n
+	a.accepted = &Proposal{n, v}
+	a.Trace.Add(trace.Event{Node: a.ID, Kind: trace.Accept, Ballot: n, Value: &v})
+	return Accepted{OK: true, Promised: n}
+}
+
+// State returns the highest number promised and the proposal
+// accepted last, nil if none.
+func (a *Acceptor) State() (int64, *Proposal) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.promised, a.copy()
+}
+
+func (a *Acceptor) copy() *Proposal {
+	if a.accepted == nil {
+		return nil
+	}
+	p := *a.accepted
+	return &p
+}
@@ -0,0 +1,88 @@
+// Package paxos is basic, single-decree Paxos, as in Lamport's
+// "Paxos Made Simple": proposers get one value chosen by a majority
+// of acceptors, however many proposers try at once.
+//
+// A Proposer talks to the acceptors through a Transport, which may
+// lose, delay or duplicate what it carries.  Each request is resent
+// after a timeout until the acceptor answers or the proposer's
+// context is done, so an acceptor that never answers costs time but
+// cannot hang a proposer, and a majority that does answer is enough.
+// Any process can run Acceptors, Proposers or both.
+package paxos
+
+import (
+	"context"
+	"fmt"
+)
+
+// A Transport carries a proposer's requests to acceptor a, one of
+// 0 through n-1 for n acceptors, and brings back the answer.  When
+// it loses either, it returns an error, or blocks until ctx is done.
+type Transport interface {
+	Prepare(ctx context.Context, a int, n int64) (Promise, error)
+	Accept(ctx context.Context, a int, n int64, v string) (Accepted, error)
+}
+
+// A Proposal is a value with its proposal number.
+type Proposal struct {
+	N int64
+	V string
+}
+
+func (p Proposal) String() string {
+	return fmt.Sprintf("%d %q", p.N, p.V)
+}
+
+// A Promise answers a Prepare.  OK means the acceptor promised not
+// to accept anything numbered below the Prepare's number.  Either
+// way, Promised is the highest number it has promised, and Accepted
+// the proposal it accepted last, nil if none.
+type Promise struct {
+	OK       bool
+	Promised int64
+	Accepted *Proposal
+}
+
+func (p Promise) String() string {
+	s := fmt.Sprintf("Promise %v %d", p.OK, p.Promised)
+	if p.Accepted != nil {
+		s += " " + p.Accepted.String()
+	}
+	return s
+}
+
+// Accepted answers an Accept.  OK means the acceptor accepted the
+// proposal, and Promised is the highest number it has promised.
+type Accepted struct {
+	OK       bool
+	Promised int64
+}
+
+func (a Accepted) String() string {
+	return fmt.Sprintf("Accepted %v %d", a.OK, a.Promised)
+}
+
+// Rejected is the error from a round that an acceptor refused,
+// having promised a higher number to another proposer.
+type Rejected struct {
+	Phase    int // 1 for Prepare, 2 for Accept
+	N        int64
+	Promised int64
+}
+
+func (r *Rejected) Error() string {
+	return fmt.Sprintf("paxos: phase %d with %d rejected for %d",
+		r.Phase, r.N, r.Promised)
+}
+
+// Local is a Transport that calls its acceptors directly, and never
+// loses anything.
+type Local []*Acceptor
+
+func (l Local) Prepare(ctx context.Context, a int, n int64) (Promise, error) {
+	return l[a].Prepare(n), nil
+}
+
+func (l Local) Accept(ctx context.Context, a int, n int64, v string) (Accepted, error) {
+	return l[a].Accept(n, v), nil
+}
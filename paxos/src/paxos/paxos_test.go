@@ -0,0 +1,175 @@
+package paxos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossy is a Local transport that loses requests and answers, and
+// delays the rest, with its choices taken from a seed.  Acceptors
+// in down never answer.
+type lossy struct {
+	Local
+	loss float64
+	down map[int]bool
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newLossy(n int, loss float64, seed int64) *lossy {
+	l := &lossy{loss: loss, down: make(map[int]bool),
+		rng: rand.New(rand.NewSource(seed))}
+	for a := 0; a < n; a++ {
+		l.Local = append(l.Local, NewAcceptor(int64(a)))
+	}
+	return l
+}
+
+// deliver waits out the delay and reports whether the message
+// arrives.
+func (l *lossy) deliver(ctx context.Context, a int) error {
+	l.mu.Lock()
+	lost := l.down[a] || l.rng.Float64() < l.loss
+	d := time.Duration(l.rng.Intn(500)) * time.Microsecond
+	l.mu.Unlock()
+	if lost {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *lossy) Prepare(ctx context.Context, a int, n int64) (Promise, error) {
+	if err := l.deliver(ctx, a); err != nil {
+		return Promise{}, err
+	}
+	r := l.Local[a].Prepare(n)
+	return r, l.deliver(ctx, a)
+}
+
+func (l *lossy) Accept(ctx context.Context, a int, n int64, v string) (Accepted, error) {
+	if err := l.deliver(ctx, a); err != nil {
+		return Accepted{}, err
+	}
+	r := l.Local[a].Accept(n, v)
+	return r, l.deliver(ctx, a)
+}
+
+func TestOne(t *testing.T) {
+	l := Local{NewAcceptor(0), NewAcceptor(1), NewAcceptor(2)}
+	p := NewProposer(3, 10, l, 3)
+	v, err := p.Propose(context.Background(), "x")
+	if err != nil || v != "x" {
+		t.Fatalf("chose %q, %v", v, err)
+	}
+	// a later proposer gets the same value chosen
+	q := NewProposer(4, 10, l, 3)
+	if v, err := q.Propose(context.Background(), "y"); err != nil || v != "x" {
+		t.Errorf("then chose %q, %v", v, err)
+	}
+	if n, acc := l[0].State(); n != 4 || acc.V != "x" {
+		t.Errorf("acceptor promised %d and accepted %v", n, acc)
+	}
+}
+
+// TestProposerID checks that a proposer outside the count is
+// refused, since it would share its numbers with another.
+func TestProposerID(t *testing.T) {
+	for _, i := range []int{-1, 3, 13} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("made proposer %d of 3", i)
+				}
+			}()
+			NewProposer(i, 3, Local{}, 3)
+		}()
+	}
+}
+
+// TestRejected checks that a proposer with a lower number is
+// refused, and does better next round.
+func TestRejected(t *testing.T) {
+	l := Local{NewAcceptor(0), NewAcceptor(1), NewAcceptor(2)}
+	for _, a := range l {
+		a.Prepare(15)
+	}
+	p := NewProposer(2, 10, l, 3)
+	_, err := p.Round(context.Background(), "x")
+	var r *Rejected
+	if !errors.As(err, &r) || r.Phase != 1 || r.N != 2 || r.Promised != 15 {
+		t.Fatalf("got %v", err)
+	}
+	if p.N() != 22 {
+		t.Errorf("next round uses %d", p.N())
+	}
+	if v, err := p.Round(context.Background(), "x"); err != nil || v != "x" {
+		t.Errorf("chose %q, %v", v, err)
+	}
+}
+
+// TestTimeout checks that a proposer that cannot reach a majority
+// gives up when its context is done, and that a majority is enough.
+func TestTimeout(t *testing.T) {
+	l := newLossy(3, 0, 1)
+	l.down[0], l.down[1] = true, true
+	p := NewProposer(0, 1, l, 3)
+	p.Timeout = 5 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.Propose(ctx, "x"); err != context.DeadlineExceeded {
+		t.Fatalf("got %v", err)
+	}
+	if p.Sent() < 3*5 {
+		t.Errorf("sent only %d requests", p.Sent())
+	}
+	l.down[1] = false
+	if v, err := p.Propose(context.Background(), "y"); err != nil || v != "y" {
+		t.Errorf("chose %q, %v", v, err)
+	}
+}
+
+// TestContention has proposers compete over lossy transports, and
+// checks that they all get the same value.
+func TestContention(t *testing.T) {
+	for seed := int64(1); seed <= 50; seed++ {
+		n := 3 + int(seed%3)
+		l := newLossy(n, 0.2, seed)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		chosen := make([]string, 4)
+		var wg sync.WaitGroup
+		for i := range chosen {
+			p := NewProposer(i, len(chosen), l, n)
+			p.Timeout = 2 * time.Millisecond
+			p.Backoff = 5 * time.Millisecond
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				v, err := p.Propose(ctx, fmt.Sprint("v", i))
+				if err != nil {
+					t.Errorf("seed %d: proposer %d: %v", seed, i, err)
+				}
+				chosen[i] = v
+			}(i)
+		}
+		wg.Wait()
+		cancel()
+		for i, v := range chosen {
+			if v != chosen[0] {
+				t.Errorf("seed %d: proposer %d got %q, proposer 0 %q",
+					seed, i, v, chosen[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package paxos
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"trace"
+)
+
+const (
+	DefaultTimeout = 100 * time.Millisecond
+	DefaultBackoff = 50 * time.Millisecond
+)
+
+// A Proposer gets a value chosen by a majority of Acceptors.  It
+// numbers its proposals i, i+Stride, i+2*Stride, and so on, so
+// proposers with different i in [0, Stride) never share a number.
+// Stride must be the same for all of them, or two could share one
+// and get different values chosen.  One Proposer must not run two
+// rounds at once.
+type Proposer struct {
+	ID        int64 // in the trace
+	T         Transport
+	Acceptors int
+	Stride    int64
+
+	// Timeout is how long to wait for an acceptor's answer before
+	// asking again.  Propose waits a random time up to Backoff
+	// after a rejected round, so that competing proposers take
+	// turns.
+	Timeout time.Duration
+	Backoff time.Duration
+
+	Trace *trace.Writer // nil for none
+
+	n    int64
+	sent int64 // requests, counting those sent again
+}
+
+// NewProposer returns proposer i of count, which talks to n
+// acceptors over t.  It panics unless 0 <= i < count.
+func NewProposer(i, count int, t Transport, n int) *Proposer {
+	if i < 0 || i >= count {
+		log.Panicf("proposer %d of %d", i, count)
+	}
+	return &Proposer{
+		ID:        int64(i),
+		T:         t,
+		Acceptors: n,
+		Stride:    int64(count),
+		Timeout:   DefaultTimeout,
+		Backoff:   DefaultBackoff,
+		n:         int64(i),
+	}
+}
+
+// N returns the number the next round will use.
+func (p *Proposer) N() int64 {
+	return p.n
+}
+
+// Sent returns how many requests the proposer has sent, counting
+// each one sent again.
+func (p *Proposer) Sent() int64 {
+	return atomic.LoadInt64(&p.sent)
+}
+
+// exceed moves past n, so that the next round's number is higher.
+func (p *Proposer) exceed(n int64) {
+	for p.n <= n {
+		p.n += p.Stride
+	}
+}
+
+// Propose runs rounds until a value is chosen, and returns it.  The
+// value may be another proposer's.  It gives up when ctx is done.
+func (p *Proposer) Propose(ctx context.Context, v string) (string, error) {
+	for {
+		chosen, err := p.Round(ctx, v)
+		if err == nil {
+			return chosen, nil
+		}
+		if ctx.Err() != nil {
+			return "", err
+		}
+		d := time.Duration(0)
+		if p.Backoff > 0 {
+			d = time.Duration(rand.Int63n(int64(p.Backoff)))
+		}
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// Round runs both phases once with the proposer's next number.  If
+// a majority promises, it proposes the value accepted with the
+// highest number among their promises, or v if there is none, and
+// returns it once a majority accepts it.  A refusal ends the round
+// with a *Rejected error, and the next round uses a higher number.
+func (p *Proposer) Round(ctx context.Context, v string) (string, error) {
+	n := p.n
+	defer p.exceed(n)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// phase 1
+	promises := make(chan Promise, p.Acceptors)
+	prepare := func(ctx context.Context, a int) (fmt.Stringer, error) {
+		r, err := p.T.Prepare(ctx, a, n)
+		if err == nil {
+			promises <- r
+		}
+		return r, err
+	}
+	for a := 0; a < p.Acceptors; a++ {
+		go p.call(ctx, a, fmt.Sprintf("Prepare %d", n), prepare)
+	}
+	var best *Proposal
+	for ok := 0; ok <= p.Acceptors/2; {
+		select {
+		case r := <-promises:
+			if !r.OK {
+				p.exceed(r.Promised)
+				return "", &Rejected{1, n, r.Promised}
+			}
+			ok++
+			if r.Accepted != nil && (best == nil || r.Accepted.N > best.N) {
+				best = r.Accepted
+			}
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	if best != nil {
+		v = best.V
+	}
+
+	// phase 2
+	accepts := make(chan Accepted, p.Acceptors)
+	accept := func(ctx context.Context, a int) (fmt.Stringer, error) {
+		r, err := p.T.Accept(ctx, a, n, v)
+		if err == nil {
+			accepts <- r
+		}
+		return r, err
+	}
+	for a := 0; a < p.Acceptors; a++ {
+		go p.call(ctx, a, fmt.Sprintf("Accept! %d %q", n, v), accept)
+	}
+	for ok := 0; ok <= p.Acceptors/2; {
+		select {
+		case r := <-accepts:
+			if !r.OK {
+				p.exceed(r.Promised)
+				return "", &Rejected{2, n, r.Promised}
+			}
+			ok++
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	p.Trace.Add(trace.Event{Node: p.ID, Kind: trace.Learn, Value: &v})
+	return v, nil
+}
+
+// call sends a request to acceptor a with f, again each Timeout,
+// until it gets an answer or ctx is done.
+func (p *Proposer) call(ctx context.Context, a int, msg string,
+	f func(context.Context, int) (fmt.Stringer, error)) {
+	for ctx.Err() == nil {
+		atomic.AddInt64(&p.sent, 1)
+		p.Trace.Add(trace.Event{Node: p.ID, Kind: trace.Send,
+			Msg: fmt.Sprintf("%d %s", a, msg)})
+		cctx, cancel := context.WithTimeout(ctx, p.Timeout)
+		r, err := f(cctx, a)
+		if err == nil {
+			cancel()
+			p.Trace.Add(trace.Event{Node: p.ID, Kind: trace.Recv,
+				Msg: fmt.Sprintf("%d %s", a, r)})
+			return
+		}
+		<-cctx.Done() // a quick failure waits like a lost one
+		cancel()
+	}
+}
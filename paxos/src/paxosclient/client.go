@@ -0,0 +1,265 @@
+// Package paxosclient sends requests to a upaxos group and waits for
+// the matching replies.
+//
+// Every request carries an ID that is unique to the client, and a
+// retry reuses it, so the group can recognize a request it has
+// already chosen.  A retry that reaches a leader that has not learned
+// the first choice may be chosen again, but the group applies it only
+// once and answers with the instance where it was first chosen.
+package paxosclient
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"flow"
+	"upnet"
+)
+
+// DefaultRetry is how long a client waits for a reply before it
+// sends the same request again.
+const DefaultRetry = 500 * time.Millisecond
+
+// ErrTooBig is the answer to a value too long for any message to
+// carry once it is framed, whether the client or the group finds it.
+var ErrTooBig = errors.New("paxosclient: value too big")
+
+type Client struct {
+	Retry time.Duration // resend after this long without a reply
+
+	// Near, if not negative, is the participant nearest the client.
+	// A leaderless group has it lead the client's writes.
+	Near int
+
+	conn   upnet.Conn
+	auth   *upnet.Auth // nil without the group key
+	prefix string      // makes request IDs unique to this client
+
+	mu      sync.Mutex
+	seq     int64
+	waiting map[string]chan upnet.Msg // by request ID
+}
+
+// Dial joins the group channel for the transport, "ip" or "udp", as
+// upnet.Join does.
+func Dial(transport, addr string) (*Client, error) {
+	conn, err := upnet.Join(transport, addr)
+	if err != nil {
+		return nil, err
+	}
+	return New(conn), nil
+}
+
+// New returns a client that talks over conn.  The client owns conn
+// and closes it on Close.
+func New(conn upnet.Conn) *Client {
+	return NewSealed(conn, nil)
+}
+
+// NewSealed is New for a client with the group key in a: it signs
+// its requests, and it drops answers not signed with the key, so no
+// one else on the network can answer for the group.
+func NewSealed(conn upnet.Conn, a *upnet.Auth) *Client {
+	if a != nil && a.Key == nil {
+		a = nil
+	}
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	c := &Client{
+		Retry:   DefaultRetry,
+		Near:    -1,
+		conn:    conn,
+		auth:    a,
+		prefix:  fmt.Sprintf("c%x", b),
+		waiting: make(map[string]chan upnet.Msg),
+	}
+	go c.listen()
+	return c
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Send sends a message as it is, and does not wait for an answer,
+// for the commands that have none, like quit.
+func (c *Client) Send(msg string) error {
+	return c.send(msg)
+}
+
+func (c *Client) send(msg string) error {
+	return c.conn.Send([]byte(c.auth.Seal(msg)))
+}
+
+func (c *Client) newID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	return fmt.Sprintf("%s-%d", c.prefix, c.seq)
+}
+
+// listen hands each OK, BUSY or TOOBIG to whoever waits for its
+// request ID.  A group with a key signs its answers, and a client
+// with the key checks them.  A group with a key answers no one
+// without it.
+func (c *Client) listen() {
+	buf := make([]byte, upnet.MaxDatagram)
+	for {
+		n, err := c.conn.Recv(buf)
+		if err != nil {
+			return
+		}
+		b := buf[:n]
+		if c.auth != nil {
+			m, how, err := c.auth.Open(b)
+			if err != nil || how != upnet.Signed {
+				continue
+			}
+			b = m
+		}
+		m, err := upnet.Parse(b)
+		if err != nil || len(m.F) < 3 {
+			continue
+		}
+		var id string
+		switch {
+		case m.F[1] == "OK" && len(m.F) >= 4:
+			id = m.F[3]
+		case m.F[1] == "BUSY" || m.F[1] == "TOOBIG":
+			id = m.F[2]
+		default:
+			continue
+		}
+		c.mu.Lock()
+		if w, ok := c.waiting[id]; ok {
+			select {
+			case w <- m:
+			default: // another participant answered first
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// call sends req until an OK for id arrives or ctx is done.  A BUSY
+// reply means the leader's queue is full, so call waits longer and
+// longer before it sends again.  A TOOBIG reply is ErrTooBig.
+func (c *Client) call(ctx context.Context, id, req string) (upnet.Msg, error) {
+	w := make(chan upnet.Msg, 1)
+	c.mu.Lock()
+	c.waiting[id] = w
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.waiting, id)
+		c.mu.Unlock()
+	}()
+
+	busy := flow.Backoff{Base: c.Retry, Max: 16 * c.Retry}
+	for {
+		if err := c.send(req); err != nil {
+			return upnet.Msg{}, err
+		}
+		t := time.NewTimer(c.Retry)
+		for waiting := true; waiting; {
+			select {
+			case m := <-w:
+				t.Stop()
+				if m.F[1] == "TOOBIG" {
+					return upnet.Msg{}, ErrTooBig
+				}
+				if m.F[1] != "BUSY" {
+					return m, nil
+				}
+				t.Reset(busy.Next())
+			case <-ctx.Done():
+				t.Stop()
+				return upnet.Msg{}, ctx.Err()
+			case <-t.C:
+				waiting = false
+			}
+		}
+	}
+}
+
+// Propose asks the group to choose value and returns the instance
+// where it was chosen.
+func (c *Client) Propose(ctx context.Context, value string) (int64, error) {
+	if value == "" {
+		return 0, errors.New("paxosclient: empty value reads, not writes")
+	}
+	id := c.newID()
+	if len(upnet.Command(id, value)) > upnet.MaxCommand {
+		return 0, ErrTooBig
+	}
+	req := upnet.Record(&value, "Request 0 %s", id)
+	if c.Near >= 0 {
+		req = upnet.Record(&value, "Request 0 %s %d", id, c.Near)
+	}
+	m, err := c.call(ctx, id, req)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(m.F[2], 0, 64)
+}
+
+// Query asks the group's state machine a question, like rsm.Get.
+// The answer comes from the first learner to reply, along with the
+// last instance it applied, so it may be stale.
+func (c *Client) Query(ctx context.Context, q string) (int64, string, error) {
+	return c.query(ctx, q, "")
+}
+
+func (c *Client) query(ctx context.Context, q, how string) (int64, string, error) {
+	id := c.newID()
+	m, err := c.call(ctx, id, upnet.Record(&q, "Query %s %s", id, how))
+	if err != nil {
+		return 0, "", err
+	}
+	i, err := strconv.ParseInt(m.F[2], 0, 64)
+	if err != nil || m.V == nil {
+		return i, "", err
+	}
+	return i, *m.V, nil
+}
+
+// QueryLeader is like Query, but only a learner on a leader with a
+// lease answers, and its answer is linearizable.  Leases are off by
+// default, and with them off, QueryLeader gets no answer.
+func (c *Client) QueryLeader(ctx context.Context, q string) (int64, string, error) {
+	return c.query(ctx, q, "leader")
+}
+
+// Read returns the values chosen for instance: the one value, the
+// values of a batch, in order, or none when the instance holds a
+// no-op that filled a gap.  Only learners that know the value
+// answer, so Read keeps trying until ctx is done when nothing has
+// been chosen yet.
+func (c *Client) Read(ctx context.Context, instance int64) ([]string, error) {
+	if instance < 1 {
+		return nil, errors.New("paxosclient: instances start at 1")
+	}
+	id := c.newID()
+	m, err := c.call(ctx, id, upnet.Record(nil, "Request %d %s", instance, id))
+	if err != nil {
+		return nil, err
+	}
+	kind := ""
+	if len(m.F) > 4 {
+		kind = m.F[4]
+	}
+	switch {
+	case kind == "noop" || m.V == nil:
+		return nil, nil
+	case kind == "batch":
+		return upnet.SplitBatch(*m.V)
+	}
+	return []string{*m.V}, nil
+}
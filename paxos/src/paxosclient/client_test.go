@@ -0,0 +1,267 @@
+package paxosclient
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"upnet"
+)
+
+// fakeGroup answers like a upaxos group that loses the first copy of
+// every request.
+type fakeGroup struct {
+	in     chan []byte
+	out    chan []byte
+	seen   map[string]int // copies of each request ID
+	chosen map[string]int64
+	log    []string
+}
+
+func newFakeGroup() *fakeGroup {
+	g := &fakeGroup{
+		in:     make(chan []byte, 10),
+		out:    make(chan []byte, 10),
+		seen:   make(map[string]int),
+		chosen: make(map[string]int64),
+	}
+	go g.serve()
+	return g
+}
+
+func (g *fakeGroup) serve() {
+	for b := range g.in {
+		m, err := upnet.Parse(b)
+		if err != nil {
+			continue
+		}
+		if m.F[0] == "Query" {
+			v := ""
+			if len(g.log) > 0 {
+				v = g.log[len(g.log)-1]
+			}
+			g.out <- []byte(upnet.Record(&v, "1 OK %d %s", len(g.log), m.F[1]))
+			continue
+		}
+		id := m.F[2]
+		g.seen[id]++
+		if g.seen[id] == 1 {
+			continue // lost
+		}
+		if m.F[1] != "0" {
+			v := g.log[0]
+			g.out <- []byte(upnet.Record(&v, "1 OK %s %s", m.F[1], id))
+			continue
+		}
+		i, ok := g.chosen[id]
+		if !ok {
+			g.log = append(g.log, *m.V)
+			i = int64(len(g.log))
+			g.chosen[id] = i
+		}
+		g.out <- []byte(upnet.Record(nil, "2 OK %d %s", i, id))
+		g.out <- []byte(upnet.Record(nil, "0 OK %d %s", i, id))
+	}
+}
+
+func (g *fakeGroup) Send(b []byte) error {
+	g.in <- append([]byte{}, b...)
+	return nil
+}
+
+func (g *fakeGroup) Recv(b []byte) (int, error) {
+	m, ok := <-g.out
+	if !ok {
+		return 0, errors.New("closed")
+	}
+	return copy(b, m), nil
+}
+
+func (g *fakeGroup) Close() error {
+	close(g.in)
+	close(g.out)
+	return nil
+}
+
+func TestProposeAndRead(t *testing.T) {
+	g := newFakeGroup()
+	c := New(g)
+	c.Retry = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	i, err := c.Propose(ctx, "one  two\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 1 {
+		t.Errorf("chosen in instance %d", i)
+	}
+	v, err := c.Read(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 1 || v[0] != "one  two\n" {
+		t.Errorf("read %q", v)
+	}
+	i, q, err := c.Query(ctx, "anything")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 1 || q != "one  two\n" {
+		t.Errorf("query got %d %q", i, q)
+	}
+	for id, n := range g.seen {
+		if n < 2 {
+			t.Errorf("request %s was not retried", id)
+		}
+	}
+	if len(g.log) != 1 {
+		t.Errorf("value chosen %d times", len(g.log))
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	c := New(&fakeGroup{in: make(chan []byte, 1000), out: make(chan []byte)})
+	c.Retry = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Propose(ctx, "x"); err != context.DeadlineExceeded {
+		t.Errorf("got %v", err)
+	}
+}
+
+// busyGroup says BUSY to the first copies of a request and notes
+// when each copy arrived.
+type busyGroup struct {
+	fakeGroup
+	busy int
+	at   []time.Time
+}
+
+func (g *busyGroup) Send(b []byte) error {
+	m, err := upnet.Parse(b)
+	if err != nil {
+		return err
+	}
+	id := m.F[2]
+	g.at = append(g.at, time.Now())
+	if len(g.at) <= g.busy {
+		g.out <- []byte(upnet.Record(nil, "0 BUSY %s", id))
+	} else {
+		g.out <- []byte(upnet.Record(nil, "0 OK 1 %s", id))
+	}
+	return nil
+}
+
+func TestBusy(t *testing.T) {
+	g := &busyGroup{fakeGroup: fakeGroup{out: make(chan []byte, 10)}, busy: 3}
+	c := New(g)
+	c.Retry = 5 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := c.Propose(ctx, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.at) != g.busy+1 {
+		t.Fatalf("sent %d copies", len(g.at))
+	}
+	// each BUSY doubles the wait before the next copy
+	for k := 1; k < len(g.at); k++ {
+		min := c.Retry << uint(k-1)
+		if d := g.at[k].Sub(g.at[k-1]); d < min {
+			t.Errorf("copy %d sent after %v, want at least %v", k, d, min)
+		}
+	}
+}
+
+// historyGroup answers every history request with the same record,
+// given the request's ID.
+type historyGroup struct {
+	fakeGroup
+	answer func(id string) string
+}
+
+func (g *historyGroup) Send(b []byte) error {
+	m, err := upnet.Parse(b)
+	if err != nil {
+		return err
+	}
+	g.out <- []byte(g.answer(m.F[2]))
+	return nil
+}
+
+func TestRead(t *testing.T) {
+	v := "one two"
+	for _, tc := range []struct {
+		name   string
+		answer func(id string) string
+		want   []string
+	}{
+		{"value", func(id string) string {
+			return upnet.Record(&v, "1 OK 3 %s", id)
+		}, []string{"one two"}},
+		{"no-op", func(id string) string {
+			return upnet.Record(nil, "1 OK 3 %s noop", id)
+		}, nil},
+		{"batch", func(id string) string {
+			_, b := upnet.SplitCommand(upnet.Batch([]string{"one two", "", "3"}))
+			return upnet.Record(&b, "1 OK 3 %s batch", id)
+		}, []string{"one two", "", "3"}},
+	} {
+		g := &historyGroup{fakeGroup: fakeGroup{in: make(chan []byte),
+			out: make(chan []byte, 10)},
+			answer: tc.answer}
+		c := New(g)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		got, err := c.Read(ctx, 3)
+		cancel()
+		c.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: read %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// sealedGroup answers every signed request with an unsigned OK, a
+// forged one and a signed one, each naming a different instance.
+type sealedGroup struct {
+	fakeGroup
+	auth *upnet.Auth
+}
+
+func (g *sealedGroup) Send(b []byte) error {
+	b, how, err := g.auth.Open(b)
+	if err != nil || how != upnet.Signed {
+		return nil
+	}
+	m, err := upnet.Parse(b)
+	if err != nil {
+		return err
+	}
+	id := m.F[2]
+	forger := &upnet.Auth{Key: []byte("guess")}
+	g.out <- []byte(upnet.Record(nil, "0 OK 9 %s", id))
+	g.out <- []byte(forger.Seal(upnet.Record(nil, "0 OK 8 %s", id)))
+	g.out <- []byte(g.auth.Seal(upnet.Record(nil, "0 OK 1 %s", id)))
+	return nil
+}
+
+func TestSealed(t *testing.T) {
+	a := &upnet.Auth{Key: []byte("sesame")}
+	g := &sealedGroup{fakeGroup: fakeGroup{in: make(chan []byte),
+		out: make(chan []byte, 10)}, auth: a}
+	c := NewSealed(g, a)
+	defer c.Close()
+	c.Retry = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if i, err := c.Propose(ctx, "x"); err != nil || i != 1 {
+		t.Errorf("got %d, %v, want the signed answer", i, err)
+	}
+}
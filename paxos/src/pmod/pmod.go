@@ -0,0 +1,538 @@
+// Package pmod moderates a game of Paxos played by people in a chat
+// channel.  The players take the parts of proposers and acceptors,
+// saying the messages of Basic Paxos to the channel, and the
+// moderator keeps track of what each has said, objects to moves that
+// break the rules, and announces the value chosen.  Each change of
+// players starts a new game, with a new number G.
+//
+// The moderator talks through a Chat, and hears through Join, Part
+// and Said, or through Handle, which takes lines from an IRC server,
+// like those of package chat.
+package pmod
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Message formats:
+const proposalFormat = `
+G P propose
+        leader (AKA proposer) proposes number P for
+        game G
+`
+const promiseFormat = `
+G P promise Q V
+       acceptor promises not to accept proposal
+       with number less than P in game G, telling
+       proposer that value V has already been accepted
+       for proposal number Q in game G.  If Q and
+       V are absent, no value has been accepted yet.
+`
+const setFormat = `
+G P set V
+       leader asks acceptors to accept value
+       V for proposal number P in game G.  It should
+       be the V with the highest Q with a non-nil V,
+       or a V of the leaders chosing if no promise had
+       a non-nil V.
+`
+const acceptFormat = `
+G P accept V
+       acceptor accepts value V.  This acceptor will
+       accept a different value with a higher proposal
+       number, though, if one comes.
+`
+
+// A Chat is how the moderator talks, to the channel or to one player.
+type Chat interface {
+	Say(to, text string)
+}
+
+// IRC is a Chat that sends lines to an IRC server.
+type IRC func(line string)
+
+func (f IRC) Say(to, text string) {
+	f("PRIVMSG " + to + " :" + text)
+}
+
+type Promise struct {
+	acceptor string
+	proposal int64
+	val      *string
+}
+
+type Acceptor struct {
+	min       int64   // player promised not to accept proposals less than this
+	pAccepted int64   // proposal number of accepted value
+	aVal      *string // the accepted value itself
+}
+
+type Leader struct {
+	lProposed int64     // this Leader did issue this proposal number
+	lSet      *string   // this Leader did attempt to set this value
+	promises  []Promise // promises received from Acceptors
+	accepts   []string  // Players who have accepted proposed value
+}
+
+type Player struct {
+	id   int
+	nick string
+	seen int64 // largest proposal number observed so far
+	Acceptor
+	Leader
+}
+
+type PMod struct {
+	nick    string // the moderator's own
+	ircchan string // like "#pmodtesting"
+	chat    Chat
+	gameno  int64 // game instance number
+	players map[string]*Player
+	order   []string // the players' nicks, by id
+}
+
+// New returns a moderator named nick for the game in channel, which
+// starts with "#".
+func New(nick, channel string, c Chat) *PMod {
+	return &PMod{
+		nick:    nick,
+		ircchan: channel,
+		chat:    c,
+		players: make(map[string]*Player),
+	}
+}
+
+// Game returns the number of the game being played.
+func (pm *PMod) Game() int64 {
+	return pm.gameno
+}
+
+func (pm *PMod) csend(s string) {
+	pm.chat.Say(pm.ircchan, s)
+}
+
+func (pm *PMod) csendm(s string) {
+	for _, i := range strings.Split(s, "\n") {
+		if i == "" {
+			i = " "
+		}
+		pm.csend(i)
+	}
+}
+
+func (pm *PMod) newProposed(player *Player, p int64) {
+	player.lProposed = p
+	player.lSet = nil
+	player.promises = nil
+	player.accepts = nil
+}
+
+// proposer returns the player who proposed p, if any.
+func (pm *PMod) proposer(p int64) *Player {
+	for _, pl := range pm.players {
+		if pl.lProposed == p {
+			return pl
+		}
+	}
+	return nil
+}
+
+func (pm *PMod) playerlines() []string {
+	a := []string{fmt.Sprintf("%d players", len(pm.players))}
+	for _, nick := range pm.order {
+		v := pm.players[nick]
+		line := fmt.Sprintf("  id:%d nick:%-15s seen:%d promised:%d",
+			v.id, nick, v.seen, v.min)
+		if v.aVal != nil {
+			line += fmt.Sprintf(" accepted:%d %q", v.pAccepted, *v.aVal)
+		}
+		a = append(a, line)
+	}
+	return a
+}
+
+var helplines = []string{
+	"say these in the channel, where G is the game number and P a proposal number:",
+	"  G P propose          proposer: P must be your id modulo the number of players",
+	"  G P promise          acceptor: you will accept nothing below P, and accepted nothing yet",
+	"  G P promise Q V      acceptor: same, but you accepted V for proposal Q",
+	"  G P set V            proposer: after promises from a majority, V from the highest Q, if any",
+	"  G P accept V         acceptor: unless you promised a higher proposal",
+	"V is chosen when a majority accepts it for one proposal.",
+	"say \"status\" for the players, or \"help\" for this",
+}
+
+func (pm *PMod) maxProposal() int64 {
+	prop := int64(-1)
+	for _, p := range pm.players {
+		if p.seen > prop {
+			prop = p.seen
+		}
+	}
+	return prop
+}
+
+func (pm *PMod) majority() int {
+	return len(pm.players)/2 + 1
+}
+
+// returns:
+// 1. whether a quorum have promised to accept no lower proposal
+// 2. the Promise with the highest-number proposal accepted
+// 3. an explanation if 1. is false
+func (pm *PMod) quorumPromised(nick string, proposal int64) (bool, *Promise, string) {
+	pl, present := pm.players[nick]
+	if !present {
+		return false, nil, nick + " is not playing"
+	}
+	if pl.lProposed != proposal {
+		return false, nil, fmt.Sprintf("%s proposed %d, not %d", nick, pl.lProposed, proposal)
+	}
+	maj := pm.majority()
+	if len(pl.promises) < maj {
+		return false, nil, fmt.Sprintf("%s received only %d of %d required promises",
+			nick, len(pl.promises), maj)
+	}
+	var max *Promise
+	for k, v := range pl.promises {
+		if v.val != nil && (max == nil || v.proposal > max.proposal) {
+			max = &pl.promises[k]
+		}
+	}
+	return true, max, "ok"
+}
+
+// wasSet reports whether the proposer of prop set val.
+func (pm *PMod) wasSet(prop int64, val string) bool {
+	pl := pm.proposer(prop)
+	return pl != nil && pl.lSet != nil && *pl.lSet == val
+}
+
+func (pm *PMod) isInvalidProposal(f []string) bool {
+	return len(f) > 0
+}
+
+// empty value is OK, but a Q needs a V
+func (pm *PMod) isInvalidPromise(f []string) bool {
+	if len(f) == 0 {
+		return false
+	}
+	if _, err := strconv.ParseInt(f[0], 0, 64); err != nil {
+		return true
+	}
+	return len(f) < 2
+}
+
+// newgame starts the next game, from scratch.
+func (pm *PMod) newgame() {
+	pm.gameno++
+	for id, nick := range pm.order {
+		pm.players[nick] = &Player{
+			id:       id,
+			nick:     nick,
+			seen:     -1,
+			Acceptor: Acceptor{min: -1, pAccepted: -1},
+			Leader:   Leader{lProposed: -1},
+		}
+	}
+	pm.csend(fmt.Sprintf("NEW GAME: %d", pm.gameno))
+	for _, line := range pm.playerlines() {
+		pm.csend(line)
+	}
+}
+
+// Join adds a player, who has joined the channel, and starts a new
+// game.
+func (pm *PMod) Join(nick string) {
+	if _, present := pm.players[nick]; present || nick == pm.nick {
+		return
+	}
+	pm.players[nick] = nil
+	pm.order = append(pm.order, nick)
+	pm.newgame()
+}
+
+// Part removes a player, who has left the channel, and starts a new
+// game.
+func (pm *PMod) Part(nick string) {
+	if _, present := pm.players[nick]; !present {
+		return
+	}
+	delete(pm.players, nick)
+	for k, v := range pm.order {
+		if v == nick {
+			pm.order = append(pm.order[:k:k], pm.order[k+1:]...)
+			break
+		}
+	}
+	pm.newgame()
+}
+
+// Rename follows a player who changes nick.
+func (pm *PMod) Rename(nick, to string) {
+	pl, present := pm.players[nick]
+	if !present {
+		return
+	}
+	delete(pm.players, nick)
+	pl.nick = to
+	pm.players[to] = pl
+	pm.order[pl.id] = to
+	for _, v := range pm.players {
+		for k := range v.promises {
+			if v.promises[k].acceptor == nick {
+				v.promises[k].acceptor = to
+			}
+		}
+		for k := range v.accepts {
+			if v.accepts[k] == nick {
+				v.accepts[k] = to
+			}
+		}
+	}
+}
+
+// Said handles what nick said to the channel or to a nick.
+func (pm *PMod) Said(nick, to, text string) {
+	psend := func(s string) {
+		pm.chat.Say(nick, s)
+	}
+	f := strings.Fields(text)
+	if len(f) < 1 {
+		return
+	}
+	switch f[0] { // in case it's not a game message but a special command
+	case "status":
+		for _, line := range pm.playerlines() {
+			psend(line)
+		}
+		return
+	case "help":
+		for _, line := range helplines {
+			psend(line)
+		}
+		return
+	}
+	if to != pm.ircchan {
+		psend("we're talking in " + pm.ircchan + ".  say \"help\" for help.")
+		return
+	}
+	if len(f) < 3 {
+		return // just chatting
+	}
+	game, proposal, op := f[0], f[1], f[2]
+	g, err := strconv.ParseInt(game, 0, 64)
+	if err != nil {
+		return // just chatting
+	}
+	if g != pm.gameno {
+		pm.csend(fmt.Sprintf("please ignore %s saying \"%s\".  we're playing game %d",
+			nick, text, pm.gameno))
+		return
+	}
+	p, err := strconv.ParseInt(proposal, 0, 64)
+	if err != nil {
+		pm.csend(fmt.Sprintf("hmm.  \"%s\" doesn't look like a proposal number.",
+			proposal))
+		pm.csend(fmt.Sprintf("the max proposal number used for game %d was %d.",
+			pm.gameno, pm.maxProposal()))
+		return
+	}
+	talker, present := pm.players[nick]
+	if !present {
+		pm.csend(nick + ": you're not playing.  try re-joining " + pm.ircchan)
+		return
+	}
+	switch op {
+	case "propose":
+		pm.propose(talker, p, f[3:])
+	case "promise":
+		pm.promise(talker, p, f[3:])
+	case "set":
+		pm.set(talker, p, strings.Join(f[3:], " "))
+	case "accept":
+		pm.accept(talker, p, strings.Join(f[3:], " "))
+	default:
+		pm.csend("unknown operation: " + op)
+	}
+}
+
+func (pm *PMod) propose(pl *Player, p int64, f []string) {
+	nick := pl.nick
+	if pm.isInvalidProposal(f) {
+		pm.csend(fmt.Sprintf("uh, %s, the format for proposals is:", nick))
+		pm.csendm(proposalFormat)
+		return
+	}
+	if p < 0 || p%int64(len(pm.players)) != int64(pl.id) {
+		rsp := nick + ": you can only use proposal numbers that are "
+		rsp += fmt.Sprintf("%d modulo %d", pl.id, len(pm.players))
+		pm.csend(rsp)
+		pm.csend("everybody ignore " + nick + "'s proposal, please")
+		pm.csend("It's like that didn't happen.")
+		return
+	}
+	if pl.lProposed >= p {
+		pm.csend(fmt.Sprintf("%s: %s %d when you already proposed %d?",
+			nick, "why are you proposing", p, pl.lProposed))
+		pm.csend(fmt.Sprintf("folks, please forget %s mentioned %d",
+			nick, p))
+		return
+	}
+	pm.newProposed(pl, p)
+	for _, v := range pm.players {
+		if p > v.seen {
+			v.seen = p
+		}
+	}
+}
+
+func (pm *PMod) promise(pl *Player, p int64, f []string) {
+	nick := pl.nick
+	if pm.isInvalidPromise(f) {
+		pm.csend(fmt.Sprintf("well, %s, the format for promises is:", nick))
+		pm.csendm(promiseFormat)
+		return
+	}
+	leader := pm.proposer(p)
+	if leader == nil {
+		pm.csend(fmt.Sprintf("hey, %s!  %d was never proposed", nick, p))
+		return
+	}
+	if pl.aVal == nil && len(f) > 0 {
+		pm.csend(fmt.Sprintf("%s, you haven't accepted anything, so just say \"%d %d promise\"",
+			nick, pm.gameno, p))
+		return
+	}
+	if pl.aVal != nil {
+		ok := len(f) > 1
+		if ok {
+			q, _ := strconv.ParseInt(f[0], 0, 64)
+			ok = q == pl.pAccepted && strings.Join(f[1:], " ") == *pl.aVal
+		}
+		if !ok {
+			pm.csend(fmt.Sprintf("%s, you have to tell %s what you accepted, like this:",
+				nick, leader.nick))
+			pm.csend(fmt.Sprintf("%d %d promise %d %s", pm.gameno, p, pl.pAccepted, *pl.aVal))
+			return
+		}
+	}
+	if pl.min > p {
+		pm.csend(fmt.Sprintf("%s has already promised not to accept proposals below %d",
+			nick, pl.min))
+		pm.csend(fmt.Sprintf("so ... although not illegal, it's weird to promise for %d",
+			p))
+	} else {
+		pl.min = p
+	}
+	pr := Promise{acceptor: nick, proposal: pl.pAccepted, val: pl.aVal}
+	for k, v := range leader.promises {
+		if v.acceptor == nick {
+			leader.promises[k] = pr
+			return
+		}
+	}
+	leader.promises = append(leader.promises, pr)
+}
+
+func (pm *PMod) set(pl *Player, p int64, val string) {
+	nick := pl.nick
+	if val == "" {
+		pm.csend(fmt.Sprintf("%s, the format for setting a value is:", nick))
+		pm.csendm(setFormat)
+		return
+	}
+	q, accepted, why := pm.quorumPromised(nick, p)
+	if !q {
+		pm.csend(fmt.Sprintf("%s can't set a value until a majority has promised on proposal %d", nick, p))
+		pm.csend("  " + why)
+		return
+	}
+	if accepted != nil && *accepted.val != val {
+		pm.csend(fmt.Sprintf("%s, you have to set the value below, because it was accepted by %s as proposal %d", nick, accepted.acceptor, accepted.proposal))
+		pm.csend("\"" + *accepted.val + "\"")
+		return
+	}
+	if pl.lSet != nil && *pl.lSet != val {
+		pm.csend(fmt.Sprintf("%s, you already set \"%s\" for proposal %d", nick, *pl.lSet, p))
+		return
+	}
+	pl.lSet = &val
+	// now it's up to the acceptors to accept
+}
+
+func (pm *PMod) accept(a *Player, p int64, val string) {
+	nick := a.nick
+	if val == "" {
+		pm.csend(fmt.Sprintf("%s, the format for accepting a value is:", nick))
+		pm.csendm(acceptFormat)
+		return
+	}
+	if !pm.wasSet(p, val) {
+		pm.csend(fmt.Sprintf("%s can't accept value for proposal %d that was never set",
+			nick, p))
+		return
+	}
+	if a.min > p {
+		pm.csend(fmt.Sprintf("%s, you promised not to accept any proposal less than %d", nick, a.min))
+		return
+	}
+	a.min = p
+	a.pAccepted = p
+	a.aVal = &val
+
+	leader := pm.proposer(p)
+	for _, v := range leader.accepts {
+		if v == nick {
+			return
+		}
+	}
+	leader.accepts = append(leader.accepts, nick)
+	if len(leader.accepts) >= pm.majority() {
+		pm.csend(fmt.Sprintf("CHOSEN in game %d: \"%s\", accepted by %s for proposal %d",
+			pm.gameno, val, strings.Join(leader.accepts, ", "), p))
+		pm.newgame()
+	}
+}
+
+var lineRE = regexp.MustCompile(`^:([^!\s]+)!~?(\S+?)@(\S+?)\s+(\S+)\s*(.*)`)
+
+// Handle handles a line from an IRC server, like
+//
+//	:wowowowowon!~ecashin@hosty.example.com JOIN #pmodtesting
+//	:wowowowowon!~ecashin@hosty.example.com PRIVMSG #pmodtesting :hello there
+//
+// and reports whether it was one that the game cares about.
+func (pm *PMod) Handle(line string) bool {
+	g := lineRE.FindStringSubmatch(line)
+	if g == nil {
+		return false
+	}
+	nick, op, rest := g[1], g[4], g[5]
+	to, text, _ := strings.Cut(rest, " :")
+	to = strings.TrimPrefix(strings.TrimSpace(to), ":")
+	switch op {
+	case "JOIN":
+		if to != pm.ircchan {
+			return false
+		}
+		pm.Join(nick)
+	case "PART":
+		if to != pm.ircchan {
+			return false
+		}
+		pm.Part(nick)
+	case "QUIT":
+		pm.Part(nick)
+	case "NICK":
+		pm.Rename(nick, strings.TrimPrefix(rest, ":"))
+	case "PRIVMSG":
+		pm.Said(nick, to, text)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package pmod
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"chat"
+)
+
+// said is a Chat that keeps what the moderator says.
+type said struct {
+	lines []string
+}
+
+func (s *said) Say(to, text string) {
+	s.lines = append(s.lines, to+" "+text)
+}
+
+// since returns what was said since the last call, and forgets it.
+func (s *said) since() string {
+	r := strings.Join(s.lines, "\n")
+	s.lines = nil
+	return r
+}
+
+type game struct {
+	t  *testing.T
+	pm *PMod
+	c  *said
+}
+
+func newGame(t *testing.T, nicks ...string) *game {
+	g := &game{t: t, c: &said{}}
+	g.pm = New("pmod", "#p", g.c)
+	for _, n := range nicks {
+		g.pm.Join(n)
+	}
+	g.c.since()
+	return g
+}
+
+// say has nick say each move in the channel, and checks that the
+// moderator says nothing but what contains want.
+func (g *game) say(nick, move, want string) {
+	g.t.Helper()
+	g.pm.Said(nick, "#p", move)
+	got := g.c.since()
+	if want == "" && got != "" || !strings.Contains(got, want) {
+		g.t.Errorf("%s: %q: moderator said %q, want %q", nick, move, got, want)
+	}
+}
+
+func TestGame(t *testing.T) {
+	g := newGame(t, "ann", "bob", "cat")
+	if g.pm.Game() != 3 {
+		t.Fatalf("game %d after three joins", g.pm.Game())
+	}
+	g.say("ann", "3 0 propose", "")
+	g.say("bob", "3 0 set x", "bob proposed -1, not 0")
+	g.say("ann", "3 0 set x", "only 0 of 2")
+	g.say("bob", "3 0 promise", "")
+	g.say("bob", "3 0 promise", "")
+	g.say("ann", "3 0 set x", "only 1 of 2")
+	g.say("cat", "3 0 promise", "")
+	g.say("bob", "3 0 accept y", "never set")
+	g.say("ann", "3 0 set x", "")
+	g.say("bob", "3 0 accept x", "")
+	g.say("bob", "3 0 accept x", "")
+	g.say("cat", "3 0 accept x", `CHOSEN in game 3: "x"`)
+	if g.pm.Game() != 4 {
+		t.Errorf("game %d after a choice", g.pm.Game())
+	}
+}
+
+// TestRules has players break the rules, and a second proposer who
+// must set the value a first one got accepted.
+func TestRules(t *testing.T) {
+	g := newGame(t, "ann", "bob", "cat")
+	g.say("ann", "2 0 propose", "we're playing game 3")
+	g.say("ann", "3 1 propose", "0 modulo 3")
+	g.say("dan", "3 0 propose", "not playing")
+	g.say("ann", "3 0 propose", "")
+	g.say("ann", "3 0 propose", "already proposed 0")
+	g.say("bob", "3 0 promise 1", "format for promises")
+	g.say("bob", "3 0 promise", "")
+	g.say("cat", "3 0 promise", "")
+	g.say("ann", "3 0 set x", "")
+	g.say("ann", "3 0 set y", "already set")
+	g.say("bob", "3 0 accept x", "")
+
+	g.say("cat", "3 2 propose", "")
+	g.say("bob", "3 2 promise", "3 2 promise 0 x")
+	g.say("bob", "3 2 promise 0 y", "3 2 promise 0 x")
+	g.say("bob", "3 2 promise 0 x", "")
+	g.say("ann", "3 2 promise 0 x", "haven't accepted anything")
+	g.say("ann", "3 2 promise", "")
+	g.say("cat", "3 2 set y", `accepted by bob as proposal 0`)
+	g.say("cat", "3 2 set x", "")
+	g.say("ann", "3 0 accept x", "promised not to accept any proposal less than 2")
+	g.say("ann", "3 2 accept x", "")
+	g.say("cat", "3 2 accept x", `CHOSEN in game 3: "x", accepted by ann, cat for proposal 2`)
+
+	g.pm.Said("ann", "pmod", "3 4 propose")
+	if got := g.c.since(); !strings.HasPrefix(got, "ann we're talking in #p") {
+		t.Errorf("private move: moderator said %q", got)
+	}
+	g.pm.Said("ann", "#p", "hello, everyone")
+	if got := g.c.since(); got != "" {
+		t.Errorf("chatting: moderator said %q", got)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	g := newGame(t)
+	for _, line := range []string{
+		":pmod!~pmod@h JOIN #p",
+		":ann!~ann@h JOIN #p",
+		":bob!bob@h JOIN #p",
+		":bob!bob@h JOIN #other",
+		":cat!~cat@h JOIN #p",
+		":cat!~cat@h PART #p :bye",
+		":ann!~ann@h NICK :amy",
+		":amy!~amy@h PRIVMSG #p :4 0 propose",
+	} {
+		g.pm.Handle(line)
+	}
+	if got, want := strings.Join(g.pm.order, " "), "amy bob"; got != want {
+		t.Errorf("players %q, want %q", got, want)
+	}
+	if p := g.pm.proposer(0); p == nil || p.nick != "amy" {
+		t.Errorf("proposer of 0 is %v", p)
+	}
+	if g.pm.Handle("PING :x") || g.pm.Handle(":x 001 pmod :hi") {
+		t.Error("handled a line from the server")
+	}
+}
+
+// TestChat plays a game over a chat server, as in a classroom.
+func TestChat(t *testing.T) {
+	s := chat.NewServer("test")
+	s.Log = log.New(io.Discard, "", 0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+	addr := l.Addr().String()
+
+	bot, err := chat.Dial(addr, "pmod", "pmod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bot.Close()
+	pm := New("pmod", "#p", IRC(func(line string) { bot.Send(line) }))
+	bot.Send("JOIN #p")
+	go func() {
+		for line := range bot.Lines {
+			pm.Handle(line)
+		}
+	}()
+
+	players := map[string]*chat.Client{}
+	for _, n := range []string{"ann", "bob"} {
+		c, err := chat.Dial(addr, n, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Send("JOIN #p")
+		players[n] = c
+	}
+	ann, bob := players["ann"], players["bob"]
+	expect(t, ann.Lines, "NEW GAME: 2")
+
+	// each waits for status, so that the moderator has heard its move
+	move := func(c *chat.Client, m string) {
+		c.Send("PRIVMSG #p :" + m)
+		c.Send("PRIVMSG pmod :status")
+		expect(t, c.Lines, "PRIVMSG "+c.Nick+" :2 players")
+	}
+	move(ann, "2 0 propose")
+	move(ann, "2 0 promise")
+	move(bob, "2 0 promise")
+	move(ann, "2 0 set hello")
+	move(ann, "2 0 accept hello")
+	bob.Send("PRIVMSG #p :2 0 accept hello")
+	expect(t, ann.Lines, `CHOSEN in game 2: "hello"`)
+	expect(t, bob.Lines, "NEW GAME: 3")
+}
+
+// expect reads lines until one contains want, or fails the test.
+func expect(t *testing.T, lines <-chan string, want string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			if strings.Contains(line, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no %q", want)
+		}
+	}
+}
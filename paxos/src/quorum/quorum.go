@@ -0,0 +1,142 @@
+// Package quorum says which sets of participants are quorums.
+//
+// Paxos is safe as long as every phase-1 quorum intersects every
+// phase-2 quorum (Flexible Paxos, Howard, Malkhi and Spiegelman,
+// 2016).  Majorities do that, but so does a larger phase 1 with a
+// smaller phase 2, which makes values chosen sooner at the cost of
+// leader changes, and so do the rows and columns of a grid.
+package quorum
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A System decides quorums from the set of participant IDs heard from.
+type System interface {
+	Phase1(ids map[int64]bool) bool // enough promises
+	Phase2(ids map[int64]bool) bool // enough accepts
+	String() string
+}
+
+// Sizes counts: any Q1 of the N participants are a phase-1 quorum,
+// and any Q2 are a phase-2 quorum.
+type Sizes struct {
+	N, Q1, Q2 int
+}
+
+func Majority(n int) Sizes {
+	return Sizes{n, n/2 + 1, n/2 + 1}
+}
+
+func (s Sizes) Phase1(ids map[int64]bool) bool { return len(ids) >= s.Q1 }
+func (s Sizes) Phase2(ids map[int64]bool) bool { return len(ids) >= s.Q2 }
+
+func (s Sizes) String() string {
+	return fmt.Sprintf("q1=%d,q2=%d", s.Q1, s.Q2)
+}
+
+// Check says why the sizes are unsafe, if they are.
+func (s Sizes) Check() error {
+	if s.Q1 < 1 || s.Q2 < 1 || s.Q1 > s.N || s.Q2 > s.N {
+		return fmt.Errorf("quorum: %v out of range for %d participants",
+			s, s.N)
+	}
+	if s.Q1+s.Q2 <= s.N {
+		return fmt.Errorf("quorum: %v do not intersect: Q1+Q2 must exceed %d",
+			s, s.N)
+	}
+	return nil
+}
+
+// Grid lays out participants row by row, so ID i is in row i/Cols and
+// column i%Cols.  A phase-1 quorum is every participant in some row,
+// and a phase-2 quorum is every participant in some column, so every
+// phase-1 quorum shares one participant with every phase-2 quorum.
+type Grid struct {
+	Rows, Cols int
+}
+
+func (g Grid) Phase1(ids map[int64]bool) bool {
+	for r := 0; r < g.Rows; r++ {
+		if g.full(ids, r*g.Cols, 1, g.Cols) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g Grid) Phase2(ids map[int64]bool) bool {
+	for c := 0; c < g.Cols; c++ {
+		if g.full(ids, c, g.Cols, g.Rows) {
+			return true
+		}
+	}
+	return false
+}
+
+// full says whether ids has all n IDs from first on, step apart.
+func (g Grid) full(ids map[int64]bool, first, step, n int) bool {
+	for k := 0; k < n; k++ {
+		if !ids[int64(first+k*step)] {
+			return false
+		}
+	}
+	return true
+}
+
+func (g Grid) String() string {
+	return fmt.Sprintf("grid=%dx%d", g.Rows, g.Cols)
+}
+
+// Parse makes a System for n participants from a flag value:
+//
+//	majority	  a majority for both phases
+//	q1=4,q2=2	  sizes, and either one alone gets the smallest safe other
+//	grid=2x3	  rows of a grid for phase 1, columns for phase 2
+func Parse(s string, n int) (System, error) {
+	if s == "" || s == "majority" {
+		return Majority(n), nil
+	}
+	if strings.HasPrefix(s, "grid=") {
+		var g Grid
+		_, err := fmt.Sscanf(s, "grid=%dx%d", &g.Rows, &g.Cols)
+		if err != nil || g.Rows < 1 || g.Cols < 1 {
+			return nil, fmt.Errorf("quorum: want grid=RxC, not %q", s)
+		}
+		if g.Rows*g.Cols != n {
+			return nil, fmt.Errorf("quorum: %v is not %d participants",
+				g, n)
+		}
+		return g, nil
+	}
+	sz := Sizes{N: n}
+	for _, kv := range strings.Split(s, ",") {
+		f := strings.SplitN(kv, "=", 2)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("quorum: want q1=N or q2=N, not %q", kv)
+		}
+		q, err := strconv.Atoi(f[1])
+		if err != nil {
+			return nil, fmt.Errorf("quorum: %q: %s", kv, err)
+		}
+		switch f[0] {
+		case "q1":
+			sz.Q1 = q
+		case "q2":
+			sz.Q2 = q
+		default:
+			return nil, fmt.Errorf("quorum: want q1=N or q2=N, not %q", kv)
+		}
+	}
+	if sz.Q1 == 0 {
+		sz.Q1 = n - sz.Q2 + 1
+	} else if sz.Q2 == 0 {
+		sz.Q2 = n - sz.Q1 + 1
+	}
+	if err := sz.Check(); err != nil {
+		return nil, err
+	}
+	return sz, nil
+}
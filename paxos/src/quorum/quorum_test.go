@@ -0,0 +1,88 @@
+package quorum
+
+import (
+	"testing"
+)
+
+// set returns the IDs whose bits are set in bits.
+func set(bits, n int) map[int64]bool {
+	ids := make(map[int64]bool)
+	for i := 0; i < n; i++ {
+		if bits&(1<<uint(i)) != 0 {
+			ids[int64(i)] = true
+		}
+	}
+	return ids
+}
+
+// intersect checks every phase-1 quorum of n against every phase-2
+// quorum, and returns a pair that share no one, if there is one.
+func intersect(s System, n int) (int, int, bool) {
+	for a := 0; a < 1<<uint(n); a++ {
+		if !s.Phase1(set(a, n)) {
+			continue
+		}
+		for b := 0; b < 1<<uint(n); b++ {
+			if s.Phase2(set(b, n)) && a&b == 0 {
+				return a, b, false
+			}
+		}
+	}
+	return 0, 0, true
+}
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		spec string
+		n    int
+		want string
+	}{
+		{"", 5, "q1=3,q2=3"},
+		{"majority", 4, "q1=3,q2=3"},
+		{"q1=4,q2=2", 5, "q1=4,q2=2"},
+		{"q1=5", 5, "q1=5,q2=1"},
+		{"q2=2", 6, "q1=5,q2=2"},
+		{"grid=2x3", 6, "grid=2x3"},
+	} {
+		s, err := Parse(c.spec, c.n)
+		if err != nil {
+			t.Errorf("%q: %s", c.spec, err)
+			continue
+		}
+		if s.String() != c.want {
+			t.Errorf("%q of %d is %v, not %s", c.spec, c.n, s, c.want)
+		}
+		if a, b, ok := intersect(s, c.n); !ok {
+			t.Errorf("%v: %b and %b do not intersect", s, a, b)
+		}
+	}
+}
+
+func TestUnsafe(t *testing.T) {
+	for _, spec := range []string{
+		"q1=3,q2=2", "q1=6", "q2=0", "q1=x", "q3=1", "grid=2x2", "grid=3",
+	} {
+		if s, err := Parse(spec, 5); err == nil {
+			t.Errorf("%q of 5 gave %v", spec, s)
+		}
+	}
+	// the check is what keeps these from being used
+	if _, _, ok := intersect(Sizes{5, 3, 2}, 5); ok {
+		t.Error("q1=3,q2=2 of 5 should not intersect")
+	}
+}
+
+func TestGrid(t *testing.T) {
+	g := Grid{2, 3}
+	row := map[int64]bool{3: true, 4: true, 5: true}
+	col := map[int64]bool{1: true, 4: true}
+	if !g.Phase1(row) || g.Phase2(row) {
+		t.Error("a row is a phase-1 quorum only")
+	}
+	if !g.Phase2(col) || g.Phase1(col) {
+		t.Error("a column is a phase-2 quorum only")
+	}
+	if g.Phase1(map[int64]bool{0: true, 1: true, 5: true}) {
+		t.Error("three IDs not in one row made a phase-1 quorum")
+	}
+}
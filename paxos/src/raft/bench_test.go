@@ -0,0 +1,60 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"paxosclient"
+	"rsm"
+	"simnet"
+)
+
+// BenchmarkRaft has ten clients propose at once on a network that
+// delays each copy of a message up to a millisecond, the workload of
+// upaxos's BenchmarkBatch, and reports how many values are committed a
+// second and how many messages each one takes.
+func BenchmarkRaft(b *testing.B) {
+	c := simConfig(3)
+	c.Heartbeat = 20 * time.Millisecond
+	c.Election = 200 * time.Millisecond
+	s := newSim(c, simnet.Config{MaxDelay: time.Millisecond}, 1)
+	defer s.Close()
+
+	const clients = 10
+	cls := make([]*paxosclient.Client, clients)
+	for k := range cls {
+		cls[k] = paxosclient.New(s.Net.Join(100 + k))
+		defer cls[k].Close()
+		cls[k].Retry = 200 * time.Millisecond
+	}
+	ctx := context.Background()
+	// the first value waits out the election
+	if _, err := cls[0].Propose(ctx, rsm.Set("k", "warm")); err != nil {
+		b.Fatal(err)
+	}
+	sent, _ := s.Net.Sent()
+	b.ResetTimer()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for k, cl := range cls {
+		wg.Add(1)
+		go func(k int, cl *paxosclient.Client) {
+			defer wg.Done()
+			for i := k; i < b.N; i += clients {
+				v := rsm.Set(fmt.Sprint("k", k), fmt.Sprint(i))
+				if _, err := cl.Propose(ctx, v); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(k, cl)
+	}
+	wg.Wait()
+	b.StopTimer()
+	after, _ := s.Net.Sent()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "values/s")
+	b.ReportMetric(float64(after-sent)/float64(b.N), "msgs/op")
+}
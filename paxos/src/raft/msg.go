@@ -0,0 +1,121 @@
+package raft
+
+import (
+	"fmt"
+	"strconv"
+
+	"upnet"
+)
+
+// An entry is a command in the log, with the term of the leader that
+// added it.
+type entry struct {
+	term int64
+	cmd  string
+}
+
+// Server message formats, where S is the sender and T its term:
+//
+//	S Vote T LASTI LASTT		candidate S asks for votes
+//	S Voted T C G			to candidate C, G is 1 if granted
+//	S Append T F PREVI PREVT COMMIT [LEN:ENTRIES]
+//					leader S to follower F
+//	S Appended T L OK MATCH		to leader L
+//
+// ENTRIES follow PREVI, as "!batch LEN:E LEN:E ..." with each E
+// "TERM CMD".  A heartbeat has none.  OK is 1 if the follower's log
+// matched at PREVI, and MATCH is its last index that matches the
+// leader's, or on a mismatch, where the leader might try next.
+type rmsg struct {
+	typ  string
+	s, t int64
+	to   int64 // C, F or L
+
+	lastI, lastT int64 // Vote
+	granted      bool  // Voted
+
+	prevI, prevT, commit int64 // Append
+	entries              []entry
+
+	ok    bool // Appended
+	match int64
+}
+
+// fields is how many fields each type has.
+var fields = map[string]int{
+	"Vote":     5,
+	"Voted":    5,
+	"Append":   7,
+	"Appended": 6,
+}
+
+func parse(m upnet.Msg) (r rmsg, err error) {
+	f := m.F
+	if len(f) < 2 || fields[f[1]] == 0 {
+		return r, fmt.Errorf("not a server message")
+	}
+	if len(f) != fields[f[1]] {
+		return r, fmt.Errorf("%s with %d fields", f[1], len(f))
+	}
+	r.typ = f[1]
+	num := func(k int) int64 {
+		n, perr := strconv.ParseInt(f[k], 10, 64)
+		if perr != nil && err == nil {
+			err = fmt.Errorf("bad number %q in %s", f[k], r.typ)
+		}
+		return n
+	}
+	r.s = num(0)
+	r.t = num(2)
+	switch r.typ {
+	case "Vote":
+		r.lastI, r.lastT = num(3), num(4)
+	case "Voted":
+		r.to = num(3)
+		r.granted = f[4] == "1"
+	case "Append":
+		r.to = num(3)
+		r.prevI, r.prevT, r.commit = num(4), num(5), num(6)
+		if m.V != nil && err == nil {
+			r.entries, err = splitEntries(*m.V)
+		}
+	case "Appended":
+		r.to = num(3)
+		r.ok = f[4] == "1"
+		r.match = num(5)
+	}
+	return r, err
+}
+
+func joinEntries(es []entry) *string {
+	if len(es) == 0 {
+		return nil
+	}
+	cmds := make([]string, len(es))
+	for k, e := range es {
+		cmds[k] = upnet.Command(fmt.Sprint(e.term), e.cmd)
+	}
+	s := upnet.Batch(cmds)
+	return &s
+}
+
+func splitEntries(s string) ([]entry, error) {
+	id, v := upnet.SplitCommand(s)
+	if id != upnet.BatchID {
+		return nil, fmt.Errorf("entries not in a batch")
+	}
+	cmds, err := upnet.SplitBatch(v)
+	if err != nil {
+		return nil, err
+	}
+	es := make([]entry, len(cmds))
+	for k, c := range cmds {
+		t, cmd := upnet.SplitCommand(c)
+		term, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad entry term %q", t)
+		}
+		es[k] = entry{term, cmd}
+	}
+	return es, nil
+}
@@ -0,0 +1,109 @@
+// Package raft is a Raft server that talks over the same unreliable
+// broadcast channel as upaxos, and answers the same client requests,
+// so that the two can be compared on the same workloads.  Each
+// server is a follower, a candidate or the leader:
+//
+//	follower:  handles Vote, Append; sends Voted, Appended, and
+//		   becomes a candidate when it hears no leader
+//	candidate: sends Vote, and leads once a majority voted for it
+//	leader:	   handles Request and Appended; sends Append to each
+//		   follower with the entries it lacks, or a heartbeat
+//
+// Messages to one server go to everyone, with the server they are
+// for, since the channel is a broadcast.  Each server applies
+// committed entries to its state machine in log order, and answers
+// history requests and queries as the upaxos learner does.
+package raft
+
+import (
+	"log"
+	"time"
+
+	"rsm"
+	"stable"
+	"upnet"
+	"upnode"
+)
+
+const DefaultHeartbeat = 100 * time.Millisecond
+const DefaultElection = 500 * time.Millisecond
+
+type Config struct {
+	ID int // this server
+	N  int // servers in the group
+
+	// The leader sends heartbeats this often.  A follower that hears
+	// no leader for a random time between Election and twice that
+	// becomes a candidate.
+	Heartbeat time.Duration
+	Election  time.Duration
+
+	// Each message type has its own rate limit, in messages a
+	// second.  Types not in Rates are not limited.
+	Rates map[string]float64
+
+	// With a group key, only clients' requests may go unsigned.
+	// With either key, admin commands need the admin key.
+	Auth *upnet.Auth
+
+	Log *log.Logger // debugging output, the standard logger if nil
+
+	// OnApply, if set, is called with each committed entry as it is
+	// applied, in log order.
+	OnApply func(i int64, cmd string)
+}
+
+type Node struct {
+	Config
+
+	proc  *upnode.Process
+	store stable.Log
+	sm    rsm.StateMachine
+}
+
+// New returns a server that talks over conn, keeps its log in store,
+// and applies committed entries to sm.
+func New(c Config, conn upnet.Conn, store stable.Log, sm rsm.StateMachine) *Node {
+	if c.Heartbeat == 0 {
+		c.Heartbeat = DefaultHeartbeat
+	}
+	if c.Election == 0 {
+		c.Election = DefaultElection
+	}
+	if c.Auth == nil {
+		c.Auth = &upnet.Auth{}
+	}
+	if c.Log == nil {
+		c.Log = log.Default()
+	}
+	return &Node{
+		Config: c,
+		proc: upnode.New(upnode.Config{ID: c.ID, Auth: c.Auth, Log: c.Log,
+			Rates: c.Rates}, conn),
+		store: store,
+		sm:    sm,
+	}
+}
+
+// Start recovers from the log and starts the server.
+func (n *Node) Start() {
+	s := newServer(n)
+	lr := n.store.Log()
+	s.load(lr)
+	lr.Close()
+
+	serverc := make(chan upnet.Msg)
+	n.proc.Run(func() { s.run(serverc) })
+	n.proc.Listen(serverc)
+}
+
+// Close stops the server and closes the channel.
+func (n *Node) Close() error {
+	return n.proc.Close()
+}
+
+// Wait returns when an admin command tells the server to quit, or
+// when it is closed.
+func (n *Node) Wait() {
+	n.proc.Wait()
+}
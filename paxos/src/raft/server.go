@@ -0,0 +1,539 @@
+package raft
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"stable"
+	"upnet"
+)
+
+const (
+	follower = iota
+	candidate
+	leader
+)
+
+// none is the vote or leader when there is none.
+const none = -1
+
+// noOpID is the request ID of the no-op a new leader appends, so
+// that it can commit the entries of earlier terms.
+const noOpID = "!noop"
+
+// maxAppend bounds the bytes of entries in one Append, so that it
+// fits in a packet.
+const maxAppend = 4000
+
+// server owns all the Raft state, in one goroutine.
+type server struct {
+	*Node
+	lf  *log.Logger
+	rng *rand.Rand
+
+	// These survive a restart.
+	term     int64
+	votedFor int64
+	log      []entry // log[0] is a placeholder; entries start at 1
+
+	commit, applied int64
+	role            int
+	leader          int64
+	heard           time.Time // when a follower last heard the leader
+	deadline        time.Time // when to start an election
+
+	votes map[int64]bool // for a candidate
+	next  map[int64]int64
+	match map[int64]int64
+	acked map[int64]time.Time // when each follower last answered
+
+	ids       map[string]int64 // the index of each request ID in the log
+	appliedAt map[string]int64 // where each request ID was first applied
+}
+
+func newServer(n *Node) *server {
+	return &server{
+		Node:      n,
+		lf:        log.New(n.store, fmt.Sprintf("%d: ", n.ID), 0),
+		rng:       rand.New(rand.NewSource(time.Now().UnixNano() + int64(n.ID))),
+		votedFor:  none,
+		log:       []entry{{}},
+		leader:    none,
+		ids:       make(map[string]int64),
+		appliedAt: make(map[string]int64),
+	}
+}
+
+func (s *server) majority() int {
+	return s.N/2 + 1
+}
+
+func (s *server) lastIndex() int64 {
+	return int64(len(s.log) - 1)
+}
+
+func (s *server) lastTerm() int64 {
+	return s.log[len(s.log)-1].term
+}
+
+// record writes a version 1 record to the log.
+func (s *server) record(v *string, format string, a ...interface{}) {
+	s.lf.Print(upnet.Record(v, format, a...) + "\n")
+}
+
+func (s *server) bcast(v *string, format string, a ...interface{}) {
+	s.proc.Send(upnet.Record(v, "%d "+format,
+		append([]interface{}{s.ID}, a...)...))
+}
+
+// load recovers the term, vote and log.  A log record at index I
+// replaces any entries from I on, as the truncation did.  The
+// recovery log itself is truncated after its last good record, so
+// that what the server logs next does not follow a torn one.
+func (s *server) load(lf io.Reader) {
+	br := stable.NewReader(lf)
+	var good int64 // where the last good record ends
+	for {
+		good = br.Offset()
+		if _, err := br.ReadString(' '); err != nil { // ID prefix
+			break
+		}
+		if b, _ := br.Peek(len(upnet.Version) + 1); string(b) != upnet.Version+" " {
+			if _, err := br.ReadString('\n'); err != nil {
+				break
+			}
+			continue
+		}
+		br.Discard(len(upnet.Version) + 1)
+		m, err := upnet.ReadRecord(br.Reader)
+		if err != nil {
+			s.Log.Printf("stopping at bad log record: %s", err)
+			break
+		}
+		if len(m.F) != 3 {
+			continue
+		}
+		num := func(k int) int64 {
+			n, err := strconv.ParseInt(m.F[k], 10, 64)
+			if err != nil {
+				log.Panicf("bad log record %v", m.F)
+			}
+			return n
+		}
+		switch m.F[0] {
+		case "term":
+			s.term, s.votedFor = num(1), num(2)
+		case "entry":
+			i := num(1)
+			if i < 1 || i > s.lastIndex()+1 || m.V == nil {
+				log.Panicf("bad log record %v", m.F)
+			}
+			s.truncate(i)
+			s.add(entry{num(2), *m.V})
+		}
+	}
+	stable.MustTruncate(s.store, good)
+	s.record(nil, "starting %d", s.ID)
+	s.heard = time.Now()
+	s.resetElection()
+}
+
+// setTerm moves to a later term, as a follower with no vote yet.
+func (s *server) setTerm(t int64) {
+	if t > s.term {
+		s.term, s.votedFor = t, none
+		s.record(nil, "term %d %d", s.term, s.votedFor)
+		stable.MustSync(s.store)
+	}
+	if s.role != follower {
+		s.Log.Printf("following in term %d", s.term)
+	}
+	s.role = follower
+	s.leader = none
+}
+
+func (s *server) resetElection() {
+	d := s.Election + time.Duration(s.rng.Int63n(int64(s.Election)))
+	s.deadline = time.Now().Add(d)
+}
+
+// add appends e to the log.  It is durable once synced.
+func (s *server) add(e entry) {
+	s.log = append(s.log, e)
+	i := s.lastIndex()
+	if id, _ := upnet.SplitCommand(e.cmd); id != upnet.NoID && id != noOpID {
+		s.ids[id] = i
+	}
+}
+
+// truncate removes the entries from i on.
+func (s *server) truncate(i int64) {
+	if i <= s.commit {
+		log.Panicf("truncating committed entry %d", i)
+	}
+	for k := i; k <= s.lastIndex(); k++ {
+		id, _ := upnet.SplitCommand(s.log[k].cmd)
+		if j, ok := s.ids[id]; ok && j == k {
+			delete(s.ids, id)
+		}
+	}
+	s.log = s.log[:i]
+}
+
+func (s *server) append(e entry) {
+	s.add(e)
+	s.record(&e.cmd, "entry %d %d", s.lastIndex(), e.term)
+}
+
+func (s *server) run(c chan upnet.Msg) {
+	tick := time.NewTicker(s.Heartbeat)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.proc.Done():
+			return
+		case now := <-tick.C:
+			if s.role == leader {
+				s.sendAppends()
+			} else if now.After(s.deadline) {
+				s.campaign()
+			}
+		case m := <-c:
+			s.handle(m)
+		}
+	}
+}
+
+func (s *server) handle(m upnet.Msg) {
+	if len(m.F) < 2 {
+		return
+	}
+	switch m.F[0] {
+	case "Request":
+		s.request(m)
+		return
+	case "Query":
+		s.query(m)
+		return
+	}
+	r, err := parse(m)
+	if err != nil {
+		if fields[m.F[1]] != 0 {
+			s.Log.Printf("skipping message: %s", err)
+		}
+		return
+	}
+	if r.s == int64(s.ID) {
+		return
+	}
+	switch r.typ {
+	case "Vote":
+		s.vote(r)
+	case "Voted":
+		s.voted(r)
+	case "Append":
+		s.appendEntries(r)
+	case "Appended":
+		s.appended(r)
+	}
+}
+
+// campaign starts an election for the next term.
+func (s *server) campaign() {
+	s.setTerm(s.term + 1)
+	s.role = candidate
+	s.votedFor = int64(s.ID)
+	s.record(nil, "term %d %d", s.term, s.votedFor)
+	stable.MustSync(s.store)
+	s.Log.Printf("candidate in term %d", s.term)
+	s.votes = map[int64]bool{int64(s.ID): true}
+	s.resetElection()
+	s.bcast(nil, "Vote %d %d %d", s.term, s.lastIndex(), s.lastTerm())
+	s.count()
+}
+
+func (s *server) vote(r rmsg) {
+	// A follower that hears from a leader does not help anyone
+	// replace it, so a server that rejoins cannot disrupt the
+	// group, and so the leader can answer reads on its own.  One
+	// that just started might have, so it waits too.
+	if s.role == leader || time.Since(s.heard) < s.Election {
+		return
+	}
+	if r.t > s.term {
+		s.setTerm(r.t)
+	}
+	upToDate := r.lastT > s.lastTerm() ||
+		(r.lastT == s.lastTerm() && r.lastI >= s.lastIndex())
+	grant := r.t == s.term && upToDate &&
+		(s.votedFor == none || s.votedFor == r.s)
+	if grant && s.votedFor != r.s {
+		s.votedFor = r.s
+		s.record(nil, "term %d %d", s.term, s.votedFor)
+		stable.MustSync(s.store)
+	}
+	g := 0
+	if grant {
+		g = 1
+		s.resetElection()
+	}
+	s.bcast(nil, "Voted %d %d %d", s.term, r.s, g)
+}
+
+func (s *server) voted(r rmsg) {
+	if r.t > s.term {
+		s.setTerm(r.t)
+		return
+	}
+	if s.role != candidate || r.t != s.term || r.to != int64(s.ID) || !r.granted {
+		return
+	}
+	s.votes[r.s] = true
+	s.count()
+}
+
+// count makes a candidate with a majority of votes the leader.
+func (s *server) count() {
+	if len(s.votes) < s.majority() {
+		return
+	}
+	s.Log.Printf("leading in term %d", s.term)
+	s.role = leader
+	s.leader = int64(s.ID)
+	s.next = make(map[int64]int64)
+	s.match = make(map[int64]int64)
+	s.acked = make(map[int64]time.Time)
+	for f := int64(0); f < int64(s.N); f++ {
+		s.next[f] = s.lastIndex() + 1
+	}
+	s.append(entry{s.term, upnet.Command(noOpID, "")})
+	stable.MustSync(s.store)
+	s.sendAppends()
+	s.advance()
+}
+
+func (s *server) sendAppends() {
+	for f := int64(0); f < int64(s.N); f++ {
+		if f != int64(s.ID) {
+			s.sendAppend(f)
+		}
+	}
+}
+
+// sendAppend sends the follower the entries from where the leader
+// thinks its log stops matching, or a heartbeat.
+func (s *server) sendAppend(f int64) {
+	prev := s.next[f] - 1
+	if prev > s.lastIndex() {
+		prev = s.lastIndex()
+	}
+	var es []entry
+	size := 0
+	for i := prev + 1; i <= s.lastIndex(); i++ {
+		size += len(s.log[i].cmd) + 30
+		if len(es) > 0 && size > maxAppend {
+			break
+		}
+		es = append(es, s.log[i])
+	}
+	s.bcast(joinEntries(es), "Append %d %d %d %d %d",
+		s.term, f, prev, s.log[prev].term, s.commit)
+}
+
+func (s *server) appendEntries(r rmsg) {
+	if r.to != int64(s.ID) {
+		return
+	}
+	reply := func(ok bool, match int64) {
+		o := 0
+		if ok {
+			o = 1
+		}
+		s.bcast(nil, "Appended %d %d %d %d", s.term, r.s, o, match)
+	}
+	if r.t < s.term {
+		reply(false, s.lastIndex())
+		return
+	}
+	if r.t > s.term || s.role != follower {
+		s.setTerm(r.t)
+	}
+	s.leader = r.s
+	s.heard = time.Now()
+	s.resetElection()
+	if r.prevI > s.lastIndex() {
+		reply(false, s.lastIndex())
+		return
+	}
+	if t := s.log[r.prevI].term; t != r.prevT {
+		// skip back over the whole mismatched term
+		k := r.prevI - 1
+		for k > s.commit && s.log[k].term == t {
+			k--
+		}
+		reply(false, k)
+		return
+	}
+	wrote := false
+	for k, e := range r.entries {
+		i := r.prevI + 1 + int64(k)
+		if i <= s.lastIndex() {
+			if s.log[i].term == e.term {
+				continue
+			}
+			s.truncate(i)
+		}
+		s.append(e)
+		wrote = true
+	}
+	if wrote {
+		stable.MustSync(s.store)
+	}
+	last := r.prevI + int64(len(r.entries))
+	if c := min(r.commit, last); c > s.commit {
+		s.commit = c
+		s.apply()
+	}
+	reply(true, last)
+}
+
+func (s *server) appended(r rmsg) {
+	if r.t > s.term {
+		s.setTerm(r.t)
+		return
+	}
+	if s.role != leader || r.t != s.term || r.to != int64(s.ID) {
+		return
+	}
+	s.acked[r.s] = time.Now()
+	if !r.ok {
+		s.next[r.s] = max(1, min(s.next[r.s]-1, r.match+1))
+		s.sendAppend(r.s)
+		return
+	}
+	if r.match > s.match[r.s] {
+		s.match[r.s] = r.match
+	}
+	if s.next[r.s] <= s.match[r.s] {
+		s.next[r.s] = s.match[r.s] + 1
+	}
+	s.advance()
+}
+
+// advance commits the last entry of this term that a majority has.
+// Earlier entries commit with it.
+func (s *server) advance() {
+	for i := s.lastIndex(); i > s.commit && s.log[i].term == s.term; i-- {
+		n := 1
+		for f, m := range s.match {
+			if f != int64(s.ID) && m >= i {
+				n++
+			}
+		}
+		if n >= s.majority() {
+			s.commit = i
+			s.apply()
+			return
+		}
+	}
+}
+
+// apply applies the committed entries to the state machine.  A
+// request that got into the log twice, under two leaders, is applied
+// only the first time.  The leader answers the client.
+func (s *server) apply() {
+	for s.applied < s.commit {
+		s.applied++
+		cmd := s.log[s.applied].cmd
+		id, v := upnet.SplitCommand(cmd)
+		if id != noOpID {
+			first, again := s.appliedAt[id]
+			if !again || id == upnet.NoID {
+				s.sm.Apply(s.applied, v)
+				first = s.applied
+				if id != upnet.NoID {
+					s.appliedAt[id] = first
+				}
+			}
+			if s.role == leader {
+				s.bcast(nil, "OK %d %s", first, id)
+			}
+		}
+		if s.OnApply != nil {
+			s.OnApply(s.applied, cmd)
+		}
+	}
+}
+
+// request appends a client's request to the leader's log.  Every
+// server answers a retry of an applied request, and history requests
+// for committed entries, as the upaxos learner does.
+func (s *server) request(m upnet.Msg) {
+	id := upnet.NoID
+	if len(m.F) > 2 {
+		id = m.F[2]
+	}
+	if m.V == nil || *m.V == "" {
+		i, err := strconv.ParseInt(m.F[1], 10, 64)
+		if err == nil && i >= 1 && i <= s.commit {
+			cid, v := upnet.SplitCommand(s.log[i].cmd)
+			if cid == noOpID {
+				s.bcast(nil, "OK %d %s noop", i, id)
+			} else {
+				s.bcast(&v, "OK %d %s", i, id)
+			}
+		}
+		return
+	}
+	if id == noOpID {
+		return
+	}
+	if id != upnet.NoID {
+		if i, ok := s.appliedAt[id]; ok {
+			s.bcast(nil, "OK %d %s", i, id)
+			return
+		}
+		if _, ok := s.ids[id]; ok {
+			return // on its way
+		}
+	}
+	if s.role != leader {
+		return
+	}
+	s.append(entry{s.term, upnet.Command(id, *m.V)})
+	stable.MustSync(s.store)
+	s.sendAppends()
+	s.advance()
+}
+
+// query answers from the state machine, possibly stale.  A query for
+// the leader gets an answer only from a leader that has committed an
+// entry in its term, and heard from a majority in the last half
+// election timeout, before which no other leader can be elected.
+func (s *server) query(m upnet.Msg) {
+	if m.V == nil {
+		return
+	}
+	if len(m.F) > 2 && m.F[2] == "leader" && !s.canRead() {
+		return
+	}
+	rsp := s.sm.Query(*m.V)
+	s.bcast(&rsp, "OK %d %s", s.applied, m.F[1])
+}
+
+func (s *server) canRead() bool {
+	if s.role != leader || s.log[s.commit].term != s.term {
+		return false
+	}
+	n := 1
+	for _, t := range s.acked {
+		if time.Since(t) < s.Election/2 {
+			n++
+		}
+	}
+	return n >= s.majority()
+}
@@ -0,0 +1,38 @@
+package raft
+
+import (
+	"io"
+	"testing"
+
+	"rsm"
+	"stable"
+)
+
+// TestTornLog has a server crash partway through logging an entry,
+// and checks that recovery cuts the torn record off, so that what the
+// server logs after the restart survives the next one.
+func TestTornLog(t *testing.T) {
+	m := &stable.Mem{}
+	n := &Node{Config: simConfig(3), store: m, sm: rsm.NewKV()}
+	recover := func() *server {
+		m = m.Crash()
+		n.store = m
+		s := newServer(n)
+		lr := m.Log()
+		defer lr.Close()
+		s.load(lr)
+		return s
+	}
+	s := newServer(n)
+	s.append(entry{1, "a"})
+	stable.MustSync(m)
+	io.WriteString(m, "0: v1 entry 2 1 10:tor") // the crash
+	m.Sync()
+	s = recover()
+	s.append(entry{2, "c"})
+	stable.MustSync(m)
+	s = recover()
+	if len(s.log) != 3 || s.log[1].cmd != "a" || s.log[2] != (entry{2, "c"}) {
+		t.Errorf("recovered %v", s.log[1:])
+	}
+}
@@ -0,0 +1,270 @@
+package raft
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"paxosclient"
+	"rsm"
+	"simgroup"
+	"simnet"
+	"stable"
+	"upnet"
+)
+
+var runs = flag.Int("runs", 100, "seeded simulations for TestSafety")
+var seed = flag.Int64("seed", 0, "run TestSafety with only this seed")
+
+// A sim is a group of servers and clients in one process.
+type sim struct {
+	*simgroup.Group
+	cfg Config
+
+	mu      sync.Mutex
+	leaders map[int64]int     // the leader heard in each term
+	applied map[int64]string  // the first entry applied at each index
+	ids     []map[string]bool // requests applied by each server, this run
+	bad     []string
+}
+
+// simConfig is fast enough for a simulation to elect a leader in a
+// few milliseconds.
+func simConfig(n int) Config {
+	return Config{
+		N:         n,
+		Heartbeat: 2 * time.Millisecond,
+		Election:  10 * time.Millisecond,
+		Log:       log.New(io.Discard, "", 0),
+	}
+}
+
+func newSim(c Config, nc simnet.Config, seed int64) *sim {
+	s := &sim{
+		Group:   simgroup.New(nc, seed),
+		cfg:     c,
+		leaders: make(map[int64]int),
+		applied: make(map[int64]string),
+		ids:     make([]map[string]bool, c.N),
+	}
+	s.Net.Tap(s.tap)
+	s.Start(c.N, s.start)
+	return s
+}
+
+// tap checks that only one server sends Append in each term.
+func (s *sim) tap(from int, b []byte) {
+	m, err := upnet.Parse(b)
+	if err != nil || len(m.F) < 2 || m.F[1] != "Append" {
+		return
+	}
+	r, err := parse(m)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.leaders[r.t]; !ok {
+		s.leaders[r.t] = int(r.s)
+	} else if l != int(r.s) {
+		s.bad = append(s.bad, fmt.Sprintf(
+			"%d and %d both led term %d", l, r.s, r.t))
+	}
+}
+
+// start starts server i, recovering from its storage.  It applies
+// everything again.
+func (s *sim) start(i int, conn upnet.Conn, store *stable.Mem) simgroup.Member {
+	c := s.cfg
+	c.ID = i
+	s.mu.Lock()
+	ids := make(map[string]bool)
+	s.ids[i] = ids
+	s.mu.Unlock()
+	c.OnApply = func(x int64, cmd string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if id, _ := upnet.SplitCommand(cmd); id != noOpID {
+			ids[id] = true
+		}
+		if first, ok := s.applied[x]; !ok {
+			s.applied[x] = cmd
+		} else if first != cmd {
+			s.bad = append(s.bad, fmt.Sprintf(
+				"%d applied %q at %d after %q", i, cmd, x, first))
+		}
+	}
+	n := New(c, conn, store, rsm.NewKV())
+	n.Start()
+	return n
+}
+
+func simulate(seed int64) []string {
+	rng := rand.New(rand.NewSource(seed))
+	s := newSim(simConfig(3+2*rng.Intn(2)), simnet.Config{
+		Loss:     0.3 * rng.Float64(),
+		Dup:      0.2 * rng.Float64(),
+		MaxDelay: time.Duration(rng.Intn(3000)) * time.Microsecond,
+	}, seed)
+	defer s.Close()
+
+	chaos, stop := context.WithTimeout(context.Background(), 60*time.Millisecond)
+	defer stop()
+	go s.Disrupt(chaos, rng, 100, 101, 102)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	s.Propose(ctx, 3, 5, simgroup.PerClient(fmt.Sprint(seed)))
+	stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bad
+}
+
+// TestSafety checks that each term has one leader, and that every
+// server applies the same entry at each index, over many simulations
+// with lost, delayed, duplicated and reordered messages, partitions
+// and restarts.
+func TestSafety(t *testing.T) {
+	n := *runs
+	if testing.Short() && n > 20 {
+		n = 20
+	}
+	for _, b := range simgroup.Safety(n, *seed, simulate) {
+		t.Error(b)
+	}
+}
+
+// TestProgress checks that a group with some loss commits every
+// request, and that every server applies them all.
+func TestProgress(t *testing.T) {
+	s := newSim(simConfig(3), simnet.Config{
+		Loss:     0.1,
+		Dup:      0.05,
+		MaxDelay: time.Millisecond,
+	}, 1)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	if ok := s.Propose(ctx, 3, 10, simgroup.PerClient("p")); ok != 30 {
+		t.Errorf("%d of 30 requests committed", ok)
+	}
+	behind := func() (int, int) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, ids := range s.ids {
+			if len(ids) < 30 {
+				return i, len(ids)
+			}
+		}
+		return -1, 0
+	}
+	for ctx.Err() == nil {
+		if i, _ := behind(); i < 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if i, n := behind(); i >= 0 {
+		t.Errorf("server %d applied %d of 30", i, n)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.bad {
+		t.Error(b)
+	}
+}
+
+// TestFailover cuts off the leader, and checks that the others elect
+// a new one and go on committing, and that the old leader catches up
+// once the network heals.
+func TestFailover(t *testing.T) {
+	s := newSim(simConfig(3), simnet.Config{}, 1)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	if ok := s.Propose(ctx, 1, 5, simgroup.PerClient("a")); ok != 5 {
+		t.Fatalf("%d of 5 requests committed", ok)
+	}
+	s.mu.Lock()
+	var term int64
+	for t := range s.leaders {
+		if t > term {
+			term = t
+		}
+	}
+	first := s.leaders[term]
+	s.mu.Unlock()
+
+	var rest []int
+	for i := range s.Nodes {
+		if i != first {
+			rest = append(rest, i)
+		}
+	}
+	s.Net.Partition(append([]int{100}, rest...))
+	start := time.Now()
+	if ok := s.Propose(ctx, 1, 5, simgroup.PerClient("b")); ok != 5 {
+		t.Fatalf("%d of 5 requests committed after failover", ok)
+	}
+	t.Logf("failover took %v", time.Since(start))
+	s.Net.Heal()
+
+	for ctx.Err() == nil {
+		s.mu.Lock()
+		n := len(s.ids[first])
+		s.mu.Unlock()
+		if n == 10 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.ids[first]); n != 10 {
+		t.Errorf("old leader applied %d of 10", n)
+	}
+	for _, b := range s.bad {
+		t.Error(b)
+	}
+}
+
+// TestHistory reads back a committed request, and a leader's no-op,
+// which has no value.
+func TestHistory(t *testing.T) {
+	s := newSim(simConfig(3), simnet.Config{}, 1)
+	defer s.Close()
+	cl := paxosclient.New(s.Net.Join(100))
+	defer cl.Close()
+	cl.Retry = 5 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	i, err := cl.Propose(ctx, "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := cl.Read(ctx, i); err != nil || len(v) != 1 || v[0] != "one" {
+		t.Errorf("entry %d is %q, %v", i, v, err)
+	}
+
+	s.mu.Lock()
+	var noop int64
+	for x, cmd := range s.applied {
+		if id, _ := upnet.SplitCommand(cmd); id == noOpID {
+			noop = x
+		}
+	}
+	s.mu.Unlock()
+	if noop == 0 {
+		t.Fatal("no no-op applied")
+	}
+	if v, err := cl.Read(ctx, noop); err != nil || len(v) != 0 {
+		t.Errorf("no-op entry %d is %q, %v", noop, v, err)
+	}
+}
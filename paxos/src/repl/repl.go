@@ -0,0 +1,302 @@
+// Package repl reads client commands a line at a time, sends them to
+// the group with paxosclient, and prints each answer with how long
+// it took:
+//
+//	write VALUE		get VALUE chosen, print its instance
+//	read N			print the value chosen in instance N
+//	set KEY VALUE		write rsm.Set(KEY, VALUE)
+//	del KEY			write rsm.Del(KEY)
+//	get KEY			query the value of KEY, with the last
+//				instance the answering learner applied
+//	status			query the last instance applied, and
+//				print the latencies seen so far
+//	watch [FROM [COUNT]]	print values as they are chosen, from
+//				FROM on, until COUNT are printed or an
+//				interrupt
+//	send TEXT		send TEXT as a message, like "send quit"
+//	help, quit
+//
+// Blank lines and lines starting with "#" are skipped, so a script
+// of commands can be run as well as typed.
+package repl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"paxosclient"
+	"rsm"
+	"upnet"
+)
+
+const DefaultTimeout = 5 * time.Second
+
+const help = `write VALUE		get VALUE chosen
+read N			print the value chosen in instance N
+set KEY VALUE		set KEY in the key-value store
+del KEY			delete KEY
+get KEY			print the value of KEY
+status			print the last instance applied, and latencies
+watch [FROM [COUNT]]	print values as they are chosen
+send TEXT		send TEXT as a message, without waiting
+quit
+`
+
+var errQuit = errors.New("quit")
+
+type REPL struct {
+	Client  *paxosclient.Client
+	Out     io.Writer
+	Timeout time.Duration // for each command but watch
+
+	// Prompt, if not empty, is printed before reading each line.
+	Prompt string
+
+	// Latency shows how long each command took after its answer.
+	Latency bool
+
+	// Interrupt, if set, stops the command in progress.
+	Interrupt <-chan os.Signal
+
+	last    int64           // the latest instance heard of
+	times   []time.Duration // of the commands that got answers
+	failed  int
+	started time.Time
+}
+
+// New returns a REPL that sends commands with c and prints to out,
+// showing latencies.
+func New(c *paxosclient.Client, out io.Writer) *REPL {
+	return &REPL{
+		Client:  c,
+		Out:     out,
+		Timeout: DefaultTimeout,
+		Latency: true,
+	}
+}
+
+// Run runs the commands read from in until it ends or a quit
+// command, and returns how many failed.
+func (r *REPL) Run(ctx context.Context, in io.Reader) int {
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for {
+		if r.Prompt != "" {
+			fmt.Fprint(r.Out, r.Prompt)
+		}
+		if !sc.Scan() {
+			break
+		}
+		err := r.Do(ctx, sc.Text())
+		if err == errQuit {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(r.Out, "error: %s\n", err)
+			r.failed++
+		}
+	}
+	if r.Prompt != "" {
+		fmt.Fprintln(r.Out)
+	}
+	return r.failed
+}
+
+// Do runs one command line.
+func (r *REPL) Do(ctx context.Context, line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+	cmd, arg := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if r.Interrupt != nil {
+		select {
+		case <-r.Interrupt: // between commands
+		default:
+		}
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-r.Interrupt:
+				cancel()
+			case <-done:
+			}
+		}()
+	}
+	if cmd != "watch" && r.Timeout > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeout(ctx, r.Timeout)
+		defer stop()
+	}
+	r.started = time.Now()
+
+	switch cmd {
+	case "write":
+		if arg == "" {
+			return errors.New("usage: write VALUE")
+		}
+		return r.write(ctx, arg)
+	case "set":
+		f := strings.SplitN(arg, " ", 2)
+		if len(f) != 2 {
+			return errors.New("usage: set KEY VALUE")
+		}
+		return r.write(ctx, rsm.Set(f[0], f[1]))
+	case "del":
+		if arg == "" || strings.Contains(arg, " ") {
+			return errors.New("usage: del KEY")
+		}
+		return r.write(ctx, rsm.Del(arg))
+	case "read":
+		i, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return errors.New("usage: read N")
+		}
+		v, err := r.Client.Read(ctx, i)
+		if err != nil {
+			return err
+		}
+		r.heard(i)
+		r.printRead(i, v)
+	case "get":
+		if arg == "" || strings.Contains(arg, " ") {
+			return errors.New("usage: get KEY")
+		}
+		a, v, err := r.Client.Query(ctx, rsm.Get(arg))
+		if err != nil {
+			return err
+		}
+		r.heard(a)
+		r.print("%q applied %d", v, a)
+	case "status":
+		a, _, err := r.Client.Query(ctx, "")
+		if err != nil {
+			return err
+		}
+		r.heard(a)
+		r.print("applied %d", a)
+		r.stats()
+	case "watch":
+		return r.watch(ctx, arg)
+	case "send":
+		if arg == "" {
+			return errors.New("usage: send TEXT")
+		}
+		return r.Client.Send(upnet.Record(nil, "%s", arg))
+	case "help", "?":
+		fmt.Fprint(r.Out, help)
+	case "quit", "exit", "bye":
+		return errQuit
+	default:
+		return fmt.Errorf("unknown command %q, try help", cmd)
+	}
+	return nil
+}
+
+func (r *REPL) write(ctx context.Context, v string) error {
+	i, err := r.Client.Propose(ctx, v)
+	if err != nil {
+		return err
+	}
+	r.heard(i)
+	r.print("ok %d", i)
+	return nil
+}
+
+// watch reads one instance after another, each as soon as it is
+// chosen.  Read keeps asking until some learner knows the value.
+func (r *REPL) watch(ctx context.Context, arg string) error {
+	from, count := r.last+1, int64(-1)
+	f := strings.Fields(arg)
+	var err error
+	if len(f) > 0 {
+		from, err = strconv.ParseInt(f[0], 10, 64)
+	}
+	if len(f) > 1 && err == nil {
+		count, err = strconv.ParseInt(f[1], 10, 64)
+	}
+	if err != nil || len(f) > 2 || from < 1 {
+		return errors.New("usage: watch [FROM [COUNT]]")
+	}
+	for i := from; count < 0 || i < from+count; i++ {
+		r.started = time.Now()
+		v, err := r.Client.Read(ctx, i)
+		if err == context.Canceled {
+			return nil // interrupted
+		}
+		if err != nil {
+			return err
+		}
+		r.heard(i)
+		r.printRead(i, v)
+	}
+	return nil
+}
+
+// printRead prints what instance i holds: its values, quoted, or
+// "noop" for a no-op.
+func (r *REPL) printRead(i int64, vs []string) {
+	s := strconv.FormatInt(i, 10)
+	for _, v := range vs {
+		s += " " + strconv.Quote(v)
+	}
+	if len(vs) == 0 {
+		s += " noop"
+	}
+	r.print("%s", s)
+}
+
+func (r *REPL) heard(i int64) {
+	if i > r.last {
+		r.last = i
+	}
+}
+
+// print prints an answer, noting the latency of the command.
+func (r *REPL) print(format string, a ...interface{}) {
+	d := time.Since(r.started)
+	r.times = append(r.times, d)
+	s := fmt.Sprintf(format, a...)
+	if r.Latency {
+		s += fmt.Sprintf("\t(%v)", round(d))
+	}
+	fmt.Fprintln(r.Out, s)
+}
+
+// stats prints how many commands got answers, and their mean and
+// worst latencies.
+func (r *REPL) stats() {
+	var sum, max time.Duration
+	for _, d := range r.times {
+		sum += d
+		if d > max {
+			max = d
+		}
+	}
+	fmt.Fprintf(r.Out, "answers %d, failures %d", len(r.times), r.failed)
+	if r.Latency && len(r.times) > 0 {
+		fmt.Fprintf(r.Out, ", mean %v, max %v",
+			round(sum/time.Duration(len(r.times))), round(max))
+	}
+	fmt.Fprintln(r.Out)
+}
+
+func round(d time.Duration) time.Duration {
+	if d > time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Microsecond)
+}
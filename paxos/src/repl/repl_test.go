@@ -0,0 +1,184 @@
+package repl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"paxosclient"
+	"rsm"
+	"simnet"
+	"upnet"
+)
+
+// fakeGroup answers at once, on a simnet, like a upaxos group that
+// has applied every value it chose.
+type fakeGroup struct {
+	net  *simnet.Net
+	conn upnet.Conn
+	log  []string
+	kv   *rsm.KV
+}
+
+func newFakeGroup() *fakeGroup {
+	g := &fakeGroup{net: simnet.New(simnet.Config{}, 1), kv: rsm.NewKV()}
+	g.conn = g.net.Join(0)
+	go g.serve()
+	return g
+}
+
+func (g *fakeGroup) serve() {
+	buf := make([]byte, 9999)
+	for {
+		n, err := g.conn.Recv(buf)
+		if err != nil {
+			return
+		}
+		m, err := upnet.Parse(buf[:n])
+		if err != nil || len(m.F) < 2 {
+			continue
+		}
+		switch {
+		case m.F[0] == "Query":
+			v := g.kv.Query(*m.V)
+			g.send(&v, "0 OK %d %s", len(g.log), m.F[1])
+		case len(m.F) < 3:
+		case m.F[1] == "0":
+			g.log = append(g.log, *m.V)
+			if _, ok := rsm.Key(*m.V); ok {
+				g.kv.Apply(int64(len(g.log)), *m.V)
+			}
+			g.send(nil, "0 OK %d %s", len(g.log), m.F[2])
+		default:
+			i, _ := strconv.Atoi(m.F[1])
+			if i >= 1 && i <= len(g.log) {
+				g.send(&g.log[i-1], "0 OK %d %s", i, m.F[2])
+			}
+		}
+	}
+}
+
+func (g *fakeGroup) send(v *string, format string, a ...interface{}) {
+	g.conn.Send([]byte(upnet.Record(v, format, a...)))
+}
+
+func (g *fakeGroup) close() {
+	g.conn.Close()
+}
+
+func newREPL(g *fakeGroup, out *bytes.Buffer) *REPL {
+	c := paxosclient.New(g.net.Join(100))
+	c.Retry = 5 * time.Millisecond
+	r := New(c, out)
+	r.Latency = false
+	r.Timeout = 100 * time.Millisecond
+	return r
+}
+
+func TestScript(t *testing.T) {
+	g := newFakeGroup()
+	defer g.close()
+	var out bytes.Buffer
+	r := newREPL(g, &out)
+	defer r.Client.Close()
+
+	script := `# comments and blank lines are skipped
+
+write one two
+set color blue
+read 1
+get color
+watch 1 2
+read 3
+status
+send nothing at all
+bogus
+quit
+write never
+`
+	failed := r.Run(context.Background(), strings.NewReader(script))
+	want := `ok 1
+ok 2
+1 "one two"
+"blue" applied 2
+1 "one two"
+2 "set 5:colorblue"
+error: context deadline exceeded
+applied 2
+answers 7, failures 1
+error: unknown command "bogus", try help
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+	if failed != 2 {
+		t.Errorf("%d failed", failed)
+	}
+	if len(g.log) != 2 {
+		t.Errorf("chose %q", g.log)
+	}
+}
+
+// TestWatch checks that watch waits for values to be chosen, and
+// that an interrupt ends it.
+func TestWatch(t *testing.T) {
+	g := newFakeGroup()
+	defer g.close()
+	var out bytes.Buffer
+	r := newREPL(g, &out)
+	defer r.Client.Close()
+	intr := make(chan os.Signal, 1)
+	r.Interrupt = intr
+	r.Prompt = "> "
+
+	in, w := newPipe()
+	done := make(chan int)
+	go func() { done <- r.Run(context.Background(), in) }()
+
+	w <- "write a\n"
+	w <- "watch\n"
+	c := paxosclient.New(g.net.Join(101))
+	defer c.Close()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := c.Propose(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	intr <- os.Interrupt
+	close(w)
+	if failed := <-done; failed != 0 {
+		t.Errorf("%d failed", failed)
+	}
+	if want := "> ok 1\n> 2 \"b\"\n> \n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+// pipe feeds the lines sent on its channel to a Reader.
+type pipe struct {
+	c   chan string
+	buf []byte
+}
+
+func newPipe() (*pipe, chan string) {
+	p := &pipe{c: make(chan string)}
+	return p, p.c
+}
+
+func (p *pipe) Read(b []byte) (int, error) {
+	if len(p.buf) == 0 {
+		s, ok := <-p.c
+		if !ok {
+			return 0, io.EOF
+		}
+		p.buf = []byte(s)
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
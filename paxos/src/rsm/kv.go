@@ -0,0 +1,104 @@
+package rsm
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// KV is a key-value store.  Its commands and queries name an
+// operation and a length-prefixed key, so keys may hold any bytes:
+//
+//	set LEN:KEYVALUE	set KEY to VALUE
+//	del LEN:KEY		remove KEY
+//	get LEN:KEY		query the value of KEY
+//
+// Set, Del and Get build them.
+type KV struct {
+	m map[string]string
+}
+
+func NewKV() *KV {
+	return &KV{make(map[string]string)}
+}
+
+func kvOp(op, k, v string) string {
+	return fmt.Sprintf("%s %d:%s%s", op, len(k), k, v)
+}
+
+func Set(k, v string) string { return kvOp("set", k, v) }
+func Del(k string) string    { return kvOp("del", k, "") }
+func Get(k string) string    { return kvOp("get", k, "") }
+
+func parseOp(s string) (op, k, v string, err error) {
+	f := strings.SplitN(s, " ", 2)
+	if len(f) < 2 {
+		return "", "", "", fmt.Errorf("no key in %q", s)
+	}
+	op, rest := f[0], f[1]
+	i := strings.IndexByte(rest, ':')
+	if i < 0 {
+		return "", "", "", fmt.Errorf("no key length in %q", s)
+	}
+	n, err := strconv.Atoi(rest[:i])
+	if err != nil || n < 0 || i+1+n > len(rest) {
+		return "", "", "", fmt.Errorf("bad key length in %q", s)
+	}
+	rest = rest[i+1:]
+	return op, rest[:n], rest[n:], nil
+}
+
+// Key returns the key a KV command changes.  Commands on different
+// keys commute, so their order does not matter.  It returns false
+// for a value that is not a KV command.
+func Key(value string) (string, bool) {
+	_, k, _, err := parseOp(value)
+	return k, err == nil
+}
+
+// Apply ignores values that are not KV commands, since anything at
+// all can be chosen.
+func (kv *KV) Apply(instance int64, value string) {
+	op, k, v, err := parseOp(value)
+	if err != nil {
+		log.Printf("kv ignoring instance %d: %s", instance, err)
+		return
+	}
+	switch op {
+	case "set":
+		kv.m[k] = v
+	case "del":
+		delete(kv.m, k)
+	default:
+		log.Printf("kv ignoring instance %d: unknown op %q",
+			instance, op)
+	}
+}
+
+// Query answers "get" with the value, which is empty for a missing
+// key.
+func (kv *KV) Query(q string) string {
+	op, k, _, err := parseOp(q)
+	if err != nil || op != "get" {
+		return ""
+	}
+	return kv.m[k]
+}
+
+func (kv *KV) Snapshot() ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(kv.m)
+	return b.Bytes(), err
+}
+
+func (kv *KV) Restore(snap []byte) error {
+	m := make(map[string]string)
+	if err := gob.NewDecoder(bytes.NewReader(snap)).Decode(&m); err != nil {
+		return err
+	}
+	kv.m = m
+	return nil
+}
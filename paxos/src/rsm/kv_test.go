@@ -0,0 +1,55 @@
+package rsm
+
+import (
+	"testing"
+)
+
+func TestKV(t *testing.T) {
+	kv := NewKV()
+	kv.Apply(1, Set("a key", "one\n"))
+	kv.Apply(2, Set("b", "two"))
+	kv.Apply(3, "not a command")
+	kv.Apply(4, Del("b"))
+	if v := kv.Query(Get("a key")); v != "one\n" {
+		t.Errorf("a key is %q", v)
+	}
+	if v := kv.Query(Get("b")); v != "" {
+		t.Errorf("deleted b is %q", v)
+	}
+
+	snap, err := kv.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv2 := NewKV()
+	kv2.Apply(1, Set("c", "three"))
+	if err := kv2.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if v := kv2.Query(Get("a key")); v != "one\n" {
+		t.Errorf("restored a key is %q", v)
+	}
+	if v := kv2.Query(Get("c")); v != "" {
+		t.Errorf("restore kept c as %q", v)
+	}
+}
+
+func TestColonKey(t *testing.T) {
+	kv := NewKV()
+	kv.Apply(1, Set("3:x", "y"))
+	if v := kv.Query(Get("3:x")); v != "y" {
+		t.Errorf("got %q", v)
+	}
+}
+
+func TestKey(t *testing.T) {
+	if k, ok := Key(Set("a b", "c")); !ok || k != "a b" {
+		t.Errorf("key %q, %v", k, ok)
+	}
+	if k, ok := Key(Del("d")); !ok || k != "d" {
+		t.Errorf("key %q, %v", k, ok)
+	}
+	if _, ok := Key("not a command"); ok {
+		t.Error("key for a non-command")
+	}
+}
@@ -0,0 +1,21 @@
+// Package rsm holds state machines for upaxos to replicate.
+package rsm
+
+// A StateMachine is what the group replicates.  The learner applies
+// each chosen value to it strictly in instance order, with no gaps,
+// so every participant's copy goes through the same states.  The
+// values in a batch are applied in order with the batch's instance.
+type StateMachine interface {
+	// Apply changes the state according to the value chosen
+	// for the instance.
+	Apply(instance int64, value string)
+
+	// Query answers a question about the current state without
+	// changing it.
+	Query(q string) string
+
+	// Snapshot and Restore save and reload the whole state, so
+	// that recovery need not apply every value ever chosen.
+	Snapshot() ([]byte, error)
+	Restore(snap []byte) error
+}
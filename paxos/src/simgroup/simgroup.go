@@ -0,0 +1,218 @@
+// Package simgroup runs a group of participants and their clients in
+// one process, on a simnet, with storage in memory, for the tests of
+// upaxos, epaxos and raft.  A Group starts, restarts and crashes the
+// participants, partitions the network, and has clients propose over
+// it, while each protocol's tests watch for what must never happen.
+package simgroup
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"paxosclient"
+	"rsm"
+	"simnet"
+	"stable"
+	"upnet"
+)
+
+// Patience is how long a test waits for a group to do what takes it
+// milliseconds on an idle machine, so that a busy machine or the race
+// detector does not fail it.  Tests wait for what they want, not for
+// Patience to pass.
+const Patience = time.Minute
+
+// concurrent is how many simulations run at once.  They spend much
+// of their time waiting on timers.
+const concurrent = 4
+
+// A Member is a participant in a group.
+type Member interface {
+	Close() error
+}
+
+// A StartFunc starts participant i talking over conn, recovering
+// from what store holds.
+type StartFunc func(i int, conn upnet.Conn, store *stable.Mem) Member
+
+// A Group is participants 0 through N-1 on a simulated network.
+// Clients join it as 100 and up.
+type Group struct {
+	Net    *simnet.Net
+	Nodes  []Member
+	Stores []*stable.Mem
+
+	// Retry is how long Propose's clients wait for an answer before
+	// they ask again, 5ms if zero.
+	Retry time.Duration
+
+	// Near, if set, has Propose's client K name participant K mod N
+	// as the one nearest it.
+	Near bool
+
+	start   StartFunc
+	life    sync.Mutex // serializes restarts
+	closed  bool
+	crashed int
+}
+
+// New returns a group with no participants yet, so that the caller
+// can tap the network before any message goes by.
+func New(nc simnet.Config, seed int64) *Group {
+	return &Group{Net: simnet.New(nc, seed)}
+}
+
+// Start starts n participants with empty storage.
+func (g *Group) Start(n int, start StartFunc) {
+	g.start = start
+	for i := 0; i < n; i++ {
+		g.Stores = append(g.Stores, &stable.Mem{})
+		g.Nodes = append(g.Nodes, nil)
+		g.run(i)
+	}
+}
+
+func (g *Group) run(i int) {
+	g.Nodes[i] = g.start(i, g.Net.Join(i), g.Stores[i])
+}
+
+// Restart closes participant i and starts it again from all it
+// stored.
+func (g *Group) Restart(i int) {
+	g.life.Lock()
+	defer g.life.Unlock()
+	g.Nodes[i].Close()
+	g.run(i)
+}
+
+// Recover starts participant i again after m crashed, from what its
+// storage had synced.
+func (g *Group) Recover(i int, m Member) {
+	m.Close()
+	g.life.Lock()
+	defer g.life.Unlock()
+	if g.closed || g.Nodes[i] != m {
+		return // restarted already
+	}
+	g.crashed++
+	g.Stores[i] = g.Stores[i].Crash()
+	g.run(i)
+}
+
+// Crashed returns how many times participants recovered from a
+// crash.
+func (g *Group) Crashed() int {
+	g.life.Lock()
+	defer g.life.Unlock()
+	return g.crashed
+}
+
+func (g *Group) Close() {
+	g.life.Lock()
+	defer g.life.Unlock()
+	g.closed = true
+	for _, m := range g.Nodes {
+		m.Close()
+	}
+}
+
+// Propose has each of the clients propose values commands one after
+// another until ctx is done, and returns how many were chosen.  The
+// k'th client's j'th command is cmd(k, j).
+func (g *Group) Propose(ctx context.Context, clients, values int, cmd func(k, j int) string) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ok := 0
+	for k := 0; k < clients; k++ {
+		c := paxosclient.New(g.Net.Join(100 + k))
+		c.Retry = g.Retry
+		if c.Retry == 0 {
+			c.Retry = 5 * time.Millisecond
+		}
+		if g.Near {
+			c.Near = k % len(g.Nodes)
+		}
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			defer c.Close()
+			for j := 0; j < values; j++ {
+				if _, err := c.Propose(ctx, cmd(k, j)); err != nil {
+					return
+				}
+				mu.Lock()
+				ok++
+				mu.Unlock()
+			}
+		}(k)
+	}
+	wg.Wait()
+	return ok
+}
+
+// PerClient gives each client a key of its own, "TAG-K", and has it
+// set the key to 0, 1, 2 and so on.
+func PerClient(tag string) func(k, j int) string {
+	return func(k, j int) string {
+		return rsm.Set(fmt.Sprintf("%s-%d", tag, k), fmt.Sprint(j))
+	}
+}
+
+// Disrupt partitions the group, heals it, and restarts participants
+// at random until ctx is done.  The ends in with stay on the first
+// side of each partition.
+func (g *Group) Disrupt(ctx context.Context, rng *rand.Rand, with ...int) {
+	for {
+		select {
+		case <-ctx.Done():
+			g.Net.Heal()
+			return
+		case <-time.After(time.Duration(5+rng.Intn(20)) * time.Millisecond):
+		}
+		n := len(g.Nodes)
+		switch rng.Intn(3) {
+		case 0:
+			p := rng.Perm(n)
+			cut := 1 + rng.Intn(n-1)
+			side := append(append([]int{}, with...), p[:cut]...)
+			g.Net.Partition(side, p[cut:])
+		case 1:
+			g.Net.Heal()
+		case 2:
+			g.Restart(rng.Intn(n))
+		}
+	}
+}
+
+// Safety runs simulate with seeds 1 through runs, or only seed if it
+// is not zero, some at once, and returns what each says went wrong.
+// A seed fixes the network's choices but not goroutine scheduling,
+// so runs are not deterministic.
+func Safety(runs int, seed int64, simulate func(seed int64) []string) []string {
+	first, last := int64(1), int64(runs)
+	if seed != 0 {
+		first, last = seed, seed
+	}
+	sem := make(chan bool, concurrent)
+	var mu sync.Mutex
+	var bad []string
+	for sd := first; sd <= last; sd++ {
+		sem <- true
+		go func(sd int64) {
+			defer func() { <-sem }()
+			b := simulate(sd)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, s := range b {
+				bad = append(bad, fmt.Sprintf("seed %d: %s", sd, s))
+			}
+		}(sd)
+	}
+	for i := 0; i < concurrent; i++ {
+		sem <- true
+	}
+	return bad
+}
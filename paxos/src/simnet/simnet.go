@@ -0,0 +1,202 @@
+// Package simnet is a group channel in one process, for testing
+// participants together.  It loses, delays, duplicates and reorders
+// messages, and it can partition the group.
+//
+// Its random choices come from a seed, so a seed that breaks
+// something breaks it the same way again, up to the scheduling of
+// the goroutines on either end.
+package simnet
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"upnet"
+)
+
+type Config struct {
+	Loss     float64       // chance that a copy is lost
+	Dup      float64       // chance that a copy is delivered twice
+	MaxDelay time.Duration // copies are delayed up to this long
+}
+
+// ErrClosed is what a closed Conn returns.
+var ErrClosed = errors.New("simnet: closed")
+
+// inbox is how many messages wait for Recv before more are dropped,
+// like a socket buffer.
+const inbox = 1000
+
+type Net struct {
+	Config
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	ends  map[int]*end
+	side  map[int]int // partition side by end, all zero when healed
+	sent  int
+	count map[string]int // messages sent, by type
+	tap   func(from int, b []byte)
+}
+
+func New(c Config, seed int64) *Net {
+	return &Net{
+		Config: c,
+		rng:    rand.New(rand.NewSource(seed)),
+		ends:   make(map[int]*end),
+		side:   make(map[int]int),
+		count:  make(map[string]int),
+	}
+}
+
+// Join adds an end with the given ID to the group, replacing any
+// end that had it, the way a restarted participant rejoins.
+func (n *Net) Join(id int) upnet.Conn {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if old, ok := n.ends[id]; ok {
+		old.close()
+	}
+	e := &end{net: n, id: id, in: make(chan []byte, inbox),
+		done: make(chan struct{})}
+	n.ends[id] = e
+	return e
+}
+
+// Partition splits the group so that only ends on the same side hear
+// each other.  Ends not named are on a side of their own.
+func (n *Net) Partition(sides ...[]int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.side = make(map[int]int)
+	for id := range n.ends {
+		n.side[id] = -1 - id
+	}
+	for s, ids := range sides {
+		for _, id := range ids {
+			n.side[id] = s + 1
+		}
+	}
+}
+
+// Heal ends the partition.
+func (n *Net) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.side = make(map[int]int)
+}
+
+// Rand runs f with the network's random source, so that a test
+// driving the network can take its choices from the same seed.
+func (n *Net) Rand(f func(*rand.Rand)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f(n.rng)
+}
+
+// Tap has f see every message sent, before anything can lose it.
+func (n *Net) Tap(f func(from int, b []byte)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.tap = f
+}
+
+// Sent returns the number of messages sent so far, and how many of
+// them had each type, for records like "v1 S Type ...".
+func (n *Net) Sent() (int, map[string]int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c := make(map[string]int)
+	for k, v := range n.count {
+		c[k] = v
+	}
+	return n.sent, c
+}
+
+func (n *Net) broadcast(from int, b []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent++
+	if m, err := upnet.Parse(b); err == nil && len(m.F) > 1 {
+		n.count[m.F[1]]++
+	}
+	if n.tap != nil {
+		n.tap(from, b)
+	}
+	for id, e := range n.ends {
+		if n.side[id] != n.side[from] {
+			continue
+		}
+		copies := 1
+		if n.rng.Float64() < n.Loss {
+			copies = 0
+		} else if n.rng.Float64() < n.Dup {
+			copies = 2
+		}
+		for ; copies > 0; copies-- {
+			d := time.Duration(0)
+			if n.MaxDelay > 0 {
+				d = time.Duration(n.rng.Int63n(int64(n.MaxDelay)))
+			}
+			e.deliver(append([]byte{}, b...), d)
+		}
+	}
+}
+
+type end struct {
+	net  *Net
+	id   int
+	in   chan []byte
+	once sync.Once
+	done chan struct{}
+}
+
+func (e *end) deliver(b []byte, d time.Duration) {
+	put := func() {
+		select {
+		case <-e.done:
+		case e.in <- b:
+		default: // full
+		}
+	}
+	if d == 0 {
+		put()
+	} else {
+		time.AfterFunc(d, put)
+	}
+}
+
+func (e *end) Send(b []byte) error {
+	select {
+	case <-e.done:
+		return ErrClosed
+	default:
+	}
+	e.net.broadcast(e.id, b)
+	return nil
+}
+
+func (e *end) Recv(b []byte) (int, error) {
+	select {
+	case <-e.done:
+		return 0, ErrClosed
+	case m := <-e.in:
+		return copy(b, m), nil
+	}
+}
+
+func (e *end) close() {
+	e.once.Do(func() { close(e.done) })
+}
+
+func (e *end) Close() error {
+	e.close()
+	e.net.mu.Lock()
+	if e.net.ends[e.id] == e {
+		delete(e.net.ends, e.id)
+	}
+	e.net.mu.Unlock()
+	return nil
+}
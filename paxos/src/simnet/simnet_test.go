@@ -0,0 +1,100 @@
+package simnet
+
+import (
+	"testing"
+	"time"
+
+	"upnet"
+)
+
+// pump reads everything c receives into a channel.
+func pump(c upnet.Conn) <-chan string {
+	got := make(chan string, 100)
+	go func() {
+		b := make([]byte, 100)
+		for {
+			n, err := c.Recv(b)
+			if err != nil {
+				close(got)
+				return
+			}
+			got <- string(b[:n])
+		}
+	}()
+	return got
+}
+
+func recv(got <-chan string) string {
+	select {
+	case s := <-got:
+		return s
+	case <-time.After(50 * time.Millisecond):
+		return ""
+	}
+}
+
+func TestPartition(t *testing.T) {
+	n := New(Config{}, 1)
+	a, c := n.Join(0), n.Join(2)
+	ins := []<-chan string{pump(a), pump(n.Join(1)), pump(c)}
+
+	a.Send([]byte("v1 0 Hi"))
+	for i, in := range ins {
+		if s := recv(in); s != "v1 0 Hi" {
+			t.Errorf("%d got %q", i, s)
+		}
+	}
+
+	n.Partition([]int{0, 1})
+	c.Send([]byte("v1 2 Hi"))
+	if s := recv(ins[0]); s != "" {
+		t.Errorf("0 heard %q across the partition", s)
+	}
+	if s := recv(ins[2]); s != "v1 2 Hi" {
+		t.Errorf("2 got %q", s)
+	}
+
+	n.Heal()
+	c.Send([]byte("v1 2 Bye"))
+	if s := recv(ins[0]); s != "v1 2 Bye" {
+		t.Errorf("0 got %q after healing", s)
+	}
+	if total, types := n.Sent(); total != 3 || types["Hi"] != 2 {
+		t.Errorf("sent %d, %v", total, types)
+	}
+}
+
+// TestSeed checks that the same seed loses the same copies.
+func TestSeed(t *testing.T) {
+	lost := func() []bool {
+		n := New(Config{Loss: 0.5}, 7)
+		a := n.Join(0)
+		in := pump(a)
+		var l []bool
+		for i := 0; i < 20; i++ {
+			a.Send([]byte("x"))
+			l = append(l, recv(in) == "")
+		}
+		return l
+	}
+	l1, l2 := lost(), lost()
+	for i := range l1 {
+		if l1[i] != l2[i] {
+			t.Fatalf("copy %d lost in one run and not the other", i)
+		}
+	}
+}
+
+func TestDelayAndDup(t *testing.T) {
+	n := New(Config{Dup: 1, MaxDelay: 5 * time.Millisecond}, 3)
+	a := n.Join(0)
+	in := pump(a)
+	a.Send([]byte("x"))
+	if recv(in) != "x" || recv(in) != "x" {
+		t.Error("did not get two copies")
+	}
+	a.Close()
+	if err := a.Send([]byte("x")); err != ErrClosed {
+		t.Errorf("send after close: %v", err)
+	}
+}
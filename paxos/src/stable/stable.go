@@ -0,0 +1,236 @@
+// Package stable is the stable storage that participants keep their
+// promises in: a log they append to and read back after a restart,
+// and for those that have one, a snapshot.  Files keeps them on disk
+// and Mem in memory, for tests.
+package stable
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A Log is a recovery log.  What was appended survives a crash only
+// once Sync returns, and a participant syncs a promise before it
+// tells anyone about it.  A crash in the middle of an append can
+// leave a torn record at the end, which recovery cuts off with
+// Truncate before it appends anything, or what it appended would be
+// lost behind the torn record at the next recovery.
+type Log interface {
+	io.Writer                 // appends to the log
+	Sync() error              // makes what was appended durable
+	Log() io.ReadCloser       // reads the log from the start
+	Truncate(off int64) error // durably drops what comes after off
+}
+
+// Storage is a log with a snapshot, which holds a state machine as
+// of some point in the log, so that recovery applies only what came
+// after it.
+type Storage interface {
+	Log
+	SaveSnapshot(b []byte) error   // replaces the snapshot
+	LoadSnapshot() ([]byte, error) // nil if there is none
+}
+
+// MustSync makes what was appended to l durable.  A participant that
+// cannot keep its promises must not go on making them, so it panics
+// if l cannot.
+func MustSync(l Log) {
+	if err := l.Sync(); err != nil {
+		log.Panic(err)
+	}
+}
+
+// MustTruncate cuts l off at off, panicking as MustSync does.
+func MustTruncate(l Log, off int64) {
+	if err := l.Truncate(off); err != nil {
+		log.Panic(err)
+	}
+}
+
+// A Reader reads a log for recovery and knows how far into the log
+// it has got, so that recovery can truncate the log after the last
+// good record.
+type Reader struct {
+	*bufio.Reader
+	c *counter
+}
+
+type counter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *counter) Read(b []byte) (int, error) {
+	k, err := c.r.Read(b)
+	c.n += int64(k)
+	return k, err
+}
+
+func NewReader(r io.Reader) *Reader {
+	c := &counter{r: r}
+	return &Reader{bufio.NewReader(c), c}
+}
+
+// Offset is the offset in the log of the next byte to be read.
+func (r *Reader) Offset() int64 {
+	return r.c.n - int64(r.Buffered())
+}
+
+// Files is storage in PREFIX-N.log and PREFIX-N.snap, like
+// upaxos-1.log.
+type Files struct {
+	Dir    string
+	Prefix string
+	ID     int
+	f      *os.File
+}
+
+func Open(dir, prefix string, id int) (*Files, error) {
+	fs := &Files{Dir: dir, Prefix: prefix, ID: id}
+	f, err := os.OpenFile(fs.name("log"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	fs.f = f
+	return fs, nil
+}
+
+func (fs *Files) name(ext string) string {
+	return filepath.Join(fs.Dir, fmt.Sprintf("%s-%d.%s", fs.Prefix, fs.ID, ext))
+}
+
+func (fs *Files) Write(b []byte) (int, error) {
+	return fs.f.Write(b)
+}
+
+func (fs *Files) Sync() error {
+	return fs.f.Sync()
+}
+
+func (fs *Files) Log() io.ReadCloser {
+	f, err := os.Open(fs.name("log"))
+	if err != nil {
+		log.Panic(err)
+	}
+	return f
+}
+
+func (fs *Files) Truncate(off int64) error {
+	if err := fs.f.Truncate(off); err != nil {
+		return err
+	}
+	return fs.f.Sync()
+}
+
+func (fs *Files) SaveSnapshot(b []byte) error {
+	tmp := fs.name("snap.tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, fs.name("snap"))
+	}
+	if err == nil {
+		// The rename is durable only once the directory is, and
+		// the log may be compacted against the new snapshot.
+		err = syncDir(fs.Dir)
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	d.Close()
+	return err
+}
+
+func (fs *Files) LoadSnapshot() ([]byte, error) {
+	b, err := os.ReadFile(fs.name("snap"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (fs *Files) Close() error {
+	return fs.f.Close()
+}
+
+// Mem is storage in memory, for participants in tests.  It survives
+// the participant, so a new one can recover from it, and it can
+// crash, losing what was not synced.
+type Mem struct {
+	mu     sync.Mutex
+	log    bytes.Buffer
+	synced int // bytes of log that survive a crash
+	snap   []byte
+}
+
+func (m *Mem) Write(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.log.Write(b)
+}
+
+func (m *Mem) Sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.synced = m.log.Len()
+	return nil
+}
+
+// Crash returns the storage that a participant would find after a
+// crash: the log as of the last Sync, and the snapshot, which is
+// replaced atomically.
+func (m *Mem) Crash() *Mem {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := &Mem{synced: m.synced, snap: m.snap}
+	c.log.Write(m.log.Bytes()[:m.synced])
+	return c
+}
+
+func (m *Mem) Log() io.ReadCloser {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(append([]byte{}, m.log.Bytes()...)))
+}
+
+func (m *Mem) Truncate(off int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.log.Truncate(int(off))
+	if int64(m.synced) > off {
+		m.synced = int(off)
+	}
+	return nil
+}
+
+func (m *Mem) SaveSnapshot(b []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snap = append([]byte{}, b...)
+	return nil
+}
+
+func (m *Mem) LoadSnapshot() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snap, nil
+}
@@ -0,0 +1,90 @@
+package stable
+
+import (
+	"io"
+	"testing"
+)
+
+func check(t *testing.T, what string, l Log, want string) {
+	t.Helper()
+	r := l.Log()
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil || string(b) != want {
+		t.Errorf("%s: log %q, %v, want %q", what, b, err, want)
+	}
+}
+
+func TestMem(t *testing.T) {
+	m := &Mem{}
+	io.WriteString(m, "promise\n")
+	m.Sync()
+	io.WriteString(m, "accept\n")
+	m.SaveSnapshot([]byte("snap"))
+	check(t, "before", m, "promise\naccept\n")
+
+	// a crash loses what was not synced, and keeps the snapshot
+	c := m.Crash()
+	check(t, "after", c, "promise\n")
+	if b, _ := c.LoadSnapshot(); string(b) != "snap" {
+		t.Errorf("snapshot %q after a crash", b)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := Open(dir, "test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.LoadSnapshot(); b != nil || err != nil {
+		t.Errorf("new snapshot %q, %v", b, err)
+	}
+	io.WriteString(fs, "promise\n")
+	MustSync(fs)
+	fs.SaveSnapshot([]byte("snap"))
+	fs.Close()
+
+	// another process finds what the first left
+	fs, err = Open(dir, "test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	io.WriteString(fs, "accept\n")
+	check(t, "reopened", fs, "promise\naccept\n")
+	if b, err := fs.LoadSnapshot(); string(b) != "snap" || err != nil {
+		t.Errorf("snapshot %q, %v", b, err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	fs, err := Open(t.TempDir(), "test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	for _, l := range []Log{&Mem{}, fs} {
+		io.WriteString(l, "promise\naccept")
+		MustSync(l)
+		r := l.Log()
+		br := NewReader(r)
+		br.ReadString('\n')
+		off := br.Offset()
+		r.Close()
+		if off != int64(len("promise\n")) {
+			t.Errorf("%T: offset %d after the first record", l, off)
+		}
+
+		// what comes after the truncation follows the good record
+		MustTruncate(l, off)
+		io.WriteString(l, "learn\n")
+		MustSync(l)
+		check(t, "truncated", l, "promise\nlearn\n")
+	}
+	m := &Mem{}
+	io.WriteString(m, "promise\naccept\n")
+	m.Sync()
+	m.Truncate(3)
+	check(t, "crashed", m.Crash(), "pro")
+}
@@ -0,0 +1,137 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"quorum"
+)
+
+type slot struct {
+	node, i int64
+}
+
+type vote struct {
+	i, b int64
+	v    string
+}
+
+// Check replays the trace and returns what breaks the invariants:
+// an acceptor that promises or accepts below what it promised before,
+// two values accepted with one ballot, two values chosen in one
+// instance, and a learner learning what no quorum accepted.  A value
+// is chosen when a phase-2 quorum, as the Config events say, accepts
+// it with the same ballot.  Without a Config, a majority of the
+// acceptors in the trace is a quorum.
+func Check(r io.Reader) ([]string, error) {
+	bad := []string{}
+	var q quorum.System
+	acceptors := map[int64]bool{}
+	promised := map[slot]int64{}
+	votes := map[vote]map[int64]bool{}
+	ballots := map[[2]int64]string{} // the value for each instance and ballot
+	learned := map[int64][]string{}
+	err := Read(r, func(e Event) {
+		switch e.Kind {
+		case Config:
+			s, err := quorum.Parse(e.Quorum, e.N)
+			if err != nil {
+				bad = append(bad, fmt.Sprintf("node %d: %s", e.Node, err))
+			} else if q == nil {
+				q = s
+			} else if s.String() != q.String() {
+				bad = append(bad, fmt.Sprintf("node %d has quorums %v, not %v",
+					e.Node, s, q))
+			}
+		case Promise, Accept:
+			acceptors[e.Node] = true
+			k := slot{e.Node, e.Instance}
+			if p, ok := promised[k]; ok && e.Ballot < p {
+				bad = append(bad, fmt.Sprintf(
+					"node %d %s %d in %d after promising %d",
+					e.Node, verb(e.Kind), e.Ballot, e.Instance, p))
+			} else {
+				promised[k] = e.Ballot
+			}
+			if e.Kind == Promise || e.Value == nil {
+				return
+			}
+			b := [2]int64{e.Instance, e.Ballot}
+			if v, ok := ballots[b]; !ok {
+				ballots[b] = *e.Value
+			} else if v != *e.Value {
+				bad = append(bad, fmt.Sprintf(
+					"%q and %q both accepted with %d in %d",
+					v, *e.Value, e.Ballot, e.Instance))
+			}
+			vt := vote{e.Instance, e.Ballot, *e.Value}
+			if votes[vt] == nil {
+				votes[vt] = map[int64]bool{}
+			}
+			votes[vt][e.Node] = true
+		case Learn:
+			if e.Value != nil {
+				learned[e.Instance] = append(learned[e.Instance], *e.Value)
+			}
+		}
+	})
+	if q == nil {
+		q = quorum.Majority(len(acceptors))
+	}
+
+	chosen := map[int64]map[string]bool{}
+	for vt, ids := range votes {
+		if !q.Phase2(ids) {
+			continue
+		}
+		if chosen[vt.i] == nil {
+			chosen[vt.i] = map[string]bool{}
+		}
+		chosen[vt.i][vt.v] = true
+	}
+	is := []int64{}
+	for i := range chosen {
+		is = append(is, i)
+	}
+	for _, i := range sorted(is) {
+		if len(chosen[i]) > 1 {
+			bad = append(bad, fmt.Sprintf("%d values chosen in %d: %q",
+				len(chosen[i]), i, values(chosen[i])))
+		}
+	}
+	is = []int64{}
+	for i := range learned {
+		is = append(is, i)
+	}
+	for _, i := range sorted(is) {
+		for _, v := range learned[i] {
+			if !chosen[i][v] {
+				bad = append(bad, fmt.Sprintf(
+					"%q learned in %d, but no quorum accepted it", v, i))
+			}
+		}
+	}
+	return bad, err
+}
+
+func verb(kind string) string {
+	if kind == Promise {
+		return "promised"
+	}
+	return "accepted"
+}
+
+func sorted(is []int64) []int64 {
+	sort.Slice(is, func(a, b int) bool { return is[a] < is[b] })
+	return is
+}
+
+func values(m map[string]bool) []string {
+	vs := []string{}
+	for v := range m {
+		vs = append(vs, v)
+	}
+	sort.Strings(vs)
+	return vs
+}
@@ -0,0 +1,130 @@
+package trace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"quorum"
+)
+
+// maxTLAAcceptors bounds the acceptors for TLA, which lists every
+// phase-2 quorum.
+const maxTLAAcceptors = 12
+
+// TLA writes a TLA+ module that defines the constants a trace
+// validation spec needs, like tla/PaxosTrace.tla:
+//
+//	Acceptors	the acceptors' node IDs
+//	Quorums		every set of them that is a phase-2 quorum
+//	Trace		the promises, accepts and learns in order, as
+//			records [node, action, i, b, v]
+//
+// Sends and receives are left out, since the spec checks only what
+// participants do with them.  A missing value is "".
+func TLA(r io.Reader, w io.Writer, module string) error {
+	var q quorum.System
+	acceptors := map[int64]bool{}
+	steps := []string{}
+	err := Read(r, func(e Event) {
+		var action string
+		switch e.Kind {
+		case Config:
+			if s, err := quorum.Parse(e.Quorum, e.N); err == nil && q == nil {
+				q = s
+			}
+			return
+		case Promise:
+			action = "Promise"
+		case Accept:
+			action = "Accept"
+		case Learn:
+			action = "Learn"
+		default:
+			return
+		}
+		if e.Kind != Learn {
+			acceptors[e.Node] = true
+		}
+		v := ""
+		if e.Value != nil {
+			v = *e.Value
+		}
+		steps = append(steps, fmt.Sprintf(
+			"[node |-> %d, action |-> %q, i |-> %d, b |-> %d, v |-> %s]",
+			e.Node, action, e.Instance, e.Ballot, tlaString(v)))
+	})
+	if err != nil {
+		return err
+	}
+	ids := []int64{}
+	for a := range acceptors {
+		ids = append(ids, a)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	if len(ids) > maxTLAAcceptors {
+		return fmt.Errorf("trace: %d acceptors are too many to list quorums",
+			len(ids))
+	}
+	if q == nil {
+		q = quorum.Majority(len(ids))
+	}
+	quorums := []string{}
+	for set := 1; set < 1<<len(ids); set++ {
+		in := map[int64]bool{}
+		for k, id := range ids {
+			if set&(1<<k) != 0 {
+				in[id] = true
+			}
+		}
+		if q.Phase2(in) {
+			quorums = append(quorums, setString(in))
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "---- MODULE %s ----\n", module)
+	fmt.Fprintf(bw, "\\* %d steps, quorums %v\n", len(steps), q)
+	fmt.Fprintf(bw, "Acceptors == %s\n", setString(acceptors))
+	fmt.Fprintf(bw, "Quorums == {%s}\n", strings.Join(quorums, ", "))
+	fmt.Fprintf(bw, "Trace == <<\n  %s\n>>\n", strings.Join(steps, ",\n  "))
+	fmt.Fprintf(bw, "====\n")
+	return bw.Flush()
+}
+
+func setString(ids map[int64]bool) string {
+	s := []string{}
+	for id := range ids {
+		s = append(s, fmt.Sprint(id))
+	}
+	sort.Strings(s)
+	return "{" + strings.Join(s, ", ") + "}"
+}
+
+// tlaString quotes s for TLA+, which knows fewer escapes than Go.
+// Other control characters become "?".
+func tlaString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c < ' ' || c == 0x7f:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
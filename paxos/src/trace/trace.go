@@ -0,0 +1,73 @@
+// Package trace writes traces of Paxos participants as JSON lines,
+// one Event per line: what each one sends and receives, and what it
+// promises, accepts and learns.  Check replays a trace and reports
+// what breaks the Paxos invariants, and TLA writes the state changes
+// for a TLA+ spec to check step by step.
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event kinds.  A participant's trace starts with a Config, and its
+// Promise and Accept events come after what they record is durable,
+// so a restart never goes back on one.
+const (
+	Config  = "config"  // N and Quorum for the group
+	Send    = "send"    // Msg went out
+	Recv    = "recv"    // Msg came in
+	Promise = "promise" // no accepting below Ballot in Instance
+	Accept  = "accept"  // accepted Value with Ballot in Instance
+	Learn   = "learn"   // learned Value was chosen in Instance
+)
+
+type Event struct {
+	T        int64 // Unix nanoseconds
+	Node     int64
+	Kind     string
+	Msg      string  `json:",omitempty"`
+	Instance int64   `json:",omitempty"`
+	Ballot   int64   `json:",omitempty"`
+	Value    *string `json:",omitempty"`
+	N        int     `json:",omitempty"`
+	Quorum   string  `json:",omitempty"` // as quorum.Parse takes it
+}
+
+// A Writer adds events to a trace.  Participants in one process may
+// share one.  A nil Writer adds nothing, so participants need not
+// check whether they are traced.
+type Writer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: json.NewEncoder(w)}
+}
+
+func (t *Writer) Add(e Event) {
+	if t == nil {
+		return
+	}
+	e.T = time.Now().UnixNano()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enc.Encode(e)
+}
+
+// Read calls f with each event in r, in order.
+func Read(r io.Reader, f func(Event)) error {
+	d := json.NewDecoder(r)
+	for {
+		var e Event
+		if err := d.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		f(e)
+	}
+}
@@ -0,0 +1,92 @@
+package trace
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func events(es ...Event) *bytes.Buffer {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	for _, e := range es {
+		w.Add(e)
+	}
+	return &b
+}
+
+func val(s string) *string {
+	return &s
+}
+
+func TestCheckGood(t *testing.T) {
+	b := events(
+		Event{Node: 0, Kind: Config, N: 3, Quorum: "majority"},
+		Event{Node: 0, Kind: Send, Msg: "v1 0 Propose 1 10"},
+		Event{Node: 0, Kind: Promise, Instance: 1, Ballot: 10},
+		Event{Node: 1, Kind: Promise, Instance: 1, Ballot: 10},
+		Event{Node: 0, Kind: Accept, Instance: 1, Ballot: 10, Value: val("a")},
+		Event{Node: 1, Kind: Accept, Instance: 1, Ballot: 10, Value: val("a")},
+		Event{Node: 2, Kind: Learn, Instance: 1, Value: val("a")},
+		// a later ballot may only choose the same value
+		Event{Node: 2, Kind: Promise, Instance: 1, Ballot: 12},
+		Event{Node: 2, Kind: Accept, Instance: 1, Ballot: 12, Value: val("a")},
+	)
+	if bad, err := Check(b); err != nil || len(bad) != 0 {
+		t.Errorf("%q, %v", bad, err)
+	}
+}
+
+func TestCheckBad(t *testing.T) {
+	b := events(
+		Event{Node: 0, Kind: Promise, Instance: 1, Ballot: 10},
+		Event{Node: 0, Kind: Accept, Instance: 1, Ballot: 7, Value: val("x")},
+		Event{Node: 1, Kind: Accept, Instance: 1, Ballot: 7, Value: val("y")},
+		Event{Node: 0, Kind: Accept, Instance: 2, Ballot: 1, Value: val("a")},
+		Event{Node: 1, Kind: Accept, Instance: 2, Ballot: 1, Value: val("a")},
+		Event{Node: 1, Kind: Accept, Instance: 2, Ballot: 3, Value: val("b")},
+		Event{Node: 2, Kind: Accept, Instance: 2, Ballot: 3, Value: val("b")},
+		Event{Node: 2, Kind: Learn, Instance: 3, Value: val("c")},
+	)
+	bad, err := Check(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"node 0 accepted 7 in 1 after promising 10",
+		`"x" and "y" both accepted with 7 in 1`,
+		`2 values chosen in 2: ["a" "b"]`,
+		`"c" learned in 3, but no quorum accepted it`,
+	}
+	if strings.Join(bad, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(bad, "\n"),
+			strings.Join(want, "\n"))
+	}
+}
+
+func TestTLA(t *testing.T) {
+	b := events(
+		Event{Node: 0, Kind: Config, N: 3, Quorum: "majority"},
+		Event{Node: 0, Kind: Promise, Instance: 1, Ballot: 10},
+		Event{Node: 1, Kind: Accept, Instance: 1, Ballot: 10, Value: val("a \"b\"\n")},
+		Event{Node: 2, Kind: Accept, Instance: 1, Ballot: 10, Value: val("a \"b\"\n")},
+		Event{Node: 2, Kind: Recv, Msg: "ignored"},
+	)
+	var out bytes.Buffer
+	if err := TLA(b, &out, "T"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"---- MODULE T ----",
+		"Acceptors == {0, 1, 2}",
+		"Quorums == {{0, 1}, {0, 2}, {1, 2}, {0, 1, 2}}",
+		`[node |-> 1, action |-> "Accept", i |-> 1, b |-> 10, v |-> "a \"b\"\n"]`,
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("no %s in\n%s", s, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "ignored") {
+		t.Errorf("message in\n%s", out.String())
+	}
+}
@@ -0,0 +1,210 @@
+package upaxos
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"lease"
+	"stable"
+	"trace"
+	"upnet"
+)
+
+type Accepted struct {
+	p int64
+	v string
+}
+
+func (n *Node) accept(c chan upnet.Msg, lf *log.Logger, lp []loggedPromise, la []loggedAccept) {
+	// per-instance record of minimum proposal number we can accept
+	minp := make(map[int64]int64)
+	accepted := make(map[int64]Accepted) // values by instance
+
+	// first, recover info from logged operations
+	for _, rec := range lp {
+		minp[rec.i] = rec.p
+	}
+	highest := int64(0) // highest instance with an accepted value
+	for _, rec := range la {
+		accepted[rec.i] = Accepted{rec.p, rec.v}
+		if rec.p > minp[rec.i] {
+			minp[rec.i] = rec.p
+		}
+		if rec.i > highest {
+			highest = rec.i
+		}
+	}
+
+	// While a lease we granted lasts, we refuse everyone else.  The
+	// grant is logged with the promise, so it outlasts a restart.
+	var g *lease.Grantor
+	if n.Lease.Duration > 0 {
+		g = lease.NewGrantor(n.Lease, lease.SystemClock)
+		for _, rec := range lp {
+			if rec.holder != nil {
+				g.Restore(*rec.holder, time.Unix(0, rec.until))
+			}
+		}
+	}
+	blocked := func(s int64) bool {
+		if g == nil || !g.Blocks(s) {
+			return false
+		}
+		holder, _ := g.Holder()
+		n.Log.Printf("refusing %d: lease held by %d", s, holder)
+		return true
+	}
+
+	inspect := func(s *Status) {
+		as := &s.Acceptor
+		as.Highest = highest
+		top := highest
+		all := []int64{}
+		for i := range minp {
+			all = append(all, i)
+			if i > top {
+				top = i
+			}
+		}
+		as.Instances = []AcceptorInstance{}
+		for _, i := range window(top, all) {
+			ai := AcceptorInstance{Instance: i, MinP: minp[i]}
+			if va, ok := accepted[i]; ok {
+				ai.Accepted = &Ballot{Proposal: va.p, Value: va.v}
+			}
+			as.Instances = append(as.Instances, ai)
+		}
+	}
+
+	// changes are the promises and accepts to trace once synced.
+	var changes []trace.Event
+	changed := func(kind string, i, p int64, v *string) {
+		if n.Trace != nil {
+			changes = append(changes, trace.Event{Node: int64(n.ID),
+				Kind: kind, Instance: i, Ballot: p, Value: v})
+		}
+	}
+
+	// handle returns the reply to m, "" for none, and whether it
+	// logged a record that must be synced before the reply goes out.
+	handle := func(m upnet.Msg) (string, bool) {
+		if len(m.F) < 2 {
+			return "", false
+		}
+		switch m.F[1] {
+		case "Propose":
+			p, err := newPropose(m)
+			if err != nil {
+				n.Log.Printf("dropping %v", err)
+				return "", false
+			}
+			var s string
+			min, present := minp[p.i]
+			if blocked(p.s) || (present && p.p < min) {
+				s = upnet.Record(nil, "%d NACK %d %d", n.ID, p.i, min)
+			} else if p.lease && highest > p.i {
+				// the leader is behind, so no lease yet
+				s = upnet.Record(nil, "%d NACK %d %d",
+					n.ID, highest, minp[highest])
+			} else {
+				minp[p.i] = p.p
+				tail, granted := "", ""
+				if p.lease && g != nil && g.Grant(p.s) {
+					tail = fmt.Sprintf("lease %d", p.round)
+					granted = fmt.Sprintf("lease %d %d",
+						p.s, g.Until().UnixNano())
+				}
+				if va, there := accepted[p.i]; there {
+					s = upnet.Record(&va.v, "%d Promise %d %d %d %s",
+						n.ID, p.i, p.p, va.p, tail)
+				} else {
+					s = upnet.Record(nil, "%d Promise %d %d %s",
+						n.ID, p.i, p.p, tail)
+				}
+				logRecord(lf, nil, "promise %d %d %s", p.i, p.p, granted)
+				changed(trace.Promise, p.i, p.p, nil)
+				return s, true
+			}
+			return s, false
+		case "Write":
+			wr, err := newWrite(m)
+			if err != nil {
+				n.Log.Printf("dropping %v", err)
+				return "", false
+			}
+			min, there := minp[wr.i]
+			var s string
+			if blocked(wr.s) {
+				s = upnet.Record(nil, "%d NACK %d %d", n.ID, wr.i, min)
+			} else if there && min > wr.p {
+				n.Log.Printf("acceptor with min %d ignoring Write %d %d %q",
+					min, wr.i, wr.p, wr.v)
+				s = upnet.Record(nil, "%d NACK %d %d", n.ID, wr.i, min)
+			} else {
+				s = upnet.Record(&wr.v, "%d Accept %d %d", n.ID, wr.i, wr.p)
+				logRecord(lf, &wr.v, "accept %d %d", wr.i, wr.p)
+				changed(trace.Accept, wr.i, wr.p, &wr.v)
+				accepted[wr.i] = Accepted{wr.p, wr.v}
+				// accepting is promising, even if the Propose
+				// never arrived, so no lower Write replaces it
+				minp[wr.i] = wr.p
+				if wr.i > highest {
+					highest = wr.i
+				}
+				return s, true
+			}
+			return s, false
+		}
+		return "", false
+	}
+
+	// A reply waits until what it tells of is synced.  Proposes and
+	// Writes that are already waiting join the batch, and one sync
+	// covers them all.
+	for {
+		var m upnet.Msg
+		select {
+		case <-n.proc.Done():
+			return
+		case in := <-n.inspectAccept:
+			inspect(in.s)
+			close(in.done)
+			continue
+		case m = <-c:
+		}
+		var replies []string
+		logged := 0
+		for more := true; more; {
+			s, l := handle(m)
+			if s != "" {
+				replies = append(replies, s)
+			}
+			if l {
+				logged++
+				if n.crash != nil && n.crash() {
+					n.proc.Halt()
+					return
+				}
+			}
+			more = false
+			if logged > 0 && logged < n.SyncBatch {
+				select {
+				case m = <-c:
+					more = true
+				default:
+				}
+			}
+		}
+		if logged > 0 {
+			stable.MustSync(n.store)
+		}
+		for _, e := range changes {
+			n.Trace.Add(e)
+		}
+		changes = changes[:0]
+		for _, s := range replies {
+			n.proc.Send(s)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package upaxos
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"paxosclient"
+	"quorum"
+	"rsm"
+	"simnet"
+	"upnet"
+)
+
+// phases times phase 1, from a Propose until a phase-1 quorum promised,
+// and phase 2, from a Write until a phase-2 quorum accepted, as the
+// messages go by on the network.
+type phases struct {
+	q quorum.System
+
+	mu    sync.Mutex
+	start map[ballot]time.Time // by instance and proposal number
+	heard map[ballot]map[int64]bool
+	total [2]time.Duration
+	n     [2]int
+}
+
+func newPhases(q quorum.System) *phases {
+	return &phases{
+		q:     q,
+		start: make(map[ballot]time.Time),
+		heard: make(map[ballot]map[int64]bool),
+	}
+}
+
+func (ph *phases) tap(from int, b []byte) {
+	m, err := upnet.Parse(b)
+	if err != nil || len(m.F) < 4 {
+		return
+	}
+	now := time.Now()
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	note := func(k int, bl ballot, s int64, enough func(map[int64]bool) bool) {
+		if ph.heard[bl] == nil {
+			return // started before the benchmark
+		}
+		ph.heard[bl][s] = true
+		if enough(ph.heard[bl]) {
+			ph.total[k] += now.Sub(ph.start[bl])
+			ph.n[k]++
+			delete(ph.heard, bl)
+		}
+	}
+	switch m.F[1] {
+	case "Propose":
+		p, _ := newPropose(m)
+		ph.begin(ballot{p.i, p.p, "1"}, now)
+	case "Promise":
+		p, _ := newPromise(m)
+		note(0, ballot{p.i, p.p, "1"}, p.s, ph.q.Phase1)
+	case "Write":
+		w, _ := newWrite(m)
+		ph.begin(ballot{w.i, w.p, "2"}, now)
+	case "Accept":
+		a, _ := newAccept(m)
+		note(1, ballot{a.i, a.p, "2"}, a.s, ph.q.Phase2)
+	}
+}
+
+// begin starts timing a phase, unless this is a retransmission.
+func (ph *phases) begin(bl ballot, now time.Time) {
+	if _, ok := ph.start[bl]; !ok {
+		ph.start[bl] = now
+		ph.heard[bl] = make(map[int64]bool)
+	}
+}
+
+func (ph *phases) mean(k int) float64 {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	if ph.n[k] == 0 {
+		return 0
+	}
+	return float64(ph.total[k]) / float64(ph.n[k]) / 1e6
+}
+
+// BenchmarkQuorum has one client get values chosen one after another
+// on a network that delays each copy of a message up to two
+// milliseconds.  A smaller phase-2 quorum waits for fewer of the slow
+// copies, and the larger phase-1 quorum it needs waits for more.
+func BenchmarkQuorum(b *testing.B) {
+	for _, bc := range []struct {
+		n    int
+		spec string
+	}{
+		{5, "majority"},
+		{5, "q1=4,q2=2"},
+		{5, "q1=5,q2=1"},
+		{6, "majority"},
+		{6, "grid=2x3"},
+	} {
+		b.Run(fmt.Sprintf("%d/%s", bc.n, bc.spec), func(b *testing.B) {
+			c := simConfig(bc.n)
+			c.Retry["Propose"] = 50 * time.Millisecond
+			c.Retry["Write"] = 50 * time.Millisecond
+			q, err := quorum.Parse(bc.spec, bc.n)
+			if err != nil {
+				b.Fatal(err)
+			}
+			c.Quorum = q
+			s := newSim(c, simnet.Config{MaxDelay: 2 * time.Millisecond}, 1)
+			defer s.Close()
+			ph := newPhases(q)
+
+			cl := paxosclient.New(s.Net.Join(100))
+			defer cl.Close()
+			cl.Retry = 100 * time.Millisecond
+			ctx := context.Background()
+			// the first value waits out the election
+			if _, err := cl.Propose(ctx, rsm.Set("k", "warm")); err != nil {
+				b.Fatal(err)
+			}
+			s.Net.Tap(func(from int, m []byte) {
+				s.tap(from, m)
+				ph.tap(from, m)
+			})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := cl.Propose(ctx, rsm.Set("k", fmt.Sprint(i))); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(ph.mean(0), "phase1-ms")
+			b.ReportMetric(ph.mean(1), "phase2-ms")
+		})
+	}
+}
+
+// BenchmarkBatch has as many clients as the leader queues requests
+// propose at once on a network that delays each copy of a message up
+// to a millisecond, with batching off and on, and reports how many
+// values are chosen a second and how many messages each one takes.
+// A BUSY would make a client back off and measure that instead, so
+// it fails the benchmark.
+func BenchmarkBatch(b *testing.B) {
+	for _, window := range []time.Duration{0, time.Millisecond, 5 * time.Millisecond} {
+		name := "off"
+		if window > 0 {
+			name = window.String()
+		}
+		b.Run(name, func(b *testing.B) {
+			c := simConfig(3)
+			c.Retry["Propose"] = 50 * time.Millisecond
+			c.Retry["Write"] = 50 * time.Millisecond
+			c.BatchWindow = window
+			s := newSim(c, simnet.Config{MaxDelay: time.Millisecond}, 1)
+			defer s.Close()
+
+			const clients = maxReqQ
+			cls := make([]*paxosclient.Client, clients)
+			for k := range cls {
+				cls[k] = paxosclient.New(s.Net.Join(100 + k))
+				defer cls[k].Close()
+				cls[k].Retry = 200 * time.Millisecond
+			}
+			ctx := context.Background()
+			// the first value waits out the election
+			if _, err := cls[0].Propose(ctx, rsm.Set("k", "warm")); err != nil {
+				b.Fatal(err)
+			}
+			var busy int64
+			s.Net.Tap(func(from int, m []byte) {
+				s.tap(from, m)
+				if p, err := upnet.Parse(m); err == nil &&
+					len(p.F) > 1 && p.F[1] == "BUSY" {
+					atomic.AddInt64(&busy, 1)
+				}
+			})
+			sent, _ := s.Net.Sent()
+			b.ResetTimer()
+			start := time.Now()
+			var wg sync.WaitGroup
+			for k, cl := range cls {
+				wg.Add(1)
+				go func(k int, cl *paxosclient.Client) {
+					defer wg.Done()
+					for i := k; i < b.N; i += clients {
+						v := rsm.Set(fmt.Sprint("k", k), fmt.Sprint(i))
+						if _, err := cl.Propose(ctx, v); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}(k, cl)
+			}
+			wg.Wait()
+			b.StopTimer()
+			after, _ := s.Net.Sent()
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "values/s")
+			b.ReportMetric(float64(after-sent)/float64(b.N), "msgs/op")
+			if n := atomic.LoadInt64(&busy); n > 0 {
+				b.Errorf("%d BUSY answers", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,606 @@
+package upaxos
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+
+	"elect"
+	"flow"
+	"lease"
+	"stable"
+	"upnet"
+)
+
+const maxReqQ = 10 // max 10 queued requests, or batches' worth
+
+// With leases on, a leader that keeps getting values chosen asks the
+// acceptors for a lease along with its promises, and it renews the
+// lease before it runs out.  While the lease is held, no one else can
+// get a value chosen, so the learner can answer reads from its own
+// state, once it has applied everything before the leader's instance.
+//
+// leaseView shares the leader's lease with the learner.
+type leaseView struct {
+	sync.Mutex
+	h         *lease.Holder // nil when leases are off
+	instance  int64         // the leader's instance
+	unsettled bool          // a value from another leader may be chosen there
+}
+
+// canRead says whether a learner that has applied everything through
+// applied may answer a read.
+func (lv *leaseView) canRead(applied int64) bool {
+	lv.Lock()
+	defer lv.Unlock()
+	return lv.h != nil && lv.h.Valid() && !lv.unsettled &&
+		applied >= lv.instance-1
+}
+
+func (lv *leaseView) setInstance(i int64, unsettled bool) {
+	lv.Lock()
+	defer lv.Unlock()
+	lv.instance = i
+	lv.unsettled = unsettled
+}
+
+func (n *Node) lead(c chan upnet.Msg, lf *log.Logger, lp []loggedPropose) {
+	instance := int64(1)         // consensus instance leader is trying to use
+	lastp := int64(n.ID)         // proposal number last sent
+	rq := list.New()             // queued requests
+	nrq := 0                     // number of queued requests
+	rqBytes := 0                 // size of the queued requests
+	var window <-chan time.Time  // when to stop gathering a batch
+	var r *Req                   // client request in progress
+	var v *string                // value to write
+	vp := int64(-1)              // proposal number associated with v
+	promised := map[int64]bool{} // who promised for r
+	accepted := map[int64]bool{} // who accepted for r
+	gaps := map[int64]bool{}     // instances learners want filled
+	resume := int64(0)           // instance to go back to after a fill
+
+	// A proposal number must never go with two values, even after
+	// a crash, so the leader logs and syncs each one before it
+	// proposes with it, and it starts above the ones it logged.
+	used := make(map[int64]int64) // highest proposal number by instance
+	for _, rec := range lp {
+		if rec.p > used[rec.i] {
+			used[rec.i] = rec.p
+		}
+	}
+	// number picks our next proposal number above p
+	number := func(p int64) {
+		if u, ok := used[instance]; ok && u > p {
+			p = u
+		}
+		g := int64(n.N)
+		p /= g
+		p++
+		lastp = p*g + int64(n.ID)
+	}
+	if _, ok := used[instance]; ok {
+		number(lastp)
+	}
+	// mark logs lastp before it is sent in a Propose
+	mark := func() {
+		if u, ok := used[instance]; !ok || u < lastp {
+			logRecord(lf, nil, "propose %d %d", instance, lastp)
+			stable.MustSync(n.store)
+			used[instance] = lastp
+		}
+	}
+	var dequeue func()
+	catchup := func(i, p int64) {
+		if r != nil && r.fill() && r.i == instance && i != instance {
+			// the fill lost its instance, and the learner asks again
+			n.Log.Printf("giving up filling instance %d", instance)
+			r = nil
+			if i < resume {
+				i, p = resume, 0
+			}
+			resume = 0
+			defer dequeue()
+		}
+		if i != instance {
+			// foreign values may be accepted there
+			n.leases.setInstance(i, true)
+		}
+		// v was for lastp, and the new one needs its own phase 1
+		v = nil
+		vp = int64(-1)
+		instance = i
+		promised = map[int64]bool{}
+		accepted = map[int64]bool{}
+		number(p)
+	}
+	nextInstance := func() {
+		i := instance + 1
+		if resume > i {
+			i = resume // back from filling a gap
+		}
+		resume = 0
+		catchup(i, 0)
+		// our lease kept others from accepting anything there
+		n.leases.setInstance(instance, false)
+	}
+
+	var tick <-chan time.Time // lease renewals
+	keepLease := false        // whether to keep a lease
+	misses := 0               // renewals in a row that got no lease
+	var round int64           // lease round in progress
+	var foreign bool          // a grant in round reported a foreign value
+	if n.Lease.Duration > 0 {
+		n.leases.Lock()
+		n.leases.h = lease.NewHolder(n.Lease, lease.SystemClock, 0)
+		// The acceptors that grant must meet every phase-2 quorum,
+		// or others could get a value accepted by one.  Every
+		// phase-1 quorum does, and no smaller set need.
+		n.leases.h.Enough = n.Quorum.Phase1
+		n.leases.instance = instance
+		n.leases.Unlock()
+		t := time.NewTicker(n.Lease.Duration / 3)
+		defer t.Stop()
+		tick = t.C
+	}
+	renew := func() {
+		// a lease round asks about our instance, not a gap
+		filling := r != nil && r.fill()
+		n.leases.Lock()
+		if n.leases.h.Valid() {
+			misses = 0
+		} else if misses++; misses > 3 {
+			keepLease = false // someone else leads
+		}
+		if keepLease && !filling {
+			round = n.leases.h.Begin()
+			foreign = false
+		}
+		n.leases.Unlock()
+		if keepLease && !filling {
+			mark()
+			n.proc.Send(upnet.Record(nil, "%d Propose %d %d lease %d",
+				n.ID, instance, lastp, round))
+		}
+	}
+	// noteGrant counts a promise that grants a lease
+	noteGrant := func(p Promise) {
+		if !p.lease || p.round != round ||
+			p.i != instance || p.p != lastp {
+			return
+		}
+		if p.v != nil && p.vp != lastp {
+			foreign = true
+		}
+		n.leases.Lock()
+		if n.leases.h.Granted(p.round, p.s) {
+			n.leases.unsettled = foreign
+		}
+		n.leases.Unlock()
+	}
+
+	// The phase in progress for r is retransmitted with backoff
+	// until it gets a quorum or the leader moves on.
+	var retry <-chan time.Time
+	var bo flow.Backoff
+	phase := ""
+	arm := func(typ string) {
+		phase = typ
+		bo = flow.Backoff{Base: n.Retry[typ], Max: n.MaxBackoff}
+		if bo.Base == 0 {
+			bo.Base = DefaultRetry
+		}
+		retry = time.After(bo.Next())
+	}
+	proposeMsg := func() string {
+		mark()
+		return upnet.Record(&r.v, "%d Propose %d %d",
+			n.ID, instance, lastp)
+	}
+	writeMsg := func() string {
+		return upnet.Record(v, "%d Write %d %d",
+			n.ID, instance, lastp)
+	}
+	propose := func() {
+		if r.fill() && r.i != instance {
+			if resume == 0 {
+				resume = instance
+			}
+			catchup(r.i, 0)
+		}
+		n.proc.Send(proposeMsg())
+		arm("Propose")
+	}
+	write := func() {
+		n.proc.Send(writeMsg())
+		arm("Write")
+	}
+	// whether a retried request is already being handled
+	pending := func(id string) bool {
+		if id == upnet.NoID {
+			return false
+		}
+		if _, done := n.chosen.lookup(id); done {
+			return true // the learner acknowledges it
+		}
+		if r != nil {
+			for _, q := range r.requests() {
+				if q.id == id {
+					return true
+				}
+			}
+		}
+		for e := rq.Front(); e != nil; e = e.Next() {
+			if e.Value.(*Req).id == id {
+				return true
+			}
+		}
+		return false
+	}
+	push := func(q *Req) {
+		rq.PushBack(q)
+		nrq++
+		rqBytes += len(q.cmd())
+	}
+	pop := func() *Req {
+		q := rq.Remove(rq.Front()).(*Req)
+		nrq--
+		rqBytes -= len(q.cmd())
+		return q
+	}
+	// take the next request that still needs choosing, after any
+	// gaps, since nothing past a gap can be applied
+	dequeue = func() {
+		if r != nil {
+			return
+		}
+		for g := range gaps {
+			if r == nil || g < r.i {
+				r = &Req{i: g, id: noOpID}
+			}
+		}
+		if r != nil {
+			delete(gaps, r.i)
+			return
+		}
+		for r == nil && rq.Front() != nil {
+			if q := pop(); !pending(q.id) {
+				r = q
+			}
+		}
+		if r == nil {
+			retry = nil
+			phase = ""
+			return
+		}
+		window = nil
+		if n.BatchWindow == 0 {
+			return
+		}
+		// the requests that waited go together, as many as fit,
+		// and the batch fits in a Write
+		rs := []*Req{r}
+		size := len(r.cmd())
+		whole := len(upnet.Batch([]string{r.cmd()}))
+		for rq.Front() != nil {
+			c := rq.Front().Value.(*Req).cmd()
+			more := len(upnet.Batch([]string{c})) - len(upnet.BatchID)
+			if size+len(c) > n.BatchBytes || whole+more > upnet.MaxCommand {
+				break
+			}
+			if q := pop(); !pending(q.id) {
+				rs = append(rs, q)
+				size += len(c)
+				whole += more
+			}
+		}
+		if len(rs) > 1 {
+			r = newBatch(rs)
+		}
+	}
+
+	leader := int64(elect.None)
+	et := time.NewTicker(n.Heartbeat)
+	defer et.Stop()
+	elected := et.C
+	forward := func(fr *Req) {
+		if leader == elect.None || fr.id == upnet.NoID {
+			// the leader heard it too, or the client retries
+			return
+		}
+		n.proc.Send(upnet.Record(&fr.v, "%d Forward %d %s",
+			n.ID, leader, fr.id))
+	}
+	take := func(newr Req) {
+		if reserved(newr.id) {
+			n.Log.Printf("dropping request with reserved ID %q", newr.id)
+			return
+		}
+		if pending(newr.id) {
+			return
+		}
+		if len(newr.cmd()) > upnet.MaxCommand {
+			// no Write could carry it
+			if leader == int64(n.ID) {
+				n.proc.Send(upnet.Record(nil, "%d TOOBIG %s",
+					n.ID, newr.id))
+			}
+			return
+		}
+		if leader != int64(n.ID) {
+			forward(&newr)
+		} else if r == nil && n.BatchWindow == 0 {
+			r = &newr
+			propose()
+		} else if nrq < maxReqQ ||
+			(n.BatchWindow > 0 && rqBytes < maxReqQ*n.BatchBytes) {
+			push(&newr)
+			if r != nil {
+				return
+			}
+			// gather a batch, but not for long
+			if window == nil {
+				window = time.After(n.BatchWindow)
+			}
+			if rqBytes >= n.BatchBytes {
+				dequeue()
+				if r != nil {
+					propose()
+				}
+			}
+		} else {
+			n.proc.Send(upnet.Record(nil, "%d BUSY %s",
+				n.ID, newr.id))
+		}
+	}
+	// hand over the requests we have when another leader takes over
+	abdicate := func() {
+		if r != nil && !r.fill() {
+			for _, q := range r.requests() {
+				forward(q)
+			}
+		}
+		r = nil
+		if resume > 0 {
+			catchup(resume, 0)
+			resume = 0
+		}
+		for e := rq.Front(); e != nil; e = e.Next() {
+			forward(e.Value.(*Req))
+		}
+		rq.Init()
+		nrq = 0
+		rqBytes = 0
+		window = nil
+		gaps = map[int64]bool{}
+		retry = nil
+		phase = ""
+		keepLease = false
+	}
+
+	inspect := func(s *Status) {
+		ls := &s.Leader
+		ls.Leader = leader
+		ls.Instance = instance
+		ls.Proposal = lastp
+		if r != nil {
+			ls.Request = r.id
+			ls.Phase = phase
+		}
+		ls.Queue = []string{}
+		for e := rq.Front(); e != nil; e = e.Next() {
+			ls.Queue = append(ls.Queue, e.Value.(*Req).id)
+		}
+		ls.Gaps = []int64{}
+		for g := range gaps {
+			ls.Gaps = append(ls.Gaps, g)
+		}
+		sortInstances(ls.Gaps)
+	}
+
+	for {
+		select {
+		case <-n.proc.Done():
+			return
+		case in := <-n.inspectLead:
+			inspect(in.s)
+			close(in.done)
+		case m := <-c:
+			if len(m.F) < 2 {
+				continue
+			}
+			if m.F[0] == "Request" {
+				newr, err := newReq(m)
+				if err != nil {
+					n.Log.Printf("dropping %v", err)
+					continue
+				}
+				if newr.v == "" {
+					// let the learner answer this read
+					continue
+				}
+				take(newr)
+				continue
+			}
+			switch m.F[1] {
+			case "Forward":
+				to, fr, err := newForward(m)
+				if err != nil {
+					n.Log.Printf("dropping %v", err)
+				} else if to == int64(n.ID) {
+					take(fr)
+				}
+			case "Gap":
+				_, g, err := newGap(m)
+				if err != nil {
+					n.Log.Printf("dropping %v", err)
+					continue
+				}
+				if leader != int64(n.ID) ||
+					(r != nil && r.fill() && r.i == g) {
+					continue
+				}
+				gaps[g] = true
+				if r == nil {
+					dequeue()
+					propose()
+				}
+			case "Promise":
+				p, err := newPromise(m)
+				if err != nil {
+					n.Log.Printf("dropping %v", err)
+					continue
+				}
+				if tick != nil {
+					noteGrant(p)
+				}
+				if r == nil {
+					if !p.lease {
+						n.Log.Print("ignoring Promise--no Req in progress")
+					}
+					continue
+				}
+				if p.i != instance {
+					oldi := instance
+					catchup(p.i, p.p)
+					n.Log.Printf("instance mismatch: %d => %d",
+						oldi, p.i)
+					continue
+				} else if p.p < lastp {
+					continue // ignore lower-numbered proposals
+				} else if p.p > lastp {
+					catchup(p.i, p.p) // snoop: like a NACK
+					continue
+				}
+				if n.Quorum.Phase1(promised) {
+					continue // the Write has its value already
+				}
+				if p.v != nil {
+					if p.vp > vp {
+						v = p.v
+						vp = p.vp
+					}
+				}
+				promised[p.s] = true
+				if n.Quorum.Phase1(promised) {
+					if v == nil {
+						cmd := r.cmd()
+						v = &cmd
+					}
+					write()
+				}
+			case "Accept":
+				if r == nil {
+					n.Log.Print("ignoring Accept with no Req in progress")
+					continue
+				}
+				a, err := newAccept(m)
+				if err != nil {
+					n.Log.Printf("dropping %v", err)
+					continue
+				}
+				if v == nil {
+					n.Log.Print("ignoring Accept: v == nil")
+					continue
+				}
+				if a.v != *v {
+					n.Log.Print("ignoring Accept: a.v != *v")
+					n.Log.Printf("a.v: %s", a.v)
+					n.Log.Printf(" *v: %s", *v)
+					continue
+				}
+				if a.i != instance {
+					n.Log.Print("ignoring Accept: instance mismatch")
+					continue
+				}
+				if a.p != lastp {
+					n.Log.Print("ignoring Accept: a.p != lastp")
+					n.Log.Printf("  a.p: %d", a.p)
+					n.Log.Printf("lastp: %d", lastp)
+					continue
+				}
+				accepted[a.s] = true
+				if n.Quorum.Phase2(accepted) {
+					if r.fill() {
+						// a no-op, or what was there already
+						n.Log.Printf("filled instance %d", instance)
+						r = nil
+					} else if a.v == r.cmd() {
+						for _, q := range r.requests() {
+							n.proc.Send(upnet.Record(nil, "%d OK %d %s",
+								n.ID, instance, q.id))
+						}
+						r = nil
+						keepLease = true
+					}
+					dequeue()
+					nextInstance()
+					if r != nil {
+						propose()
+					}
+				}
+			case "NACK":
+				nk, err := newNack(m)
+				if err != nil {
+					n.Log.Printf("dropping %v", err)
+					continue
+				}
+				if nk.i > instance || nk.p > lastp {
+					catchup(nk.i, nk.p)
+					if r != nil {
+						propose()
+					}
+				}
+			}
+		case <-retry:
+			retry = nil
+			if r == nil {
+				continue
+			}
+			done := true
+			for _, q := range r.requests() {
+				if _, ok := n.chosen.lookup(q.id); !ok {
+					done = false
+				}
+			}
+			if done {
+				// someone else got it chosen
+				r = nil
+				dequeue()
+				if r != nil {
+					propose()
+				}
+				continue
+			}
+			n.Log.Printf("retransmitting %s for instance %d", phase, instance)
+			// v is only settled once a quorum promised at lastp
+			if phase == "Write" && n.Quorum.Phase1(promised) {
+				n.proc.Send(writeMsg())
+			} else {
+				n.proc.Send(proposeMsg())
+			}
+			retry = time.After(bo.Next())
+		case <-elected:
+			l := n.elector.Leader()
+			if l == leader {
+				continue
+			}
+			n.Log.Printf("leader %d => %d", leader, l)
+			was := leader == int64(n.ID)
+			leader = l
+			if was {
+				abdicate()
+			}
+		case <-window:
+			window = nil
+			if r == nil {
+				dequeue()
+				if r != nil {
+					propose()
+				}
+			}
+		case <-tick:
+			renew()
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package upaxos
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"rsm"
+	"trace"
+	"upnet"
+)
+
+// chosenIDs maps the request ID of each chosen command to the first
+// instance it was chosen in.  The learner fills it in, and the leader
+// consults it so as not to propose a client's retry of a request its
+// learner knows was chosen.  It is in memory, per node, and a leader
+// may not have learned every choice yet, so a retry can be chosen
+// again.  apply skips it there, which is what keeps one request from
+// taking effect twice.
+type chosenIDs struct {
+	sync.Mutex
+	m map[string]int64
+}
+
+// note records id as chosen in instance i, unless it was chosen
+// earlier, and returns the instance where it was first chosen.
+func (c *chosenIDs) note(id string, i int64) int64 {
+	c.Lock()
+	defer c.Unlock()
+	if id == upnet.NoID || id == noOpID {
+		return i
+	}
+	if first, ok := c.m[id]; ok && first < i {
+		return first
+	}
+	c.m[id] = i
+	return i
+}
+
+func (c *chosenIDs) lookup(id string) (int64, bool) {
+	c.Lock()
+	defer c.Unlock()
+	i, ok := c.m[id]
+	return i, ok && id != upnet.NoID && id != noOpID
+}
+
+// commands returns the commands in the value chosen for instance i:
+// the value itself, or what it holds if it is a batch.
+func (n *Node) commands(i int64, cmd string) []string {
+	id, v := upnet.SplitCommand(cmd)
+	if id != upnet.BatchID {
+		return []string{cmd}
+	}
+	cmds, err := upnet.SplitBatch(v)
+	if err != nil {
+		n.Log.Printf("instance %d: %s", i, err)
+	}
+	return cmds
+}
+
+// history answers a client reading instance i, chosen as cmd: its
+// value, "noop" and no value for a no-op that filled a gap, or
+// "batch" and the values of a batch's commands, framed as by
+// upnet.Batch.
+func (n *Node) history(i int64, id, cmd string) string {
+	cid, v := upnet.SplitCommand(cmd)
+	switch cid {
+	case noOpID:
+		return upnet.Record(nil, "%d OK %d %s noop", n.ID, i, id)
+	case upnet.BatchID:
+		var vs []string
+		for _, c := range n.commands(i, cmd) {
+			_, cv := upnet.SplitCommand(c)
+			vs = append(vs, cv)
+		}
+		_, b := upnet.SplitCommand(upnet.Batch(vs))
+		return upnet.Record(&b, "%d OK %d %s batch", n.ID, i, id)
+	}
+	return upnet.Record(&v, "%d OK %d %s", n.ID, i, id)
+}
+
+// The Accepts for a given consensus instance
+// Storing the proposal number protects against out-of-order delivery
+// of accept messages by the network.  A value is chosen only when a
+// phase-2 quorum accepted it with the same proposal number, so hosts
+// are grouped by both.
+type Accepts struct {
+	by  map[int64]Accepted          // latest accepted value by participant (host) ID
+	who map[Accepted]map[int64]bool // hosts by value and proposal number
+}
+
+func newAccepts() Accepts {
+	return Accepts{
+		make(map[int64]Accepted),
+		make(map[Accepted]map[int64]bool),
+	}
+}
+func (n *Node) learn(c chan upnet.Msg, lf *log.Logger, ll []loggedLearn, sm rsm.StateMachine) {
+	history := make(map[int64]Accepts)
+	written := make(map[int64]string) // quorum-accepted value by instance
+	applied := n.loadSnapshot(sm)     // last instance applied to sm
+
+	// The state machine sees each request once, in the first
+	// instance that chose it, and it never sees a later instance
+	// before an earlier one.  The requests in a batch share their
+	// instance.
+	apply := func() {
+		for {
+			cmd, ok := written[applied+1]
+			if !ok {
+				return
+			}
+			applied++
+			for _, c := range n.commands(applied, cmd) {
+				id, v := upnet.SplitCommand(c)
+				if id == noOpID {
+					n.Log.Printf("instance %d is a no-op", applied)
+				} else if first, ok := n.chosen.lookup(id); ok && first != applied {
+					n.Log.Printf("not applying request %s again in %d",
+						id, applied)
+				} else {
+					sm.Apply(applied, v)
+				}
+			}
+			if n.SnapEvery > 0 && applied%n.SnapEvery == 0 {
+				n.saveSnapshot(sm, applied)
+			}
+		}
+	}
+
+	// A value may be learned while an earlier instance never gets a
+	// quorum, and then nothing after the gap can be applied.  The
+	// learner notes each gap below the highest instance it learned,
+	// and while a gap stays open, it asks the leader to fill it.
+	missing := make(map[int64]time.Time) // gaps by when last reported
+	top := applied                       // highest instance learned
+	noteGaps := func(i int64) {
+		delete(missing, i)
+		for ; top < i; top++ {
+			if _, ok := written[top]; !ok && top > applied {
+				missing[top] = time.Now()
+			}
+		}
+	}
+	reportGaps := func() {
+		for i, t := range missing {
+			if _, ok := written[i]; ok || i <= applied {
+				delete(missing, i)
+			} else if time.Since(t) >= n.GapTimeout {
+				n.Log.Printf("instance %d is missing", i)
+				n.proc.Send(upnet.Record(nil, "%d Gap %d", n.ID, i))
+				missing[i] = time.Now()
+			}
+		}
+	}
+	gt := time.NewTicker(n.GapTimeout / 2)
+	defer gt.Stop()
+
+	// prime written with info recovered from log
+	for _, rec := range ll {
+		n.Log.Printf("load learned: i:%d v:%q", rec.i, rec.v)
+		written[rec.i] = rec.v
+		for _, c := range n.commands(rec.i, rec.v) {
+			id, _ := upnet.SplitCommand(c)
+			n.chosen.note(id, rec.i)
+		}
+	}
+	apply()
+	for i := range written {
+		noteGaps(i)
+	}
+
+	inspect := func(s *Status) {
+		ls := &s.Learner
+		ls.Applied = applied
+		ls.Highest = top
+		ls.Missing = []int64{}
+		for i := range missing {
+			ls.Missing = append(ls.Missing, i)
+		}
+		sortInstances(ls.Missing)
+		all := []int64{}
+		for i := range written {
+			all = append(all, i)
+		}
+		for i := range history {
+			if _, ok := written[i]; !ok {
+				all = append(all, i)
+			}
+		}
+		ls.Instances = []LearnerInstance{}
+		for _, i := range window(top, all) {
+			li := LearnerInstance{Instance: i, Accepts: []Ballot{}}
+			li.Value, li.Learned = written[i]
+			for b, who := range history[i].who {
+				if len(who) == 0 {
+					continue
+				}
+				from := []int64{}
+				for id := range who {
+					from = append(from, id)
+				}
+				sortInstances(from)
+				li.Accepts = append(li.Accepts, Ballot{b.p, b.v, from})
+			}
+			sort.Slice(li.Accepts, func(a, b int) bool {
+				return li.Accepts[a].Proposal < li.Accepts[b].Proposal
+			})
+			ls.Instances = append(ls.Instances, li)
+		}
+	}
+
+	for {
+		var m upnet.Msg
+		select {
+		case <-n.proc.Done():
+			return
+		case in := <-n.inspectLearn:
+			inspect(in.s)
+			close(in.done)
+			continue
+		case <-gt.C:
+			reportGaps()
+			continue
+		case m = <-c:
+		}
+		if len(m.F) < 2 {
+			continue
+		}
+		if m.F[0] == "Query" && m.V != nil {
+			// possibly stale, unless we hold the lease
+			if len(m.F) > 2 && m.F[2] == "leader" &&
+				!n.leases.canRead(applied) {
+				continue
+			}
+			rsp := sm.Query(*m.V)
+			n.proc.Send(upnet.Record(&rsp, "%d OK %d %s",
+				n.ID, applied, m.F[1]))
+			continue
+		}
+		if m.F[0] == "Request" {
+			r, err := newReq(m)
+			if err != nil {
+				n.Log.Printf("dropping %v", err)
+				continue
+			}
+			if r.v != "" {
+				// a retry of a chosen request gets its ack again
+				if i, ok := n.chosen.lookup(r.id); ok {
+					n.proc.Send(upnet.Record(nil, "%d OK %d %s",
+						n.ID, i, r.id))
+				}
+			} else if cmd, present := written[r.i]; present {
+				n.proc.Send(n.history(r.i, r.id, cmd))
+			}
+			continue
+		}
+		switch m.F[1] {
+		case "Accept":
+			a, err := newAccept(m)
+			if err != nil {
+				n.Log.Printf("dropping %v", err)
+				continue
+			}
+			if _, ok := written[a.i]; ok {
+				n.Log.Printf("ignoring Accept for written instance %d",
+					a.i)
+				continue
+			}
+			if _, ok := history[a.i]; !ok {
+				history[a.i] = newAccepts()
+			}
+			as := history[a.i]
+			old, wasThere := as.by[a.s]
+			if wasThere && a.p <= old.p {
+				continue // ignore old or repeated Accept
+			}
+			b := Accepted{a.p, a.v}
+			as.by[a.s] = b
+			if wasThere {
+				delete(as.who[old], a.s)
+			}
+			if as.who[b] == nil {
+				as.who[b] = make(map[int64]bool)
+			}
+			as.who[b][a.s] = true
+			n.Log.Printf("learner got %q from %d, for %d accepts",
+				a.v, a.s, len(as.who[b]))
+			if n.Quorum.Phase2(as.who[b]) {
+				logRecord(lf, &a.v, "learn %d", a.i)
+				written[a.i] = a.v
+				delete(history, a.i)
+				n.Trace.Add(trace.Event{Node: int64(n.ID),
+					Kind: trace.Learn, Instance: a.i, Value: &a.v})
+				if n.OnLearn != nil {
+					n.OnLearn(a.i, a.v)
+				}
+				for _, c := range n.commands(a.i, a.v) {
+					id, _ := upnet.SplitCommand(c)
+					if first := n.chosen.note(id, a.i); first != a.i {
+						n.Log.Printf("request %s chosen again in %d; first in %d",
+							id, a.i, first)
+					}
+				}
+				noteGaps(a.i)
+				apply()
+			}
+		}
+	}
+}
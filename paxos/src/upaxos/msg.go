@@ -0,0 +1,334 @@
+package upaxos
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"upnet"
+)
+
+// mustStrtoll is for the recovery log, which the participant wrote
+// itself.  Messages go through the parsers below, which return an
+// error instead, so that nobody on the network can crash a
+// participant.
+func mustStrtoll(s string) (n int64) {
+	n, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+func badMsg(m upnet.Msg) error {
+	return fmt.Errorf("bad message %q", m.F)
+}
+
+// ints parses each of f, or returns the first error.
+func ints(f ...string) ([]int64, error) {
+	ns := make([]int64, len(f))
+	for k, s := range f {
+		n, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		ns[k] = n
+	}
+	return ns, nil
+}
+
+// unlike Wikipedia, it's instance first
+func sipParse(f []string) (s, i, p int64, err error) {
+	ns, err := ints(f[0], f[2], f[3])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return ns[0], ns[1], ns[2], nil
+}
+
+// Request message format:
+// I	consensus instance (zero for new state)
+// ID	the client's request ID, absent from legacy requests
+// V	the value the client wants to set (ignored for lookup)
+type Req struct {
+	i  int64  // 0 for new instance
+	id string // upnet.NoID for legacy requests
+	v  string // ignored for history query
+
+	batch []*Req // the requests in a batch, whose id is upnet.BatchID
+}
+
+func newReq(m upnet.Msg) (Req, error) {
+	if len(m.F) < 2 || m.F[0] != "Request" {
+		return Req{}, badMsg(m)
+	}
+	i, err := strconv.ParseInt(m.F[1], 0, 64)
+	if err != nil {
+		return Req{}, badMsg(m)
+	}
+	id := upnet.NoID
+	if len(m.F) > 2 {
+		id = m.F[2]
+	}
+	s := ""
+	if m.V != nil {
+		s = *m.V
+	}
+	return Req{i: i, id: id, v: s}, nil
+}
+
+// cmd is the value the group agrees on for r.
+func (r *Req) cmd() string {
+	return upnet.Command(r.id, r.v)
+}
+
+// noOpID is the request ID of the no-op a leader proposes to fill a
+// gap, in the instance r.i.  The learner never applies a no-op.
+const noOpID = "!noop"
+
+func (r *Req) fill() bool {
+	return r.id == noOpID
+}
+
+// reserved reports whether a request ID is one the participants keep
+// for their own values, like noOpID and upnet.BatchID, all of which
+// begin with "!".  A leader drops a client's request with one.
+func reserved(id string) bool {
+	return strings.HasPrefix(id, "!")
+}
+
+// newBatch makes one request of rs, to be chosen in one instance.
+func newBatch(rs []*Req) *Req {
+	cmds := make([]string, len(rs))
+	for k, q := range rs {
+		cmds[k] = q.cmd()
+	}
+	_, v := upnet.SplitCommand(upnet.Batch(cmds))
+	return &Req{id: upnet.BatchID, v: v, batch: rs}
+}
+
+// requests returns the client requests that r stands for.
+func (r *Req) requests() []*Req {
+	if r.batch != nil {
+		return r.batch
+	}
+	return []*Req{r}
+}
+
+// OK message format:
+// S	sender ID
+// I	consensus instance
+// ID	the request ID being answered
+// V	the value, when answering a history query
+
+// leaseTail parses the optional "lease T" at the end of a Propose
+// or Promise.
+func leaseTail(f []string) (bool, int64, error) {
+	if len(f) == 2 && f[0] == "lease" {
+		t, err := strconv.ParseInt(f[1], 0, 64)
+		return err == nil, t, err
+	}
+	return false, 0, nil
+}
+
+// Propose message format is "S Propose I P [lease T]", where...
+// S	sender ID
+// I	instance
+// P	the proposal number the leader is attempting to use
+// T	the leader's lease round, when it also asks for a lease
+type Propose struct {
+	s, i, p int64
+	lease   bool
+	round   int64
+}
+
+func newPropose(m upnet.Msg) (Propose, error) {
+	f := m.F
+	if len(f) < 4 || f[1] != "Propose" {
+		return Propose{}, badMsg(m)
+	}
+	s, i, p, err := sipParse(f)
+	if err != nil {
+		return Propose{}, badMsg(m)
+	}
+	l, t, err := leaseTail(f[4:])
+	if err != nil {
+		return Propose{}, badMsg(m)
+	}
+	return Propose{s, i, p, l, t}, nil
+}
+
+// Promise message format is "S Promise I A [B V] [lease T]", where...
+// S	sender ID
+// I	instance
+// A	the minimum proposal number sender will accept
+// B	the proposal number associated with previously accepted value
+// V	the previously accepted value
+// T	the lease round, when the promise grants a lease
+type Promise struct {
+	// required fields
+	s, i, p int64
+
+	// optional fields, absent if no prior accepted value
+	vp int64   // proposal number associated with the accepted value
+	v  *string // the previously accepted value, nil if none accepted
+
+	lease bool  // whether the promise grants a lease
+	round int64 // the lease round
+}
+
+func newPromise(m upnet.Msg) (Promise, error) {
+	f := m.F
+	if len(f) < 4 || f[1] != "Promise" {
+		return Promise{}, badMsg(m)
+	}
+	src, i, p, err := sipParse(f)
+	if err != nil {
+		return Promise{}, badMsg(m)
+	}
+	vp := int64(0)
+	var v *string
+	tail := f[4:]
+	if m.V != nil || (len(f) > 4 && f[4] != "lease") {
+		if len(f) < 5 {
+			return Promise{}, badMsg(m)
+		}
+		if vp, err = strconv.ParseInt(f[4], 0, 64); err != nil {
+			return Promise{}, badMsg(m)
+		}
+		s := ""
+		if m.V != nil {
+			s = *m.V
+		}
+		v = &s
+		tail = f[5:]
+	}
+	l, t, err := leaseTail(tail)
+	if err != nil {
+		return Promise{}, badMsg(m)
+	}
+	return Promise{src, i, p, vp, v, l, t}, nil
+}
+
+// Accept message format:
+// S	sender ID
+// I	consensus instance number
+// P	proposal number
+// V	value accepted
+type Accept struct {
+	s, i, p int64
+	v       string
+}
+
+func newAccept(m upnet.Msg) (Accept, error) {
+	f := m.F
+	if len(f) < 4 || f[1] != "Accept" {
+		return Accept{}, badMsg(m)
+	}
+	src, i, p, err := sipParse(f)
+	if err != nil {
+		return Accept{}, badMsg(m)
+	}
+	s := ""
+	if m.V != nil {
+		s = *m.V
+	}
+	return Accept{src, i, p, s}, nil
+}
+
+// message format:
+// S	sender ID
+// I	consensus instance
+// P	minimum acceptable proposal number
+type Nack struct {
+	s, i, p int64
+}
+
+func newNack(m upnet.Msg) (Nack, error) {
+	f := m.F
+	if len(f) != 4 || f[1] != "NACK" {
+		return Nack{}, badMsg(m)
+	}
+	s, i, p, err := sipParse(f)
+	if err != nil {
+		return Nack{}, badMsg(m)
+	}
+	return Nack{s, i, p}, nil
+}
+
+// Write message format:
+// S	sender ID
+// I	consensus instance
+// P	proposal number
+// V	value
+type Write struct {
+	s, i, p int64
+	v       string
+}
+
+func newWrite(m upnet.Msg) (Write, error) {
+	f := m.F
+	if len(f) < 4 || f[1] != "Write" {
+		return Write{}, badMsg(m)
+	}
+	s, i, p, err := sipParse(f)
+	if err != nil {
+		return Write{}, badMsg(m)
+	}
+	v := ""
+	if m.V != nil {
+		v = *m.V
+	}
+	return Write{s, i, p, v}, nil
+}
+
+// Forward message format:
+// S	sender ID
+// L	the leader it is forwarded to
+// ID	the client's request ID
+// V	the value the client wants to set
+func newForward(m upnet.Msg) (int64, Req, error) {
+	f := m.F
+	if len(f) != 4 || f[1] != "Forward" {
+		return 0, Req{}, badMsg(m)
+	}
+	l, err := strconv.ParseInt(f[2], 0, 64)
+	if err != nil {
+		return 0, Req{}, badMsg(m)
+	}
+	v := ""
+	if m.V != nil {
+		v = *m.V
+	}
+	return l, Req{id: f[3], v: v}, nil
+}
+
+// Gap message format:
+// S	sender ID
+// I	an instance the sender has not learned, below one it has
+func newGap(m upnet.Msg) (s, i int64, err error) {
+	f := m.F
+	if len(f) != 3 || f[1] != "Gap" {
+		return 0, 0, badMsg(m)
+	}
+	ns, err := ints(f[0], f[2])
+	if err != nil {
+		return 0, 0, badMsg(m)
+	}
+	return ns[0], ns[1], nil
+}
+
+// Heartbeat message format:
+// S	sender ID
+// L	the leader the sender follows, elect.None if none yet
+func newHeartbeat(m upnet.Msg) (s, l int64, err error) {
+	f := m.F
+	if len(f) != 3 || f[1] != "Heartbeat" {
+		return 0, 0, badMsg(m)
+	}
+	ns, err := ints(f[0], f[2])
+	if err != nil {
+		return 0, 0, badMsg(m)
+	}
+	return ns[0], ns[1], nil
+}
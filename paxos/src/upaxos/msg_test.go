@@ -0,0 +1,67 @@
+package upaxos
+
+import (
+	"testing"
+
+	"upnet"
+)
+
+// TestBadMessages has the parsers turn away what anyone on the
+// network might send, without a panic.
+func TestBadMessages(t *testing.T) {
+	v := "x"
+	parse := map[string]func(upnet.Msg) error{
+		"Request":   func(m upnet.Msg) error { _, err := newReq(m); return err },
+		"Propose":   func(m upnet.Msg) error { _, err := newPropose(m); return err },
+		"Promise":   func(m upnet.Msg) error { _, err := newPromise(m); return err },
+		"Accept":    func(m upnet.Msg) error { _, err := newAccept(m); return err },
+		"NACK":      func(m upnet.Msg) error { _, err := newNack(m); return err },
+		"Write":     func(m upnet.Msg) error { _, err := newWrite(m); return err },
+		"Forward":   func(m upnet.Msg) error { _, _, err := newForward(m); return err },
+		"Gap":       func(m upnet.Msg) error { _, _, err := newGap(m); return err },
+		"Heartbeat": func(m upnet.Msg) error { _, _, err := newHeartbeat(m); return err },
+	}
+	for _, tc := range []struct {
+		typ string
+		m   upnet.Msg
+	}{
+		{"Request", upnet.Msg{F: []string{"Request"}}},
+		{"Request", upnet.Msg{F: []string{"Request", "x", "id"}, V: &v}},
+		{"Propose", upnet.Msg{F: []string{"1", "Propose", "2"}}},
+		{"Propose", upnet.Msg{F: []string{"1", "Propose", "x", "3"}}},
+		{"Propose", upnet.Msg{F: []string{"1", "Propose", "2", "3", "lease", "x"}}},
+		{"Promise", upnet.Msg{F: []string{"x", "Promise", "2", "3"}}},
+		{"Promise", upnet.Msg{F: []string{"1", "Promise", "2", "3"}, V: &v}},
+		{"Promise", upnet.Msg{F: []string{"1", "Promise", "2", "3", "x"}, V: &v}},
+		{"Accept", upnet.Msg{F: []string{"1", "Accept", "2", "0x"}}},
+		{"NACK", upnet.Msg{F: []string{"1", "NACK", "2", "3", "4"}}},
+		{"Write", upnet.Msg{F: []string{"1", "Write", "", "3"}, V: &v}},
+		{"Forward", upnet.Msg{F: []string{"1", "Forward", "x", "id"}, V: &v}},
+		{"Forward", upnet.Msg{F: []string{"1", "Forward"}}},
+		{"Gap", upnet.Msg{F: []string{"1", "Gap", "x"}}},
+		{"Gap", upnet.Msg{F: []string{"1", "Gap"}}},
+		{"Heartbeat", upnet.Msg{F: []string{"1", "Heartbeat"}}},
+		{"Heartbeat", upnet.Msg{F: []string{"one", "Heartbeat", "0"}}},
+	} {
+		if err := parse[tc.typ](tc.m); err == nil {
+			t.Errorf("no error for %q", tc.m.F)
+		}
+	}
+
+	// and take what is well formed
+	for typ, f := range map[string][]string{
+		"Request":   {"Request", "0", "id"},
+		"Propose":   {"1", "Propose", "2", "3", "lease", "4"},
+		"Promise":   {"1", "Promise", "2", "3", "1"},
+		"Accept":    {"1", "Accept", "2", "3"},
+		"NACK":      {"1", "NACK", "2", "3"},
+		"Write":     {"1", "Write", "2", "3"},
+		"Forward":   {"1", "Forward", "2", "id"},
+		"Gap":       {"1", "Gap", "2"},
+		"Heartbeat": {"1", "Heartbeat", "-1"},
+	} {
+		if err := parse[typ](upnet.Msg{F: f, V: &v}); err != nil {
+			t.Errorf("%q: %v", f, err)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Package upaxos is a Paxos participant that talks over an
+// unreliable broadcast channel, where every participant hears every
+// message.  Each participant plays all the roles, in goroutines:
+//
+//	leader:   handles Request, Forward, NACK, Promise, Accept, Gap;
+//		  sends Propose, Write, Forward
+//	acceptor: handles Propose, Write; sends NACK, Promise, Accept
+//	learner:  notes observed quorums, answers history requests and
+//		  queries, applies chosen values to the state machine,
+//		  and sends Gap for instances missing below what it learned
+//	watcher:  handles Heartbeat; sends Heartbeat
+//
+// The channel is anything that is a upnet.Conn, so participants can
+// run over a real network or together in one process over simnet.
+//
+// A client's retry carries the ID of its first try, and the leader
+// does not propose a request whose ID its learner has seen chosen.
+// A new leader that has not yet learned the first choice can still
+// get a retry chosen again in a later instance.  The learners then
+// apply it only once, in its first instance, and answer the retry
+// with that instance: requests are deduplicated when they execute,
+// not when they are chosen.
+package upaxos
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"elect"
+	"lease"
+	"quorum"
+	"rsm"
+	"stable"
+	"trace"
+	"upnet"
+	"upnode"
+)
+
+const DefaultRetry = 300 * time.Millisecond
+const DefaultMaxBackoff = 5 * time.Second
+const DefaultHeartbeat = 100 * time.Millisecond
+const DefaultSuspect = 500 * time.Millisecond
+const DefaultGapTimeout = time.Second
+const DefaultBatchBytes = 4000
+
+type Config struct {
+	ID int // this participant
+	N  int // participants in the group
+
+	// Quorum decides which participants are enough to promise and
+	// to accept.  Nil means a majority for both.
+	Quorum quorum.System
+
+	Lease lease.Config // Duration zero for no leases
+
+	// Each message type has its own rate limit, in messages a
+	// second, and the leader's retransmissions of each phase have
+	// their own starting delay.  Types not in Rates are not limited.
+	Rates      map[string]float64
+	Retry      map[string]time.Duration
+	MaxBackoff time.Duration
+
+	// With a BatchWindow, an idle leader gathers requests for that
+	// long, or until they make BatchBytes, and gets them chosen
+	// together in one instance.  Requests that queue while it is
+	// busy go together too.  Zero BatchWindow means no batches.
+	BatchWindow time.Duration
+	BatchBytes  int
+
+	// Only the elected leader runs phase 1.  The others forward
+	// client requests to it.
+	Heartbeat time.Duration // time between heartbeats
+	Suspect   time.Duration // suspect a participant not heard from in this long
+
+	SnapEvery int64 // snapshot the state machine this often, 0 never
+
+	// The acceptor syncs its log before it replies.  When more
+	// Proposes and Writes are waiting, it handles up to this many
+	// and syncs once for all of them.  Zero means one.
+	SyncBatch int
+
+	// A learner that has learned a higher instance but not a lower
+	// one waits this long before it asks the leader to fill the
+	// gap with a no-op, and asks again this often.
+	GapTimeout time.Duration
+
+	// With a group key, only clients' requests may go unsigned.
+	// With either key, admin commands need the admin key.
+	Auth *upnet.Auth
+
+	Log *log.Logger // debugging output, the standard logger if nil
+
+	// Trace, if set, gets every message sent and received, and
+	// each promise, accept and learn.
+	Trace *trace.Writer
+
+	// OnLearn, if set, is called with each value the learner
+	// learns, in the order it learns them.
+	OnLearn func(i int64, v string)
+}
+
+type Node struct {
+	Config
+
+	proc    *upnode.Process
+	store   stable.Storage
+	sm      rsm.StateMachine
+	elector *elect.Detector
+	chosen  chosenIDs
+	leases  leaseView
+
+	logBytes int64 // size of the recovery log, accessed atomically
+
+	// crash, if set, is asked after the acceptor logs a promise or
+	// accept and before it syncs and replies, whether the
+	// participant crashes right there.  Tests set it.
+	crash func() bool
+
+	// Status asks the roles for their parts over these.
+	inspectLead, inspectAccept, inspectLearn chan inspection
+}
+
+// New returns a participant that talks over conn, keeps its recovery
+// log and snapshots in store, and applies chosen values to sm.
+func New(c Config, conn upnet.Conn, store stable.Storage, sm rsm.StateMachine) *Node {
+	if c.Quorum == nil {
+		c.Quorum = quorum.Majority(c.N)
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = DefaultMaxBackoff
+	}
+	if c.Heartbeat == 0 {
+		c.Heartbeat = DefaultHeartbeat
+	}
+	if c.Suspect == 0 {
+		c.Suspect = DefaultSuspect
+	}
+	if c.BatchBytes == 0 {
+		c.BatchBytes = DefaultBatchBytes
+	}
+	if c.SyncBatch < 1 {
+		c.SyncBatch = 1
+	}
+	if c.GapTimeout == 0 {
+		c.GapTimeout = DefaultGapTimeout
+	}
+	if c.Auth == nil {
+		c.Auth = &upnet.Auth{}
+	}
+	if c.Log == nil {
+		c.Log = log.Default()
+	}
+	n := &Node{
+		Config:  c,
+		store:   store,
+		sm:      sm,
+		elector: elect.New(int64(c.ID), c.Suspect),
+		chosen:  chosenIDs{m: make(map[string]int64)},
+
+		inspectLead:   make(chan inspection),
+		inspectAccept: make(chan inspection),
+		inspectLearn:  make(chan inspection),
+	}
+	n.proc = upnode.New(upnode.Config{ID: c.ID, Auth: c.Auth, Log: c.Log,
+		Rates: c.Rates, Trace: c.Trace}, conn)
+	return n
+}
+
+// Start recovers from the log and starts the roles.
+func (n *Node) Start() {
+	lr := n.store.Log()
+	promises, accepts, learnings, proposals := n.loadLogData(lr)
+	lr.Close()
+	lf := log.New(counted{w: n.store, n: &n.logBytes},
+		fmt.Sprintf("%d: ", n.ID), 0)
+	logRecord(lf, nil, "starting %d", n.ID)
+	n.Trace.Add(trace.Event{Node: int64(n.ID), Kind: trace.Config,
+		N: n.N, Quorum: n.Quorum.String()})
+
+	leadc := make(chan upnet.Msg)
+	acceptc := make(chan upnet.Msg)
+	learnc := make(chan upnet.Msg)
+	watchc := make(chan upnet.Msg)
+	n.proc.Run(func() { n.watch(watchc) })
+	n.proc.Run(func() { n.lead(leadc, lf, proposals) })
+	n.proc.Run(func() { n.accept(acceptc, lf, promises, accepts) })
+	n.proc.Run(func() { n.learn(learnc, lf, learnings, n.sm) })
+	n.proc.Listen(leadc, acceptc, learnc, watchc)
+}
+
+// Close stops the roles and closes the channel.
+func (n *Node) Close() error {
+	return n.proc.Close()
+}
+
+// Wait returns when an admin command tells the participant to quit,
+// or when it is closed.
+func (n *Node) Wait() {
+	n.proc.Wait()
+}
+
+// watch sends heartbeats and feeds the ones it hears to the elector.
+func (n *Node) watch(c chan upnet.Msg) {
+	tick := time.NewTicker(n.Heartbeat)
+	defer tick.Stop()
+	for {
+		select {
+		case <-n.proc.Done():
+			return
+		case m := <-c:
+			if len(m.F) < 2 || m.F[1] != "Heartbeat" {
+				continue
+			}
+			s, l, err := newHeartbeat(m)
+			if err != nil {
+				n.Log.Printf("dropping %v", err)
+			} else if s != int64(n.ID) {
+				n.elector.Heard(s, l)
+			}
+		case <-tick.C:
+			n.proc.Send(upnet.Record(nil, "%d Heartbeat %d",
+				n.ID, n.elector.Leader()))
+		}
+	}
+}
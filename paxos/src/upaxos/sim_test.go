@@ -0,0 +1,776 @@
+package upaxos
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"lease"
+	"paxosclient"
+	"quorum"
+	"rsm"
+	"simgroup"
+	"simnet"
+	"stable"
+	"trace"
+	"upnet"
+)
+
+var runs = flag.Int("runs", 100, "seeded simulations for TestSafety")
+var seed = flag.Int64("seed", 0, "run TestSafety with only this seed")
+
+// A sim is a group of participants and clients in one process.
+type sim struct {
+	*simgroup.Group
+	cfg Config
+
+	crashes float64 // see crashAt; guarded by the network's Rand
+
+	mu       sync.Mutex
+	learned  map[int64]string // the first value any learner learned
+	accepted map[ballot]map[int64]bool
+	chosen   map[int64]string // the first value a quorum accepted
+	bad      []string         // what went wrong
+}
+
+// A ballot is a value proposed with a proposal number in an instance.
+type ballot struct {
+	i, p int64
+	v    string
+}
+
+// simConfig is fast enough for a simulation to get things chosen in
+// a few milliseconds.
+func simConfig(n int) Config {
+	return Config{
+		N: n,
+		Retry: map[string]time.Duration{
+			"Propose": 5 * time.Millisecond,
+			"Write":   5 * time.Millisecond,
+		},
+		MaxBackoff: 20 * time.Millisecond,
+		Heartbeat:  5 * time.Millisecond,
+		Suspect:    25 * time.Millisecond,
+		GapTimeout: 10 * time.Millisecond,
+		SnapEvery:  3,
+		Log:        log.New(io.Discard, "", 0),
+	}
+}
+
+func newSim(c Config, nc simnet.Config, seed int64) *sim {
+	if c.Quorum == nil {
+		c.Quorum = quorum.Majority(c.N)
+	}
+	s := &sim{
+		Group:    simgroup.New(nc, seed),
+		cfg:      c,
+		learned:  make(map[int64]string),
+		accepted: make(map[ballot]map[int64]bool),
+		chosen:   make(map[int64]string),
+	}
+	s.Net.Tap(s.tap)
+	s.Start(c.N, s.start)
+	return s
+}
+
+func (s *sim) node(i int) *Node {
+	return s.Nodes[i].(*Node)
+}
+
+// tap watches the Accepts go by, and checks that no instance has two
+// values that were each accepted by a phase-2 quorum, whether or not
+// any learner hears about it.
+func (s *sim) tap(from int, b []byte) {
+	m, err := upnet.Parse(b)
+	if err != nil || len(m.F) < 2 || m.F[1] != "Accept" {
+		return
+	}
+	a, err := newAccept(m)
+	if err != nil {
+		return
+	}
+	bl := ballot{a.i, a.p, a.v}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accepted[bl] == nil {
+		s.accepted[bl] = make(map[int64]bool)
+	}
+	s.accepted[bl][a.s] = true
+	if !s.cfg.Quorum.Phase2(s.accepted[bl]) {
+		return
+	}
+	if first, ok := s.chosen[a.i]; !ok {
+		s.chosen[a.i] = a.v
+	} else if first != a.v {
+		s.bad = append(s.bad, fmt.Sprintf(
+			"%q chosen in %d after %q", a.v, a.i, first))
+	}
+}
+
+// start starts participant i, recovering from its storage.
+func (s *sim) start(i int, conn upnet.Conn, store *stable.Mem) simgroup.Member {
+	c := s.cfg
+	c.ID = i
+	c.OnLearn = func(in int64, v string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if first, ok := s.learned[in]; !ok {
+			s.learned[in] = v
+		} else if first != v {
+			s.bad = append(s.bad, fmt.Sprintf(
+				"%d learned %q in %d, not %q", i, v, in, first))
+		}
+	}
+	n := New(c, conn, store, rsm.NewKV())
+	n.crash = func() bool {
+		crash := false
+		s.Net.Rand(func(rng *rand.Rand) {
+			crash = s.crashes > 0 && rng.Float64() < s.crashes
+		})
+		if crash {
+			go s.Recover(i, n)
+		}
+		return crash
+	}
+	n.Start()
+	return n
+}
+
+// crashAt has a participant crash with chance p each time its
+// acceptor logs a record, after the write and before the sync.
+func (s *sim) crashAt(p float64) {
+	s.Net.Rand(func(*rand.Rand) { s.crashes = p })
+}
+
+// simulate runs one seeded simulation and returns what went wrong.
+func simulate(seed int64) []string {
+	rng := rand.New(rand.NewSource(seed))
+	c := simConfig(3 + 2*rng.Intn(2))
+	// Flexible quorums: a small phase 2 with a large phase 1, or
+	// the rows and columns of a grid.
+	switch rng.Intn(4) {
+	case 2:
+		c.Quorum = quorum.Sizes{N: c.N, Q1: c.N - 1, Q2: 2}
+	case 3:
+		c = simConfig(6)
+		c.Quorum = quorum.Grid{Rows: 2, Cols: 3}
+	}
+	// Suspecting others sooner than they send heartbeats makes
+	// leaders come and go, so that they duel.
+	c.Suspect = []time.Duration{
+		2 * time.Millisecond, 8 * time.Millisecond, 25 * time.Millisecond,
+	}[rng.Intn(3)]
+	if rng.Intn(2) == 0 {
+		c.SyncBatch = 8
+	}
+	if rng.Intn(3) == 0 {
+		c.BatchWindow = time.Millisecond
+		c.BatchBytes = 100
+	}
+	if rng.Intn(4) == 0 {
+		c.Lease = lease.Config{
+			Duration: 20 * time.Millisecond,
+			Drift:    0.01,
+			Margin:   time.Millisecond,
+		}
+	}
+	s := newSim(c, simnet.Config{
+		Loss:     0.3 * rng.Float64(),
+		Dup:      0.2 * rng.Float64(),
+		MaxDelay: time.Duration(rng.Intn(3000)) * time.Microsecond,
+	}, seed)
+	defer s.Close()
+	if rng.Intn(3) == 0 {
+		s.crashAt(0.05)
+	}
+
+	chaos, stop := context.WithTimeout(context.Background(), 60*time.Millisecond)
+	defer stop()
+	go s.Disrupt(chaos, rng)
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	s.Propose(ctx, 2, 4, simgroup.PerClient(fmt.Sprint(seed)))
+	stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bad
+}
+
+// TestSafety checks that no two learners learn different values for
+// the same instance, and that no two values are chosen there, over
+// many simulations with lost, delayed, duplicated and reordered
+// messages, partitions and restarts.
+func TestSafety(t *testing.T) {
+	n := *runs
+	if testing.Short() && n > 20 {
+		n = 20
+	}
+	for _, b := range simgroup.Safety(n, *seed, simulate) {
+		t.Error(b)
+	}
+}
+
+// TestProgress checks that a group with some loss gets every value
+// chosen when nothing else goes wrong.
+func TestProgress(t *testing.T) {
+	s := newSim(simConfig(3), simnet.Config{
+		Loss:     0.1,
+		Dup:      0.05,
+		MaxDelay: time.Millisecond,
+	}, 1)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	if ok := s.Propose(ctx, 3, 10, simgroup.PerClient("p")); ok != 30 {
+		t.Errorf("%d of 30 values chosen", ok)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.bad {
+		t.Error(b)
+	}
+}
+
+// TestKeyed has clients with and without the group key propose to a
+// group that signs everything, and checks that only the one with the
+// key is heard.
+func TestKeyed(t *testing.T) {
+	c := simConfig(3)
+	c.Auth = &upnet.Auth{Key: []byte("sesame")}
+	s := newSim(c, simnet.Config{}, 1)
+	defer s.Close()
+	keyed := paxosclient.NewSealed(s.Net.Join(100), c.Auth)
+	unkeyed := paxosclient.New(s.Net.Join(101))
+	forger := paxosclient.NewSealed(s.Net.Join(102),
+		&upnet.Auth{Key: []byte("guess")})
+	for _, pc := range []*paxosclient.Client{keyed, unkeyed, forger} {
+		pc.Retry = 5 * time.Millisecond
+		defer pc.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	i, err := keyed.Propose(ctx, "one")
+	if err != nil {
+		t.Fatalf("keyed client: %v", err)
+	}
+	if v, err := keyed.Read(ctx, i); err != nil || len(v) != 1 || v[0] != "one" {
+		t.Errorf("keyed client read %q, %v", v, err)
+	}
+	short, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := unkeyed.Propose(short, "two"); err == nil {
+		t.Error("a client without the key got an answer")
+	}
+	if _, err := forger.Propose(short, "three"); err == nil {
+		t.Error("a client with the wrong key got an answer")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for in, cmd := range s.learned {
+		if _, v := upnet.SplitCommand(cmd); v == "two" || v == "three" {
+			t.Errorf("learned %q in %d", v, in)
+		}
+	}
+}
+
+// TestGapFill has a value chosen in instance 2 and nothing in
+// instance 1, and checks that the leader fills 1 with a no-op, so
+// that the learners can apply both.
+func TestGapFill(t *testing.T) {
+	s := newSim(simConfig(3), simnet.Config{}, 1)
+	defer s.Close()
+
+	// a proposer that skips phase 1 and instance 1
+	w := upnet.Command("w-1", rsm.Set("k", "v"))
+	stray := s.Net.Join(50)
+	defer stray.Close()
+	if err := stray.Send([]byte(upnet.Record(&w, "50 Write 2 50"))); err != nil {
+		t.Fatal(err)
+	}
+
+	cl := paxosclient.New(s.Net.Join(100))
+	defer cl.Close()
+	cl.Retry = 5 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	if v, err := cl.Read(ctx, 1); err != nil || len(v) != 0 {
+		t.Fatalf("instance 1 is %q, %v, not a no-op", v, err)
+	}
+	for {
+		a, v, err := cl.Query(ctx, rsm.Get("k"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a >= 2 {
+			if v != "v" {
+				t.Errorf("k is %q after instance %d", v, a)
+			}
+			break
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.learned[1] != upnet.Command(noOpID, "") || s.learned[2] != w {
+		t.Errorf("learned %q in 1 and %q in 2", s.learned[1], s.learned[2])
+	}
+	for _, b := range s.bad {
+		t.Error(b)
+	}
+}
+
+// TestReserved has a client send requests with the IDs the
+// participants keep for themselves, and checks that none is chosen.
+func TestReserved(t *testing.T) {
+	s := newSim(simConfig(3), simnet.Config{}, 1)
+	defer s.Close()
+	cl := paxosclient.New(s.Net.Join(100))
+	defer cl.Close()
+	cl.Retry = 5 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	if _, err := cl.Propose(ctx, rsm.Set("k", "before")); err != nil {
+		t.Fatal(err)
+	}
+
+	stray := s.Net.Join(50)
+	defer stray.Close()
+	for _, id := range []string{noOpID, upnet.BatchID, "!mine"} {
+		v := rsm.Set("k", id)
+		if id == upnet.BatchID {
+			v = upnet.Batch([]string{upnet.Command("x-1", v)})[len(id)+1:]
+		}
+		if err := stray.Send([]byte(upnet.Record(&v, "Request 0 %s", id))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cl.Propose(ctx, rsm.Set("k", "after")); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, cmd := range s.learned {
+		if id, v := upnet.SplitCommand(cmd); reserved(id) && v != "" {
+			t.Errorf("learned %q in %d", cmd, i)
+		}
+	}
+	for _, b := range s.bad {
+		t.Error(b)
+	}
+}
+
+// TestTooBig has a client send a request that fits in a datagram but
+// whose Write would not, and checks that the leader refuses it.
+func TestTooBig(t *testing.T) {
+	s := newSim(simConfig(3), simnet.Config{}, 1)
+	defer s.Close()
+	cl := paxosclient.New(s.Net.Join(100))
+	defer cl.Close()
+	cl.Retry = 5 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	if _, err := cl.Propose(ctx, rsm.Set("k", "before")); err != nil {
+		t.Fatal(err)
+	}
+
+	stray := s.Net.Join(50)
+	defer stray.Close()
+	v := strings.Repeat("x", upnet.MaxDatagram-100)
+	if err := stray.Send([]byte(upnet.Record(&v, "Request 0 big-1"))); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, upnet.MaxDatagram)
+	for {
+		n, err := stray.Recv(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := upnet.Parse(buf[:n])
+		if err == nil && len(m.F) == 3 && m.F[1] == "TOOBIG" && m.F[2] == "big-1" {
+			break
+		}
+	}
+	if _, err := cl.Propose(ctx, v); err != paxosclient.ErrTooBig {
+		t.Errorf("client proposed a value too big: %v", err)
+	}
+	if _, err := cl.Propose(ctx, rsm.Set("k", "after")); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, cmd := range s.learned {
+		if len(cmd) > upnet.MaxCommand {
+			t.Errorf("learned %d bytes in %d", len(cmd), i)
+		}
+	}
+	for _, b := range s.bad {
+		t.Error(b)
+	}
+}
+
+// TestCrash has participants crash between logging a promise or
+// accept and replying, and checks that what they synced keeps them
+// to what they said.
+func TestCrash(t *testing.T) {
+	for sd := int64(1); sd <= 20; sd++ {
+		c := simConfig(3)
+		c.SyncBatch = int(sd % 3 * 4)
+		s := newSim(c, simnet.Config{
+			Loss:     0.1,
+			Dup:      0.1,
+			MaxDelay: time.Millisecond,
+		}, sd)
+		s.crashAt(0.1)
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		s.Propose(ctx, 2, 10, simgroup.PerClient(fmt.Sprint(sd)))
+		cancel()
+		s.Close()
+		s.mu.Lock()
+		for _, b := range s.bad {
+			t.Errorf("seed %d: %s", sd, b)
+		}
+		s.mu.Unlock()
+		if s.Crashed() == 0 {
+			t.Errorf("seed %d: no crashes", sd)
+		}
+	}
+}
+
+// TestSnapshotCrash has every participant snapshot and then crash,
+// losing what it had not synced, and checks that a client's retry of
+// a request chosen before the snapshot is still known as chosen, and
+// so not applied again.
+func TestSnapshotCrash(t *testing.T) {
+	s := newSim(simConfig(3), simnet.Config{}, 1)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+
+	stray := s.Net.Join(50)
+	defer stray.Close()
+	oks := make(chan upnet.Msg, 100)
+	go func() {
+		buf := make([]byte, upnet.MaxDatagram)
+		for {
+			k, err := stray.Recv(buf)
+			if err != nil {
+				return
+			}
+			m, err := upnet.Parse(buf[:k])
+			if err == nil && len(m.F) >= 4 && m.F[1] == "OK" {
+				oks <- m
+			}
+		}
+	}()
+	// call sends a request until it gets an OK, and returns the
+	// instance the OK names.
+	call := func(id, v string) int64 {
+		for {
+			stray.Send([]byte(upnet.Record(&v, "Request 0 %s", id)))
+			retry := time.After(50 * time.Millisecond)
+			for {
+				select {
+				case m := <-oks:
+					if m.F[3] == id {
+						return mustStrtoll(m.F[2])
+					}
+					continue
+				case <-retry:
+				case <-ctx.Done():
+					t.Fatalf("no OK for %s", id)
+				}
+				break
+			}
+		}
+	}
+
+	// Only the last learn records may be unsynced, since the
+	// acceptors sync what came before along with their accepts.
+	call("r-1", rsm.Set("k", "a"))
+	call("r-2", rsm.Set("k", "b"))
+	last := call("r-3", rsm.Set("k", "c"))
+	applied := func() {
+		for i := range s.Nodes {
+			for s.node(i).Status().Learner.Applied < 3 {
+				if ctx.Err() != nil {
+					t.Fatalf("participant %d did not apply three values", i)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	applied()
+	for i := range s.Nodes {
+		s.Recover(i, s.Nodes[i])
+	}
+	applied() // from the snapshot, once each learner has recovered
+	for i := range s.Nodes {
+		if in, ok := s.node(i).chosen.lookup("r-3"); !ok || in != last {
+			t.Errorf("participant %d lost r-3 after the crash", i)
+		}
+	}
+	if again := call("r-3", rsm.Set("k", "c")); again != last {
+		t.Errorf("retry chosen in %d after the crash, first in %d",
+			again, last)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.bad {
+		t.Error(b)
+	}
+}
+
+// TestLeaseRestart has an acceptor that granted a lease restart, and
+// checks that it goes on refusing others until the lease runs out.
+func TestLeaseRestart(t *testing.T) {
+	net := simnet.New(simnet.Config{}, 1)
+	c := simConfig(3)
+	c.Lease = lease.Config{Duration: time.Second}
+	store := &stable.Mem{}
+	n := New(c, net.Join(0), store, rsm.NewKV())
+	n.Start()
+
+	// ask sends a Propose for an instance no leader uses, and
+	// returns the acceptor's answer.
+	ask := func(from int, p int64, tail string) string {
+		conn := net.Join(from)
+		defer conn.Close()
+		replies := make(chan upnet.Msg, 100)
+		go func() {
+			buf := make([]byte, 9999)
+			for {
+				k, err := conn.Recv(buf)
+				if err != nil {
+					close(replies)
+					return
+				}
+				if m, err := upnet.Parse(buf[:k]); err == nil {
+					replies <- m
+				}
+			}
+		}()
+		conn.Send([]byte(upnet.Record(nil, "%d Propose 50 %d %s", from, p, tail)))
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case m := <-replies:
+				if len(m.F) > 3 && m.F[0] == "0" && m.F[2] == "50" &&
+					(m.F[1] == "Promise" || m.F[1] == "NACK") {
+					return m.F[1]
+				}
+			case <-timeout:
+				t.Fatal("no answer from the acceptor")
+			}
+		}
+	}
+	if got := ask(1, 1, "lease 1"); got != "Promise" {
+		t.Fatalf("lease request got %s", got)
+	}
+	granted := time.Now()
+
+	n.Close()
+	store = store.Crash()
+	n = New(c, net.Join(0), store, rsm.NewKV())
+	n.Start()
+	defer n.Close()
+	got := ask(2, 2, "")
+	if time.Since(granted) < c.Lease.Duration && got != "NACK" {
+		t.Errorf("restarted acceptor answered %s within the lease", got)
+	}
+	time.Sleep(time.Until(granted.Add(c.Lease.Duration)))
+	if got := ask(2, 5, ""); got != "Promise" {
+		t.Errorf("after the lease, got %s", got)
+	}
+}
+
+// TestLeaseQuorum has a leader with a lease under "q1=4,q2=2" cut off
+// with one other acceptor, which is a phase-2 quorum but not enough
+// to renew the lease, and a rival on the other side write a value.
+// The rival's value must not be chosen while the lease is held.
+func TestLeaseQuorum(t *testing.T) {
+	c := simConfig(5)
+	c.Quorum = quorum.Sizes{N: 5, Q1: 4, Q2: 2}
+	c.Lease = lease.Config{Duration: 100 * time.Millisecond}
+	s := newSim(c, simnet.Config{}, 1)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+
+	held := func(i int) bool {
+		lv := &s.node(i).leases
+		lv.Lock()
+		defer lv.Unlock()
+		return lv.h != nil && lv.h.Valid()
+	}
+	leader := -1
+	for leader < 0 {
+		if s.Propose(ctx, 1, 1, simgroup.PerClient("l")) != 1 {
+			t.Fatal("nothing chosen")
+		}
+		for i := range s.Nodes {
+			if held(i) {
+				leader = i
+			}
+		}
+	}
+
+	var rest []int
+	for i := range s.Nodes {
+		if i != leader && i != (leader+1)%len(s.Nodes) {
+			rest = append(rest, i)
+		}
+	}
+	s.Net.Partition([]int{leader, (leader + 1) % len(s.Nodes)},
+		append([]int{50}, rest...))
+	rival := s.Net.Join(50)
+	defer rival.Close()
+	v := upnet.Command("r-1", "rival")
+	w := upnet.Record(&v, "50 Write 1000 %d", int64(1)<<40+50)
+	for {
+		s.mu.Lock()
+		chosen := s.chosen[1000] == v
+		s.mu.Unlock()
+		if chosen {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal("the rival's value was never chosen")
+		}
+		rival.Send([]byte(w))
+		time.Sleep(time.Millisecond)
+	}
+	if held(leader) {
+		t.Errorf("%d holds a lease with the rival's value chosen", leader)
+	}
+}
+
+// TestBatch has clients propose at once to a leader that batches,
+// and checks that their requests are chosen together and each is
+// applied once.
+func TestBatch(t *testing.T) {
+	c := simConfig(3)
+	c.BatchWindow = 2 * time.Millisecond
+	// slow enough that a group under the race detector keeps up
+	c.Heartbeat, c.Suspect = 20*time.Millisecond, 100*time.Millisecond
+	s := newSim(c, simnet.Config{Dup: 0.1, MaxDelay: time.Millisecond}, 1)
+	s.Retry = 50 * time.Millisecond
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	if ok := s.Propose(ctx, 8, 5, simgroup.PerClient("b")); ok != 40 {
+		t.Fatalf("%d of 40 values chosen", ok)
+	}
+
+	cl := paxosclient.New(s.Net.Join(99))
+	defer cl.Close()
+	cl.Retry = 5 * time.Millisecond
+	for k := 0; k < 8; k++ {
+		// a learner that is behind answers with an earlier value
+		for v := ""; v != "4"; {
+			var err error
+			_, v, err = cl.Query(ctx, rsm.Get(fmt.Sprintf("b-%d", k)))
+			if err != nil {
+				t.Fatalf("b-%d is %q, not 4", k, v)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	batches, requests := 0, 0
+	var batchAt int64    // a batch's instance
+	var batched []string // its values
+	for i, v := range s.learned {
+		id, cmds := upnet.SplitCommand(v)
+		if id != upnet.BatchID {
+			requests++
+			continue
+		}
+		batches++
+		rs, err := upnet.SplitBatch(cmds)
+		if err != nil {
+			t.Error(err)
+		}
+		requests += len(rs)
+		batchAt, batched = i, nil
+		for _, r := range rs {
+			_, v := upnet.SplitCommand(r)
+			batched = append(batched, v)
+		}
+	}
+	for _, b := range s.bad {
+		t.Error(b)
+	}
+	s.mu.Unlock()
+	if batches == 0 || requests < 40 {
+		t.Fatalf("%d requests in %d batches", requests, batches)
+	}
+
+	// a history request gets the batch's values, not its framing
+	vs, err := cl.Read(ctx, batchAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vs, batched) {
+		t.Errorf("instance %d read as %q, not %q", batchAt, vs, batched)
+	}
+}
+
+// TestTrace traces groups through loss, partitions, restarts and
+// crashes, lets them get every value chosen, and checks the traces.
+func TestTrace(t *testing.T) {
+	for sd := int64(1); sd <= 10; sd++ {
+		var b bytes.Buffer
+		c := simConfig(3 + 2*int(sd%2))
+		c.Trace = trace.NewWriter(&b)
+		// slow enough that a group under the race detector keeps up
+		c.Heartbeat, c.Suspect = 20*time.Millisecond, 100*time.Millisecond
+		s := newSim(c, simnet.Config{
+			Loss:     0.1,
+			Dup:      0.1,
+			MaxDelay: time.Millisecond,
+		}, sd)
+		s.Retry = 50 * time.Millisecond
+		s.crashAt(0.05)
+		chaos, stop := context.WithTimeout(context.Background(), 60*time.Millisecond)
+		go func() {
+			// then let the group finish in peace
+			s.Disrupt(chaos, rand.New(rand.NewSource(sd)))
+			s.crashAt(0)
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+		ok := s.Propose(ctx, 2, 10, simgroup.PerClient(fmt.Sprint(sd)))
+		cancel()
+		stop()
+		s.Close()
+		if ok != 20 {
+			t.Errorf("seed %d: %d of 20 values chosen", sd, ok)
+		}
+
+		learned := 0
+		trace.Read(bytes.NewReader(b.Bytes()), func(e trace.Event) {
+			if e.Kind == trace.Learn {
+				learned++
+			}
+		})
+		bad, err := trace.Check(&b)
+		if err != nil {
+			t.Fatalf("seed %d: %s", sd, err)
+		}
+		for _, x := range bad {
+			t.Errorf("seed %d: %s", sd, x)
+		}
+		if learned == 0 {
+			t.Errorf("seed %d: nothing learned", sd)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package upaxos
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"quorum"
+	"upnet"
+)
+
+// A Sniffer follows the messages that go by on the group channel,
+// the way the roles do, and keeps for each instance the ballots seen
+// and who promised and accepted in them, for someone watching the
+// protocol.  It sends nothing.
+type Sniffer struct {
+	Quorum quorum.System
+
+	mu        sync.Mutex
+	instances map[int64]*sniffInstance
+	counts    map[string]int // messages by type
+}
+
+type sniffInstance struct {
+	first   time.Time
+	ballots map[int64]*SniffBallot
+	oks     []string
+	chosen  *string
+	at      time.Duration
+}
+
+// SniffBallot is what went by for one proposal number in one
+// instance.  The times are since the first message for the instance,
+// and zero until a quorum answered.
+type SniffBallot struct {
+	Instance int64
+	P        int64
+	Leader   int64 // who sent Propose or Write, -1 if unseen
+	Promised []int64
+	Accepted []int64
+	Nacks    int
+	Value    *string // from Write or Accept, nil if none yet
+	Phase1   time.Duration
+	Phase2   time.Duration
+
+	promised, accepted map[int64]bool
+}
+
+// SniffInstance is what went by for one instance.
+type SniffInstance struct {
+	Instance int64
+	Ballots  []SniffBallot // by proposal number
+	OKs      []string      // the request IDs the leader answered
+	Chosen   *string       // accepted by a phase-2 quorum, if any
+	At       time.Duration // since the first message, when chosen
+}
+
+func NewSniffer(q quorum.System) *Sniffer {
+	return &Sniffer{
+		Quorum:    q,
+		instances: make(map[int64]*sniffInstance),
+		counts:    make(map[string]int),
+	}
+}
+
+// Add notes a message that went by at t.  A signed message must be
+// opened first.
+func (sn *Sniffer) Add(t time.Time, b []byte) error {
+	m, err := upnet.Parse(b)
+	if err != nil {
+		return err
+	}
+	if len(m.F) < 2 {
+		return nil
+	}
+	typ := m.F[1]
+	if _, err := strconv.ParseInt(m.F[0], 0, 64); err != nil {
+		typ = m.F[0] // from a client or admin
+	}
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.counts[typ]++
+	switch typ {
+	case "Propose":
+		p, err := newPropose(m)
+		if err != nil {
+			return err
+		}
+		sn.ballot(t, p.i, p.p).Leader = p.s
+	case "Promise":
+		p, err := newPromise(m)
+		if err != nil {
+			return err
+		}
+		bl := sn.ballot(t, p.i, p.p)
+		bl.promised[p.s] = true
+		if bl.Phase1 == 0 && sn.Quorum.Phase1(bl.promised) {
+			bl.Phase1 = sn.since(t, p.i)
+		}
+	case "NACK":
+		n, err := newNack(m)
+		if err != nil {
+			return err
+		}
+		sn.instance(t, n.i).nack(n.p)
+	case "Write":
+		w, err := newWrite(m)
+		if err != nil {
+			return err
+		}
+		bl := sn.ballot(t, w.i, w.p)
+		bl.Leader = w.s
+		bl.Value = &w.v
+	case "Accept":
+		a, err := newAccept(m)
+		if err != nil {
+			return err
+		}
+		bl := sn.ballot(t, a.i, a.p)
+		bl.accepted[a.s] = true
+		if bl.Value == nil {
+			bl.Value = &a.v
+		}
+		if bl.Phase2 == 0 && sn.Quorum.Phase2(bl.accepted) {
+			bl.Phase2 = sn.since(t, a.i)
+			in := sn.instances[a.i]
+			if in.chosen == nil {
+				in.chosen, in.at = &a.v, bl.Phase2
+			}
+		}
+	case "OK":
+		// history and query answers carry a value; a write's does not
+		if len(m.F) >= 4 && m.V == nil {
+			i, err := strconv.ParseInt(m.F[2], 0, 64)
+			if err != nil {
+				return badMsg(m)
+			}
+			in := sn.instance(t, i)
+			for _, id := range in.oks {
+				if id == m.F[3] {
+					return nil // a retry, or another learner
+				}
+			}
+			in.oks = append(in.oks, m.F[3])
+		}
+	}
+	return nil
+}
+
+func (sn *Sniffer) instance(t time.Time, i int64) *sniffInstance {
+	in, ok := sn.instances[i]
+	if !ok {
+		in = &sniffInstance{first: t, ballots: make(map[int64]*SniffBallot)}
+		sn.instances[i] = in
+	}
+	return in
+}
+
+func (sn *Sniffer) ballot(t time.Time, i, p int64) *SniffBallot {
+	in := sn.instance(t, i)
+	bl, ok := in.ballots[p]
+	if !ok {
+		bl = &SniffBallot{
+			Instance: i,
+			P:        p,
+			Leader:   -1,
+			promised: make(map[int64]bool),
+			accepted: make(map[int64]bool),
+		}
+		in.ballots[p] = bl
+	}
+	return bl
+}
+
+// nack counts a NACK against the highest ballot below the proposal
+// number the acceptor wants, which is the one it refused.
+func (in *sniffInstance) nack(min int64) {
+	var refused *SniffBallot
+	for p, bl := range in.ballots {
+		if p < min && (refused == nil || p > refused.P) {
+			refused = bl
+		}
+	}
+	if refused != nil {
+		refused.Nacks++
+	}
+}
+
+func (sn *Sniffer) since(t time.Time, i int64) time.Duration {
+	d := t.Sub(sn.instances[i].first)
+	if d <= 0 {
+		d = 1 // nonzero marks the quorum as reached
+	}
+	return d
+}
+
+// Instances returns the last n instances seen, or all of them if n
+// is zero, in order.
+func (sn *Sniffer) Instances(n int) []SniffInstance {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	is := make([]int64, 0, len(sn.instances))
+	for i := range sn.instances {
+		is = append(is, i)
+	}
+	sort.Slice(is, func(a, b int) bool { return is[a] < is[b] })
+	if n > 0 && len(is) > n {
+		is = is[len(is)-n:]
+	}
+	var r []SniffInstance
+	for _, i := range is {
+		in := sn.instances[i]
+		si := SniffInstance{
+			Instance: i,
+			OKs:      append([]string{}, in.oks...),
+			Chosen:   in.chosen,
+			At:       in.at,
+		}
+		for _, bl := range in.ballots {
+			b := *bl
+			b.Promised, b.Accepted = ids(bl.promised), ids(bl.accepted)
+			b.promised, b.accepted = nil, nil
+			si.Ballots = append(si.Ballots, b)
+		}
+		sort.Slice(si.Ballots, func(a, b int) bool {
+			return si.Ballots[a].P < si.Ballots[b].P
+		})
+		r = append(r, si)
+	}
+	return r
+}
+
+func ids(set map[int64]bool) []int64 {
+	r := make([]int64, 0, len(set))
+	for id := range set {
+		r = append(r, id)
+	}
+	sort.Slice(r, func(a, b int) bool { return r[a] < r[b] })
+	return r
+}
+
+// Counts returns how many messages of each type went by.
+func (sn *Sniffer) Counts() map[string]int {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	r := make(map[string]int, len(sn.counts))
+	for k, v := range sn.counts {
+		r[k] = v
+	}
+	return r
+}
+
+// WriteTable writes the last n instances as a table, a line for
+// each ballot, with the message counts above it.
+func (sn *Sniffer) WriteTable(w io.Writer, n int) {
+	counts := sn.Counts()
+	types := make([]string, 0, len(counts))
+	total := 0
+	for t, c := range counts {
+		types = append(types, t)
+		total += c
+	}
+	sort.Strings(types)
+	fmt.Fprintf(w, "%d messages:", total)
+	for _, t := range types {
+		fmt.Fprintf(w, " %s %d", t, counts[t])
+	}
+	fmt.Fprintf(w, "\n\n%5s %6s %3s %-12s %-12s %5s %8s %8s  %s\n",
+		"INST", "BALLOT", "LDR", "PROMISED", "ACCEPTED", "NACKS",
+		"PHASE1", "PHASE2", "VALUE")
+	for _, in := range sn.Instances(n) {
+		for k, bl := range in.Ballots {
+			inst := ""
+			if k == 0 {
+				inst = fmt.Sprint(in.Instance)
+			}
+			ldr := "?"
+			if bl.Leader >= 0 {
+				ldr = fmt.Sprint(bl.Leader)
+			}
+			v := ""
+			if bl.Value != nil {
+				v = command(*bl.Value)
+			}
+			if bl.Phase2 != 0 && in.Chosen != nil && *in.Chosen == *bl.Value {
+				v += " chosen"
+				if len(in.OKs) > 0 {
+					v += fmt.Sprintf(", %d OK", len(in.OKs))
+				}
+			}
+			fmt.Fprintf(w, "%5s %6d %3s %-12s %-12s %5d %8s %8s  %s\n",
+				inst, bl.P, ldr, idList(bl.Promised), idList(bl.Accepted),
+				bl.Nacks, ms(bl.Phase1), ms(bl.Phase2), v)
+		}
+	}
+}
+
+func idList(ids []int64) string {
+	s := make([]string, len(ids))
+	for k, id := range ids {
+		s[k] = fmt.Sprint(id)
+	}
+	return strings.Join(s, ",")
+}
+
+func ms(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fms", float64(d)/1e6)
+}
+
+// command shows a value as its request ID and quoted value, cut
+// down to fit in a table.
+func command(v string) string {
+	id, v := upnet.SplitCommand(v)
+	if id == upnet.BatchID {
+		cmds, _ := upnet.SplitBatch(v)
+		return fmt.Sprintf("%s of %d", id, len(cmds))
+	}
+	if len(v) > 24 {
+		return fmt.Sprintf("%s %q...", id, v[:21])
+	}
+	return fmt.Sprintf("%s %q", id, v)
+}
+
+// WriteCapture writes a message that went by at t as one line of a
+// capture, which ReadCapture can replay.
+func WriteCapture(w io.Writer, t time.Time, b []byte) error {
+	_, err := fmt.Fprintf(w, "%s %q\n", t.Format(time.RFC3339Nano), b)
+	return err
+}
+
+// ReadCapture calls f with each message in a capture, in order.
+func ReadCapture(r io.Reader, f func(t time.Time, b []byte)) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		ts, q, ok := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		if !ok {
+			return fmt.Errorf("bad capture line %q", line)
+		}
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return err
+		}
+		b, err := strconv.Unquote(q)
+		if err != nil {
+			return fmt.Errorf("bad capture line %q", line)
+		}
+		f(t, []byte(b))
+	}
+}
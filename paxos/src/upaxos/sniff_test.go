@@ -0,0 +1,107 @@
+package upaxos
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"quorum"
+	"simgroup"
+	"simnet"
+	"upnet"
+)
+
+// TestSniff sniffs a group through loss and duplication, and checks
+// that the sniffer saw each value chosen, and that replaying its
+// capture gives the same table.
+func TestSniff(t *testing.T) {
+	s := newSim(simConfig(3), simnet.Config{
+		Loss:     0.1,
+		Dup:      0.1,
+		MaxDelay: time.Millisecond,
+	}, 1)
+	defer s.Close()
+	sn := NewSniffer(quorum.Majority(3))
+	var mu sync.Mutex
+	var capture bytes.Buffer
+	s.Net.Tap(func(from int, b []byte) {
+		s.tap(from, b)
+		// a capture keeps only the wall clock, so the live sniffer
+		// must not see the monotonic reading either
+		now := time.Now().Round(0)
+		mu.Lock()
+		defer mu.Unlock()
+		if err := sn.Add(now, b); err != nil {
+			t.Error(err)
+		}
+		WriteCapture(&capture, now, b)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	if ok := s.Propose(ctx, 2, 5, simgroup.PerClient("s")); ok != 10 {
+		t.Fatalf("%d of 10 values chosen", ok)
+	}
+	s.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ins := sn.Instances(0)
+	if len(ins) < len(s.chosen) {
+		t.Errorf("sniffed %d instances, %d chosen", len(ins), len(s.chosen))
+	}
+	oks := 0
+	for _, in := range ins {
+		v, ok := s.chosen[in.Instance]
+		if !ok {
+			continue
+		}
+		if in.Chosen == nil || *in.Chosen != v {
+			t.Errorf("instance %d chosen as %q, sniffed %v",
+				in.Instance, v, in.Chosen)
+		}
+		if len(in.Ballots) == 0 || in.At == 0 {
+			t.Errorf("instance %d sniffed as %+v", in.Instance, in)
+		}
+		oks += len(in.OKs)
+	}
+	if oks < 10 {
+		t.Errorf("sniffed %d OKs for 10 values", oks)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var live, replayed bytes.Buffer
+	sn.WriteTable(&live, 0)
+	again := NewSniffer(quorum.Majority(3))
+	err := ReadCapture(&capture, func(t time.Time, b []byte) {
+		again.Add(t, b)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.WriteTable(&replayed, 0)
+	if live.String() != replayed.String() {
+		t.Errorf("live\n%s\nreplayed\n%s", live.String(), replayed.String())
+	}
+	if !strings.Contains(live.String(), " chosen, 1 OK") {
+		t.Errorf("no OK in\n%s", live.String())
+	}
+}
+
+func TestSniffBad(t *testing.T) {
+	sn := NewSniffer(quorum.Majority(3))
+	for _, m := range []string{
+		upnet.Record(nil, "0 Propose x 1"),
+		upnet.Record(nil, "0 NACK 1 2 3"),
+	} {
+		if err := sn.Add(time.Now(), []byte(m)); err == nil {
+			t.Errorf("no error for %q", m)
+		}
+	}
+	if err := sn.Add(time.Now(), []byte(upnet.Record(nil, "1 Heartbeat 0"))); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,182 @@
+package upaxos
+
+import (
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// statusWindow is how many of the latest instances a Status shows
+// for the acceptor and the learner, which remember every instance.
+const statusWindow = 50
+
+// Status is what a participant's roles know at one moment, for
+// someone debugging the group.
+type Status struct {
+	ID       int
+	N        int
+	Quorum   string
+	LogBytes int64 // size of the recovery log
+
+	Leader   LeaderStatus
+	Acceptor AcceptorStatus
+	Learner  LearnerStatus
+}
+
+type LeaderStatus struct {
+	Leader   int64  // the leader this participant follows
+	Instance int64  // the instance it would propose in
+	Proposal int64  // the proposal number last sent
+	Phase    string // "Propose" or "Write" while a request is in progress
+	Request  string // the request ID in progress, "" if none
+	Queue    []string
+	Gaps     []int64 // instances waiting to be filled
+}
+
+type AcceptorStatus struct {
+	Highest   int64 // highest instance with an accepted value
+	Instances []AcceptorInstance
+}
+
+type AcceptorInstance struct {
+	Instance int64
+	MinP     int64   // the lowest proposal number it will accept
+	Accepted *Ballot // nil if it accepted nothing
+}
+
+type LearnerStatus struct {
+	Applied   int64   // last instance applied to the state machine
+	Highest   int64   // highest instance learned
+	Missing   []int64 // gaps below Highest
+	Instances []LearnerInstance
+}
+
+type LearnerInstance struct {
+	Instance int64
+	Learned  bool
+	Value    string   // the value learned
+	Accepts  []Ballot // what the learner heard, until it learned
+}
+
+// A Ballot is a value with the proposal number it was accepted with,
+// and for the learner, the participants it heard accept it.
+type Ballot struct {
+	Proposal int64
+	Value    string
+	From     []int64 `json:",omitempty"`
+}
+
+// inspection asks a role to fill in its part of a Status.
+type inspection struct {
+	s    *Status
+	done chan struct{}
+}
+
+// Status asks each running role what it knows.  If the participant
+// is closed meanwhile, it returns what it has so far.
+func (n *Node) Status() Status {
+	s := Status{
+		ID:       n.ID,
+		N:        n.N,
+		Quorum:   n.Quorum.String(),
+		LogBytes: atomic.LoadInt64(&n.logBytes),
+	}
+	for _, c := range []chan inspection{
+		n.inspectLead, n.inspectAccept, n.inspectLearn,
+	} {
+		in := inspection{&s, make(chan struct{})}
+		select {
+		case c <- in:
+		case <-n.proc.Done():
+			return s
+		}
+		<-in.done
+	}
+	return s
+}
+
+// window returns the instances in the last statusWindow up to top,
+// in order.
+func window(top int64, all []int64) []int64 {
+	is := []int64{}
+	for _, i := range all {
+		if i > top-statusWindow {
+			is = append(is, i)
+		}
+	}
+	sortInstances(is)
+	return is
+}
+
+func sortInstances(is []int64) {
+	sort.Slice(is, func(a, b int) bool { return is[a] < is[b] })
+}
+
+// ServeHTTP shows the Status as JSON for paths ending in ".json",
+// and as HTML otherwise.
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := n.Status()
+	if strings.HasSuffix(r.URL.Path, ".json") {
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		e.Encode(s)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusPage.Execute(w, s)
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html><head><title>upaxos {{.ID}}</title></head><body>
+<h1>upaxos {{.ID}} of {{.N}}</h1>
+<p>quorums {{.Quorum}}, log {{.LogBytes}} bytes,
+<a href="status.json">JSON</a></p>
+
+<h2>Leader</h2>
+{{with .Leader}}
+<p>following {{.Leader}}, instance {{.Instance}}, proposal {{.Proposal}}</p>
+<p>in progress: {{if .Request}}{{.Request}} ({{.Phase}}){{else}}nothing{{end}}</p>
+<p>queued: {{range .Queue}}{{.}} {{else}}nothing{{end}}</p>
+<p>gaps to fill: {{range .Gaps}}{{.}} {{else}}none{{end}}</p>
+{{end}}
+
+<h2>Acceptor</h2>
+{{with .Acceptor}}
+<p>highest accepted instance {{.Highest}}</p>
+<table border="1">
+<tr><th>instance</th><th>minp</th><th>accepted proposal</th><th>accepted value</th></tr>
+{{range .Instances}}<tr><td>{{.Instance}}</td><td>{{.MinP}}</td>
+{{with .Accepted}}<td>{{.Proposal}}</td><td>{{printf "%q" .Value}}</td>{{else}}<td></td><td></td>{{end}}</tr>
+{{end}}</table>
+{{end}}
+
+<h2>Learner</h2>
+{{with .Learner}}
+<p>applied through {{.Applied}}, learned up to {{.Highest}},
+missing {{range .Missing}}{{.}} {{else}}none{{end}}</p>
+<table border="1">
+<tr><th>instance</th><th>learned</th><th>accepts heard</th></tr>
+{{range .Instances}}<tr><td>{{.Instance}}</td>
+<td>{{if .Learned}}{{printf "%q" .Value}}{{end}}</td>
+<td>{{range .Accepts}}{{.Proposal}}: {{printf "%q" .Value}} from {{.From}}<br>{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+</body></html>
+`))
+
+// counted counts the bytes written through it into n.
+type counted struct {
+	w io.Writer
+	n *int64
+}
+
+func (c counted) Write(b []byte) (int, error) {
+	k, err := c.w.Write(b)
+	atomic.AddInt64(c.n, int64(k))
+	return k, err
+}
@@ -0,0 +1,84 @@
+package upaxos
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"elect"
+	"simgroup"
+	"simnet"
+)
+
+// TestStatus gets three values chosen and checks what a participant
+// serves about them.
+func TestStatus(t *testing.T) {
+	s := newSim(simConfig(3), simnet.Config{}, 1)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), simgroup.Patience)
+	defer cancel()
+	if ok := s.Propose(ctx, 1, 3, simgroup.PerClient("s")); ok != 3 {
+		t.Fatalf("%d of 3 values chosen", ok)
+	}
+	n := s.node(0)
+	for n.Status().Learner.Applied < 3 {
+		if ctx.Err() != nil {
+			t.Fatal("participant 0 did not apply three values")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	srv := httptest.NewServer(n)
+	defer srv.Close()
+	get := func(path string) string {
+		rsp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		b, err := io.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	var st Status
+	if err := json.Unmarshal([]byte(get("/status.json")), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.ID != 0 || st.N != 3 || st.Quorum != "q1=2,q2=2" {
+		t.Errorf("participant %d of %d with %s", st.ID, st.N, st.Quorum)
+	}
+	if st.LogBytes == 0 {
+		t.Error("empty log")
+	}
+	if len(st.Acceptor.Instances) < 3 {
+		t.Fatalf("acceptor shows %d instances", len(st.Acceptor.Instances))
+	}
+	for _, ai := range st.Acceptor.Instances[:3] {
+		if ai.Accepted == nil || ai.MinP < ai.Accepted.Proposal {
+			t.Errorf("acceptor instance %+v", ai)
+		}
+	}
+	if len(st.Learner.Instances) < 3 {
+		t.Fatalf("learner shows %d instances", len(st.Learner.Instances))
+	}
+	for k, li := range st.Learner.Instances[:3] {
+		if li.Instance != int64(k+1) || !li.Learned {
+			t.Errorf("learner instance %+v", li)
+		}
+	}
+	if st.Leader.Leader == elect.None {
+		t.Error("following no leader")
+	}
+
+	if h := get("/"); !strings.Contains(h, "upaxos 0 of 3") {
+		t.Errorf("status page:\n%s", h)
+	}
+}
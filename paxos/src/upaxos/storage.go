@@ -0,0 +1,187 @@
+package upaxos
+
+import (
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"rsm"
+	"stable"
+	"upnet"
+)
+
+func (n *Node) saveSnapshot(sm rsm.StateMachine, i int64) {
+	b, err := sm.Snapshot()
+	if err != nil {
+		n.Log.Printf("no snapshot at %d: %s", i, err)
+		return
+	}
+	// The learn records are what tell a restarted learner which
+	// requests were chosen, so the snapshot must not get ahead of
+	// them, or a retry could be applied again.
+	stable.MustSync(n.store)
+	snap := string(b)
+	err = n.store.SaveSnapshot([]byte(upnet.Record(&snap, "snapshot %d", i)))
+	if err != nil {
+		log.Panic(err)
+	}
+	n.Log.Printf("saved snapshot at instance %d", i)
+}
+
+// loadSnapshot restores sm and returns the instance it is current
+// through, zero if there is no snapshot.
+func (n *Node) loadSnapshot(sm rsm.StateMachine) int64 {
+	b, err := n.store.LoadSnapshot()
+	if err != nil {
+		log.Panic(err)
+	} else if b == nil {
+		return 0
+	}
+	m, err := upnet.Parse(b)
+	if err != nil || len(m.F) != 2 || m.F[0] != "snapshot" || m.V == nil {
+		log.Panicf("bad snapshot for %d", n.ID)
+	}
+	if err := sm.Restore([]byte(*m.V)); err != nil {
+		log.Panic(err)
+	}
+	i := mustStrtoll(m.F[1])
+	n.Log.Printf("restored snapshot at instance %d", i)
+	return i
+}
+
+// logRecord writes a version 1 record to the recovery log.  The
+// newline is explicit, because the logger would not add one after a
+// value that happens to end with a newline.
+func logRecord(lf *log.Logger, v *string, format string, a ...interface{}) {
+	lf.Print(upnet.Record(v, format, a...) + "\n")
+}
+
+type loggedPromise struct {
+	i, p int64
+
+	// a lease granted with the promise, when holder is set: it
+	// lasts until this many nanoseconds into the Unix epoch
+	holder *int64
+	until  int64
+}
+type loggedPropose struct {
+	i, p int64
+}
+type loggedAccept struct {
+	i, p int64
+	v    string
+}
+type loggedLearn struct {
+	i int64
+	v string
+}
+
+// recordFields is how many fields each kind of log record has at
+// least, all but the first of them numbers.
+var recordFields = map[string]int{
+	"promise": 3,
+	"accept":  3,
+	"propose": 3,
+	"learn":   2,
+}
+
+func numeric(fs []string) bool {
+	for _, f := range fs {
+		if _, err := strconv.ParseInt(f, 0, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// loadLogData reads the recovery log up to the first torn or bad
+// record, and truncates the log there so that what the participant
+// logs next is not lost behind it.
+func (n *Node) loadLogData(lf io.Reader) (p []loggedPromise, a []loggedAccept, lrn []loggedLearn, pr []loggedPropose) {
+	p = []loggedPromise{}
+	a = []loggedAccept{}
+	lrn = []loggedLearn{}
+	pr = []loggedPropose{}
+	r := stable.NewReader(lf)
+	var good int64 // where the last good record ends
+	defer func() {
+		stable.MustTruncate(n.store, good)
+		atomic.StoreInt64(&n.logBytes, good)
+	}()
+	for {
+		good = r.Offset()
+		_, err := r.ReadString(' ') // ignore ID prefix
+		if err != nil {
+			break
+		}
+		var m upnet.Msg
+		if b, _ := r.Peek(len(upnet.Version) + 1); string(b) == upnet.Version+" " {
+			r.Discard(len(b))
+			m, err = upnet.ReadRecord(r.Reader)
+			if err != nil {
+				n.Log.Printf("stopping at bad log record: %s", err)
+				break
+			}
+		} else {
+			// legacy: the value had its whitespace squeezed
+			ln, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			m.F = strings.Fields(ln)
+			if len(m.F) > 3 || (len(m.F) == 3 && m.F[0] == "learn") {
+				k := 3
+				if m.F[0] == "learn" {
+					k = 2
+				}
+				s := strings.Join(m.F[k:], " ")
+				m.F = m.F[:k]
+				m.V = &s
+			}
+		}
+		if len(m.F) == 0 {
+			continue
+		}
+		if k, ok := recordFields[m.F[0]]; ok && (len(m.F) < k || !numeric(m.F[1:k])) ||
+			m.F[0] == "promise" && len(m.F) == 6 && m.F[3] == "lease" && !numeric(m.F[4:]) {
+			n.Log.Printf("stopping at bad log record %q", m.F)
+			break
+		}
+		v := ""
+		if m.V != nil {
+			v = *m.V
+		}
+		switch m.F[0] {
+		case "promise":
+			lp := loggedPromise{
+				i: mustStrtoll(m.F[1]),
+				p: mustStrtoll(m.F[2]),
+			}
+			if len(m.F) == 6 && m.F[3] == "lease" {
+				holder := mustStrtoll(m.F[4])
+				lp.holder = &holder
+				lp.until = mustStrtoll(m.F[5])
+			}
+			p = append(p, lp)
+		case "accept":
+			a = append(a, loggedAccept{
+				mustStrtoll(m.F[1]),
+				mustStrtoll(m.F[2]),
+				v,
+			})
+		case "propose":
+			pr = append(pr, loggedPropose{
+				mustStrtoll(m.F[1]),
+				mustStrtoll(m.F[2]),
+			})
+		case "learn":
+			lrn = append(lrn, loggedLearn{
+				mustStrtoll(m.F[1]),
+				v,
+			})
+		}
+	}
+	return
+}
@@ -0,0 +1,62 @@
+package upaxos
+
+import (
+	"io"
+	"log"
+	"reflect"
+	"testing"
+
+	"stable"
+)
+
+// TestTornLog has a participant crash partway through logging an
+// accept, and checks that recovery cuts the torn record off, so that
+// the promise it logs after the restart survives the next one.
+func TestTornLog(t *testing.T) {
+	m := &stable.Mem{}
+	n := &Node{Config: Config{Log: log.New(io.Discard, "", 0)}, store: m}
+	lf := log.New(m, "0: ", 0)
+	logRecord(lf, nil, "promise 1 5")
+	io.WriteString(m, "0: v1 accept 1 5 10:tor") // the crash
+	m.Sync()
+
+	recover := func() []loggedPromise {
+		m = m.Crash()
+		n.store = m
+		lr := m.Log()
+		defer lr.Close()
+		p, a, _, _ := n.loadLogData(lr)
+		if len(a) != 0 {
+			t.Errorf("recovered torn accepts %v", a)
+		}
+		return p
+	}
+	recover()
+	lf = log.New(m, "0: ", 0)
+	logRecord(lf, nil, "promise 2 7")
+	m.Sync()
+	want := []loggedPromise{{i: 1, p: 5}, {i: 2, p: 7}}
+	if p := recover(); !reflect.DeepEqual(p, want) {
+		t.Errorf("recovered %v, want %v", p, want)
+	}
+}
+
+// TestShortLogRecord checks that recovery treats a record missing
+// fields, or with a field that is not a number, as bad, instead of
+// panicking.
+func TestShortLogRecord(t *testing.T) {
+	for _, bad := range []string{
+		"promise 1", "accept 1", "propose x 2", "learn", "promise 1 2 lease 3 x",
+	} {
+		m := &stable.Mem{}
+		n := &Node{Config: Config{Log: log.New(io.Discard, "", 0)}, store: m}
+		lf := log.New(m, "0: ", 0)
+		logRecord(lf, nil, "promise 1 5")
+		logRecord(lf, nil, "%s", bad)
+		logRecord(lf, nil, "promise 2 7")
+		p, _, _, _ := n.loadLogData(m.Log())
+		if want := []loggedPromise{{i: 1, p: 5}}; !reflect.DeepEqual(p, want) {
+			t.Errorf("%q: recovered %v, want %v", bad, p, want)
+		}
+	}
+}
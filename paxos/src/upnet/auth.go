@@ -0,0 +1,159 @@
+package upnet
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signed message formats:
+//
+//	sig T MAC MSG	MAC is the HMAC-SHA256 of "T MSG" with the group
+//			key, where T is when it was sent, in Unix
+//			nanoseconds
+//	adm T MAC MSG	the same with the admin key
+//
+// Both MACs are in hex.  Anyone with the group key can speak for
+// any participant, so the key must be kept to the participants.
+// Signed messages carry a time so that an old one, like a captured
+// heartbeat, cannot be replayed later than the window allows.
+type Auth struct {
+	Key      []byte        // group key, nil to send unsigned
+	AdminKey []byte        // nil when admin commands are refused
+	Window   time.Duration // how old a signed message may be
+}
+
+// How a message was authenticated.
+const (
+	Unsigned = iota
+	Signed
+	Admin
+)
+
+var ErrAuth = errors.New("upnet: bad signature")
+
+// DefaultWindow is the window for signed messages.
+const DefaultWindow = 30 * time.Second
+
+// ReadKey reads a key from a file, ignoring surrounding whitespace.
+func ReadKey(name string) ([]byte, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	k := strings.TrimSpace(string(b))
+	if k == "" {
+		return nil, fmt.Errorf("%s: empty key", name)
+	}
+	return []byte(k), nil
+}
+
+func mac(key []byte, s string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// seal signs s, sent now, with key.
+func seal(kind string, key []byte, s string) string {
+	t := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return kind + " " + t + " " + mac(key, t+" "+s) + " " + s
+}
+
+// Seal signs s with the group key, if there is one.
+func (a *Auth) Seal(s string) string {
+	if a == nil || a.Key == nil {
+		return s
+	}
+	return seal("sig", a.Key, s)
+}
+
+// SealAdmin signs an admin command sent now.
+func (a *Auth) SealAdmin(s string) string {
+	return seal("adm", a.AdminKey, s)
+}
+
+// open checks a message of the form seal makes with key, and returns
+// it without its signature.  One signed outside the window is an
+// error, whether it was replayed or the sender's clock is off.
+func (a *Auth) open(key []byte, s string) ([]byte, error) {
+	f := strings.SplitN(s, " ", 4)
+	if key == nil || len(f) < 4 ||
+		!hmac.Equal([]byte(f[2]), []byte(mac(key, f[1]+" "+f[3]))) {
+		return nil, ErrAuth
+	}
+	t, err := strconv.ParseInt(f[1], 10, 64)
+	if err != nil {
+		return nil, ErrAuth
+	}
+	w := a.Window
+	if w == 0 {
+		w = DefaultWindow
+	}
+	if age := time.Since(time.Unix(0, t)); age > w || age < -w {
+		return nil, fmt.Errorf("upnet: message %v old", age)
+	}
+	return []byte(f[3]), nil
+}
+
+// Open checks a message and returns it without its signature, along
+// with how it was authenticated.  A message with a bad signature is
+// an error, but an unsigned one is not, so the caller decides what
+// may go unsigned.
+func (a *Auth) Open(b []byte) ([]byte, int, error) {
+	if a == nil {
+		a = &Auth{}
+	}
+	s := string(b)
+	var key []byte
+	var how int
+	switch {
+	case strings.HasPrefix(s, "sig "):
+		key, how = a.Key, Signed
+	case strings.HasPrefix(s, "adm "):
+		key, how = a.AdminKey, Admin
+	default:
+		return b, Unsigned, nil
+	}
+	m, err := a.open(key, s)
+	if err != nil {
+		return nil, Unsigned, err
+	}
+	return m, how, nil
+}
+
+// sealed signs what it sends and drops what it receives unsigned.
+type sealed struct {
+	Conn
+	a *Auth
+}
+
+// Sealed wraps a Conn so that everything sent is signed with the
+// group key and everything received unsigned or badly signed is
+// dropped.
+func Sealed(c Conn, a *Auth) Conn {
+	return &sealed{c, a}
+}
+
+func (s *sealed) Send(b []byte) error {
+	return s.Conn.Send([]byte(s.a.Seal(string(b))))
+}
+
+func (s *sealed) Recv(b []byte) (int, error) {
+	for {
+		n, err := s.Conn.Recv(b)
+		if err != nil {
+			return n, err
+		}
+		m, how, err := s.a.Open(b[:n])
+		if err == nil && how == Signed {
+			return copy(b, m), nil
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package upnet
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAuth = &Auth{Key: []byte("group"), AdminKey: []byte("admin")}
+
+func TestSeal(t *testing.T) {
+	s := Record(nil, "0 Accept 1 2")
+	b, how, err := testAuth.Open([]byte(testAuth.Seal(s)))
+	if err != nil || how != Signed || string(b) != s {
+		t.Errorf("got %q %d %v", b, how, err)
+	}
+
+	// tampering, the wrong key, and no key at all
+	forged := strings.Replace(testAuth.Seal(s), "Accept 1", "Accept 9", 1)
+	if _, _, err := testAuth.Open([]byte(forged)); err != ErrAuth {
+		t.Errorf("tampered message got %v", err)
+	}
+	other := &Auth{Key: []byte("other")}
+	if _, _, err := testAuth.Open([]byte(other.Seal(s))); err != ErrAuth {
+		t.Errorf("wrong key got %v", err)
+	}
+	if _, how, _ := testAuth.Open([]byte(s)); how != Unsigned {
+		t.Errorf("unsigned message authenticated as %d", how)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	b, how, err := testAuth.Open([]byte(testAuth.SealAdmin("quit")))
+	if err != nil || how != Admin || string(b) != "quit" {
+		t.Errorf("got %q %d %v", b, how, err)
+	}
+
+	// the group key is not enough
+	groupOnly := &Auth{Key: testAuth.Key, AdminKey: testAuth.Key}
+	if _, _, err := testAuth.Open([]byte(groupOnly.SealAdmin("quit"))); err != ErrAuth {
+		t.Errorf("admin command with group key got %v", err)
+	}
+
+	// replay after the window
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).UnixNano(), 10)
+	replay := "adm " + old + " " + mac(testAuth.AdminKey, old+" quit") + " quit"
+	if _, how, err := testAuth.Open([]byte(replay)); err == nil || how == Admin {
+		t.Error("accepted an old admin command")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	s := Record(nil, "0 Heartbeat 0")
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).UnixNano(), 10)
+	replay := "sig " + old + " " + mac(testAuth.Key, old+" "+s) + " " + s
+	if _, how, err := testAuth.Open([]byte(replay)); err == nil || how == Signed {
+		t.Error("accepted an old signed message")
+	}
+	short := &Auth{Key: testAuth.Key, Window: time.Millisecond}
+	sealed := short.Seal(s)
+	time.Sleep(5 * time.Millisecond)
+	if _, _, err := short.Open([]byte(sealed)); err == nil {
+		t.Error("accepted a message signed before the window")
+	}
+}
@@ -0,0 +1,86 @@
+package upnet
+
+import (
+	"fmt"
+	"net"
+)
+
+// The group channel is where every participant hears every message,
+// its own included, so that roles can snoop on each other.  Raw IP
+// protocol 253 needs root.  UDP multicast does not, and any number of
+// processes on a host can join the same group.
+const IPProto = "ip4:253"
+const DefaultIPAddr = "127.0.0.1"
+const DefaultUDPAddr = "239.253.0.1:9253"
+
+// A Conn sends to and receives from the whole group.
+type Conn interface {
+	Send(b []byte) error
+	Recv(b []byte) (int, error)
+	Close() error
+}
+
+// A group sends on its own socket, because a multicast listener
+// does not hear what it sends itself.
+type group struct {
+	conn net.PacketConn
+	out  net.Conn
+}
+
+func (g *group) Send(b []byte) error {
+	_, err := g.out.Write(b)
+	return err
+}
+
+func (g *group) Recv(b []byte) (int, error) {
+	n, _, err := g.conn.ReadFrom(b)
+	return n, err
+}
+
+func (g *group) Close() error {
+	g.out.Close()
+	return g.conn.Close()
+}
+
+func newGroup(conn net.PacketConn, network, addr string) (Conn, error) {
+	out, err := net.Dial(network, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &group{conn, out}, nil
+}
+
+// Join listens on the group channel for the given transport, "ip" or
+// "udp".  An empty addr means the transport's default.
+func Join(transport, addr string) (Conn, error) {
+	switch transport {
+	case "ip":
+		if addr == "" {
+			addr = DefaultIPAddr
+		}
+		a, err := net.ResolveIPAddr("ip4", addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenIP(IPProto, a)
+		if err != nil {
+			return nil, err
+		}
+		return newGroup(conn, IPProto, addr)
+	case "udp":
+		if addr == "" {
+			addr = DefaultUDPAddr
+		}
+		a, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenMulticastUDP("udp4", nil, a)
+		if err != nil {
+			return nil, err
+		}
+		return newGroup(conn, "udp4", addr)
+	}
+	return nil, fmt.Errorf("unknown transport %q", transport)
+}
@@ -0,0 +1,49 @@
+package upnet
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestUDP has two members of a UDP multicast group, which needs no
+// root, hear what either sends, as the raw IP group does.
+func TestUDP(t *testing.T) {
+	addr := fmt.Sprintf("239.253.0.1:%d", 20000+os.Getpid()%10000)
+	a, err := Join("udp", addr)
+	if err != nil {
+		t.Skipf("no multicast here: %v", err)
+	}
+	defer a.Close()
+	b, err := Join("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	got := make(chan string, 2)
+	for _, c := range []Conn{a, b} {
+		go func(c Conn) {
+			buf := make([]byte, MaxDatagram)
+			n, err := c.Recv(buf)
+			if err == nil {
+				got <- string(buf[:n])
+			}
+		}(c)
+	}
+	msg := Record(nil, "0 Accept 1 2")
+	if err := a.Send([]byte(msg)); err != nil {
+		t.Skipf("no multicast route here: %v", err)
+	}
+	for k := 0; k < 2; k++ {
+		select {
+		case s := <-got:
+			if s != msg {
+				t.Errorf("got %q, want %q", s, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of 2 members heard the message", k)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Package upnet holds what upaxos participants and their clients
+// share: the message format and the group channel.
+package upnet
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type Msg struct {
+	F []string // whitespace-separated message fields
+	V *string  // the value carried by the message, nil if none
+}
+
+// Wire and log record format, version 1:
+//
+//	v1 F1 F2 ... Fn [LEN:VALUE]
+//
+// The fields are words or numbers separated by single spaces.  The
+// optional value comes last, prefixed by its length in bytes, so it
+// may hold any bytes at all, including whitespace and newlines.  In
+// the log, each record is followed by a newline.
+//
+// Anything without a version is a legacy message, like the text
+// upclient's send command sends.
+const Version = "v1"
+
+// Record formats fields like fmt.Sprintf and adds the value, if any.
+func Record(v *string, format string, a ...interface{}) string {
+	s := Version + " " + strings.Join(strings.Fields(fmt.Sprintf(format, a...)), " ")
+	if v != nil {
+		s += fmt.Sprintf(" %d:%s", len(*v), *v)
+	}
+	return s
+}
+
+func isDigits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+// MaxDatagram is the most a participant reads of one datagram, and
+// so the longest value a record in a log can hold.
+const MaxDatagram = 9999
+
+// MaxFraming bounds what a message adds to the command it carries:
+// a signature, the version, the fields and the value's length.
+// MaxCommand is the longest command that still fits in a datagram
+// once it is framed, so a participant refuses a request for a longer
+// one rather than send what no one can read.
+const MaxFraming = 256
+const MaxCommand = MaxDatagram - MaxFraming
+
+// ReadRecord reads the rest of a version 1 record after its version
+// field.  The record ends after its value or, when it has no value,
+// at a newline or the end of input.  A value longer than MaxDatagram
+// is an error.
+func ReadRecord(r *bufio.Reader) (m Msg, err error) {
+	return readRecord(r, MaxDatagram)
+}
+
+// readRecord is ReadRecord for values of at most max bytes.
+func readRecord(r *bufio.Reader, max int) (m Msg, err error) {
+	tok := []byte{}
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF && (len(m.F) > 0 || len(tok) > 0) {
+			err = nil
+			c = '\n'
+		}
+		if err != nil {
+			return m, err
+		}
+		switch {
+		case c == ' ' || c == '\n':
+			if len(tok) > 0 {
+				m.F = append(m.F, string(tok))
+				tok = tok[:0]
+			}
+			if c == '\n' {
+				return m, nil
+			}
+		case c == ':' && isDigits(tok):
+			n, err := strconv.Atoi(string(tok))
+			if err != nil || n < 0 || n > max {
+				return m, fmt.Errorf("bad value length %q", tok)
+			}
+			b := make([]byte, n)
+			if _, err = io.ReadFull(r, b); err != nil {
+				return m, io.ErrUnexpectedEOF
+			}
+			v := string(b)
+			m.V = &v
+			c, err = r.ReadByte()
+			if err == nil && c != '\n' {
+				return m, fmt.Errorf("junk after value: %q", c)
+			}
+			return m, nil
+		default:
+			tok = append(tok, c)
+		}
+	}
+}
+
+// Parse decodes one datagram from the group channel.
+func Parse(b []byte) (Msg, error) {
+	f := strings.Fields(string(b))
+	if len(f) == 0 {
+		return Msg{}, fmt.Errorf("zero-field message")
+	}
+	if f[0] == Version {
+		r := bufio.NewReader(strings.NewReader(string(b)))
+		skip, _ := r.ReadString(' ')
+		return readRecord(r, len(b)-len(skip))
+	}
+	if len(f[0]) > 1 && f[0][0] == 'v' && isDigits([]byte(f[0][1:])) {
+		return Msg{}, fmt.Errorf("unsupported version %s", f[0])
+	}
+
+	// legacy: everything after "Request N " is the value
+	m := Msg{F: f}
+	if f[0] == "Request" && len(f) > 2 {
+		s := strings.TrimRight(string(b), "\r\n")
+		s = strings.TrimLeft(s, " \t")
+		s = strings.TrimLeft(s[len("Request"):], " \t")
+		s = strings.TrimLeft(s[len(f[1]):], " \t")
+		m.F = f[:2]
+		m.V = &s
+	}
+	return m, nil
+}
+
+// NoID stands in for the request ID of a legacy client, which
+// does not send one.
+const NoID = "-"
+
+// A command is what the group agrees on: the client's value tagged
+// with the client's request ID, so that a retried request can be
+// recognized after its value was chosen.  IDs never hold spaces.
+func Command(id, v string) string {
+	if id == "" {
+		id = NoID
+	}
+	return id + " " + v
+}
+
+// SplitCommand undoes Command.  A value from before request IDs
+// existed has no ID.
+func SplitCommand(s string) (id, v string) {
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		return NoID, s
+	}
+	return s[:i], s[i+1:]
+}
+
+// BatchID tags a command that holds other commands, chosen together
+// in one instance.
+const BatchID = "!batch"
+
+// Batch makes one command of cmds, each prefixed by its length, so
+// that they may hold any bytes: "!batch LEN:CMD LEN:CMD ...".
+func Batch(cmds []string) string {
+	var b strings.Builder
+	for k, c := range cmds {
+		if k > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%d:%s", len(c), c)
+	}
+	return Command(BatchID, b.String())
+}
+
+// SplitBatch undoes Batch, given the value after the batch's ID.
+func SplitBatch(v string) ([]string, error) {
+	var cmds []string
+	for len(v) > 0 {
+		i := strings.IndexByte(v, ':')
+		if i < 0 || !isDigits([]byte(v[:i])) {
+			return cmds, fmt.Errorf("no command length in batch at %q", v)
+		}
+		n, err := strconv.Atoi(v[:i])
+		if err != nil || i+1+n > len(v) {
+			return cmds, fmt.Errorf("bad command length in batch at %q", v)
+		}
+		cmds = append(cmds, v[i+1:i+1+n])
+		v = strings.TrimPrefix(v[i+1+n:], " ")
+	}
+	return cmds, nil
+}
@@ -0,0 +1,135 @@
+package upnet
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestValueRoundTrip(t *testing.T) {
+	vals := []string{
+		"",
+		"one",
+		"a  b\nc  \n d  x",
+		" 12:34 \n",
+		"\x00\xff\n\n",
+	}
+	for _, v := range vals {
+		v := v
+		m, err := Parse([]byte(Record(&v, "%d Accept %d %d", 2, 3, 7)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.F) != 4 || m.F[1] != "Accept" || m.F[3] != "7" {
+			t.Errorf("fields %q", m.F)
+		}
+		if m.V == nil || *m.V != v {
+			t.Errorf("value %q came back as %v", v, m.V)
+		}
+	}
+}
+
+func TestLogRecords(t *testing.T) {
+	a, b := "x\ny", "z\n"
+	log := Record(&a, "accept 1 2") + "\n" +
+		Record(nil, "promise 2 3") + "\n" +
+		Record(&b, "learn 1") + "\n"
+	r := bufio.NewReader(strings.NewReader(log))
+	want := []string{"x\ny", "", "z\n"}
+	for i, w := range want {
+		if _, err := r.ReadString(' '); err != nil {
+			t.Fatal(err)
+		}
+		m, err := ReadRecord(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if m.V != nil {
+			got = *m.V
+		}
+		if got != w {
+			t.Errorf("record %d: got %q, want %q", i, got, w)
+		}
+	}
+	if _, err := r.ReadString(' '); err == nil {
+		t.Error("expected end of log")
+	}
+}
+
+func TestHostileLengths(t *testing.T) {
+	for _, s := range []string{
+		"v1 0 Accept 1 1 99999999999999999:x",
+		"v1 0 Accept 1 1 999999999999999999999999:x",
+		"v1 0 Accept 1 1 10:short",
+		"v1 0 Accept 1 1 6:short",
+		"v1 0 Accept 1 1 5:short junk",
+	} {
+		if m, err := Parse([]byte(s)); err == nil {
+			t.Errorf("%q parsed as %q %v", s, m.F, m.V)
+		}
+	}
+	long := strings.Repeat("x", MaxDatagram+1)
+	if _, err := Parse([]byte(Record(&long, "snapshot 7"))); err != nil {
+		t.Errorf("long value in a buffer: %v", err)
+	}
+	r := bufio.NewReader(strings.NewReader(Record(&long, "accept 1 2")[len(Version)+1:]))
+	if _, err := ReadRecord(r); err == nil {
+		t.Error("read a value longer than a datagram from a log")
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	m, err := Parse([]byte("Request 0   spaced   out \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.F) != 2 || m.V == nil || *m.V != "spaced   out " {
+		t.Errorf("legacy request parsed as %q %v", m.F, m.V)
+	}
+	if _, err := Parse([]byte("v2 0 OK 1")); err == nil {
+		t.Error("accepted unknown version")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	id, v := SplitCommand(Command("c1-2", "a b"))
+	if id != "c1-2" || v != "a b" {
+		t.Errorf("got %q %q", id, v)
+	}
+	if id, _ := SplitCommand(Command("", "x")); id != NoID {
+		t.Errorf("legacy id %q", id)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	cmds := []string{Command("c1-1", "a b"), Command("c2-7", ""), "- 3:x\n"}
+	id, v := SplitCommand(Batch(cmds))
+	if id != BatchID {
+		t.Fatalf("batch id %q", id)
+	}
+	got, err := SplitBatch(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "|") != strings.Join(cmds, "|") {
+		t.Errorf("batch came back as %q", got)
+	}
+	for _, v := range []string{"5:abc", "abc", "x:1", "-1:a"} {
+		if _, err := SplitBatch(v); err == nil {
+			t.Errorf("split bad batch %q", v)
+		}
+	}
+}
+
+// TestFraming checks that the longest message that carries a command
+// of MaxCommand bytes, signed, still fits in a datagram.
+func TestFraming(t *testing.T) {
+	v := strings.Repeat("x", MaxCommand)
+	const big = int64(1<<63 - 1)
+	s := testAuth.Seal(Record(&v, "%d Promise %d %d %d lease %d",
+		big, big, big, big, big))
+	if len(s) > MaxDatagram {
+		t.Errorf("%d bytes", len(s))
+	}
+}
@@ -0,0 +1,229 @@
+// Package upnode is what upaxos, epaxos and raft participants share
+// around their protocols: reading the channel, opening and checking
+// what arrives and handing it to the roles, admin commands, sending,
+// and shutting down.
+package upnode
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"flow"
+	"trace"
+	"upnet"
+)
+
+// SendQueue is how many messages of each rate-limited type wait for
+// their turn before more are dropped.
+const SendQueue = 1000
+
+type Config struct {
+	ID int // this participant
+
+	// With a group key, everything but admin commands must be
+	// signed with it, clients' requests and queries included.  With
+	// either key, admin commands need the admin key.
+	Auth *upnet.Auth
+
+	Log *log.Logger // debugging output, the standard logger if nil
+
+	// Each message type has its own rate limit, in messages a
+	// second.  Types not in Rates are not limited.
+	Rates map[string]float64
+
+	// Trace, if set, gets every message sent and received.
+	Trace *trace.Writer
+}
+
+// A Process runs a participant's roles, each in a goroutine, and
+// feeds them what arrives on the channel.
+type Process struct {
+	Config
+
+	conn      upnet.Conn
+	sendq     *flow.Queue
+	receivers []chan upnet.Msg
+	done      chan struct{} // closed by Halt
+	quit      chan struct{} // closed by an admin command
+	halting   sync.Once
+	closing   sync.Once
+	quitting  sync.Once
+	wg        sync.WaitGroup
+}
+
+func New(c Config, conn upnet.Conn) *Process {
+	if c.Auth == nil {
+		c.Auth = &upnet.Auth{}
+	}
+	if c.Log == nil {
+		c.Log = log.Default()
+	}
+	p := &Process{
+		Config: c,
+		conn:   conn,
+		done:   make(chan struct{}),
+		quit:   make(chan struct{}),
+	}
+	p.sendq = flow.NewQueue(flow.NewLimiter(c.Rates), SendQueue, p.transmit)
+	return p
+}
+
+// Run runs f in a goroutine that Close waits for.  Roles return
+// when Done is closed.
+func (p *Process) Run(f func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		f()
+	}()
+}
+
+// Listen starts handing every message from the channel to each of
+// cs in turn, and handles admin commands.
+func (p *Process) Listen(cs ...chan upnet.Msg) {
+	mainc := make(chan upnet.Msg)
+	p.receivers = append(cs, mainc)
+	p.Run(func() { p.control(mainc) })
+	p.Run(p.listen)
+}
+
+// Done is closed when the roles are to stop.
+func (p *Process) Done() <-chan struct{} {
+	return p.done
+}
+
+// Halt stops the roles, and nothing more is sent after it returns.
+func (p *Process) Halt() {
+	p.halting.Do(func() { close(p.done) })
+}
+
+// Close stops the roles and closes the channel.
+func (p *Process) Close() error {
+	var err error
+	p.closing.Do(func() {
+		p.Halt()
+		err = p.conn.Close()
+		p.wg.Wait()
+		p.sendq.Close()
+	})
+	return err
+}
+
+// Wait returns when an admin command tells the participant to quit,
+// or when it is closed.
+func (p *Process) Wait() {
+	select {
+	case <-p.quit:
+	case <-p.done:
+	}
+}
+
+func (p *Process) Closed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// control handles admin commands.
+func (p *Process) control(c chan upnet.Msg) {
+	for {
+		select {
+		case <-p.done:
+			return
+		case m := <-c:
+			if len(m.F) == 0 {
+				continue
+			}
+			switch m.F[0] {
+			case "quit", "exit", "bye":
+				p.Log.Print("exiting")
+				p.quitting.Do(func() { close(p.quit) })
+			}
+		}
+	}
+}
+
+func (p *Process) listen() {
+	buf := make([]byte, upnet.MaxDatagram)
+	for {
+		nb, err := p.conn.Recv(buf)
+		if err != nil {
+			if p.Closed() {
+				return
+			}
+			log.Panic(err)
+		}
+		p.Log.Printf("RECV %q", buf[:nb])
+		b, how, err := p.Auth.Open(buf[:nb])
+		if err != nil {
+			p.Log.Printf("dropping message: %s", err)
+			continue
+		}
+		m, err := upnet.Parse(b)
+		if err != nil {
+			p.Log.Printf("skipping message: %s", err)
+			continue
+		}
+		if !p.trusted(m, how) {
+			p.Log.Printf("dropping unauthenticated %v", m.F)
+			continue
+		}
+		p.Trace.Add(trace.Event{Node: int64(p.ID), Kind: trace.Recv,
+			Msg: string(b)})
+		for _, c := range p.receivers {
+			select {
+			case c <- m:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+func (p *Process) trusted(m upnet.Msg, how int) bool {
+	switch m.F[0] {
+	case "quit", "exit", "bye":
+		if p.Auth.Key != nil || p.Auth.AdminKey != nil {
+			return how == upnet.Admin
+		}
+		return true
+	}
+	return p.Auth.Key == nil || how == upnet.Signed
+}
+
+// msgType is the type of a participant's record, "v1 S Type ...".
+func msgType(s string) string {
+	f := strings.SplitN(s, " ", 4)
+	if len(f) < 3 {
+		return ""
+	}
+	return f[2]
+}
+
+// Send queues a message for its turn under the rate limits.  When
+// its type's queue is full the message is dropped, as the channel
+// might have dropped it; retries and heartbeats make up for it.
+func (p *Process) Send(s string) {
+	if !p.sendq.Put(msgType(s), s) {
+		p.Log.Printf("send queue full, dropping %q", s)
+	}
+}
+
+// transmit seals s and sends it, unless the participant has halted.
+func (p *Process) transmit(s string) {
+	if p.Closed() {
+		return
+	}
+	p.Log.Printf("%20s: %q", "SEND", s)
+	p.Trace.Add(trace.Event{Node: int64(p.ID), Kind: trace.Send, Msg: s})
+	if err := p.conn.Send([]byte(p.Auth.Seal(s))); err != nil {
+		if p.Closed() {
+			return
+		}
+		log.Panic(err)
+	}
+}
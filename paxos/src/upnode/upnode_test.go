@@ -0,0 +1,92 @@
+package upnode
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"simnet"
+	"upnet"
+)
+
+var testAuth = &upnet.Auth{Key: []byte("group"), AdminKey: []byte("admin")}
+
+func TestTrusted(t *testing.T) {
+	keyed := New(Config{Auth: testAuth}, nil)
+	open := New(Config{}, nil)
+	for _, tc := range []struct {
+		p    *Process
+		msg  string
+		how  int
+		want bool
+	}{
+		{keyed, "0 Accept 1 2", upnet.Signed, true},
+		{keyed, "0 Accept 1 2", upnet.Unsigned, false},
+		{keyed, "Request 1 c-1", upnet.Unsigned, false},
+		{keyed, "Query c-1", upnet.Unsigned, false},
+		{keyed, "Request 1 c-1", upnet.Signed, true},
+		{open, "Request 1 c-1", upnet.Unsigned, true},
+		{keyed, "quit", upnet.Signed, false},
+		{keyed, "quit", upnet.Admin, true},
+		{open, "0 Accept 1 2", upnet.Unsigned, true},
+		{open, "quit", upnet.Unsigned, true},
+	} {
+		m, err := upnet.Parse([]byte(upnet.Record(nil, "%s", tc.msg)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tc.p.trusted(m, tc.how); got != tc.want {
+			t.Errorf("%q as %d: trusted %v", tc.msg, tc.how, got)
+		}
+	}
+}
+
+// TestListen has a keyed participant hear forged and signed
+// messages, and an admin quit.
+func TestListen(t *testing.T) {
+	net := simnet.New(simnet.Config{}, 1)
+	p := New(Config{ID: 0, Auth: testAuth, Log: log.New(io.Discard, "", 0)},
+		net.Join(0))
+	defer p.Close()
+	c := make(chan upnet.Msg)
+	p.Listen(c)
+
+	other := net.Join(1)
+	defer other.Close()
+	other.Send([]byte(upnet.Record(nil, "1 Accept 1 2")))
+	other.Send([]byte(testAuth.Seal(upnet.Record(nil, "1 Accept 3 4"))))
+	select {
+	case m := <-c:
+		if m.F[2] != "3" {
+			t.Errorf("got %v", m.F)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing signed got through")
+	}
+
+	go func() { // the roles hear quit too
+		for {
+			select {
+			case <-c:
+			case <-p.Done():
+				return
+			}
+		}
+	}()
+	other.Send([]byte("quit"))
+	other.Send([]byte(testAuth.SealAdmin("quit")))
+	quit := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(quit)
+	}()
+	select {
+	case <-quit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("admin quit did not quit")
+	}
+	if p.Closed() {
+		t.Error("quitting closed the participant")
+	}
+}
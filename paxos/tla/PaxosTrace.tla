@@ -0,0 +1,76 @@
+---------------------------- MODULE PaxosTrace ----------------------------
+(* Checks a trace from upaxos or bpaxos against the acceptor and learner  *)
+(* steps of Paxos, as in Lamport's Paxos.tla.  paxtrace writes the trace: *)
+(*                                                                        *)
+(*   paxtrace -tla PaxosTraceData upaxos.jsonl > tla/PaxosTraceData.tla   *)
+(*                                                                        *)
+(* Then TLC checks this spec with PaxosTrace.cfg.  Each step of Next must *)
+(* take the next record of the trace, so if some record is not a step     *)
+(* that Paxos allows, TLC reports a deadlock before the trace ends.       *)
+(* Termination says the whole trace is taken, and Safe that no two       *)
+(* values are learned for one instance.                                  *)
+EXTENDS Naturals, Sequences, PaxosTraceData
+
+Instances == {Trace[j].i : j \in 1..Len(Trace)}
+
+VARIABLES
+  k,        \* the next record of the trace
+  maxBal,   \* maxBal[a][i]: the highest ballot a promised or accepted in i
+  maxVBal,  \* the ballot of a's accepted value in i, -1 for none
+  maxVal,   \* a's accepted value in i
+  votes,    \* every <<a, i, b, v>> accepted so far
+  learned   \* learned[i]: the values learned in i
+
+vars == <<k, maxBal, maxVBal, maxVal, votes, learned>>
+
+Init ==
+  /\ k = 1
+  /\ maxBal = [a \in Acceptors |-> [i \in Instances |-> -1]]
+  /\ maxVBal = [a \in Acceptors |-> [i \in Instances |-> -1]]
+  /\ maxVal = [a \in Acceptors |-> [i \in Instances |-> ""]]
+  /\ votes = {}
+  /\ learned = [i \in Instances |-> {}]
+
+Chosen(i, v) ==
+  \E b \in {vt[3] : vt \in votes}, Q \in Quorums :
+    \A a \in Q : <<a, i, b, v>> \in votes
+
+\* Phase 1b: a promise never goes below one before.  (upaxos repeats a
+\* promise to a leader that asks again, so equal is allowed.)
+Promise(e) ==
+  /\ e.action = "Promise"
+  /\ e.b >= maxBal[e.node][e.i]
+  /\ maxBal' = [maxBal EXCEPT ![e.node][e.i] = e.b]
+  /\ UNCHANGED <<maxVBal, maxVal, votes, learned>>
+
+\* Phase 2b: accepting is promising, too.  One ballot has one value.
+Accept(e) ==
+  /\ e.action = "Accept"
+  /\ e.b >= maxBal[e.node][e.i]
+  /\ \A vt \in votes : vt[2] = e.i /\ vt[3] = e.b => vt[4] = e.v
+  /\ maxBal' = [maxBal EXCEPT ![e.node][e.i] = e.b]
+  /\ maxVBal' = [maxVBal EXCEPT ![e.node][e.i] = e.b]
+  /\ maxVal' = [maxVal EXCEPT ![e.node][e.i] = e.v]
+  /\ votes' = votes \cup {<<e.node, e.i, e.b, e.v>>}
+  /\ UNCHANGED learned
+
+\* A learner learns only what a quorum accepted.
+Learn(e) ==
+  /\ e.action = "Learn"
+  /\ Chosen(e.i, e.v)
+  /\ learned' = [learned EXCEPT ![e.i] = @ \cup {e.v}]
+  /\ UNCHANGED <<maxBal, maxVBal, maxVal, votes>>
+
+Next ==
+  \/ /\ k <= Len(Trace)
+     /\ Promise(Trace[k]) \/ Accept(Trace[k]) \/ Learn(Trace[k])
+     /\ k' = k + 1
+  \/ /\ k > Len(Trace)
+     /\ UNCHANGED vars
+
+Spec == Init /\ [][Next]_vars /\ WF_vars(Next)
+
+Done == k > Len(Trace)
+Termination == <>Done
+Safe == \A i \in Instances : \A v, w \in learned[i] : v = w
+=============================================================================
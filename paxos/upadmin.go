@@ -0,0 +1,52 @@
+// upadmin.go - send an admin command, like quit, to upaxos
+//
+// When upaxos runs with an admin key ("-K"), it obeys only admin
+// commands signed with that key:
+//
+//   paxos$ ./upadmin -K admin.key -t udp quit
+//
+// The command is good for upnet.DefaultWindow after it is sent.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"upnet"
+)
+
+var adminKeyFile string
+var transport string
+var groupAddr string
+
+func init() {
+	flag.StringVar(&adminKeyFile, "K", "",
+		"file with the admin key")
+	flag.StringVar(&transport, "t", "ip",
+		"group transport: \"ip\" (raw IP, needs root) or \"udp\" (multicast)")
+	flag.StringVar(&groupAddr, "g", "",
+		"group address (default "+upnet.DefaultIPAddr+" for ip, "+
+			upnet.DefaultUDPAddr+" for udp)")
+}
+func main() {
+	flag.Parse()
+	if adminKeyFile == "" || flag.NArg() == 0 {
+		log.Panic("usage")
+	}
+	k, err := upnet.ReadKey(adminKeyFile)
+	if err != nil {
+		log.Panic(err)
+	}
+	a := &upnet.Auth{AdminKey: k}
+	conn, err := upnet.Join(transport, groupAddr)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer conn.Close()
+	cmd := upnet.Record(nil, "%s", strings.Join(flag.Args(), " "))
+	if err := conn.Send([]byte(a.SealAdmin(cmd))); err != nil {
+		log.Panic(err)
+	}
+}
@@ -0,0 +1,112 @@
+// upclient.go - interactive client for upaxos, epaxos and raft
+//
+// Commands come from the terminal, a script, or the arguments:
+//
+//   paxos$ ./upclient -t udp
+//   paxos> write one
+//   ok 1	(2.113ms)
+//   paxos> read 1
+//   1 "one"	(804µs)
+//
+//   paxos$ ./upclient -t udp -f script.txt
+//   paxos$ ./upclient -t udp set color blue
+//
+// Type "help" for the commands.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"paxosclient"
+	"repl"
+	"upnet"
+)
+
+var transport string
+var groupAddr string
+var keyFile string
+var scriptFile string
+var quiet bool
+var timeout = repl.DefaultTimeout
+var retry = paxosclient.DefaultRetry
+var near = -1
+
+func init() {
+	flag.StringVar(&transport, "t", "ip",
+		"group transport: \"ip\" (raw IP, needs root) or \"udp\" (multicast)")
+	flag.StringVar(&groupAddr, "g", "",
+		"group address (default "+upnet.DefaultIPAddr+" for ip, "+
+			upnet.DefaultUDPAddr+" for udp)")
+	flag.StringVar(&keyFile, "k", "",
+		"sign requests with the group key in this file, and drop unsigned answers")
+	flag.StringVar(&scriptFile, "f", "",
+		"read commands from this file instead of standard input")
+	flag.BoolVar(&quiet, "q", false,
+		"do not show latencies")
+	flag.DurationVar(&timeout, "timeout", timeout,
+		"give up on a command after this long")
+	flag.DurationVar(&retry, "retry", retry,
+		"resend a request after this long without an answer")
+	flag.IntVar(&near, "near", near,
+		"the participant nearest this client, which leads its writes in epaxos")
+}
+
+// terminal reports whether f is a terminal rather than a file or
+// pipe, so that a prompt makes sense.
+func terminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func main() {
+	flag.Parse()
+	conn, err := upnet.Join(transport, groupAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var auth *upnet.Auth
+	if keyFile != "" {
+		k, err := upnet.ReadKey(keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		auth = &upnet.Auth{Key: k}
+	}
+	c := paxosclient.NewSealed(conn, auth)
+	defer c.Close()
+	c.Retry = retry
+	c.Near = near
+
+	r := repl.New(c, os.Stdout)
+	r.Timeout = timeout
+	r.Latency = !quiet
+	intr := make(chan os.Signal, 1)
+	signal.Notify(intr, os.Interrupt)
+	r.Interrupt = intr
+
+	var in io.Reader = os.Stdin
+	switch {
+	case flag.NArg() > 0:
+		in = strings.NewReader(strings.Join(flag.Args(), " "))
+	case scriptFile != "":
+		f, err := os.Open(scriptFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	case terminal(os.Stdin):
+		r.Prompt = "paxos> "
+	}
+	if failed := r.Run(context.Background(), in); failed > 0 && r.Prompt == "" {
+		c.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,161 @@
+// upsniff.go - watch upaxos messages go by, instance by instance
+//
+// upsniff listens on the group channel like a participant, but sends
+// nothing.  It shows a table of the latest instances, redrawn as
+// messages arrive: the ballots seen in each, who promised and
+// accepted, how long a quorum took, and the value chosen.
+//
+//   paxos$ ./upsniff -t udp -n 3 -w capture.txt
+//   paxos$ ./upsniff -n 3 -r capture.txt		# the final table
+//   paxos$ ./upsniff -n 3 -r capture.txt -speed 1	# as it happened
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"quorum"
+	"upaxos"
+	"upnet"
+)
+
+var n int
+var quorumFlag string
+var keyFile string
+var transport string
+var groupAddr string
+var captureFile, replayFile string
+var speed float64
+var rows int
+var every time.Duration
+
+func init() {
+	flag.IntVar(&n, "n", -1,
+		"number of Paxos participants")
+	flag.StringVar(&quorumFlag, "q", "majority",
+		"quorums: \"majority\", sizes like \"q1=4,q2=2\", or a grid like \"grid=2x3\"")
+	flag.StringVar(&keyFile, "k", "",
+		"file with the group key, to check signed messages")
+	flag.StringVar(&transport, "t", "ip",
+		"group transport: \"ip\" (raw IP, needs root) or \"udp\" (multicast)")
+	flag.StringVar(&groupAddr, "g", "",
+		"group address (default "+upnet.DefaultIPAddr+" for ip, "+
+			upnet.DefaultUDPAddr+" for udp)")
+	flag.StringVar(&captureFile, "w", "",
+		"append the messages to this capture file")
+	flag.StringVar(&replayFile, "r", "",
+		"replay this capture file instead of listening")
+	flag.Float64Var(&speed, "speed", 0,
+		"replay at this many times the captured pace (0 for at once)")
+	flag.IntVar(&rows, "rows", 20,
+		"show this many of the latest instances (0 for all)")
+	flag.DurationVar(&every, "every", 200*time.Millisecond,
+		"redraw the table this often")
+}
+
+var sn *upaxos.Sniffer
+
+// redraw redraws the table every so often.
+func redraw() {
+	for range time.Tick(every) {
+		draw()
+	}
+}
+
+func draw() {
+	fmt.Print("\033[H\033[2J") // home, clear
+	sn.WriteTable(os.Stdout, rows)
+}
+
+func replay() {
+	f, err := os.Open(replayFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if speed > 0 {
+		go redraw()
+	}
+	var first, start time.Time
+	err = upaxos.ReadCapture(f, func(t time.Time, b []byte) {
+		if first.IsZero() {
+			first, start = t, time.Now()
+		}
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(t.Sub(first)) / speed))
+			time.Sleep(time.Until(due))
+		}
+		if err := sn.Add(t, b); err != nil {
+			log.Print(err)
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if speed > 0 {
+		draw()
+	} else {
+		sn.WriteTable(os.Stdout, rows)
+	}
+}
+
+func main() {
+	flag.Parse()
+	if n == -1 {
+		log.Fatal("usage: upsniff -n N [flags]")
+	}
+	q, err := quorum.Parse(quorumFlag, n)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sn = upaxos.NewSniffer(q)
+	if replayFile != "" {
+		replay()
+		return
+	}
+
+	auth := &upnet.Auth{}
+	if keyFile != "" {
+		if auth.Key, err = upnet.ReadKey(keyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var capture *os.File
+	if captureFile != "" {
+		capture, err = os.OpenFile(captureFile,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer capture.Close()
+	}
+	conn, err := upnet.Join(transport, groupAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	go redraw()
+	buf := make([]byte, upnet.MaxDatagram)
+	for {
+		nb, err := conn.Recv(buf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		now := time.Now()
+		b, _, err := auth.Open(buf[:nb])
+		if err != nil {
+			continue // forged, or signed with another key
+		}
+		if capture != nil {
+			if err := upaxos.WriteCapture(capture, now, b); err != nil {
+				log.Fatal(err)
+			}
+		}
+		sn.Add(now, b)
+	}
+}